@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	defaultIOAlignment = 4096
+	alignedBlockMagic  = 0x414c4e42 // "ALNB"; tells aligned files apart from plain SST files
+	alignedHeaderSize  = 16         // magic, reserved and data length
+)
+
+// AlignedBlockWriter writes blocks padded with zeros to a multiple of the alignment, as
+// direct I/O requires. Each block starts with a header holding the unpadded data length.
+type AlignedBlockWriter struct {
+	w         io.Writer
+	alignment int
+}
+
+func NewAlignedBlockWriter(w io.Writer, alignment int) *AlignedBlockWriter {
+	return &AlignedBlockWriter{w: w, alignment: alignment}
+}
+
+// WriteBlock writes data as one block from an aligned buffer.
+func (w *AlignedBlockWriter) WriteBlock(data []byte) error {
+	size := alignUp(alignedHeaderSize+len(data), w.alignment)
+	buf, err := alignedBuffer(size)
+	if err != nil {
+		return err
+	}
+	defer freeAlignedBuffer(buf)
+
+	binary.LittleEndian.PutUint32(buf, alignedBlockMagic)
+	binary.LittleEndian.PutUint64(buf[8:], uint64(len(data)))
+	copy(buf[alignedHeaderSize:], data)
+	_, err = w.w.Write(buf)
+	return err
+}
+
+// AlignedBlockReader reads the blocks written by AlignedBlockWriter, skipping their padding.
+// All reads are whole multiples of the alignment into aligned buffers.
+type AlignedBlockReader struct {
+	r         io.Reader
+	alignment int
+}
+
+func NewAlignedBlockReader(r io.Reader, alignment int) *AlignedBlockReader {
+	return &AlignedBlockReader{r: r, alignment: alignment}
+}
+
+// ReadBlock returns the data of the next block.
+func (r *AlignedBlockReader) ReadBlock() ([]byte, error) {
+	first, err := alignedBuffer(r.alignment)
+	if err != nil {
+		return nil, err
+	}
+	defer freeAlignedBuffer(first)
+	if _, err := io.ReadFull(r.r, first); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(first) != alignedBlockMagic {
+		return nil, fmt.Errorf("%w: missing aligned block header", ErrInvalidSSTFormat)
+	}
+	length := binary.LittleEndian.Uint64(first[8:])
+	if length > 1<<40 {
+		return nil, fmt.Errorf("%w: aligned block length %d", ErrInvalidSSTFormat, length)
+	}
+
+	data := make([]byte, length)
+	n := copy(data, first[alignedHeaderSize:])
+	if n == len(data) {
+		return data, nil
+	}
+	rest, err := alignedBuffer(alignUp(len(data)-n, r.alignment))
+	if err != nil {
+		return nil, err
+	}
+	defer freeAlignedBuffer(rest)
+	if _, err := io.ReadFull(r.r, rest); err != nil {
+		return nil, fmt.Errorf("error reading aligned block: %w", unexpectedEOF(err))
+	}
+	copy(data[n:], rest)
+	return data, nil
+}
+
+func alignUp(n, alignment int) int {
+	return (n + alignment - 1) / alignment * alignment
+}
+
+// writeDirectFile writes data to path as a single aligned block, bypassing the page cache.
+func writeDirectFile(path string, data []byte, alignment int) error {
+	file, err := openDirectFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := NewAlignedBlockWriter(CountingWriter{W: file, Count: &sstBytesWritten}, alignment).WriteBlock(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// sstSource is what the SST readers need of a file: sequential, positioned and random reads.
+type sstSource interface {
+	io.Reader
+	io.Seeker
+	io.ReaderAt
+}
+
+// openSSTSource opens an SST file for reading. Files written with direct I/O are read
+// into memory as one aligned block, through direct I/O when direct is set.
+func openSSTSource(path string, direct bool, alignment int) (sstSource, func() error, error) {
+	if direct {
+		file, err := openDirectFile(path, os.O_RDONLY, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer file.Close()
+		data, err := NewAlignedBlockReader(file, alignment).ReadBlock()
+		if err != nil {
+			return nil, nil, err
+		}
+		return bytes.NewReader(data), func() error { return nil }, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sstSourceOf(file)
+}
+
+// sstSourceOf reads the SST file opened as file like openSSTSource does without direct I/O.
+// The source takes over file.
+func sstSourceOf(file *os.File) (sstSource, func() error, error) {
+	var magic [4]byte
+	if _, err := file.ReadAt(magic[:], 0); err != nil || binary.LittleEndian.Uint32(magic[:]) != alignedBlockMagic {
+		return file, file.Close, nil
+	}
+	defer file.Close()
+	data, err := NewAlignedBlockReader(file, alignedHeaderSize).ReadBlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	return bytes.NewReader(data), func() error { return nil }, nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const asyncWriteQueueSize = 4096 // Writes AsyncSet queues before it blocks
+
+// asyncWrite is a write queued by AsyncSet, or a marker queued by DrainAsync.
+type asyncWrite struct {
+	kv    KeyValue
+	ack   chan<- error // Receives the result of the write; may be nil
+	drain bool         // Acknowledged once the writes queued before it are committed
+}
+
+// asyncWriter logs the writes queued by AsyncSet in group commits.
+type asyncWriter struct {
+	mu       sync.RWMutex // Held for reading while queueing, and for writing to stop
+	queue    chan asyncWrite
+	closed   bool
+	drainErr error // First error of the writes committed since the last drain marker; used by the writer only
+}
+
+func newAsyncWriter() *asyncWriter {
+	return &asyncWriter{queue: make(chan asyncWrite, asyncWriteQueueSize)}
+}
+
+// AsyncSet queues the entry for the background writer and returns without waiting for
+// it to be logged. The writer logs up to cfg.AsyncWriteBatchSize queued writes, or the ones
+// queued within cfg.AsyncWriteFlushInterval, in a single WAL batch and then sends nil or the
+// error to the ack channel of each, unless it is nil. The channel should be buffered, as the
+// writer waits for the receiver. Entries not yet logged are lost in a crash. AsyncSet
+// blocks only while asyncWriteQueueSize writes are queued.
+func (mem *memDB) AsyncSet(key, value []byte, ack chan<- error) {
+	writer := mem.asyncWriter
+	if writer == nil || mem.readOnly {
+		sendAck(ack, mem.Set(key, value))
+		return
+	}
+	key = mem.transformKey(key)
+	if err := mem.validateValue(key, value); err != nil {
+		sendAck(ack, err)
+		return
+	}
+	writer.mu.RLock()
+	defer writer.mu.RUnlock()
+	if writer.closed {
+		sendAck(ack, ErrDatabaseClosed)
+		return
+	}
+	writer.queue <- asyncWrite{kv: KeyValue{Key: key, Value: value, Operation: Set}, ack: ack}
+}
+
+// DrainAsync blocks until the writes AsyncSet queued before the call are logged and in
+// the memtable. Their errors go to their ack channels, and the first of them is returned;
+// a write whose error an earlier DrainAsync returned is not counted again. It fails with
+// ErrDatabaseClosed once the database is closed, as Close logs the queued writes itself.
+func (mem *memDB) DrainAsync() error {
+	writer := mem.asyncWriter
+	if writer == nil || mem.readOnly {
+		return nil // AsyncSet writes synchronously
+	}
+	done := make(chan error, 1)
+	writer.mu.RLock()
+	if writer.closed {
+		writer.mu.RUnlock()
+		return ErrDatabaseClosed
+	}
+	writer.queue <- asyncWrite{ack: done, drain: true}
+	writer.mu.RUnlock()
+	return <-done
+}
+
+func sendAck(ack chan<- error, err error) {
+	if ack != nil {
+		ack <- err
+	}
+}
+
+// runAsyncWriter logs the writes queued by AsyncSet until stopAsyncWriter, and then the
+// ones still queued.
+func (mem *memDB) runAsyncWriter() {
+	defer mem.bgWG.Done()
+	queue := mem.asyncWriter.queue
+	batchSize := max(mem.cfg.AsyncWriteBatchSize, 1)
+	batch := make([]asyncWrite, 0, batchSize)
+	timer := time.NewTimer(mem.cfg.AsyncWriteFlushInterval)
+	timer.Stop()
+
+	for {
+		write, ok := <-queue
+		if !ok {
+			return
+		}
+		batch = append(batch[:0], write)
+		timer.Reset(mem.cfg.AsyncWriteFlushInterval)
+	fill:
+		for len(batch) < batchSize && !batch[len(batch)-1].drain {
+			select {
+			case write, ok := <-queue:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, write)
+			case <-timer.C:
+				break fill
+			}
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		mem.commitAsyncWrites(batch)
+	}
+}
+
+// stopAsyncWriter makes AsyncSet fail with ErrDatabaseClosed and lets the writer exit
+// once it logged the queued writes. Writes being queued are waited for.
+func (mem *memDB) stopAsyncWriter() {
+	writer := mem.asyncWriter
+	if writer == nil {
+		return
+	}
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+	if !writer.closed {
+		writer.closed = true
+		close(writer.queue)
+	}
+}
+
+// commitAsyncWrites logs the writes in one WAL batch, applies them to the memtable and
+// acknowledges each, and the drain markers after them. Writes refused by the key limit
+// fail alone; a failed WAL append fails them all.
+func (mem *memDB) commitAsyncWrites(writes []asyncWrite) {
+	errs := make([]error, len(writes))
+	unlock := mem.lockReserve()
+	mem.awaitPendingWrites()
+
+	ops := make([]KeyValue, 0, len(writes))
+	var added []bool
+	batched := make(map[string]bool, len(writes))
+	for i, write := range writes {
+		if write.drain {
+			continue
+		}
+		mem.sketch.Update(write.kv.Key)
+		isNew := false
+		if !batched[string(write.kv.Key)] {
+			var err error
+			if isNew, err = mem.reserveKey(write.kv.Key); err != nil {
+				errs[i] = err
+				continue
+			}
+			batched[string(write.kv.Key)] = true
+		}
+		ops = append(ops, write.kv)
+		added = append(added, isNew)
+	}
+
+	if len(ops) > 0 {
+		if err := mem.wal.AppendBatch(ops); err != nil {
+			for _, isNew := range added {
+				if isNew {
+					mem.keyCount.Add(-1)
+				}
+			}
+			for i := range errs {
+				if errs[i] == nil && !writes[i].drain {
+					errs[i] = err
+				}
+			}
+		} else {
+			var size int64
+			for _, kv := range ops {
+				oldValue := mem.memtableValue(kv.Key)
+				size = mem.upsert(kv)
+				mem.events.Publish(Set, kv.Key, oldValue, kv.Value)
+			}
+			mem.flushIfFull(size)
+		}
+	}
+	unlock()
+
+	// A drain marker ends its batch, so the writes before it were all committed
+	writer := mem.asyncWriter
+	for i, write := range writes {
+		if write.drain {
+			errs[i], writer.drainErr = writer.drainErr, nil
+		} else if errs[i] != nil && writer.drainErr == nil {
+			writer.drainErr = errs[i]
+		}
+	}
+	for i, write := range writes {
+		sendAck(write.ack, errs[i])
+	}
+}
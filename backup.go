@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// IncrementalBackupResult describes what an incremental backup copied. WALPosition is
+// the sinceWALPosition to pass to the next incremental backup.
+type IncrementalBackupResult struct {
+	WALPosition int64
+	WALSegment  string
+	WALEntries  int
+	SSTFiles    []string
+}
+
+// BackupIncremental copies the WAL records appended since sinceWALPosition into a new
+// WAL segment in destDir, together with the SST files flushed after that position.
+func (mem *memDB) BackupIncremental(destDir string, sinceWALPosition int64) (IncrementalBackupResult, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	mem.awaitPendingWrites()
+
+	result := IncrementalBackupResult{WALPosition: sinceWALPosition}
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return result, err
+	}
+
+	position, err := mem.wal.Position()
+	if err != nil {
+		return result, err
+	}
+	if position < sinceWALPosition {
+		return result, fmt.Errorf("WAL position %d is beyond the end of the log (%d)", sinceWALPosition, position)
+	}
+
+	walFile, err := os.Open(mem.wal.file.Name())
+	if err != nil {
+		return result, err
+	}
+	defer walFile.Close()
+
+	delta := io.NewSectionReader(walFile, sinceWALPosition, position-sinceWALPosition)
+	entries, err := readWALEntries(delta)
+	if err != nil {
+		return result, fmt.Errorf("error reading WAL delta: %w", err)
+	}
+
+	segment := filepath.Join(destDir, fmt.Sprintf("wal-%d-%d.log", sinceWALPosition, position))
+	if err := copyFile(segment, io.NewSectionReader(walFile, sinceWALPosition, position-sinceWALPosition)); err != nil {
+		return result, fmt.Errorf("error writing WAL segment: %w", err)
+	}
+
+	files, err := ReadManifest(mem.cfg.DataDir)
+	if err != nil {
+		return result, err
+	}
+	for _, meta := range files {
+		if meta.WALPosition <= sinceWALPosition {
+			continue
+		}
+		src, err := os.Open(filepath.Join(mem.cfg.DataDir, meta.FileName))
+		if err != nil {
+			return result, err
+		}
+		err = copyFile(filepath.Join(destDir, meta.FileName), src)
+		src.Close()
+		if err != nil {
+			return result, fmt.Errorf("error copying SST file %s: %w", meta.FileName, err)
+		}
+		// The sidecar is optional, so a file without one is still backed up
+		if sidecar, err := os.Open(bloomSidecarPath(filepath.Join(mem.cfg.DataDir, meta.FileName))); err == nil {
+			err = copyFile(bloomSidecarPath(filepath.Join(destDir, meta.FileName)), sidecar)
+			sidecar.Close()
+			if err != nil {
+				return result, fmt.Errorf("error copying bloom sidecar of %s: %w", meta.FileName, err)
+			}
+		}
+		result.SSTFiles = append(result.SSTFiles, meta.FileName)
+	}
+
+	result.WALPosition = position
+	result.WALSegment = segment
+	result.WALEntries = len(entries)
+	return result, nil
+}
+
+func copyFile(dst string, src io.Reader) error {
+	file, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, src); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,80 @@
+package main
+
+import "errors"
+
+var ErrBatchClosed = errors.New("write batch already committed or rolled back")
+
+// WriteBatch collects writes that are logged and applied together by Commit,
+// or dropped by Rollback without touching the WAL or the memtable.
+type WriteBatch struct {
+	db     *memDB
+	ops    []KeyValue
+	closed bool
+}
+
+func (mem *memDB) NewWriteBatch() *WriteBatch {
+	return &WriteBatch{db: mem}
+}
+
+func (b *WriteBatch) Set(key, value []byte) {
+	b.ops = append(b.ops, KeyValue{Key: b.db.transformKey(key), Value: value, Operation: Set})
+}
+
+// setEntry adds kv as a Set, keeping its tags and expiry time.
+func (b *WriteBatch) setEntry(kv KeyValue) {
+	b.ops = append(b.ops, KeyValue{Key: b.db.transformKey(kv.Key), Value: kv.Value, Operation: Set, ExpiresAt: kv.ExpiresAt, Tags: kv.Tags})
+}
+
+func (b *WriteBatch) Del(key []byte) {
+	b.ops = append(b.ops, KeyValue{Key: b.db.transformKey(key), Operation: Delete})
+}
+
+// Commit logs the batch as a single WAL write and applies it to the memtable.
+// If the process stops between the two, replay applies the batch.
+func (b *WriteBatch) Commit() error {
+	if b.closed {
+		return ErrBatchClosed
+	}
+	b.closed = true
+	if len(b.ops) == 0 {
+		return nil
+	}
+	if b.db.readOnly {
+		return ErrReadOnly
+	}
+	for _, op := range b.ops {
+		if op.Operation == Set {
+			if err := b.db.validateValue(op.Key, op.Value); err != nil {
+				return err
+			}
+		}
+	}
+
+	mem := b.db
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	mem.awaitPendingWrites()
+
+	if err := mem.wal.AppendBatch(b.ops); err != nil {
+		return err
+	}
+	var size int64
+	for _, op := range b.ops {
+		oldValue := mem.memtableValue(op.Key)
+		size = mem.applyEntry(op)
+		if op.Operation == Delete {
+			mem.events.Publish(Delete, op.Key, oldValue, nil)
+		} else {
+			mem.events.Publish(Set, op.Key, oldValue, op.Value)
+		}
+	}
+
+	mem.flushIfFull(size)
+	return nil
+}
+
+// Rollback discards the batch.
+func (b *WriteBatch) Rollback() {
+	b.closed = true
+	b.ops = nil
+}
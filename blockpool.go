@@ -0,0 +1,38 @@
+package main
+
+import "sync"
+
+// BlockPool recycles the buffers SST files are decompressed into, so repeated
+// reads do not allocate a new buffer each time.
+type BlockPool struct {
+	blockSize int
+	pool      sync.Pool // Holds *[]byte to avoid allocating when putting a slice back
+}
+
+// NewBlockPool returns a pool of buffers holding at least blockSize bytes.
+func NewBlockPool(blockSize int) *BlockPool {
+	p := &BlockPool{blockSize: blockSize}
+	p.pool.New = func() interface{} {
+		buf := make([]byte, 0, blockSize)
+		return &buf
+	}
+	return p
+}
+
+// Get returns an empty buffer. A nil pool returns nil, which callers grow as needed.
+func (p *BlockPool) Get() []byte {
+	if p == nil {
+		return nil
+	}
+	return (*p.pool.Get().(*[]byte))[:0]
+}
+
+// Put returns buf to the pool once nothing refers to its contents anymore.
+// Buffers smaller than a block and a nil pool are ignored.
+func (p *BlockPool) Put(buf []byte) {
+	if p == nil || cap(buf) < p.blockSize {
+		return
+	}
+	buf = buf[:0]
+	p.pool.Put(&buf)
+}
@@ -0,0 +1,46 @@
+package main
+
+import "math"
+
+// BloomFilter answers whether a key may be in a set. It has no false negatives;
+// false positives occur at about the rate it was sized for.
+type BloomFilter struct {
+	bits   []uint64
+	hashes int // Number of bits set per key
+	hash   HashFunc
+}
+
+// NewBloomFilter sizes a filter for expectedKeys keys with the given false positive rate.
+func NewBloomFilter(expectedKeys int, falsePositiveRate float64, hash HashFunc) *BloomFilter {
+	n := float64(max(expectedKeys, 1))
+	m := math.Ceil(-n * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	k := max(int(math.Round(m/n*math.Ln2)), 1)
+	return &BloomFilter{
+		bits:   make([]uint64, (int(m)+63)/64),
+		hashes: k,
+		hash:   hash,
+	}
+}
+
+// Add inserts key into the filter.
+func (f *BloomFilter) Add(key []byte) {
+	h1, h2 := splitHash(f.hash(key))
+	m := uint64(len(f.bits) * 64)
+	for i := 0; i < f.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// MayContain reports whether key may have been added. False means it was not.
+func (f *BloomFilter) MayContain(key []byte) bool {
+	h1, h2 := splitHash(f.hash(key))
+	m := uint64(len(f.bits) * 64)
+	for i := 0; i < f.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+	"strings"
+)
+
+// bloomSidecarMagic starts every bloom sidecar file.
+const bloomSidecarMagic uint32 = 0x424c4f4d // "BLOM"
+
+// bloomSidecarPath returns the sidecar file holding the filter of the SST file at path:
+// the same name with a .bloom extension instead of .sst.
+func bloomSidecarPath(path string) string {
+	return strings.TrimSuffix(path, ".sst") + ".bloom"
+}
+
+// writeBloomSidecar atomically stores the filter of the SST file at path, built over keys
+// keys, next to it. The little-endian layout is the magic number, the bits per key as a
+// float64, the serialized filter block (number of hashes, hash function name and bit
+// array) and a CRC-32 of all of them, followed by their HMAC-SHA256 with integrityKey if
+// it is set, as the SST files are.
+func writeBloomSidecar(path string, filter *FilterBlock, keys int, integrityKey []byte) error {
+	bitsPerKey := float64(64*len(filter.filter.bits)) / float64(max(keys, 1))
+	data := binary.LittleEndian.AppendUint32(nil, bloomSidecarMagic)
+	data = binary.LittleEndian.AppendUint64(data, math.Float64bits(bitsPerKey))
+	data = append(data, filter.Serialize(binary.LittleEndian)...)
+	data = binary.LittleEndian.AppendUint32(data, crc32.ChecksumIEEE(data))
+	if integrityKey != nil {
+		mac := hmac.New(sha256.New, integrityKey)
+		mac.Write(data)
+		data = mac.Sum(data)
+	}
+	return atomicWriteFile(bloomSidecarPath(path), data)
+}
+
+// readBloomSidecar returns the filter stored next to the SST file at path. A missing
+// sidecar fails with an error wrapping os.ErrNotExist. With integrityKey, a sidecar whose
+// HMAC does not match, such as one written without the key, fails with
+// ErrIntegrityViolation, as a forged filter could hide keys.
+func readBloomSidecar(path string, integrityKey []byte) (*FilterBlock, error) {
+	data, err := os.ReadFile(bloomSidecarPath(path))
+	if err != nil {
+		return nil, err
+	}
+	if integrityKey != nil {
+		if len(data) < hmacSize {
+			return nil, ErrIntegrityViolation
+		}
+		stored := data[len(data)-hmacSize:]
+		data = data[:len(data)-hmacSize]
+		mac := hmac.New(sha256.New, integrityKey)
+		mac.Write(data)
+		if !hmac.Equal(mac.Sum(nil), stored) {
+			return nil, ErrIntegrityViolation
+		}
+	}
+	if len(data) < 16 || binary.LittleEndian.Uint32(data) != bloomSidecarMagic {
+		return nil, fmt.Errorf("%w: bloom sidecar of %d bytes", ErrInvalidSSTFormat, len(data))
+	}
+	sum := len(data) - 4
+	if crc32.ChecksumIEEE(data[:sum]) != binary.LittleEndian.Uint32(data[sum:]) {
+		return nil, fmt.Errorf("%w: bloom sidecar", ErrChecksumMismatch)
+	}
+	filter := new(FilterBlock)
+	if err := filter.Deserialize(data[12:sum], binary.LittleEndian); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// loadSSTFilter puts the filter of the SST file at path in the filter cache. It is read
+// from the bloom sidecar if the file has a valid one. Otherwise it is read from the filter
+// block of the file, or rebuilt from its keys for files written before version 5, and the
+// sidecar is written for the next start.
+func (mem *memDB) loadSSTFilter(path string) {
+	if mem.filters == nil {
+		return
+	}
+	filter, err := readBloomSidecar(path, mem.cfg.IntegrityKey)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Warn("ignoring corrupt bloom sidecar", "file", path, "error", err)
+		}
+		var keys int
+		if filter, keys, err = mem.rebuildSSTFilter(path); err != nil {
+			logger.Warn("error loading SST filter", "file", path, "error", err)
+			return
+		}
+		if err := writeBloomSidecar(path, filter, keys, mem.cfg.IntegrityKey); err != nil {
+			logger.Warn("error writing bloom sidecar", "file", path, "error", err)
+		}
+	}
+	mem.filters.Put(path, filter)
+}
+
+// rebuildSSTFilter returns the filter of the SST file at path and the number of keys it
+// holds, reading all the entries if the file has no filter block.
+func (mem *memDB) rebuildSSTFilter(path string) (*FilterBlock, int, error) {
+	file, closeFile, err := openSSTSource(path, false, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer closeFile()
+	header, err := readSSTHeader(file)
+	if err != nil {
+		return nil, 0, err
+	}
+	if filter, err := readSSTFilter(file, mem.cfg.IntegrityKey); err != nil || filter != nil {
+		return filter, int(header.EntryCount), err
+	}
+
+	entries, err := readSSTEntriesWithKey(path, mem.cfg.IntegrityKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	filter := newSSTFilter(len(entries), mem.cfg)
+	for _, kv := range entries {
+		filter.Add(kv.Key)
+	}
+	return filter, len(entries), nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker is open: SST reads are disabled")
+
+type breakerState int
+
+const (
+	Closed breakerState = iota
+	Open
+	HalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreaker stops calling a failing dependency after ConsecutiveFailures errors
+// and lets a single probe through once RecoveryTimeout has passed.
+type CircuitBreaker struct {
+	ConsecutiveFailures int
+	RecoveryTimeout     time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func NewCircuitBreaker(consecutiveFailures int, recoveryTimeout time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		ConsecutiveFailures: consecutiveFailures,
+		RecoveryTimeout:     recoveryTimeout,
+	}
+}
+
+// Execute runs fn unless the breaker is open. A nil breaker always runs fn.
+func (cb *CircuitBreaker) Execute(fn func() error) error {
+	if cb == nil {
+		return fn()
+	}
+	if !cb.allow() {
+		return ErrCircuitOpen
+	}
+	err := fn()
+	cb.record(err)
+	return err
+}
+
+func (cb *CircuitBreaker) allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case Open:
+		if time.Since(cb.openedAt) < cb.RecoveryTimeout {
+			return false
+		}
+		cb.state = HalfOpen
+		cb.probing = true
+		return true
+	case HalfOpen:
+		// Only one probe read at a time
+		if cb.probing {
+			return false
+		}
+		cb.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (cb *CircuitBreaker) record(err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.probing = false
+	// A missing file says nothing about the health of the disk
+	if err == nil || errors.Is(err, os.ErrNotExist) {
+		cb.state = Closed
+		cb.failures = 0
+		return
+	}
+
+	cb.failures++
+	if cb.state == HalfOpen || cb.failures >= cb.ConsecutiveFailures {
+		cb.state = Open
+		cb.openedAt = time.Now()
+	}
+}
+
+func (cb *CircuitBreaker) State() string {
+	if cb == nil {
+		return Closed.String()
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state.String()
+}
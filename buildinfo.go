@@ -0,0 +1,28 @@
+package main
+
+import "runtime"
+
+// Build information, overridden at build time with
+// -ldflags "-X main.Version=... -X main.GitCommit=... -X main.BuildTime=..."
+var (
+	Version   = "dev"
+	GitCommit = "unknown"
+	BuildTime = "unknown"
+)
+
+// BuildInfo describes the running binary. It is served by /version.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"git_commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+func currentBuildInfo() BuildInfo {
+	return BuildInfo{
+		Version:   Version,
+		GitCommit: GitCommit,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+)
+
+// CachePolicy is a fixed-capacity cache deciding which entry to evict when full.
+type CachePolicy interface {
+	Get(key string) (interface{}, bool)
+	Put(key string, value interface{})
+	// Range calls fn with every cached entry without changing the eviction order.
+	// fn runs with the cache locked and must not use it.
+	Range(fn func(key string, value interface{}))
+}
+
+// NewCachePolicy returns the cache named by policy ("lru", "lfu" or "arc") holding up to capacity entries.
+func NewCachePolicy(policy string, capacity int) (CachePolicy, error) {
+	if capacity <= 0 {
+		return nil, fmt.Errorf("invalid cache capacity: %d", capacity)
+	}
+	switch policy {
+	case "lru", "":
+		return NewLRUCache(capacity), nil
+	case "lfu":
+		return NewLFUCache(capacity), nil
+	case "arc":
+		return NewARCCache(capacity), nil
+	default:
+		return nil, fmt.Errorf("unknown cache policy: %s", policy)
+	}
+}
+
+type cacheEntry struct {
+	key   string
+	value interface{}
+	freq  int        // Access count, used by LFUCache
+	queue *list.List // Queue holding the entry, used by ARCCache
+}
+
+// LRUCache evicts the least recently used entry.
+type LRUCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List // Most recently used at the front
+	entries  map[string]*list.Element
+}
+
+func NewLRUCache(capacity int) *LRUCache {
+	return &LRUCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (c *LRUCache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).value, true
+}
+
+func (c *LRUCache) Put(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*cacheEntry).value = value
+		c.order.MoveToFront(elem)
+		return
+	}
+	if c.order.Len() >= c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, value: value})
+}
+
+func (c *LRUCache) Range(fn func(key string, value interface{})) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, elem := range c.entries {
+		fn(key, elem.Value.(*cacheEntry).value)
+	}
+}
+
+// LFUCache evicts the least frequently used entry, the least recently used one among ties.
+type LFUCache struct {
+	mu       sync.Mutex
+	capacity int
+	minFreq  int
+	entries  map[string]*list.Element
+	freqs    map[int]*list.List // Entries by access count, most recent at the front
+}
+
+func NewLFUCache(capacity int) *LFUCache {
+	return &LFUCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		freqs:    make(map[int]*list.List),
+	}
+}
+
+func (c *LFUCache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.touch(elem)
+	return elem.Value.(*cacheEntry).value, true
+}
+
+func (c *LFUCache) Put(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*cacheEntry).value = value
+		c.touch(elem)
+		return
+	}
+	if len(c.entries) >= c.capacity {
+		victims := c.freqs[c.minFreq]
+		oldest := victims.Back()
+		victims.Remove(oldest)
+		if victims.Len() == 0 {
+			delete(c.freqs, c.minFreq)
+		}
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+	c.minFreq = 1
+	c.entries[key] = c.frequencyList(1).PushFront(&cacheEntry{key: key, value: value, freq: 1})
+}
+
+// Range leaves the access counts alone, so the next eviction picks the same entry.
+func (c *LFUCache) Range(fn func(key string, value interface{})) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, elem := range c.entries {
+		fn(key, elem.Value.(*cacheEntry).value)
+	}
+}
+
+// touch moves elem to the list of the next access count.
+func (c *LFUCache) touch(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	current := c.freqs[entry.freq]
+	current.Remove(elem)
+	if current.Len() == 0 {
+		delete(c.freqs, entry.freq)
+		if c.minFreq == entry.freq {
+			c.minFreq++
+		}
+	}
+	entry.freq++
+	c.entries[entry.key] = c.frequencyList(entry.freq).PushFront(entry)
+}
+
+func (c *LFUCache) frequencyList(freq int) *list.List {
+	l, ok := c.freqs[freq]
+	if !ok {
+		l = list.New()
+		c.freqs[freq] = l
+	}
+	return l
+}
+
+// ARCCache is an Adaptive Replacement Cache. T1 holds entries seen once recently and T2
+// entries seen at least twice; B1 and B2 remember the keys recently evicted from each and
+// steer the target size p of T1 towards whichever list would have produced more hits.
+type ARCCache struct {
+	mu             sync.Mutex
+	capacity       int
+	p              int
+	t1, t2, b1, b2 *list.List // Most recent at the front
+	entries        map[string]*list.Element
+}
+
+func NewARCCache(capacity int) *ARCCache {
+	return &ARCCache{
+		capacity: capacity,
+		t1:       list.New(),
+		t2:       list.New(),
+		b1:       list.New(),
+		b2:       list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (c *ARCCache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if entry.queue == c.b1 || entry.queue == c.b2 {
+		return nil, false
+	}
+	c.move(elem, c.t2)
+	return entry.value, true
+}
+
+func (c *ARCCache) Put(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*cacheEntry)
+		switch entry.queue {
+		case c.b1:
+			// A recently evicted once-seen key came back: favour recency
+			c.p = min(c.capacity, c.p+max(c.b2.Len()/c.b1.Len(), 1))
+			c.replace(false)
+		case c.b2:
+			// A recently evicted frequent key came back: favour frequency
+			c.p = max(0, c.p-max(c.b1.Len()/c.b2.Len(), 1))
+			c.replace(true)
+		}
+		entry.value = value
+		c.move(elem, c.t2)
+		return
+	}
+
+	if c.t1.Len()+c.b1.Len() >= c.capacity {
+		if c.t1.Len() < c.capacity {
+			c.removeOldest(c.b1)
+			c.replace(false)
+		} else {
+			c.removeOldest(c.t1)
+		}
+	} else if total := c.t1.Len() + c.t2.Len() + c.b1.Len() + c.b2.Len(); total >= c.capacity {
+		if total >= 2*c.capacity {
+			c.removeOldest(c.b2)
+		}
+		c.replace(false)
+	}
+
+	entry := &cacheEntry{key: key, value: value, queue: c.t1}
+	c.entries[key] = c.t1.PushFront(entry)
+}
+
+// Range skips the keys of the ghost lists, whose values were evicted.
+func (c *ARCCache) Range(fn func(key string, value interface{})) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, l := range []*list.List{c.t1, c.t2} {
+		for elem := l.Front(); elem != nil; elem = elem.Next() {
+			entry := elem.Value.(*cacheEntry)
+			fn(entry.key, entry.value)
+		}
+	}
+}
+
+// replace evicts one cached entry into its ghost list if the cache is full.
+func (c *ARCCache) replace(inB2 bool) {
+	if c.t1.Len()+c.t2.Len() < c.capacity {
+		return
+	}
+	if c.t1.Len() > 0 && (c.t1.Len() > c.p || (inB2 && c.t1.Len() == c.p)) {
+		c.move(c.t1.Back(), c.b1)
+	} else if c.t2.Len() > 0 {
+		c.move(c.t2.Back(), c.b2)
+	}
+}
+
+func (c *ARCCache) move(elem *list.Element, to *list.List) {
+	entry := elem.Value.(*cacheEntry)
+	entry.queue.Remove(elem)
+	if to == c.b1 || to == c.b2 {
+		entry.value = nil
+	}
+	entry.queue = to
+	c.entries[entry.key] = to.PushFront(entry)
+}
+
+func (c *ARCCache) removeOldest(l *list.List) {
+	if oldest := l.Back(); oldest != nil {
+		l.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
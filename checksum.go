@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"hash/crc32"
+	"math/bits"
+)
+
+// ChecksumAlgorithm selects the checksum SST files store over their entries. It is
+// recorded in the high byte of the version field of the SST header.
+type ChecksumAlgorithm uint8
+
+const (
+	ChecksumCRC32IEEE ChecksumAlgorithm = iota
+	// ChecksumCRC32C uses the Castagnoli polynomial, which x86 (SSE 4.2) and arm64 CPUs
+	// compute with a dedicated instruction. Go also computes CRC32 IEEE with carry-less
+	// multiplication on amd64, so CRC32C is not 5-10x faster there as it is with a table-driven
+	// CRC32; both run at several GB/s. See BenchmarkChecksumAlgorithms for a given machine.
+	ChecksumCRC32C
+	ChecksumXXHash32
+	ChecksumAdler32
+)
+
+func (a ChecksumAlgorithm) String() string {
+	switch a {
+	case ChecksumCRC32IEEE:
+		return "crc32"
+	case ChecksumCRC32C:
+		return "crc32c"
+	case ChecksumXXHash32:
+		return "xxhash32"
+	case ChecksumAdler32:
+		return "adler32"
+	default:
+		return fmt.Sprintf("ChecksumAlgorithm(%d)", uint8(a))
+	}
+}
+
+// ChecksumFunc computes a 32-bit checksum of data.
+type ChecksumFunc func(data []byte) uint32
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+var checksumFuncs = map[ChecksumAlgorithm]ChecksumFunc{
+	ChecksumCRC32IEEE: crc32.ChecksumIEEE,
+	ChecksumCRC32C:    func(data []byte) uint32 { return crc32.Checksum(data, castagnoliTable) },
+	ChecksumXXHash32:  xxhash32,
+	ChecksumAdler32:   adler32.Checksum,
+}
+
+// checksumHashes computes the same checksums as checksumFuncs incrementally, for
+// entries that are streamed rather than held in memory.
+var checksumHashes = map[ChecksumAlgorithm]func() hash.Hash32{
+	ChecksumCRC32IEEE: crc32.NewIEEE,
+	ChecksumCRC32C:    func() hash.Hash32 { return crc32.New(castagnoliTable) },
+	ChecksumXXHash32:  newXXHash32,
+	ChecksumAdler32:   adler32.New,
+}
+
+// sstChecksum applies checksum to the operation type, key and value of every entry.
+func sstChecksum(checksum ChecksumFunc, data []KeyValue) uint32 {
+	size := 0
+	for _, kv := range data {
+		size += 1 + len(kv.Key) + len(kv.Value)
+	}
+	buf := make([]byte, 0, size)
+	for _, kv := range data {
+		buf = append(buf, sstOpType(kv))
+		buf = append(buf, kv.Key...)
+		buf = append(buf, kv.Value...)
+	}
+	return checksum(buf)
+}
+
+const (
+	xx32Prime1 uint32 = 2654435761
+	xx32Prime2 uint32 = 2246822519
+	xx32Prime3 uint32 = 3266489917
+	xx32Prime4 uint32 = 668265263
+	xx32Prime5 uint32 = 374761393
+)
+
+// xxhash32 is XXH32 with seed 0.
+func xxhash32(data []byte) uint32 {
+	n := len(data)
+	var h uint32
+	if n >= 16 {
+		v3 := uint32(0) // The seed; the lanes start at offsets from it that wrap around
+		v1 := v3 + xx32Prime1 + xx32Prime2
+		v2 := v3 + xx32Prime2
+		v4 := v3 - xx32Prime1
+		for len(data) >= 16 {
+			v1 = xx32Round(v1, binary.LittleEndian.Uint32(data))
+			v2 = xx32Round(v2, binary.LittleEndian.Uint32(data[4:]))
+			v3 = xx32Round(v3, binary.LittleEndian.Uint32(data[8:]))
+			v4 = xx32Round(v4, binary.LittleEndian.Uint32(data[12:]))
+			data = data[16:]
+		}
+		h = bits.RotateLeft32(v1, 1) + bits.RotateLeft32(v2, 7) + bits.RotateLeft32(v3, 12) + bits.RotateLeft32(v4, 18)
+	} else {
+		h = xx32Prime5
+	}
+	h += uint32(n)
+
+	for ; len(data) >= 4; data = data[4:] {
+		h += binary.LittleEndian.Uint32(data) * xx32Prime3
+		h = bits.RotateLeft32(h, 17) * xx32Prime4
+	}
+	for _, b := range data {
+		h += uint32(b) * xx32Prime5
+		h = bits.RotateLeft32(h, 11) * xx32Prime1
+	}
+
+	h ^= h >> 15
+	h *= xx32Prime2
+	h ^= h >> 13
+	h *= xx32Prime3
+	h ^= h >> 16
+	return h
+}
+
+// xxHash32Digest computes xxhash32 over data written in pieces of any size.
+type xxHash32Digest struct {
+	v1, v2, v3, v4 uint32
+	total          uint64
+	buf            [16]byte // Bytes not yet making up a full stripe
+	buffered       int
+}
+
+func newXXHash32() hash.Hash32 {
+	d := &xxHash32Digest{}
+	d.Reset()
+	return d
+}
+
+func (d *xxHash32Digest) Reset() {
+	d.v3 = 0 // The seed; the lanes start at offsets from it that wrap around
+	d.v1 = d.v3 + xx32Prime1 + xx32Prime2
+	d.v2 = d.v3 + xx32Prime2
+	d.v4 = d.v3 - xx32Prime1
+	d.total = 0
+	d.buffered = 0
+}
+
+func (d *xxHash32Digest) Size() int      { return 4 }
+func (d *xxHash32Digest) BlockSize() int { return 16 }
+
+func (d *xxHash32Digest) Write(data []byte) (int, error) {
+	n := len(data)
+	d.total += uint64(n)
+	if d.buffered > 0 {
+		copied := copy(d.buf[d.buffered:], data)
+		d.buffered += copied
+		data = data[copied:]
+		if d.buffered < len(d.buf) {
+			return n, nil
+		}
+		d.stripe(d.buf[:])
+		d.buffered = 0
+	}
+	for ; len(data) >= 16; data = data[16:] {
+		d.stripe(data)
+	}
+	d.buffered = copy(d.buf[:], data)
+	return n, nil
+}
+
+func (d *xxHash32Digest) stripe(data []byte) {
+	d.v1 = xx32Round(d.v1, binary.LittleEndian.Uint32(data))
+	d.v2 = xx32Round(d.v2, binary.LittleEndian.Uint32(data[4:]))
+	d.v3 = xx32Round(d.v3, binary.LittleEndian.Uint32(data[8:]))
+	d.v4 = xx32Round(d.v4, binary.LittleEndian.Uint32(data[12:]))
+}
+
+func (d *xxHash32Digest) Sum32() uint32 {
+	var h uint32
+	if d.total >= 16 {
+		h = bits.RotateLeft32(d.v1, 1) + bits.RotateLeft32(d.v2, 7) + bits.RotateLeft32(d.v3, 12) + bits.RotateLeft32(d.v4, 18)
+	} else {
+		h = xx32Prime5
+	}
+	h += uint32(d.total)
+
+	data := d.buf[:d.buffered]
+	for ; len(data) >= 4; data = data[4:] {
+		h += binary.LittleEndian.Uint32(data) * xx32Prime3
+		h = bits.RotateLeft32(h, 17) * xx32Prime4
+	}
+	for _, b := range data {
+		h += uint32(b) * xx32Prime5
+		h = bits.RotateLeft32(h, 11) * xx32Prime1
+	}
+
+	h ^= h >> 15
+	h *= xx32Prime2
+	h ^= h >> 13
+	h *= xx32Prime3
+	h ^= h >> 16
+	return h
+}
+
+func (d *xxHash32Digest) Sum(b []byte) []byte {
+	return binary.BigEndian.AppendUint32(b, d.Sum32())
+}
+
+func xx32Round(acc, lane uint32) uint32 {
+	acc += lane * xx32Prime2
+	return bits.RotateLeft32(acc, 13) * xx32Prime1
+}
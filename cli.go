@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// runCommand executes a command line subcommand such as "inspect-sst <file>".
+func runCommand(args []string, cfg DBConfig, out io.Writer) error {
+	switch args[0] {
+	case "inspect-sst":
+		if len(args) != 2 {
+			return errors.New("usage: inspect-sst <file>")
+		}
+		result, err := InspectSST(args[1], cfg.IntegrityKey)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "format_version: %d\nindex_status: %s\n", result.FormatVersion, result.IndexStatus)
+		if result.IndexError != "" {
+			fmt.Fprintf(out, "index_error: %s\n", result.IndexError)
+		}
+		properties, err := ReadSSTProperties(args[1], cfg.IntegrityKey)
+		if err != nil {
+			return err
+		}
+
+		names := make([]string, 0, len(properties))
+		for name := range properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(out, "%s: %s\n", name, properties[name])
+		}
+		return nil
+	case "dump-wal":
+		if len(args) != 2 {
+			return errors.New("usage: dump-wal <file>")
+		}
+		return WALDump(args[1], out)
+	case "recover-to-seq":
+		if len(args) != 3 {
+			return errors.New("usage: recover-to-seq <sequence> <data-dir>")
+		}
+		seq, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid sequence number %q: %w", args[1], err)
+		}
+		n, err := recoverToSequence(cfg, seq, args[2])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "recovered %d keys at sequence %d to %s\n", n, seq, args[2])
+		return nil
+	default:
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+var ErrReadOnly = errors.New("database is read-only")
+
+// cloneMarkerFileName names the file CloneTo writes to mark a directory as a clone.
+const cloneMarkerFileName = "CLONE"
+
+// cloneMarker is the content of the clone marker file.
+type cloneMarker struct {
+	Source   string    `json:"source"` // Absolute path of the data directory that was cloned
+	ClonedAt time.Time `json:"cloned_at"`
+}
+
+// CloneTo copies the database as it is now to destDir, which must be empty or missing,
+// for OpenClone to open read-only. The memtable is flushed first, then the SST files and
+// the manifest are hard linked, or copied when destDir is on another device. Cold files
+// are placed in destDir itself. Later writes to the database are not seen by the clone.
+// Hard linked files share their content, so a file must not be rewritten in place
+// while a clone uses it. Only the flush holds the database lock; compactions and tiering
+// wait until the files are cloned, so none of them is removed or moved meanwhile.
+func (mem *memDB) CloneTo(destDir string) error {
+	mem.compactionMu.Lock()
+	defer mem.compactionMu.Unlock()
+	files, err := mem.flushForClone()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
+	if entries, err := os.ReadDir(destDir); err != nil {
+		return err
+	} else if len(entries) > 0 {
+		return fmt.Errorf("clone directory %s is not empty", destDir)
+	}
+
+	for i, file := range files {
+		fileName := filepath.Base(file.FileName)
+		if err := linkOrCopyFile(filepath.Join(mem.cfg.DataDir, file.FileName), filepath.Join(destDir, fileName)); err != nil {
+			return fmt.Errorf("error cloning %s: %w", file.FileName, err)
+		}
+		files[i].FileName = fileName
+	}
+	if err := WriteManifest(destDir, files); err != nil {
+		return fmt.Errorf("error writing clone manifest: %w", err)
+	}
+
+	source, err := filepath.Abs(mem.cfg.DataDir)
+	if err != nil {
+		return err
+	}
+	marker, err := json.Marshal(cloneMarker{Source: source, ClonedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	if err := atomicWriteFile(filepath.Join(destDir, cloneMarkerFileName), marker); err != nil {
+		return fmt.Errorf("error writing clone marker: %w", err)
+	}
+	logger.Info("cloned database", "source", source, "destination", destDir, "sst_files", len(files))
+	return nil
+}
+
+// flushForClone flushes the memtable and returns the files of the manifest.
+func (mem *memDB) flushForClone() ([]SSTFileMeta, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	if mem.closed {
+		return nil, ErrDatabaseClosed
+	}
+	mem.awaitPendingWrites()
+	if len(mem.data) > 0 || len(mem.tombstones) > 0 {
+		if err := mem.createSSTFile(); err != nil {
+			return nil, fmt.Errorf("error flushing memtable: %w", err)
+		}
+	}
+	files, err := ReadManifest(mem.cfg.DataDir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+	return files, nil
+}
+
+// linkOrCopyFile hard links src to dst, copying it when they are on different devices.
+func linkOrCopyFile(src, dst string) error {
+	err := os.Link(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := copyFile(dst, file); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return nil
+}
+
+// OpenClone opens the clone CloneTo wrote to cfg.DataDir. The clone has no WAL: Set, Del
+// and the other writes fail with ErrReadOnly. Nothing flushes, compacts or tiers its files,
+// which it may share with the source database.
+func OpenClone(cfg DBConfig) (*memDB, error) {
+	data, err := os.ReadFile(filepath.Join(cfg.DataDir, cloneMarkerFileName))
+	if err != nil {
+		return nil, fmt.Errorf("error reading clone marker: %w", err)
+	}
+	var marker cloneMarker
+	if err := json.Unmarshal(data, &marker); err != nil {
+		return nil, fmt.Errorf("error parsing clone marker: %w", err)
+	}
+	files, err := ReadManifest(cfg.DataDir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+	for _, file := range files {
+		if _, err := readSSTFileHeader(filepath.Join(cfg.DataDir, file.FileName)); err != nil {
+			return nil, fmt.Errorf("error opening %s: %w", file.FileName, err)
+		}
+	}
+
+	mem := newMemDB(nil, cfg)
+	mem.readOnly = true
+	mem.startBackground()
+	logger.Info("opened clone", "source", marker.Source, "cloned_at", marker.ClonedAt)
+	return mem, nil
+}
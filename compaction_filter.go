@@ -0,0 +1,11 @@
+package main
+
+// CompactionFilter inspects every key that survives a compaction. It runs after
+// tombstones and expired keys have been dropped, so it only sees live values.
+type CompactionFilter interface {
+	// ShouldKeep reports whether the pair is written to the compacted file.
+	// Dropping a pair has the same effect as deleting its key.
+	ShouldKeep(key, value []byte) bool
+	// Transform returns the value written for a kept pair.
+	Transform(key, value []byte) (newValue []byte)
+}
@@ -0,0 +1,59 @@
+package main
+
+// CompactionStrategy picks the SST files a compaction merges.
+type CompactionStrategy interface {
+	// SelectFiles returns the files to merge into one, or none to skip the compaction.
+	// files are ordered oldest first and carry their FileSize; the returned files must be
+	// a run of consecutive files in that order, as the output replaces them in time.
+	SelectFiles(files []SSTFileMeta, maxSSTFiles int) []SSTFileMeta
+}
+
+// MergeAllStrategy merges every SST file once there are more than maxSSTFiles of them.
+// It is the strategy used when DBConfig.CompactionStrategy is nil.
+type MergeAllStrategy struct{}
+
+func (MergeAllStrategy) SelectFiles(files []SSTFileMeta, maxSSTFiles int) []SSTFileMeta {
+	if len(files) <= maxSSTFiles {
+		return nil
+	}
+	return files
+}
+
+// SizeTieredStrategy merges files of similar size, so large files are not rewritten each
+// time a few small ones are flushed. maxSSTFiles is ignored.
+type SizeTieredStrategy struct {
+	SizeRatio       float64 // Files within this factor of the smallest file of a tier belong to it
+	MinFilesPerTier int     // A tier is merged once it holds more than this many files
+}
+
+func (s SizeTieredStrategy) SelectFiles(files []SSTFileMeta, maxSSTFiles int) []SSTFileMeta {
+	return SelectSizeTieredFiles(files, s.SizeRatio, s.MinFilesPerTier)
+}
+
+// SelectSizeTieredFiles splits files, oldest first, into runs of consecutive files whose
+// FileSize are all within sizeRatio of the smallest one. It returns the run with the largest
+// files among those holding more than minFilesPerTier files, or nil if no run does. Only
+// consecutive files are merged, so the output stands where its inputs stood in time.
+func SelectSizeTieredFiles(files []SSTFileMeta, sizeRatio float64, minFilesPerTier int) []SSTFileMeta {
+	var selected []SSTFileMeta
+	var selectedSize int64 // Size of the smallest file of selected
+	for start := 0; start < len(files); {
+		smallest, largest := files[start].FileSize, files[start].FileSize
+		end := start + 1
+		for ; end < len(files); end++ {
+			size := files[end].FileSize
+			if float64(max(largest, size)) > float64(min(smallest, size))*sizeRatio {
+				break
+			}
+			smallest, largest = min(smallest, size), max(largest, size)
+		}
+		if end-start > minFilesPerTier && (selected == nil || smallest >= selectedSize) {
+			selected, selectedSize = files[start:end], smallest
+		}
+		start = end
+	}
+	if selected == nil {
+		return nil
+	}
+	return append([]SSTFileMeta(nil), selected...)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"hash/adler32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	maxDictionarySize     = 32 << 10 // Deflate only looks back this far, so a longer dictionary is cut
+	dictionarySegmentSize = 16       // Length of the substrings BuildCompressionDictionary counts
+)
+
+// dictionarySampleBytes is how many bytes of keys and values BuildCompressionDictionary
+// reads at most, across all sample files.
+var dictionarySampleBytes = 4 << 20
+
+var ErrUnknownCompressionDictionary = errors.New("SST file compressed with an unknown dictionary")
+
+// compressionDictionaries holds the dictionaries SST files may be compressed with, by
+// their ID, so the readers find the one a file names in its header.
+var compressionDictionaries sync.Map
+
+// compressionDictionaryID returns the ID files compressed with dict store, which is also
+// the one zlib records in the compressed stream.
+func compressionDictionaryID(dict []byte) uint32 {
+	return adler32.Checksum(dict)
+}
+
+// RegisterCompressionDictionary makes dict available for reading the SST files compressed
+// with it and returns its ID. OpenDB registers every dictionary stored in the data directory.
+func RegisterCompressionDictionary(dict []byte) uint32 {
+	id := compressionDictionaryID(dict)
+	compressionDictionaries.Store(id, dict)
+	return id
+}
+
+// dictionaryFilePattern names the copies of the dictionaries kept in the data directory.
+const dictionaryFilePattern = "dictionary-%08x.dict"
+
+// loadCompressionDictionaries stores current, unless it is empty, in dir under its ID and
+// registers every dictionary stored there, so the SST files compressed with a dictionary
+// that is no longer configured stay readable.
+func loadCompressionDictionaries(dir string, current []byte) error {
+	if len(current) > 0 {
+		path := filepath.Join(dir, fmt.Sprintf(dictionaryFilePattern, compressionDictionaryID(current)))
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			if err := atomicWriteFile(path, current); err != nil {
+				return fmt.Errorf("error storing compression dictionary: %w", err)
+			}
+		}
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "dictionary-*.dict"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		dict, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("error reading compression dictionary: %w", err)
+		}
+		var id uint32
+		if _, err := fmt.Sscanf(filepath.Base(path), dictionaryFilePattern, &id); err != nil || id != compressionDictionaryID(dict) {
+			return fmt.Errorf("compression dictionary %s does not match its ID", filepath.Base(path))
+		}
+		RegisterCompressionDictionary(dict)
+	}
+	return nil
+}
+
+// newSSTCompressor returns the writer the entries of an SST file are compressed with:
+// zlib with dict as preset dictionary, or gzip without one. All entries of a file share
+// one stream, so only its first entries are primed by the dictionary; the later ones find
+// the same matches among the entries before them.
+func newSSTCompressor(w io.Writer, compressionLevel int, dict []byte) (io.WriteCloser, error) {
+	if len(dict) > 0 {
+		return zlib.NewWriterLevelDict(w, compressionLevel, dict)
+	}
+	return gzip.NewWriterLevel(w, compressionLevel)
+}
+
+// newSSTDecompressor returns a reader of the entries compressed in r, with the dictionary
+// the header names if it has one.
+func newSSTDecompressor(r io.Reader, header sstHeader) (io.ReadCloser, error) {
+	if header.Version&sstDictionaryFlag == 0 {
+		return gzip.NewReader(r)
+	}
+	dict, ok := compressionDictionaries.Load(header.DictionaryID)
+	if !ok {
+		return nil, fmt.Errorf("%w: %#x", ErrUnknownCompressionDictionary, header.DictionaryID)
+	}
+	return zlib.NewReaderDict(r, dict.([]byte))
+}
+
+// BuildCompressionDictionary returns a dictionary for compressing entries like those of
+// sampleSSTs. It counts the substrings of dictionarySegmentSize bytes of their keys and
+// values and keeps the ones found more than once, most frequent last, as deflate encodes
+// the nearest matches in the fewest bits.
+func BuildCompressionDictionary(sampleSSTs []string) ([]byte, error) {
+	counts := make(map[string]int)
+	sampled := 0
+samples:
+	for _, path := range sampleSSTs {
+		entries, err := readSSTEntries(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", path, err)
+		}
+		for _, kv := range entries {
+			for _, data := range [][]byte{kv.Key, kv.Value} {
+				for i := 0; i+dictionarySegmentSize <= len(data); i++ {
+					counts[string(data[i:i+dictionarySegmentSize])]++
+				}
+				sampled += len(data)
+			}
+			if sampled >= dictionarySampleBytes {
+				break samples
+			}
+		}
+	}
+
+	segments := make([]string, 0, len(counts))
+	for segment, count := range counts {
+		if count > 1 {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		if counts[segments[i]] != counts[segments[j]] {
+			return counts[segments[i]] > counts[segments[j]]
+		}
+		return segments[i] < segments[j]
+	})
+	// covered holds every substring of dictionarySegmentSize bytes of the kept segments
+	// laid end to end, so overlapping substrings of the same text are only kept once
+	covered := make(map[string]struct{})
+	var dict []byte
+	var kept []string
+	for _, segment := range segments {
+		if len(dict)+len(segment) > maxDictionarySize {
+			break
+		}
+		if _, ok := covered[segment]; ok {
+			continue
+		}
+		start := max(len(dict)-dictionarySegmentSize+1, 0)
+		dict = append(dict, segment...)
+		for i := start; i+dictionarySegmentSize <= len(dict); i++ {
+			covered[string(dict[i:i+dictionarySegmentSize])] = struct{}{}
+		}
+		kept = append(kept, segment)
+	}
+	if len(kept) == 0 {
+		return nil, errors.New("no repeated data in the sample SST files")
+	}
+
+	result := make([]byte, 0, len(dict))
+	for i := len(kept) - 1; i >= 0; i-- {
+		result = append(result, kept[i]...)
+	}
+	return result, nil
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// DeleteMode selects how Del removes a key from the memtable.
+type DeleteMode uint8
+
+const (
+	DeleteLogical  DeleteMode = iota // Replace the entry with a tombstone that is flushed like a write
+	DeletePhysical                   // Remove the entry at once and keep the tombstone aside until the next flush
+)
+
+func (m DeleteMode) String() string {
+	switch m {
+	case DeleteLogical:
+		return "logical"
+	case DeletePhysical:
+		return "physical"
+	default:
+		return fmt.Sprintf("DeleteMode(%d)", uint8(m))
+	}
+}
+
+// DBConfig holds the tunable settings of the database and its HTTP server.
+type DBConfig struct {
+	DataDir    string        // Directory holding the SST files
+	WALPath    string        // File holding the write-ahead log
+	GetTimeout time.Duration // Maximum time a /get request may take
+	SetTimeout time.Duration // Maximum time a /set request may take
+	DelTimeout time.Duration // Maximum time a /del request may take
+
+	MaxRequestsPerSecondPerIP int      // Requests per second each client IP may make on average; 0 disables rate limiting
+	BurstSize                 int      // Requests a client IP may make at once before being limited to its rate
+	TrustedProxies            []string // Addresses or CIDR ranges of the proxies whose X-Forwarded-For header names the client IP
+	MaxConcurrentRequests     int      // Requests handled at once; more are rejected with 503 Service Unavailable. 0 is unlimited
+
+	MaxMemtableEntries       int           // Flush the memtable once it holds this many entries
+	MaxMemtableBytes         int64         // Flush the memtable once its keys and values exceed this size
+	MaxSSTFileSize           int64         // Flush the memtable before the SST file it produces would exceed this size
+	FlushInterval            time.Duration // Time between periodic flushes of pending writes
+	SoftMemoryLimit          int64         // Memtable size beyond which the oldest entries are evicted to an SST file before flushing; 0 disables eviction
+	EvictionBatchSize        int           // Entries evicted at a time once the memtable exceeds SoftMemoryLimit
+	MaxSSTFiles              int           // Compact the SST files once there are more than this many
+	CompactionSchedule       string        // When to check for compaction: a duration ("30m") or a cron expression ("0 2 * * *")
+	MinCompactionIntervalSec int           // Seconds after a compaction before the next one may run; earlier triggers wait for the rest
+	TransformBytesPerSecond  int64         // Rate at which TransformAllSSTs writes the rewritten SST files; 0 is unlimited
+
+	AsyncWriteBatchSize     int           // Most AsyncSet writes logged in one WAL batch
+	AsyncWriteFlushInterval time.Duration // Longest time an AsyncSet write waits for its batch to fill
+
+	MemtableValueCompression bool // Keep the values of Set entries gzip-compressed in the memtable, trading CPU for memory
+	MinCompressionSize       int  // Values shorter than this many bytes are kept uncompressed in the memtable
+
+	MaxKeyCount          int64      // Set fails with ErrDatabaseFull once this many keys exist; 0 is unlimited
+	SoftWarningThreshold float64    // Share of MaxKeyCount beyond which a warning is logged
+	DeleteMode           DeleteMode // How Del removes keys: DeleteLogical or DeletePhysical
+
+	NamespaceSeparator string                        // Separates a namespace name from the keys it contains
+	MergeOperator      MergeOperator                 // Combines writes to the same key in Merge, Get and compaction
+	KeyTransformer     func([]byte) []byte           `json:"-"` // Normalizes keys in Set, Get and Del, such as KeyNormalize; nil keeps them as they are
+	ValueValidator     func(key, value []byte) error `json:"-"` // Rejects written values with ErrValueValidationFailed, such as ValidateJSON; nil accepts all
+	ShardKeyFn         func([]byte) []byte           `json:"-"` // Extracts the part of a key ShardedDB places it by, such as a prefix; nil places it by the whole key
+
+	CompactionFilter   CompactionFilter   // Drops or rewrites key-value pairs during compaction
+	CompactionStrategy CompactionStrategy `json:"-"` // Picks the SST files each compaction merges; nil merges all of them
+	IOSemaphore        *IOSemaphore       `json:"-"` // Gives SST reads priority over compaction I/O; nil disables it
+
+	BlockCachePolicy string // Eviction policy of the block cache: "lru", "lfu" or "arc"
+	BlockCacheSize   int    // Number of SST files kept decoded in the block cache; 0 disables the cache
+	SSTBlockSize     int    // Size of the pooled buffers uncached SST files are decoded into; 0 disables the pool
+
+	WarmCacheOnStartup       bool // Fill the block cache in the background after OpenDB returns instead of before
+	RequireWarmCacheForReady bool // Report /health/ready as not ready until the block cache is warm
+	WarmupMaxKeys            int  // Most keys one /warmup request may load into the memtable
+
+	ColdDataDir          string        // Directory SST files that were not read for ColdDataAge are moved to; empty disables tiering
+	ColdDataAge          time.Duration // Time without reads after which an SST file is cold
+	TieringCheckInterval time.Duration // Time between checks for cold SST files
+	PromoteColdFiles     bool          // Move cold SST files back to DataDir once they are read again
+
+	GzipCompressionLevel      int               // Level SST entries are compressed at, from gzip.NoCompression to gzip.BestCompression
+	CompressionDictionaryFile string            // File holding a dictionary new SST files are compressed with, such as one from BuildCompressionDictionary. It primes one stream per file, so it mostly shrinks files of few entries
+	CompressionDictionary     []byte            `json:"-"` // Content of CompressionDictionaryFile, read by LoadConfigFile and LoadConfigFromEnv
+	ChecksumAlgorithm         ChecksumAlgorithm // Checksum new SST files store over their entries
+	ByteOrder                 binary.ByteOrder  `json:"-"` // Order of the fixed-size fields of new SST files and WAL records: binary.LittleEndian or binary.BigEndian
+	UseDirectIO               bool              // Write and read SST files with O_DIRECT, bypassing the page cache (Linux only)
+	IOAlignment               int               // Alignment of direct I/O buffers and blocks, a multiple of 512
+	SyncDirectory             bool              // Sync DataDir after every flush, so the entry of the new SST file survives a power failure
+
+	SketchWidth int // Counters per row of the access frequency sketch
+	SketchDepth int // Rows of the access frequency sketch
+
+	HashFuncName           string  // Hash of the bloom filters, the frequency sketch and the shard ring: "fnv64", "xxhash64" or "murmur3_64"
+	BloomFalsePositiveRate float64 // False positive rate of the filter block of new SST files
+
+	ReplicaAddr     string // TCP address of a replica that must acknowledge every WAL entry
+	ReplicaHTTPAddr string // HTTP address of a replica that corrupt SST files are repaired from
+	RepairToken     string // Required in X-Repair-Token to use /internal/block once set; also sent to ReplicaHTTPAddr
+
+	WALShippingBackend string // Where rotated WAL segments are uploaded for disaster recovery: "s3", or empty to keep them local
+	WALShippingBucket  string // Bucket the segments are uploaded to
+	WALShippingPrefix  string // Prefix of the segment object names, such as "orders/", so several databases can share the bucket; each shard adds "shard-N/"
+
+	LogOutput    string // "stdout", "stderr", "file:<path>" or "syslog:<facility>"
+	LogMaxSizeMB int    // Rotate a log file once it exceeds this size; 0 disables rotation
+	LogLevel     string // Least severe events logged: "debug", "info", "warn" or "error"
+
+	SSTReadRetryPolicy  RetryPolicy // Retries of SST reads that fail with a transient error
+	WALWriteRetryPolicy RetryPolicy // Retries of the WAL appends of Set that fail with a transient error
+
+	WALCompactionThresholdBytes int64     // Drop superseded WAL entries once the log exceeds this size; 0 disables it
+	MaxWALSize                  int64     // Rotate the WAL into a new file once it exceeds this size; 0 disables rotation
+	WALFormat                   WALFormat // Encoding of new WAL entries: WALBinary, or WALJSON for reading the log with standard tools
+	EntryTimestamp              bool      // Record the wall-clock time of every WAL entry, for change data capture consumers
+
+	WALSyncPolicy         WALSyncPolicy // When WAL appends are synced to disk: SyncNone or SyncPerEntry
+	WALErrorRateThreshold float64       // Share of failed WAL appends over the last minute beyond which SyncNone is upgraded to SyncPerEntry; 0 disables it
+	WALSyncRecoveryWindow time.Duration // Time the error rate must stay at or below the threshold before SyncNone is restored
+
+	IntegrityKey []byte // 32-byte key of the HMAC-SHA256 appended to SST files; nil keeps CRC32 only
+
+	StatsFlushInterval  time.Duration // Time between writes of the stats to a file in DataDir; 0 disables them
+	StatsRetentionDays  int           // Delete stats files older than this many days; 0 keeps them all
+	StatsReportInterval time.Duration // Time between writes of the stats to the log output; 0 disables them
+
+	Debug      bool   // Serve GET /debug, a snapshot of the memtable, manifest and caches
+	DebugToken string // Required in X-Debug-Token to use /debug once set; without it only localhost may
+}
+
+func DefaultDBConfig() DBConfig {
+	return DBConfig{
+		DataDir:    "./GO_PROJECT",
+		WALPath:    "newal.log",
+		GetTimeout: 5 * time.Second,
+		SetTimeout: 5 * time.Second,
+		DelTimeout: 5 * time.Second,
+
+		MaxRequestsPerSecondPerIP: 1000,
+		BurstSize:                 100,
+		MaxConcurrentRequests:     1000,
+
+		MaxMemtableEntries:       1000,
+		MaxMemtableBytes:         4 << 20,
+		MaxSSTFileSize:           64 << 20,
+		FlushInterval:            30 * time.Minute,
+		EvictionBatchSize:        100,
+		MaxSSTFiles:              10,
+		CompactionSchedule:       "30m",
+		MinCompactionIntervalSec: 60,
+
+		AsyncWriteBatchSize:     100,
+		AsyncWriteFlushInterval: time.Millisecond,
+		TransformBytesPerSecond: 64 << 20,
+
+		MinCompressionSize: 256,
+
+		SoftWarningThreshold: 0.9,
+
+		NamespaceSeparator: ":",
+
+		LogLevel: "info",
+
+		BlockCachePolicy: "lru",
+		BlockCacheSize:   64,
+		SSTBlockSize:     64 << 10,
+
+		WarmupMaxKeys: 100000,
+
+		ColdDataAge:          7 * 24 * time.Hour,
+		TieringCheckInterval: time.Hour,
+
+		GzipCompressionLevel: gzip.DefaultCompression,
+		ByteOrder:            binary.LittleEndian,
+		IOAlignment:          defaultIOAlignment,
+		SyncDirectory:        true,
+
+		// 1% error with 0.1% probability: width ceil(e/0.01), depth ceil(ln(1/0.001))
+		SketchWidth: 272,
+		SketchDepth: 7,
+
+		HashFuncName:           "fnv64",
+		BloomFalsePositiveRate: 0.01,
+
+		LogOutput:    "stderr",
+		LogMaxSizeMB: 100,
+
+		StatsRetentionDays: 7,
+
+		SSTReadRetryPolicy:  DefaultRetryPolicy(),
+		WALWriteRetryPolicy: DefaultWALRetryPolicy(),
+
+		WALCompactionThresholdBytes: 64 << 20,
+		MaxWALSize:                  256 << 20,
+
+		WALErrorRateThreshold: 0.001,
+		WALSyncRecoveryWindow: 5 * time.Minute,
+	}
+}
+
+// LoadConfigFile overlays the JSON settings in path on cfg. Durations are in nanoseconds.
+func LoadConfigFile(path string, cfg DBConfig) (DBConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+	return loadCompressionDictionary(cfg)
+}
+
+// loadCompressionDictionary reads cfg.CompressionDictionaryFile into cfg.CompressionDictionary.
+func loadCompressionDictionary(cfg DBConfig) (DBConfig, error) {
+	if cfg.CompressionDictionaryFile == "" {
+		return cfg, nil
+	}
+	dict, err := os.ReadFile(cfg.CompressionDictionaryFile)
+	if err != nil {
+		return cfg, fmt.Errorf("error reading compression dictionary: %w", err)
+	}
+	cfg.CompressionDictionary = dict
+	return cfg, nil
+}
+
+// LoadConfigFromEnv overrides the settings of cfg that are set in the environment:
+// DB_DATA_DIR, DB_WAL_PATH, DB_MAX_ENTRIES, DB_FLUSH_INTERVAL (e.g. "10m") and DB_MAX_SST_FILES.
+func LoadConfigFromEnv(cfg DBConfig) (DBConfig, error) {
+	if dir := os.Getenv("DB_DATA_DIR"); dir != "" {
+		cfg.DataDir = dir
+	}
+	if path := os.Getenv("DB_WAL_PATH"); path != "" {
+		cfg.WALPath = path
+	}
+	if value := os.Getenv("DB_MAX_ENTRIES"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid DB_MAX_ENTRIES %q: %w", value, err)
+		}
+		cfg.MaxMemtableEntries = n
+	}
+	if value := os.Getenv("DB_FLUSH_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid DB_FLUSH_INTERVAL %q: %w", value, err)
+		}
+		cfg.FlushInterval = interval
+	}
+	if value := os.Getenv("DB_MAX_SST_FILES"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid DB_MAX_SST_FILES %q: %w", value, err)
+		}
+		cfg.MaxSSTFiles = n
+	}
+	if value := os.Getenv("DB_DEBUG"); value != "" {
+		debug, err := strconv.ParseBool(value)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid DB_DEBUG %q: %w", value, err)
+		}
+		cfg.Debug = debug
+	}
+	if token := os.Getenv("DB_DEBUG_TOKEN"); token != "" {
+		cfg.DebugToken = token
+	}
+	if token := os.Getenv("DB_REPAIR_TOKEN"); token != "" {
+		cfg.RepairToken = token
+	}
+	if level := os.Getenv("DB_LOG_LEVEL"); level != "" {
+		cfg.LogLevel = level
+	}
+	if path := os.Getenv("DB_COMPRESSION_DICTIONARY"); path != "" {
+		cfg.CompressionDictionaryFile = path
+		return loadCompressionDictionary(cfg)
+	}
+	return cfg, nil
+}
+
+// ValidateConfig reports every setting of cfg that cannot work.
+func ValidateConfig(cfg DBConfig) error {
+	var errs []error
+	if cfg.DataDir == "" {
+		errs = append(errs, errors.New("DataDir must not be empty"))
+	}
+	if cfg.WALPath == "" {
+		errs = append(errs, errors.New("WALPath must not be empty"))
+	} else if file, err := os.OpenFile(cfg.WALPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+		errs = append(errs, fmt.Errorf("WAL path %s is not writable: %w", cfg.WALPath, err))
+	} else {
+		file.Close()
+	}
+	if cfg.GetTimeout <= 0 || cfg.SetTimeout <= 0 || cfg.DelTimeout <= 0 {
+		errs = append(errs, errors.New("request timeouts must be positive"))
+	}
+	if cfg.MaxMemtableEntries < 0 {
+		errs = append(errs, fmt.Errorf("MaxMemtableEntries must not be negative, got %d", cfg.MaxMemtableEntries))
+	}
+	if cfg.MaxMemtableBytes < 1<<20 {
+		errs = append(errs, fmt.Errorf("MaxMemtableBytes must be at least 1 MB, got %d", cfg.MaxMemtableBytes))
+	}
+	if cfg.MaxSSTFileSize > 0 && cfg.MaxSSTFileSize < cfg.MaxMemtableBytes {
+		errs = append(errs, fmt.Errorf("MaxSSTFileSize (%d) must not be smaller than MaxMemtableBytes (%d)", cfg.MaxSSTFileSize, cfg.MaxMemtableBytes))
+	}
+	if cfg.MaxConcurrentRequests < 0 {
+		errs = append(errs, fmt.Errorf("MaxConcurrentRequests must not be negative, got %d", cfg.MaxConcurrentRequests))
+	}
+	if cfg.SoftMemoryLimit < 0 {
+		errs = append(errs, fmt.Errorf("SoftMemoryLimit must not be negative, got %d", cfg.SoftMemoryLimit))
+	}
+	if cfg.SoftMemoryLimit > 0 && cfg.EvictionBatchSize < 1 {
+		errs = append(errs, fmt.Errorf("EvictionBatchSize must be at least 1 with a SoftMemoryLimit, got %d", cfg.EvictionBatchSize))
+	}
+	if cfg.MinCompressionSize < 0 {
+		errs = append(errs, fmt.Errorf("MinCompressionSize must not be negative, got %d", cfg.MinCompressionSize))
+	}
+	if cfg.FlushInterval <= 0 {
+		errs = append(errs, fmt.Errorf("FlushInterval must be positive, got %s", cfg.FlushInterval))
+	}
+	if _, err := ParseSchedule(cfg.CompactionSchedule); err != nil {
+		errs = append(errs, fmt.Errorf("invalid CompactionSchedule: %w", err))
+	}
+	if _, err := parseLogLevel(cfg.LogLevel); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.AsyncWriteBatchSize < 1 {
+		errs = append(errs, fmt.Errorf("AsyncWriteBatchSize must be at least 1, got %d", cfg.AsyncWriteBatchSize))
+	}
+	if cfg.AsyncWriteFlushInterval < 0 {
+		errs = append(errs, fmt.Errorf("AsyncWriteFlushInterval must not be negative, got %s", cfg.AsyncWriteFlushInterval))
+	}
+	if cfg.MinCompactionIntervalSec < 0 {
+		errs = append(errs, fmt.Errorf("MinCompactionIntervalSec must not be negative, got %d", cfg.MinCompactionIntervalSec))
+	}
+	switch cfg.WALShippingBackend {
+	case "":
+	case "s3":
+		if cfg.WALShippingBucket == "" {
+			errs = append(errs, errors.New("WALShippingBucket is required with a WALShippingBackend"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown WALShippingBackend %q", cfg.WALShippingBackend))
+	}
+	if cfg.TransformBytesPerSecond < 0 {
+		errs = append(errs, fmt.Errorf("TransformBytesPerSecond must not be negative, got %d", cfg.TransformBytesPerSecond))
+	}
+	if cfg.MaxSSTFiles < 1 {
+		errs = append(errs, fmt.Errorf("MaxSSTFiles must be at least 1, got %d", cfg.MaxSSTFiles))
+	}
+	if cfg.BlockCacheSize != 0 {
+		if _, err := NewCachePolicy(cfg.BlockCachePolicy, cfg.BlockCacheSize); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if cfg.WarmupMaxKeys < 1 {
+		errs = append(errs, fmt.Errorf("WarmupMaxKeys must be at least 1, got %d", cfg.WarmupMaxKeys))
+	}
+	if cfg.StatsFlushInterval < 0 || cfg.StatsRetentionDays < 0 {
+		errs = append(errs, errors.New("StatsFlushInterval and StatsRetentionDays must not be negative"))
+	}
+	if cfg.StatsReportInterval < 0 {
+		errs = append(errs, fmt.Errorf("StatsReportInterval must not be negative, got %s", cfg.StatsReportInterval))
+	}
+	if cfg.WALCompactionThresholdBytes < 0 {
+		errs = append(errs, fmt.Errorf("WALCompactionThresholdBytes must not be negative, got %d", cfg.WALCompactionThresholdBytes))
+	}
+	if cfg.MaxRequestsPerSecondPerIP < 0 {
+		errs = append(errs, fmt.Errorf("MaxRequestsPerSecondPerIP must not be negative, got %d", cfg.MaxRequestsPerSecondPerIP))
+	}
+	if cfg.MaxRequestsPerSecondPerIP > 0 && cfg.BurstSize < 1 {
+		errs = append(errs, fmt.Errorf("BurstSize must be at least 1, got %d", cfg.BurstSize))
+	}
+	if _, err := parseTrustedProxies(cfg.TrustedProxies); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.MaxKeyCount < 0 {
+		errs = append(errs, fmt.Errorf("MaxKeyCount must not be negative, got %d", cfg.MaxKeyCount))
+	}
+	if cfg.MaxKeyCount > 0 && (cfg.SoftWarningThreshold <= 0 || cfg.SoftWarningThreshold > 1) {
+		errs = append(errs, fmt.Errorf("SoftWarningThreshold must be in (0, 1], got %g", cfg.SoftWarningThreshold))
+	}
+	if cfg.ColdDataDir != "" && (cfg.ColdDataAge <= 0 || cfg.TieringCheckInterval <= 0) {
+		errs = append(errs, errors.New("ColdDataAge and TieringCheckInterval must be positive when ColdDataDir is set"))
+	}
+	if cfg.DeleteMode > DeletePhysical {
+		errs = append(errs, fmt.Errorf("unknown delete mode %s", cfg.DeleteMode))
+	}
+	if cfg.WALFormat > WALJSON {
+		errs = append(errs, fmt.Errorf("unknown WAL format %s", cfg.WALFormat))
+	}
+	if cfg.WALSyncPolicy > SyncPerEntry {
+		errs = append(errs, fmt.Errorf("unknown WAL sync policy %s", cfg.WALSyncPolicy))
+	}
+	if cfg.WALErrorRateThreshold < 0 || cfg.WALErrorRateThreshold >= 1 {
+		errs = append(errs, fmt.Errorf("WALErrorRateThreshold must be in [0, 1), got %g", cfg.WALErrorRateThreshold))
+	}
+	if cfg.WALSyncRecoveryWindow < 0 {
+		errs = append(errs, fmt.Errorf("WALSyncRecoveryWindow must not be negative, got %s", cfg.WALSyncRecoveryWindow))
+	}
+	if cfg.MaxWALSize < 0 {
+		errs = append(errs, fmt.Errorf("MaxWALSize must not be negative, got %d", cfg.MaxWALSize))
+	}
+	if _, ok := checksumFuncs[cfg.ChecksumAlgorithm]; !ok {
+		errs = append(errs, fmt.Errorf("unknown checksum algorithm %s", cfg.ChecksumAlgorithm))
+	}
+	if cfg.ByteOrder != nil && cfg.ByteOrder != binary.LittleEndian && cfg.ByteOrder != binary.BigEndian {
+		errs = append(errs, fmt.Errorf("unsupported byte order %s", cfg.ByteOrder))
+	}
+	if cfg.UseDirectIO && (cfg.IOAlignment < 512 || cfg.IOAlignment%512 != 0) {
+		errs = append(errs, fmt.Errorf("IOAlignment must be a positive multiple of 512, got %d", cfg.IOAlignment))
+	}
+	if _, err := NewHashFunc(cfg.HashFuncName); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.SketchWidth < 1 || cfg.SketchDepth < 1 {
+		// An empty sketch has no counter to index
+		errs = append(errs, fmt.Errorf("SketchWidth and SketchDepth must be at least 1, got %d and %d", cfg.SketchWidth, cfg.SketchDepth))
+	}
+	if cfg.BloomFalsePositiveRate <= 0 || cfg.BloomFalsePositiveRate >= 1 {
+		errs = append(errs, fmt.Errorf("BloomFalsePositiveRate must be between 0 and 1, got %g", cfg.BloomFalsePositiveRate))
+	}
+	if cfg.SSTBlockSize < 0 {
+		errs = append(errs, fmt.Errorf("SSTBlockSize must not be negative, got %d", cfg.SSTBlockSize))
+	}
+	if cfg.GzipCompressionLevel < gzip.DefaultCompression || cfg.GzipCompressionLevel > gzip.BestCompression {
+		errs = append(errs, fmt.Errorf("GzipCompressionLevel must be between %d and %d, got %d",
+			gzip.NoCompression, gzip.BestCompression, cfg.GzipCompressionLevel))
+	}
+	if cfg.IntegrityKey != nil && len(cfg.IntegrityKey) != 32 {
+		errs = append(errs, fmt.Errorf("IntegrityKey must be 32 bytes, got %d", len(cfg.IntegrityKey)))
+	}
+	if sem := cfg.IOSemaphore; sem != nil && (cap(sem.reads) < 1 || cap(sem.writes) < 1) {
+		errs = append(errs, fmt.Errorf("IOSemaphore needs at least 1 read and 1 write token, got %d and %d", cap(sem.reads), cap(sem.writes)))
+	}
+	return errors.Join(errs...)
+}
@@ -1,8 +1,30 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"math/bits"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -165,3 +187,4975 @@ func TestCreateAndFlushSSTFile(t *testing.T) {
 		return
 	}
 }
+
+func TestReadSSTProperties(t *testing.T) {
+	data := []KeyValue{
+		{Key: []byte("key1"), Value: []byte("value1")},
+		{Key: []byte("key2"), Value: []byte("value2")},
+		{Key: []byte("key3"), Value: []byte("value3")},
+	}
+	fileName := filepath.Join(t.TempDir(), "props.sst")
+	if err := writeSSTFile(fileName, data); err != nil {
+		t.Fatalf("Error writing SST file: %s", err)
+	}
+
+	properties, err := ReadSSTProperties(fileName, nil)
+	if err != nil {
+		t.Fatalf("Error reading SST properties: %s", err)
+	}
+	expected := map[string]string{
+		"entry_count":  "3",
+		"smallest_key": hex.EncodeToString([]byte("key1")),
+		"largest_key":  hex.EncodeToString([]byte("key3")),
+		"compression":  "gzip",
+	}
+	for name, value := range expected {
+		if properties[name] != value {
+			t.Errorf("Property %s: expected %q, got %q", name, value, properties[name])
+		}
+	}
+	if _, err := time.Parse(time.RFC3339, properties["creation_time"]); err != nil {
+		t.Errorf("Invalid creation_time %q: %s", properties["creation_time"], err)
+	}
+
+	entries, err := readSSTEntries(fileName)
+	if err != nil {
+		t.Fatalf("Error reading SST entries: %s", err)
+	}
+	if len(entries) != len(data) {
+		t.Fatalf("Expected %d entries, got %d", len(data), len(entries))
+	}
+	for i, kv := range entries {
+		if string(kv.Key) != string(data[i].Key) || string(kv.Value) != string(data[i].Value) {
+			t.Errorf("Entry %d: expected %s=%s, got %s=%s", i, data[i].Key, data[i].Value, kv.Key, kv.Value)
+		}
+	}
+}
+
+func TestCircuitBreakerOpensAfterSSTFailures(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWriteAheadLog(filepath.Join(dir, "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	// The manifest lists a file whose key range covers the key being read
+	if err := WriteManifest(dir, []SSTFileMeta{{FileName: "file_1.sst", SmallestKey: []byte("a"), LargestKey: []byte("z")}}); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	db := NewMemDBWithConfig(wal, cfg)
+	db.breaker = NewCircuitBreaker(10, time.Minute)
+	reads := 0
+	db.readSST = func(fileName string) ([]KeyValue, error) {
+		reads++
+		return nil, errors.New("input/output error")
+	}
+
+	for i := 0; i < 10; i++ {
+		if _, err := db.Get([]byte("missing")); errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("Breaker opened after only %d failures", i)
+		}
+	}
+	if state := db.CircuitBreakerState(); state != "open" {
+		t.Fatalf("Expected breaker to be open, got %s", state)
+	}
+
+	start := time.Now()
+	_, err = db.Get([]byte("missing"))
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Expected ErrCircuitOpen, got %v", err)
+	}
+	if reads != 10 {
+		t.Errorf("Expected no disk read while open, got %d reads", reads)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Get blocked for %s while the breaker was open", elapsed)
+	}
+}
+
+func TestCompactionLogsStatistics(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 3; i++ {
+		data := []KeyValue{
+			{Key: []byte("key_shared"), Value: []byte(fmt.Sprintf("value_%d", i))},
+			{Key: []byte(fmt.Sprintf("key_%d", i)), Value: []byte(fmt.Sprintf("value_%d", i))},
+		}
+		if err := writeSSTFile(filepath.Join(dir, fmt.Sprintf("file_%d.sst", i)), data); err != nil {
+			t.Fatalf("Error writing SST file: %s", err)
+		}
+	}
+
+	var logs bytes.Buffer
+	originalLogger := logger
+	logger = slog.New(slog.NewJSONHandler(&logs, nil))
+	defer func() { logger = originalLogger }()
+
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	metrics := NewMetricsCollector()
+	if err := compactSSTFiles(cfg, 1, metrics, nil); err != nil {
+		t.Fatalf("Error compacting SST files: %s", err)
+	}
+
+	var event map[string]interface{}
+	if err := json.Unmarshal(logs.Bytes(), &event); err != nil {
+		t.Fatalf("Error decoding compaction log %q: %s", logs.String(), err)
+	}
+	for _, field := range []string{"duration_ms", "keys_dropped_tombstones", "keys_dropped_expired"} {
+		if _, ok := event[field]; !ok {
+			t.Errorf("Compaction log is missing %s", field)
+		}
+	}
+	for _, field := range []string{"files_merged_count", "total_input_bytes", "total_output_bytes", "keys_total", "write_amplification_this_run"} {
+		if value, _ := event[field].(float64); value == 0 {
+			t.Errorf("Expected non-zero %s, got %v", field, event[field])
+		}
+	}
+	if event["keys_total"] != float64(6) {
+		t.Errorf("Expected 6 input keys, got %v", event["keys_total"])
+	}
+
+	stats := metrics.Snapshot()
+	if stats.CompactionsTotal != 1 || stats.CompactionBytesWrittenTotal == 0 {
+		t.Errorf("Compaction not recorded in metrics: %+v", stats)
+	}
+}
+
+// failingWriter fails once more than limit bytes have been written, like a crash mid-write.
+type failingWriter struct {
+	w     io.Writer
+	limit int
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > f.limit {
+		n, _ := f.w.Write(p[:f.limit])
+		f.limit -= n
+		return n, errors.New("simulated crash")
+	}
+	f.limit -= len(p)
+	return f.w.Write(p)
+}
+
+func TestManifestSurvivesFailedWrite(t *testing.T) {
+	dir := t.TempDir()
+	original := []SSTFileMeta{{FileName: "file_1.sst", SequenceNumber: 1, SmallestKey: []byte("a"), LargestKey: []byte("m")}}
+	if err := WriteManifest(dir, original); err != nil {
+		t.Fatalf("Error writing manifest: %s", err)
+	}
+
+	originalWriter := manifestWriter
+	manifestWriter = func(file *os.File) io.Writer { return &failingWriter{w: file, limit: 10} }
+	defer func() { manifestWriter = originalWriter }()
+
+	updated := append(original, SSTFileMeta{FileName: "file_2.sst", SequenceNumber: 2})
+	if err := WriteManifest(dir, updated); err == nil {
+		t.Fatal("Expected the interrupted manifest write to fail")
+	}
+
+	files, err := ReadManifest(dir)
+	if err != nil {
+		t.Fatalf("Error reading manifest after failed write: %s", err)
+	}
+	if len(files) != 1 || files[0].FileName != "file_1.sst" {
+		t.Errorf("Expected the previous manifest, got %+v", files)
+	}
+}
+
+func TestBackupIncremental(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWriteAheadLog(filepath.Join(dir, "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	db := NewMemDBWithConfig(wal, cfg)
+
+	var position int64
+	var result IncrementalBackupResult
+	for backup := 0; backup < 3; backup++ {
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprintf("key_%d_%d", backup, i))
+			if err := db.Set(key, []byte("value")); err != nil {
+				t.Fatalf("Error inserting entry: %v", err)
+			}
+		}
+
+		result, err = db.BackupIncremental(filepath.Join(dir, "backup"), position)
+		if err != nil {
+			t.Fatalf("Backup %d failed: %s", backup, err)
+		}
+		position = result.WALPosition
+	}
+
+	segment, err := os.Open(result.WALSegment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer segment.Close()
+	entries, err := readWALEntries(segment)
+	if err != nil {
+		t.Fatalf("Error reading WAL segment: %s", err)
+	}
+	if len(entries) != 100 {
+		t.Fatalf("Expected 100 entries in the third WAL delta, got %d", len(entries))
+	}
+	if string(entries[0].Key) != "key_2_0" {
+		t.Errorf("Third WAL delta starts with %s instead of key_2_0", entries[0].Key)
+	}
+}
+
+func TestFlushOnMemtableSize(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWriteAheadLog(filepath.Join(dir, "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	cfg.MaxMemtableBytes = 1 << 20
+	db := NewMemDBWithConfig(wal, cfg)
+
+	value := bytes.Repeat([]byte("v"), 200<<10)
+	for i := 0; i < 10; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key_%d", i)), value); err != nil {
+			t.Fatalf("Error inserting entry: %v", err)
+		}
+	}
+
+	files, err := ReadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("Expected the memtable size limit to trigger a flush")
+	}
+	if db.Size() >= cfg.MaxMemtableBytes {
+		t.Errorf("Memtable still holds %d bytes after flushing", db.Size())
+	}
+}
+
+func TestNamespacesAreIsolated(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWriteAheadLog(filepath.Join(dir, "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	db := NewMemDBWithConfig(wal, cfg)
+	defer db.Close()
+	tenantA := db.Namespace("a")
+	tenantB := db.Namespace("b")
+
+	if err := tenantA.Set([]byte("user"), []byte("alice")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tenantB.Set([]byte("user"), []byte("bob")); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, err := tenantA.Get([]byte("user")); err != nil || string(value) != "alice" {
+		t.Errorf("Namespace a returned %q, %v", value, err)
+	}
+	if value, err := tenantB.Get([]byte("user")); err != nil || string(value) != "bob" {
+		t.Errorf("Namespace b returned %q, %v", value, err)
+	}
+	keys, err := tenantA.Keys()
+	if err != nil || len(keys) != 1 || string(keys[0]) != "user" {
+		t.Errorf("Namespace a listed keys %q, %v", keys, err)
+	}
+
+	// One key only on disk, one overwritten in the memtable after its flush
+	if err := tenantA.Set([]byte("flushed"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tenantA.Set([]byte("user"), []byte("alice2")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.DropNamespace("a"); err != nil {
+		t.Fatalf("Error dropping namespace: %s", err)
+	}
+	check := func(when string) {
+		t.Helper()
+		for _, key := range []string{"user", "flushed"} {
+			if value, err := tenantA.Get([]byte(key)); !errors.Is(err, ErrKeyNotFound) {
+				t.Errorf("%s: expected %s to be dropped, got %q, %v", when, key, value, err)
+			}
+		}
+		if value, err := tenantB.Get([]byte("user")); err != nil || string(value) != "bob" {
+			t.Errorf("%s: dropping namespace a affected namespace b: %q, %v", when, value, err)
+		}
+	}
+	check("After the drop")
+	if err := db.Flush(nil); err != nil {
+		t.Fatal(err)
+	}
+	check("After the next flush")
+}
+
+func TestStringAppendMergeOperator(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWriteAheadLog(filepath.Join(dir, "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	cfg.MergeOperator = StringAppendMergeOperator{Delimiter: ","}
+	db := NewMemDBWithConfig(wal, cfg)
+
+	expected := make([]string, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		operand := fmt.Sprintf("%d", i)
+		if err := db.Merge([]byte("log"), []byte(operand)); err != nil {
+			t.Fatalf("Append %d failed: %s", i, err)
+		}
+		expected = append(expected, operand)
+	}
+	value, err := db.Get([]byte("log"))
+	if err != nil {
+		t.Fatalf("Get failed: %s", err)
+	}
+	if string(value) != strings.Join(expected, ",") {
+		t.Errorf("Unexpected merged value: %.40s...", value)
+	}
+
+	// Compaction folds the operands of a key found in several files into its value, while a
+	// newer Set replaces the older value
+	sstDir := t.TempDir()
+	cfg.DataDir = sstDir
+	files := [][]KeyValue{
+		{{Key: []byte("log"), Value: []byte("a")}, {Key: []byte("set"), Value: []byte("old")}},
+		{{Key: []byte("log"), Value: []byte("b"), Operation: Merge}, {Key: []byte("set"), Value: []byte("new")}},
+		{{Key: []byte("log"), Value: []byte("c"), Operation: Merge}},
+	}
+	for i, data := range files {
+		if err := writeSSTFile(filepath.Join(sstDir, fmt.Sprintf("file_%d.sst", i)), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := compactSSTFiles(cfg, 1, nil, nil); err != nil {
+		t.Fatalf("Compaction failed: %s", err)
+	}
+	fileNames, err := getSSTFileNames(sstDir)
+	if err != nil || len(fileNames) != 1 {
+		t.Fatalf("Expected a single merged file, got %v, %v", fileNames, err)
+	}
+	entries, err := readSSTEntries(filepath.Join(sstDir, fileNames[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || string(entries[0].Value) != "a,b,c" || entries[0].Operation != Set || string(entries[1].Value) != "new" {
+		t.Errorf("Expected compacted values a,b,c and new, got %+v", entries)
+	}
+}
+
+func TestGetAfterCompaction(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	cfg.MaxMemtableEntries = 1
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		if err := db.Set([]byte(key), []byte("value-"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := compactSSTFiles(cfg, 1, nil, nil); err != nil {
+		t.Fatalf("Compaction failed: %s", err)
+	}
+	manifest, err := ReadManifest(cfg.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest) != 1 || !strings.HasPrefix(manifest[0].FileName, "merged_sst_file_") {
+		t.Fatalf("Expected the manifest to list only the merged file, got %+v", manifest)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		value, err := db.Get([]byte(key))
+		if err != nil || string(value) != "value-"+key {
+			t.Errorf("Expected value-%s after compaction, got %q, %v", key, value, err)
+		}
+	}
+}
+
+func TestLoadSSTFileRejectsInvalidFormat(t *testing.T) {
+	contents := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(contents)
+	fileName := filepath.Join(t.TempDir(), "random.sst")
+	if err := os.WriteFile(fileName, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mem := &memDB{}
+	err := mem.loadSSTFile(fileName)
+	if !errors.Is(err, ErrInvalidSSTFormat) {
+		t.Errorf("Expected ErrInvalidSSTFormat, got %v", err)
+	}
+}
+
+func TestReplicationToReplica(t *testing.T) {
+	replicaDir, primaryDir := t.TempDir(), t.TempDir()
+	replicaWAL, err := NewWriteAheadLog(filepath.Join(replicaDir, "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replicaWAL.Close()
+	replicaCfg := DefaultDBConfig()
+	replicaCfg.DataDir = replicaDir
+	replica := NewMemDBWithConfig(replicaWAL, replicaCfg)
+	listener, err := replica.StartReplicaServer(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	primaryWAL, err := NewWriteAheadLog(filepath.Join(primaryDir, "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primaryWAL.Close()
+	primaryCfg := DefaultDBConfig()
+	primaryCfg.DataDir = primaryDir
+	primaryCfg.ReplicaAddr = listener.Addr().String()
+	primary := NewMemDBWithConfig(primaryWAL, primaryCfg)
+
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 100; i++ {
+			if err := primary.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))); err != nil {
+				done <- err
+				return
+			}
+		}
+		_, err := primary.Del([]byte("key0"))
+		done <- err
+	}()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(100 * time.Millisecond)
+	for i := 1; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		value, err := replica.Get([]byte(key))
+		for err != nil && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+			value, err = replica.Get([]byte(key))
+		}
+		if err != nil || string(value) != fmt.Sprintf("value%d", i) {
+			t.Fatalf("Replica returned %q, %v for %s", value, err, key)
+		}
+	}
+	if _, err := replica.Get([]byte("key0")); err == nil {
+		t.Error("Deleted key still readable from the replica")
+	}
+	if primary.ReplicationLag() <= 0 {
+		t.Error("Expected a replication lag after acknowledged writes")
+	}
+}
+
+// flakyStorage is a Storage whose reads fail with a transient error a number of times.
+type flakyStorage struct {
+	Storage
+	failures int
+	calls    int
+}
+
+func (f *flakyStorage) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	f.calls++
+	if f.calls <= f.failures {
+		return nil, &os.PathError{Op: "read", Path: "file_1.sst", Err: syscall.EAGAIN}
+	}
+	return []byte("value"), nil
+}
+
+func TestRetryTransientErrors(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, BackoffMultiplier: 2, MaxBackoff: 5 * time.Millisecond}
+	storage := &flakyStorage{failures: 2}
+
+	var value []byte
+	err := withRetry(context.Background(), policy, func() error {
+		var err error
+		value, err = storage.GetContext(context.Background(), []byte("key"))
+		return err
+	})
+	if err != nil || string(value) != "value" {
+		t.Fatalf("Expected the third attempt to succeed, got %q, %v", value, err)
+	}
+	if storage.calls != 3 {
+		t.Errorf("Expected 3 attempts, got %d", storage.calls)
+	}
+
+	attempts := 0
+	err = withRetry(context.Background(), policy, func() error {
+		attempts++
+		return ErrInvalidSSTFormat
+	})
+	if !errors.Is(err, ErrInvalidSSTFormat) || attempts != 1 {
+		t.Errorf("Permanent error was retried: %d attempts, %v", attempts, err)
+	}
+
+	mem := &memDB{cfg: DefaultDBConfig()}
+	mem.cfg.SSTReadRetryPolicy = policy
+	readFailures := 0
+	mem.readSST = func(string) ([]KeyValue, error) {
+		if readFailures < 2 {
+			readFailures++
+			return nil, syscall.EAGAIN
+		}
+		return []KeyValue{{Key: []byte("key"), Value: []byte("value")}}, nil
+	}
+	if err := mem.loadSSTFile("file_1.sst"); err != nil {
+		t.Errorf("Expected SST load to succeed after retries, got %v", err)
+	}
+}
+
+// tmpKeyFilter drops keys starting with "tmp:" and upper-cases the values it keeps.
+type tmpKeyFilter struct{}
+
+func (tmpKeyFilter) ShouldKeep(key, value []byte) bool {
+	return !bytes.HasPrefix(key, []byte("tmp:"))
+}
+
+func (tmpKeyFilter) Transform(key, value []byte) []byte {
+	return bytes.ToUpper(value)
+}
+
+func TestCompactionFilter(t *testing.T) {
+	dir := t.TempDir()
+	inputs := [][]KeyValue{
+		{{Key: []byte("tmp:a"), Value: []byte("x")}, {Key: []byte("user:1"), Value: []byte("alice")}},
+		{{Key: []byte("tmp:b"), Value: []byte("y")}, {Key: []byte("user:2"), Value: []byte("bob")}},
+	}
+	fileNames := make([]string, len(inputs))
+	for i, data := range inputs {
+		fileNames[i] = filepath.Join(dir, fmt.Sprintf("file_%d.sst", i))
+		if err := writeSSTFile(fileNames[i], data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := DefaultDBConfig()
+	cfg.CompactionFilter = tmpKeyFilter{}
+	output := filepath.Join(dir, "merged.sst")
+	stats, err := mergeSSTFiles(fileNames, output, cfg, nil)
+	if err != nil {
+		t.Fatalf("Error merging SST files: %s", err)
+	}
+	if stats.KeysDroppedFilter != 2 {
+		t.Errorf("Expected 2 keys dropped by the filter, got %d", stats.KeysDroppedFilter)
+	}
+
+	entries, err := readSSTEntries(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries in the compacted file, got %d", len(entries))
+	}
+	for _, kv := range entries {
+		if bytes.HasPrefix(kv.Key, []byte("tmp:")) {
+			t.Errorf("Filtered key %s found in compacted output", kv.Key)
+		}
+	}
+	if string(entries[0].Value) != "ALICE" || string(entries[1].Value) != "BOB" {
+		t.Errorf("Values were not transformed: %q, %q", entries[0].Value, entries[1].Value)
+	}
+}
+
+func TestSelectSizeTieredFiles(t *testing.T) {
+	tests := []struct {
+		sizes           []int64
+		minFilesPerTier int
+		want            []string
+	}{
+		// Runs: {1000, 1100}, {100, 110, 150, 180, 190} and {10, 12, 15}
+		{[]int64{1000, 1100, 100, 110, 150, 180, 190, 10, 12, 15}, 1, []string{"file_0.sst", "file_1.sst"}},
+		{[]int64{1000, 1100, 100, 110, 150, 180, 190, 10, 12, 15}, 2, []string{"file_2.sst", "file_3.sst", "file_4.sst", "file_5.sst", "file_6.sst"}},
+		{[]int64{1000, 1100, 100, 110, 150, 180, 190, 10, 12, 15}, 4, []string{"file_2.sst", "file_3.sst", "file_4.sst", "file_5.sst", "file_6.sst"}},
+		{[]int64{1000, 1100, 100, 110, 150, 180, 190, 10, 12, 15}, 5, nil},
+		// Files of similar size separated by a larger one are not merged together
+		{[]int64{100, 1000, 110, 120}, 1, []string{"file_2.sst", "file_3.sst"}},
+		{[]int64{10, 100, 12, 110, 15}, 1, nil},
+	}
+	for _, tt := range tests {
+		files := make([]SSTFileMeta, len(tt.sizes))
+		for i, size := range tt.sizes {
+			files[i] = SSTFileMeta{FileName: fmt.Sprintf("file_%d.sst", i), FileSize: size}
+		}
+		var got []string
+		for _, meta := range SelectSizeTieredFiles(files, 2, tt.minFilesPerTier) {
+			got = append(got, meta.FileName)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("SelectSizeTieredFiles(%v, minFilesPerTier=%d) = %v, want %v", tt.sizes, tt.minFilesPerTier, got, tt.want)
+		}
+	}
+}
+
+// newestFilesStrategy merges the n newest SST files.
+type newestFilesStrategy struct{ n int }
+
+func (s newestFilesStrategy) SelectFiles(files []SSTFileMeta, maxSSTFiles int) []SSTFileMeta {
+	if len(files) < s.n {
+		return nil
+	}
+	return files[len(files)-s.n:]
+}
+
+func TestCompactionKeepsTombstonesOverOlderFiles(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	cfg.MaxSSTFiles = 100
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Set([]byte("key"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	db.Flush(nil)
+	if _, err := db.Del([]byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	db.Flush(nil)
+	if err := db.Set([]byte("other"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	db.Flush(nil)
+
+	// The oldest file, which still holds the old value, is left out of the merge
+	cfg.CompactionStrategy = newestFilesStrategy{n: 2}
+	if err := compactSSTFiles(cfg, cfg.MaxSSTFiles, nil, nil); err != nil {
+		t.Fatalf("Error compacting SST files: %s", err)
+	}
+	if value, err := db.Get([]byte("key")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected the deleted key to stay deleted, got %q, %v", value, err)
+	}
+
+	// Merging every file drops the tombstone with the value it hides
+	cfg.CompactionStrategy = nil
+	if err := compactSSTFiles(cfg, 1, nil, nil); err != nil {
+		t.Fatalf("Error compacting SST files: %s", err)
+	}
+	files, err := getSSTFileNames(cfg.DataDir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected a single merged file, got %v, %v", files, err)
+	}
+	entries, err := readSSTEntries(filepath.Join(cfg.DataDir, files[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || string(entries[0].Key) != "other" {
+		t.Errorf("Expected only the live key after a full merge, got %+v", entries)
+	}
+	if value, err := db.Get([]byte("key")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected the deleted key to stay deleted, got %q, %v", value, err)
+	}
+}
+
+func TestSizeTieredCompactionMergesEqualFlushes(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	cfg.MaxSSTFiles = 100
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for flush := 0; flush < 20; flush++ {
+		for i := 0; i < 50; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("key%02d-%03d", flush, i)), []byte(fmt.Sprintf("value%02d-%03d", flush, i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Flush(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg.CompactionStrategy = SizeTieredStrategy{SizeRatio: 2, MinFilesPerTier: 4}
+	if err := compactSSTFiles(cfg, cfg.MaxSSTFiles, nil, nil); err != nil {
+		t.Fatalf("Error compacting SST files: %s", err)
+	}
+	files, err := getSSTFileNames(cfg.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || !strings.HasPrefix(files[0], "merged_sst_file_") {
+		t.Fatalf("Expected a single merged file, got %v", files)
+	}
+	entries, err := readSSTEntries(filepath.Join(cfg.DataDir, files[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 20*50 {
+		t.Errorf("Expected %d entries in the merged file, got %d", 20*50, len(entries))
+	}
+}
+
+func TestMergeSSTFilesKWay(t *testing.T) {
+	dir := t.TempDir()
+	const files, perFile = 10, 10000
+	expected := make(map[string]KeyValue) // Newest version of every key
+	fileNames := make([]string, files)
+	for f := 0; f < files; f++ {
+		// Neighbouring files overlap, and the newest file deletes every 100th of its keys
+		data := make([]KeyValue, perFile)
+		for j := range data {
+			kv := KeyValue{Key: []byte(fmt.Sprintf("key_%06d", f*2000+j)), Value: []byte(fmt.Sprintf("value_%d", f))}
+			if f == files-1 && j%100 == 0 {
+				kv.Operation, kv.Value = Delete, nil
+			}
+			data[j] = kv
+			expected[string(kv.Key)] = kv
+		}
+		fileNames[f] = filepath.Join(dir, fmt.Sprintf("file_%02d.sst", f))
+		if err := writeSSTFile(fileNames[f], data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key, kv := range expected {
+		if kv.Operation == Delete {
+			delete(expected, key)
+		}
+	}
+
+	output := filepath.Join(dir, "merged.sst")
+	stats, err := mergeSSTFiles(fileNames, output, DefaultDBConfig(), nil)
+	if err != nil {
+		t.Fatalf("Error merging SST files: %s", err)
+	}
+	if stats.KeysTotal != files*perFile || stats.KeysDroppedTombstones != perFile/100 {
+		t.Errorf("Expected %d keys read and %d tombstones dropped, got %d and %d",
+			files*perFile, perFile/100, stats.KeysTotal, stats.KeysDroppedTombstones)
+	}
+
+	entries, err := readSSTEntries(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("Expected %d entries after merging, got %d", len(expected), len(entries))
+	}
+	for i, kv := range entries {
+		if i > 0 && bytes.Compare(entries[i-1].Key, kv.Key) >= 0 {
+			t.Fatalf("Output not sorted and deduplicated at %q after %q", kv.Key, entries[i-1].Key)
+		}
+		if want, ok := expected[string(kv.Key)]; !ok || !bytes.Equal(kv.Value, want.Value) {
+			t.Fatalf("Expected %q = %q, got %q", kv.Key, want.Value, kv.Value)
+		}
+	}
+	for _, fileName := range fileNames {
+		if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+			t.Errorf("Input %s was not removed after merging", fileName)
+		}
+	}
+}
+
+func TestSSTFileWriterSpoolsEntries(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "file_1.sst")
+	fw, err := createSSTFileWriter(fileName, DefaultDBConfig(), 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data []KeyValue
+	for i := 0; i < 10000; i++ {
+		kv := KeyValue{Key: []byte(fmt.Sprintf("key%05d", i)), Value: []byte(fmt.Sprintf("value %d", i*7919))}
+		if err := fw.Add(kv); err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, kv)
+	}
+	spooled, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil || len(spooled) != 1 || fw.spool == nil {
+		t.Fatalf("Expected the entries to be spooled to a temporary file, got %v, %v", spooled, err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if spooled, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(spooled) != 0 {
+		t.Errorf("Expected the spool file to be removed, got %v", spooled)
+	}
+	entries, err := readSSTEntries(fileName)
+	if err != nil || len(entries) != len(data) {
+		t.Fatalf("Expected %d entries, got %d, %v", len(data), len(entries), err)
+	}
+	for i := range data {
+		if !bytes.Equal(entries[i].Key, data[i].Key) || !bytes.Equal(entries[i].Value, data[i].Value) {
+			t.Fatalf("Entry %d: expected %s=%s, got %s=%s", i, data[i].Key, data[i].Value, entries[i].Key, entries[i].Value)
+		}
+	}
+
+	// An aborted file leaves no spool behind
+	fw, err = createSSTFileWriter(filepath.Join(dir, "file_2.sst"), DefaultDBConfig(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Abort()
+	if spooled, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(spooled) != 0 {
+		t.Errorf("Expected the spool file of an aborted file to be removed, got %v", spooled)
+	}
+}
+
+func TestSSTIteratorDetectsCorruption(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "file_0.sst")
+	data := []KeyValue{{Key: []byte("key1"), Value: []byte("value1")}, {Key: []byte("key2"), Value: []byte("value2")}}
+	if err := writeSSTFile(fileName, data); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents[len(contents)-1] ^= 0xff // Last byte of the stored checksum
+	if err := os.WriteFile(fileName, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	it, err := newSSTIterator(fileName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	count := 0
+	for it.Next() {
+		count++
+	}
+	if count != 2 || !errors.Is(it.Err(), ErrChecksumMismatch) {
+		t.Errorf("Expected 2 entries and ErrChecksumMismatch, got %d and %v", count, it.Err())
+	}
+}
+
+func TestCompactionDropsExpiredEntries(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	data := make([]KeyValue, 0, 20)
+	for i := 0; i < 20; i++ {
+		kv := KeyValue{Key: []byte(fmt.Sprintf("key_%02d", i)), Value: []byte("value")}
+		switch i % 4 {
+		case 0, 1:
+			kv.ExpiresAt = now.Add(-time.Hour).UnixNano()
+		case 2:
+			kv.ExpiresAt = now.Add(time.Hour).UnixNano()
+		}
+		data = append(data, kv)
+	}
+	input := filepath.Join(dir, "file_0.sst")
+	if err := writeSSTFile(input, data); err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(dir, "merged.sst")
+	stats, err := mergeSSTFiles([]string{input}, output, DefaultDBConfig(), nil)
+	if err != nil {
+		t.Fatalf("Error merging SST files: %s", err)
+	}
+	if stats.KeysDroppedExpired != 10 {
+		t.Errorf("Expected 10 expired keys dropped, got %d", stats.KeysDroppedExpired)
+	}
+
+	// readSSTEntries fails unless the checksum covers exactly the written entries
+	entries, err := readSSTEntries(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(data)/2 {
+		t.Fatalf("Expected %d entries after compaction, got %d", len(data)/2, len(entries))
+	}
+	for _, kv := range entries {
+		if kv.expired(now) {
+			t.Errorf("Expired key %s survived compaction", kv.Key)
+		}
+	}
+}
+
+func TestEncodedUint64KeysSortNumerically(t *testing.T) {
+	wal, err := NewWriteAheadLog(filepath.Join(t.TempDir(), "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	cfg := DefaultDBConfig()
+	cfg.MaxMemtableEntries = 0
+	db := NewMemDBWithConfig(wal, cfg)
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		if err := db.Set(EncodeUint64(rng.Uint64()>>uint(rng.Intn(64))), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := db.GetRange(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var previous uint64
+	for i, kv := range entries {
+		v, err := DecodeUint64(kv.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 && v <= previous {
+			t.Fatalf("Key %d (%d) sorted after %d", i, v, previous)
+		}
+		previous = v
+	}
+
+	for _, v := range []int64{math.MinInt64, -1, 0, 1, math.MaxInt64} {
+		if decoded, err := DecodeInt64(EncodeInt64(v)); err != nil || decoded != v {
+			t.Errorf("Int64 %d round-tripped to %d, %v", v, decoded, err)
+		}
+	}
+	if bytes.Compare(EncodeInt64(-1), EncodeInt64(1)) >= 0 {
+		t.Error("Encoded -1 does not sort before 1")
+	}
+}
+
+func TestCountMinSketchEstimate(t *testing.T) {
+	cfg := DefaultDBConfig()
+	sketch := NewCountMinSketch(cfg.SketchWidth, cfg.SketchDepth, fnv64)
+
+	hot := []byte("hot")
+	for i := 0; i < 10000; i++ {
+		sketch.Update(hot)
+	}
+	for i := 0; i < 1000; i++ {
+		sketch.Update([]byte(fmt.Sprintf("cold%d", i)))
+	}
+
+	estimate := sketch.Estimate(hot)
+	if estimate < 10000 || estimate > 11000 {
+		t.Errorf("Expected an estimate within 10%% of 10000, got %d", estimate)
+	}
+	if cold := sketch.Estimate([]byte("cold1")); cold < 1 {
+		t.Errorf("Sketch undercounted a cold key: %d", cold)
+	}
+
+	cfg.SketchWidth = 0
+	if err := ValidateConfig(cfg); err == nil || !strings.Contains(err.Error(), "SketchWidth") {
+		t.Errorf("Expected a sketch without counters to be rejected, got %v", err)
+	}
+	cfg.SketchWidth, cfg.SketchDepth = 272, 0
+	if err := ValidateConfig(cfg); err == nil || !strings.Contains(err.Error(), "SketchDepth") {
+		t.Errorf("Expected a sketch without rows to be rejected, got %v", err)
+	}
+}
+
+func manifestFixture(n int) []SSTFileMeta {
+	files := make([]SSTFileMeta, n)
+	for i := range files {
+		files[i] = SSTFileMeta{
+			FileName:       fmt.Sprintf("file_%d.sst", i),
+			SequenceNumber: uint64(i),
+			Level:          uint8(i % 4),
+			CreationTime:   int64(i) * int64(time.Second),
+			SmallestKey:    []byte(fmt.Sprintf("key_%08d", i)),
+			LargestKey:     []byte(fmt.Sprintf("key_%08d", i+1)),
+			Checksum:       uint32(i * 31),
+			MagicNumber:    magicNumber,
+			WALPosition:    int64(i * 100),
+			WALSegment:     uint64(i),
+		}
+	}
+	return files
+}
+
+func TestManifestBinaryFormat(t *testing.T) {
+	if size := binary.Size(manifestRecord{}); size != manifestRecordSize {
+		t.Fatalf("manifestRecordSize is %d, record encodes to %d bytes", manifestRecordSize, size)
+	}
+
+	files := manifestFixture(3)
+	data, err := MarshalManifest(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := UnmarshalManifest(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(decoded) != fmt.Sprint(files) {
+		t.Errorf("Manifest did not round-trip:\n%v\n%v", decoded, files)
+	}
+	if _, err := UnmarshalManifest(data[:len(data)-1]); err == nil {
+		t.Error("Expected an error for a truncated manifest")
+	}
+
+	// Version 1 records end before the WAL segment
+	file := files[1]
+	v1, err := MarshalManifest([]SSTFileMeta{file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1[0] = 1
+	v1 = append(v1[:5+manifestRecordSizeV1], v1[5+manifestRecordSize:]...)
+	file.WALSegment = 0
+	if decoded, err := UnmarshalManifest(v1); err != nil || len(decoded) != 1 || fmt.Sprint(decoded[0]) != fmt.Sprint(file) {
+		t.Errorf("Expected the version 1 record to decode to %v, got %v, %v", file, decoded, err)
+	}
+
+	// Manifests written as JSON are still readable
+	dir := t.TempDir()
+	legacy, _ := json.Marshal(files)
+	if err := os.WriteFile(filepath.Join(dir, manifestFileName), legacy, 0644); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err = ReadManifest(dir)
+	if err != nil || fmt.Sprint(decoded) != fmt.Sprint(files) {
+		t.Errorf("Legacy JSON manifest read as %v, %v", decoded, err)
+	}
+}
+
+func BenchmarkManifestParse(b *testing.B) {
+	files := manifestFixture(10000)
+	jsonData, _ := json.Marshal(files)
+	binaryData, _ := MarshalManifest(files)
+
+	b.Run("json", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var decoded []SSTFileMeta
+			if err := json.Unmarshal(jsonData, &decoded); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("binary", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := UnmarshalManifest(binaryData); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestDeadlockDetectorAbortsCycle(t *testing.T) {
+	detector := NewDeadlockDetector(50 * time.Millisecond)
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	detector.startDeadlockDetector(ctx)
+
+	a, b := NewDetectedMutex(detector), NewDetectedMutex(detector)
+	bothLocked := make(chan struct{})
+	var locked sync.WaitGroup
+	locked.Add(2)
+
+	// Each goroutine holds one mutex and then waits for the other one
+	run := func(id goroutineID, first, second *DetectedMutex) error {
+		txCtx, abort := context.WithCancel(context.Background())
+		defer abort()
+		detector.Register(id, abort)
+		defer detector.Unregister(id)
+
+		if err := first.Lock(txCtx, id); err != nil {
+			return err
+		}
+		defer first.Unlock()
+		locked.Done()
+		<-bothLocked
+
+		if err := second.Lock(txCtx, id); err != nil {
+			return err
+		}
+		second.Unlock()
+		return nil
+	}
+
+	results := make(chan error, 2)
+	go func() { results <- run(1, a, b) }()
+	go func() { results <- run(2, b, a) }()
+	locked.Wait()
+	close(bothLocked)
+
+	timeout := time.After(2 * detector.DetectionInterval)
+	var aborted, completed int
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-results:
+			if errors.Is(err, context.Canceled) {
+				aborted++
+			} else if err == nil {
+				completed++
+			} else {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+		case <-timeout:
+			t.Fatal("Deadlock was not resolved within 2x the detection interval")
+		}
+	}
+	if aborted != 1 || completed != 1 {
+		t.Errorf("Expected one aborted and one completed transaction, got %d and %d", aborted, completed)
+	}
+}
+
+func TestFlushOnMaxSSTFileSize(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWriteAheadLog(filepath.Join(dir, "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	cfg.MaxMemtableEntries = 0
+	cfg.MaxMemtableBytes = 0
+	cfg.MaxSSTFileSize = 500 << 10
+	db := NewMemDBWithConfig(wal, cfg)
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		value := make([]byte, 1024)
+		rng.Read(value)
+		if err := db.Set([]byte(fmt.Sprintf("key%04d", i)), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fileNames, err := getSSTFileNames(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fileNames) < 2 {
+		t.Fatalf("Expected at least 2 SST files for 1000 KB of data, got %d", len(fileNames))
+	}
+	for _, fileName := range fileNames {
+		info, err := os.Stat(filepath.Join(dir, fileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 600<<10 {
+			t.Errorf("SST file %s is %d bytes, more than 600 KB", fileName, info.Size())
+		}
+	}
+}
+
+func TestConfigFromEnvironment(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("DB_DATA_DIR", dir)
+	t.Setenv("DB_WAL_PATH", filepath.Join(dir, "env_wal.log"))
+	t.Setenv("DB_MAX_ENTRIES", "2")
+	t.Setenv("DB_FLUSH_INTERVAL", "10m")
+
+	cfg, err := LoadConfigFromEnv(DefaultDBConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateConfig(cfg); err != nil {
+		t.Fatalf("Unexpected validation error: %s", err)
+	}
+	if cfg.FlushInterval != 10*time.Minute {
+		t.Errorf("Expected a 10m flush interval, got %s", cfg.FlushInterval)
+	}
+
+	wal, err := NewWriteAheadLog(cfg.WALPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	db := NewMemDBWithConfig(wal, cfg)
+	db.Set([]byte("key1"), []byte("value1"))
+	db.Set([]byte("key2"), []byte("value2"))
+
+	fileNames, err := getSSTFileNames(dir)
+	if err != nil || len(fileNames) != 1 {
+		t.Errorf("Expected the flush to write one SST file to %s, got %v, %v", dir, fileNames, err)
+	}
+
+	t.Setenv("DB_MAX_ENTRIES", "many")
+	if _, err := LoadConfigFromEnv(DefaultDBConfig()); err == nil {
+		t.Error("Expected an error for a non-numeric DB_MAX_ENTRIES")
+	}
+	cfg.MaxMemtableBytes = 1024
+	cfg.WALPath = filepath.Join(dir, "missing", "wal.log")
+	if err := ValidateConfig(cfg); err == nil || !strings.Contains(err.Error(), "MaxMemtableBytes") || !strings.Contains(err.Error(), "not writable") {
+		t.Errorf("Expected errors for MaxMemtableBytes and the WAL path, got %v", err)
+	}
+}
+
+func TestSSTIntegrityViolation(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "file_1.sst")
+	key := bytes.Repeat([]byte{0x42}, 32)
+	data := []KeyValue{{Key: []byte("key1"), Value: []byte("value1")}, {Key: []byte("key2"), Value: []byte("value2")}}
+	if err := writeSSTFileWithKey(fileName, data, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readSSTEntriesWithKey(fileName, key); err != nil {
+		t.Fatalf("Error reading untampered SST file: %v", err)
+	}
+
+	contents, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := readSSTFileHeader(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents[header.size()+10] ^= 0xff
+	if err := os.WriteFile(fileName, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readSSTEntriesWithKey(fileName, key); !errors.Is(err, ErrIntegrityViolation) {
+		t.Errorf("Expected ErrIntegrityViolation, got %v", err)
+	}
+}
+
+func TestSSTFilterIntegrityViolation(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	cfg.IntegrityKey = bytes.Repeat([]byte{0x42}, 32)
+	fileName := filepath.Join(dir, "file_1.sst")
+	if err := writeSSTFileWithConfig(fileName, []KeyValue{{Key: []byte("key1"), Value: []byte("value1")}}, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// An empty filter with a valid checksum in place of the real one would hide key1
+	contents, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := readSSTFileHeader(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := header.byteOrder()
+	start := header.size() + 4
+	end := start + int64(order.Uint32(contents[header.size():]))
+	block := contents[start:end]
+	for i := 2 + int(block[1]); i < len(block)-4; i++ {
+		block[i] = 0
+	}
+	order.PutUint32(block[len(block)-4:], crc32.ChecksumIEEE(block[:len(block)-4]))
+	if err := os.WriteFile(fileName, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := readSSTFilter(file, cfg.IntegrityKey); !errors.Is(err, ErrIntegrityViolation) {
+		t.Errorf("Expected ErrIntegrityViolation for a forged filter block, got %v", err)
+	}
+	db := NewMemDBWithConfig(nil, cfg)
+	defer db.Close()
+	if !db.sstMayContain(fileName, []byte("key1")) {
+		t.Error("Expected the forged filter to be ignored")
+	}
+}
+
+func TestSSTTombstones(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "file_1.sst")
+	data := []KeyValue{
+		{Key: []byte("deleted"), Operation: Delete},
+		{Key: []byte("expiring"), Value: []byte("soon"), ExpiresAt: time.Now().Add(time.Hour).UnixNano()},
+		{Key: []byte("live"), Value: []byte("value")},
+	}
+	if err := writeSSTFile(fileName, data); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := readSSTEntries(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(data) {
+		t.Fatalf("Expected %d entries, got %d", len(data), len(entries))
+	}
+	for i, kv := range entries {
+		if kv.Operation != data[i].Operation || kv.ExpiresAt != data[i].ExpiresAt {
+			t.Errorf("Entry %s did not round-trip: %+v", kv.Key, kv)
+		}
+	}
+
+	wal, err := NewWriteAheadLog(filepath.Join(t.TempDir(), "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	db := NewMemDB(wal)
+	if err := db.loadSSTFile(fileName); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.tombstones) != 1 {
+		t.Errorf("Expected 1 tombstone, got %d", len(db.tombstones))
+	}
+	if _, err := db.Get([]byte("deleted")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound for a tombstoned key, got %v", err)
+	}
+	if value, err := db.Get([]byte("live")); err != nil || string(value) != "value" {
+		t.Errorf("Expected live=value, got %q, %v", value, err)
+	}
+}
+
+func TestWriteBatchCommitAndRollback(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "wal.log")
+	wal, err := NewWriteAheadLog(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := NewMemDB(wal)
+	db.Set([]byte("removed"), []byte("value"))
+
+	rolledBack := db.NewWriteBatch()
+	rolledBack.Set([]byte("discarded"), []byte("value"))
+	rolledBack.Rollback()
+	if err := rolledBack.Commit(); !errors.Is(err, ErrBatchClosed) {
+		t.Errorf("Expected ErrBatchClosed after Rollback, got %v", err)
+	}
+
+	committed := db.NewWriteBatch()
+	committed.Set([]byte("kept"), []byte("value"))
+	committed.Del([]byte("removed"))
+	if err := committed.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A batch whose commit record never reached the log must not be replayed
+	wal.AppendEntry(BatchBegin, KeyValue{})
+	wal.AppendEntry(Set, KeyValue{Key: []byte("uncommitted"), Value: []byte("value")})
+	wal.Close()
+
+	wal, err = NewWriteAheadLog(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	restarted := NewMemDB(wal)
+	if _, err := restarted.ReplayWAL(); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, err := restarted.Get([]byte("kept")); err != nil || string(value) != "value" {
+		t.Errorf("Committed write lost after restart: %q, %v", value, err)
+	}
+	for _, key := range []string{"removed", "discarded", "uncommitted"} {
+		if value, err := restarted.Get([]byte(key)); err == nil {
+			t.Errorf("Expected %s to be absent after restart, got %q", key, value)
+		}
+	}
+}
+
+func BenchmarkGetFromSSTFiles(b *testing.B) {
+	dir := b.TempDir()
+	for i := 0; i < 100; i++ {
+		var data []KeyValue
+		for j := 0; j < 100; j++ {
+			key := fmt.Sprintf("cold_%03d_%03d", i, j)
+			if i == 99 {
+				key = fmt.Sprintf("hot_%04d", j) // The newest file holds the hot keys
+			}
+			data = append(data, KeyValue{Key: []byte(key), Value: []byte("value")})
+		}
+		fileName := fmt.Sprintf("file_%03d.sst", i)
+		if err := writeSSTFile(filepath.Join(dir, fileName), data); err != nil {
+			b.Fatal(err)
+		}
+		meta := SSTFileMeta{FileName: fileName, SmallestKey: data[0].Key, LargestKey: data[len(data)-1].Key}
+		if err := addToManifest(dir, meta); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	wal, err := NewWriteAheadLog(filepath.Join(dir, "wal.log"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer wal.Close()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	db := NewMemDBWithConfig(wal, cfg)
+
+	rng := rand.New(rand.NewSource(1))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := fmt.Sprintf("hot_%04d", rng.Intn(100))
+		if rng.Intn(100) == 0 {
+			key = fmt.Sprintf("cold_%03d_%03d", rng.Intn(99), rng.Intn(100))
+		}
+		if _, err := db.Get([]byte(key)); err != nil {
+			b.Fatalf("Error reading %s: %s", key, err)
+		}
+	}
+	b.StopTimer()
+
+	opened := float64(db.sstFilesOpened.Load()) / float64(b.N)
+	b.ReportMetric(opened, "files/get")
+	if opened > 1.1 {
+		b.Errorf("Expected about one SST file opened per Get, got %.2f", opened)
+	}
+}
+
+func TestShardedDBDistribution(t *testing.T) {
+	cfg := DefaultDBConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.MaxMemtableEntries = 0 // Keep every key in the memtables so they can be counted
+	db, err := NewShardedDB(cfg, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, shard := range db.shards {
+		defer shard.wal.Close()
+	}
+
+	for i := 0; i < 10000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, shard := range db.shards {
+		if n := len(shard.data); n < 2000 || n > 3000 {
+			t.Errorf("Shard %d holds %d keys, expected between 2000 and 3000", i, n)
+		}
+	}
+	all, err := db.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 10000 {
+		t.Errorf("Expected GetAll to return 10000 keys, got %d", len(all))
+	}
+	value, err := db.Get([]byte("key1234"))
+	if err != nil || string(value) != "value" {
+		t.Errorf("Expected value for key1234, got %q, %v", value, err)
+	}
+}
+
+func TestShardKeyFn(t *testing.T) {
+	cfg := DefaultDBConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.MaxMemtableEntries = 0
+	cfg.ShardKeyFn = func(key []byte) []byte {
+		return key[:4]
+	}
+	db, err := NewShardedDB(cfg, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, shard := range db.shards {
+		defer shard.wal.Close()
+	}
+
+	// The ring does not place any 5 prefixes on distinct shards, so take the first
+	// prefix that lands on each one.
+	prefixes := make([]string, len(db.shards))
+	for n, found := 0, 0; found < len(prefixes); n++ {
+		prefix := fmt.Sprintf("p%03d", n)
+		for i, shard := range db.shards {
+			if prefixes[i] == "" && db.shardFor([]byte(prefix)) == shard {
+				prefixes[i] = prefix
+				found++
+			}
+		}
+	}
+
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("%s-%05d", prefixes[i%len(prefixes)], i)
+		if err := db.Set([]byte(key), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Overwrites, including of flushed keys, and deletes leave the live keys counted
+	if err := db.shards[0].Flush(nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("%s-%05d", prefixes[0], i*len(prefixes))), []byte("updated")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Del([]byte(fmt.Sprintf("%s-%05d", prefixes[1], 1))); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[int]int{0: 2000, 1: 1999, 2: 2000, 3: 2000, 4: 2000}
+	if got, err := db.DebugShardDistribution(); err != nil || !maps.Equal(got, want) {
+		t.Errorf("Expected distribution %v, got %v, %v", want, got, err)
+	}
+	for i, prefix := range prefixes {
+		for _, kv := range db.shards[i].data {
+			if !bytes.HasPrefix(kv.Key, []byte(prefix)) {
+				t.Errorf("Expected shard %d to hold only keys with prefix %s, found %s", i, prefix, kv.Key)
+				break
+			}
+		}
+	}
+}
+
+// Run with -race: GetAll must not hand out memory that Set keeps modifying.
+func TestGetAllConcurrentWithSet(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWriteAheadLog(filepath.Join(dir, "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	cfg.MaxMemtableEntries = 0
+	db := NewMemDBWithConfig(wal, cfg)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			db.Set([]byte(fmt.Sprintf("key%d", i%100)), []byte(fmt.Sprintf("value%d", i)))
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		entries, err := db.GetAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, kv := range entries {
+			_ = string(kv.Key) + string(kv.Value)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	sorted, err := db.GetAllSorted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sort.SliceIsSorted(sorted, func(i, j int) bool { return bytes.Compare(sorted[i].Key, sorted[j].Key) < 0 }) {
+		t.Error("GetAllSorted returned unsorted entries")
+	}
+}
+
+// BenchmarkGCPressure compares garbage collection under a read-heavy workload with
+// and without the block pool. The block cache is disabled so every Get decodes a file.
+func BenchmarkGCPressure(b *testing.B) {
+	dir := b.TempDir()
+	var data []KeyValue
+	for i := 0; i < 2000; i++ {
+		data = append(data, KeyValue{Key: []byte(fmt.Sprintf("key%05d", i)), Value: bytes.Repeat([]byte("v"), 100)})
+	}
+	if err := writeSSTFile(filepath.Join(dir, "file_1.sst"), data); err != nil {
+		b.Fatal(err)
+	}
+	meta := SSTFileMeta{FileName: "file_1.sst", SmallestKey: data[0].Key, LargestKey: data[len(data)-1].Key}
+	if err := addToManifest(dir, meta); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bc := range []struct {
+		name      string
+		blockSize int
+	}{
+		{"without-pool", 0},
+		{"with-pool", 256 << 10},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			wal, err := NewWriteAheadLog(filepath.Join(b.TempDir(), "wal.log"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer wal.Close()
+			cfg := DefaultDBConfig()
+			cfg.DataDir = dir
+			cfg.BlockCacheSize = 0
+			cfg.SSTBlockSize = bc.blockSize
+			db := NewMemDBWithConfig(wal, cfg)
+
+			runtime.GC()
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Get(data[i%len(data)].Key); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			runtime.ReadMemStats(&after)
+
+			b.ReportMetric(float64(after.NumGC-before.NumGC)/float64(b.N), "gc/op")
+			b.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/float64(b.N), "gc-pause-ns/op")
+		})
+	}
+}
+
+func TestWatchMultipleWatchers(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWriteAheadLog(filepath.Join(dir, "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	db := NewMemDBWithConfig(wal, cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	want := []WatchEvent{
+		{Op: Set, Key: []byte("watched"), NewValue: []byte("v1")},
+		{Op: Set, Key: []byte("watched"), OldValue: []byte("v1"), NewValue: []byte("v2")},
+		{Op: Delete, Key: []byte("watched"), OldValue: []byte("v2")},
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 3; w++ {
+		events := db.Watch(ctx, []byte("watched"))
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			var lastSeq uint64
+			for i, expected := range want {
+				got := <-events
+				if got.Op != expected.Op || !bytes.Equal(got.Key, expected.Key) ||
+					!bytes.Equal(got.OldValue, expected.OldValue) || !bytes.Equal(got.NewValue, expected.NewValue) {
+					t.Errorf("Watcher %d event %d: expected %+v, got %+v", w, i, expected, got)
+				}
+				if got.SequenceNumber <= lastSeq {
+					t.Errorf("Watcher %d event %d: sequence number %d did not increase", w, i, got.SequenceNumber)
+				}
+				lastSeq = got.SequenceNumber
+			}
+			if _, ok := <-events; ok {
+				t.Errorf("Watcher %d received an event after the context was cancelled", w)
+			}
+		}(w)
+	}
+
+	db.Set([]byte("watched"), []byte("v1"))
+	db.Set([]byte("other"), []byte("ignored"))
+	db.Set([]byte("watched"), []byte("v2"))
+	if _, err := db.Del([]byte("watched")); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	wg.Wait()
+}
+
+func TestGetSearchesOverlappingL0FilesNewestFirst(t *testing.T) {
+	dir := t.TempDir()
+	var manifest []SSTFileMeta
+	for _, seq := range []uint64{3, 1, 5, 2, 4} {
+		fileName := fmt.Sprintf("file_%d.sst", seq)
+		data := []KeyValue{
+			{Key: []byte(fmt.Sprintf("a%d", seq)), Value: []byte("low")},
+			{Key: []byte("key"), Value: []byte(fmt.Sprintf("value%d", seq))},
+			{Key: []byte(fmt.Sprintf("z%d", seq)), Value: []byte("high")},
+		}
+		if err := writeSSTFile(filepath.Join(dir, fileName), data); err != nil {
+			t.Fatal(err)
+		}
+		manifest = append(manifest, SSTFileMeta{FileName: fileName, SequenceNumber: seq, SmallestKey: data[0].Key, LargestKey: data[2].Key})
+	}
+	manifest = append(manifest,
+		SSTFileMeta{FileName: "other.sst", SequenceNumber: 6, SmallestKey: []byte("m"), LargestKey: []byte("n")},
+		SSTFileMeta{FileName: "deeper.sst", SequenceNumber: 7, Level: 1, SmallestKey: []byte("a"), LargestKey: []byte("z")},
+	)
+	if err := WriteManifest(dir, manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	candidates := FindL0Candidates([]byte("key"), manifest)
+	if len(candidates) != 5 {
+		t.Fatalf("Expected 5 L0 candidates, got %d", len(candidates))
+	}
+	for i, file := range candidates {
+		if file.SequenceNumber != uint64(5-i) {
+			t.Errorf("Candidate %d has sequence number %d, expected %d", i, file.SequenceNumber, 5-i)
+		}
+	}
+
+	wal, err := NewWriteAheadLog(filepath.Join(dir, "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	db := NewMemDBWithConfig(wal, cfg)
+	value, err := db.Get([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "value5" {
+		t.Errorf("Expected the value of the newest file, got %q", value)
+	}
+}
+
+func TestStatsFlushWritesFiles(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWriteAheadLog(filepath.Join(dir, "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	cfg.StatsFlushInterval = 100 * time.Millisecond
+	start := time.Now()
+	db := NewMemDBWithConfig(wal, cfg)
+
+	time.Sleep(time.Second)
+	db.stopStatsFlush()
+
+	files, err := statsFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 8 {
+		t.Errorf("Expected at least 8 stats files after 1s, got %d", len(files))
+	}
+	history, err := ReadHistoricalStats(dir, start, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != len(files) {
+		t.Errorf("Expected %d historical stats, got %d", len(files), len(history))
+	}
+	if history, _ := ReadHistoricalStats(dir, start.Add(-time.Hour), start); len(history) != 0 {
+		t.Errorf("Expected no stats before the database started, got %d", len(history))
+	}
+}
+
+func TestStatsReportWritesLog(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	cfg.LogOutput = "file:" + filepath.Join(dir, "db.log")
+	cfg.StatsReportInterval = 100 * time.Millisecond
+
+	originalLogger, originalOutput := logger, logOutput
+	defer func() { logger, logOutput = originalLogger, originalOutput }()
+	output, err := ConfigureLogging(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal, err := NewWriteAheadLog(filepath.Join(dir, "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := NewMemDBWithConfig(wal, cfg)
+	time.Sleep(time.Second)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := output.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "db.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports := 0
+	for _, blob := range strings.Split(string(data), " stats ")[1:] {
+		var stats DBStats
+		if err := json.NewDecoder(strings.NewReader(blob)).Decode(&stats); err != nil {
+			t.Fatalf("Error decoding stats report %d: %s", reports+1, err)
+		}
+		reports++
+	}
+	if reports < 5 {
+		t.Errorf("Expected at least 5 stats reports after 1s, got %d:\n%s", reports, data)
+	}
+
+	var printed bytes.Buffer
+	if err := db.PrintStats(&printed); err != nil {
+		t.Fatal(err)
+	}
+	if !json.Valid(printed.Bytes()) || !strings.Contains(printed.String(), "\n  ") {
+		t.Errorf("Expected indented JSON, got %s", printed.String())
+	}
+}
+
+func TestSSTVersionRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	data := []KeyValue{{Key: []byte("key1"), Value: []byte("value1")}, {Key: []byte("key2"), Value: []byte("value2")}}
+	for formatVersion := uint16(1); formatVersion <= version; formatVersion++ {
+		fileName := filepath.Join(dir, fmt.Sprintf("file_%d.sst", formatVersion))
+		var err error
+		if formatVersion == 1 {
+			err = writeSSTFileV1(fileName, data)
+		} else {
+			err = writeSSTFileVersion(fileName, data, nil, gzip.DefaultCompression, formatVersion)
+		}
+		if err != nil {
+			t.Fatalf("Error writing version %d: %v", formatVersion, err)
+		}
+
+		entries, err := readSSTEntries(fileName)
+		if err != nil {
+			t.Fatalf("Error reading version %d: %v", formatVersion, err)
+		}
+		if len(entries) != len(data) {
+			t.Fatalf("Version %d: expected %d entries, got %d", formatVersion, len(data), len(entries))
+		}
+		for i, kv := range entries {
+			if !bytes.Equal(kv.Key, data[i].Key) || !bytes.Equal(kv.Value, data[i].Value) {
+				t.Errorf("Version %d: expected %s=%s, got %s=%s", formatVersion, data[i].Key, data[i].Value, kv.Key, kv.Value)
+			}
+		}
+	}
+}
+
+func TestSSTUnsupportedVersion(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "file_1.sst")
+	data := []KeyValue{{Key: []byte("key1"), Value: []byte("value1")}}
+	if err := writeSSTFileVersion(fileName, data, nil, gzip.DefaultCompression, version+1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readSSTEntries(fileName); !errors.Is(err, ErrUnsupportedSSTVersion) {
+		t.Errorf("Expected ErrUnsupportedSSTVersion, got %v", err)
+	}
+}
+
+func TestMigrateAllSSTs(t *testing.T) {
+	dir := t.TempDir()
+	data := []KeyValue{{Key: []byte("key1"), Value: []byte("value1")}, {Key: []byte("key2"), Value: []byte("value2")}}
+	if err := writeSSTFileV1(filepath.Join(dir, "file_1.sst"), data); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSSTFileVersion(filepath.Join(dir, "file_2.sst"), data, nil, gzip.DefaultCompression, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSSTFile(filepath.Join(dir, "file_3.sst"), data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MigrateAllSSTs(dir, version+1); !errors.Is(err, ErrUnsupportedSSTVersion) {
+		t.Errorf("Expected ErrUnsupportedSSTVersion, got %v", err)
+	}
+	if err := MigrateAllSSTs(dir, version); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"file_1.sst", "file_2.sst", "file_3.sst"} {
+		path := filepath.Join(dir, name)
+		header, err := readSSTFileHeader(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Version != version {
+			t.Errorf("%s: expected version %d, got %d", name, version, header.Version)
+		}
+		entries, err := readSSTEntries(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != len(data) || !bytes.Equal(entries[1].Value, data[1].Value) {
+			t.Errorf("%s: unexpected entries after migration: %v", name, entries)
+		}
+	}
+}
+
+func TestSetWALFailureLeavesMemtable(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWriteAheadLog(filepath.Join(dir, "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	db := NewMemDBWithConfig(wal, cfg)
+	if err := db.Set([]byte("key1"), []byte("value1")); err != nil {
+		t.Fatal(err)
+	}
+
+	wal.Close()
+	if err := db.Set([]byte("key2"), []byte("value2")); !errors.Is(err, ErrDatabaseClosed) {
+		t.Fatalf("Expected ErrDatabaseClosed, got %v", err)
+	}
+	entries, _ := db.GetAll()
+	if len(entries) != 1 || string(entries[0].Key) != "key1" {
+		t.Errorf("Expected only key1 in the memtable, got %v", entries)
+	}
+	if len(db.pending) != 0 {
+		t.Errorf("Expected no pending writes, got %d", len(db.pending))
+	}
+}
+
+func TestConcurrentSetsMatchWAL(t *testing.T) {
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "wal.log")
+	wal, err := NewWriteAheadLog(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	db := NewMemDBWithConfig(wal, cfg)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				if err := db.Set([]byte(fmt.Sprintf("key%d", i%10)), []byte(fmt.Sprintf("value%d_%d", g, i))); err != nil {
+					t.Error(err)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	replayed, _, err := ReplayUntilSequence(wal, math.MaxUint64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		want, err := db.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := replayed.memtableValue(key); !bytes.Equal(got, want) {
+			t.Errorf("%s: memtable holds %s but the WAL replays to %s", key, want, got)
+		}
+	}
+}
+
+// BenchmarkConcurrentSet compares pipelined Sets with Sets whose WAL write blocks
+// every other operation, with 8 goroutines writing and reading.
+func BenchmarkConcurrentSet(b *testing.B) {
+	run := func(b *testing.B, lockHeld bool) {
+		dir := b.TempDir()
+		wal, err := NewWriteAheadLog(filepath.Join(dir, "wal.log"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer wal.Close()
+		cfg := DefaultDBConfig()
+		cfg.DataDir = dir
+		db := NewMemDBWithConfig(wal, cfg)
+
+		var held sync.Mutex
+		var wg sync.WaitGroup
+		b.ResetTimer()
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := g; i < b.N; i += 8 {
+					key := []byte(fmt.Sprintf("key%d", i%100))
+					if lockHeld {
+						held.Lock()
+					}
+					err := db.Set(key, []byte("value"))
+					if lockHeld {
+						held.Unlock()
+					}
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					if lockHeld {
+						held.Lock()
+					}
+					db.Get(key)
+					if lockHeld {
+						held.Unlock()
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+	}
+	b.Run("pipelined", func(b *testing.B) { run(b, false) })
+	b.Run("lock-held", func(b *testing.B) { run(b, true) })
+}
+
+// BenchmarkSSTCompressionLevel writes 10 MB of repetitive entries at several gzip levels
+// and logs the resulting file sizes, to help choose GzipCompressionLevel.
+func BenchmarkSSTCompressionLevel(b *testing.B) {
+	var data []KeyValue
+	var rawSize int64
+	for i := 0; rawSize < 10<<20; i++ {
+		kv := KeyValue{
+			Key:   []byte(fmt.Sprintf("user:%08d:profile", i)),
+			Value: []byte(fmt.Sprintf(`{"id":%d,"name":"user %d","email":"user%d@example.com","active":true,"roles":["reader"]}`, i, i, i)),
+		}
+		data = append(data, kv)
+		rawSize += entrySize(kv)
+	}
+
+	for _, level := range []int{gzip.NoCompression, gzip.BestSpeed, 6, gzip.BestCompression} {
+		b.Run(fmt.Sprintf("level-%d", level), func(b *testing.B) {
+			fileName := filepath.Join(b.TempDir(), "file_1.sst")
+			b.SetBytes(rawSize)
+			for i := 0; i < b.N; i++ {
+				if err := writeSSTFileVersion(fileName, data, nil, level, version); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			info, err := os.Stat(fileName)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportMetric(float64(info.Size()), "file-bytes")
+			b.Logf("level %d: %d bytes of entries written to a %d byte file (%.1f%%)",
+				level, rawSize, info.Size(), 100*float64(info.Size())/float64(rawSize))
+		})
+	}
+}
+
+// BenchmarkCompactionPreWarm compacts 8 MB of SST files with and without pre-warming the
+// page cache. The inputs were just written, so like on a tmpfs they are in memory and the
+// difference is the cost of pre-warming without disk noise. With a cold cache, as after
+// dropping it between runs, it is what pre-warming saves.
+func BenchmarkCompactionPreWarm(b *testing.B) {
+	rng := rand.New(rand.NewSource(1))
+	files := make([][]KeyValue, 8)
+	for f := range files {
+		files[f] = make([]KeyValue, 2000)
+		for i := range files[f] {
+			value := make([]byte, 512)
+			rng.Read(value)
+			files[f][i] = KeyValue{Key: []byte(fmt.Sprintf("key%d_%05d", f, i)), Value: value}
+		}
+	}
+	// Compaction deletes its inputs, so every run writes them again
+	writeInputs := func(b *testing.B, dir string) ([]string, int64) {
+		var inputs []string
+		var inputBytes int64
+		for f, data := range files {
+			fileName := filepath.Join(dir, fmt.Sprintf("file_%d.sst", f))
+			if err := writeSSTFile(fileName, data); err != nil {
+				b.Fatal(err)
+			}
+			info, err := os.Stat(fileName)
+			if err != nil {
+				b.Fatal(err)
+			}
+			inputs = append(inputs, fileName)
+			inputBytes += info.Size()
+		}
+		return inputs, inputBytes
+	}
+
+	defer func(original func([]string)) { preWarmCompactionInputs = original }(preWarmCompactionInputs)
+	for _, preWarm := range []bool{false, true} {
+		b.Run(fmt.Sprintf("prewarm-%t", preWarm), func(b *testing.B) {
+			preWarmCompactionInputs = preWarmPageCacheAll
+			if !preWarm {
+				preWarmCompactionInputs = func([]string) {}
+			}
+			cfg := DefaultDBConfig()
+			cfg.DataDir = b.TempDir()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				inputs, inputBytes := writeInputs(b, cfg.DataDir)
+				b.SetBytes(inputBytes)
+				b.StartTimer()
+				if _, err := mergeSSTFiles(inputs, filepath.Join(cfg.DataDir, "merged.sst"), cfg, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestMemtableValueCompression(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	cfg.MemtableValueCompression = true
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	large := bytes.Repeat([]byte("compressible "), 100)
+	if err := db.Set([]byte("large"), large); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("small"), []byte("tiny")); err != nil {
+		t.Fatal(err)
+	}
+	db.mu.Lock()
+	flags := make(map[string]uint8)
+	for _, kv := range db.data {
+		flags[string(kv.Key)] = kv.Flags
+	}
+	size := db.Size()
+	db.mu.Unlock()
+	if flags["large"]&CompressedFlag == 0 || flags["small"]&CompressedFlag != 0 {
+		t.Errorf("Expected only the large value to be compressed, got flags %v", flags)
+	}
+	if size >= int64(len(large)) {
+		t.Errorf("Expected the memtable to hold less than %d bytes, got %d", len(large), size)
+	}
+
+	check := func(stage string) {
+		t.Helper()
+		if value, err := db.Get([]byte("large")); err != nil || !bytes.Equal(value, large) {
+			t.Errorf("%s: Get returned %d bytes, %v", stage, len(value), err)
+		}
+		if value, err := db.Get([]byte("small")); err != nil || string(value) != "tiny" {
+			t.Errorf("%s: Get returned %q, %v", stage, value, err)
+		}
+	}
+	check("memtable")
+	entries, err := db.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range entries {
+		if kv.Flags != 0 || (string(kv.Key) == "large" && !bytes.Equal(kv.Value, large)) {
+			t.Errorf("GetAll returned a compressed value for %s", kv.Key)
+		}
+	}
+
+	if err := db.Flush(nil); err != nil {
+		t.Fatal(err)
+	}
+	check("SST file")
+}
+
+// BenchmarkMemtableValueCompression reports the heap held by a memtable of 10 000 1 KB
+// values with and without memtable value compression.
+func BenchmarkMemtableValueCompression(b *testing.B) {
+	const values = 10000
+	for _, compress := range []bool{false, true} {
+		b.Run(fmt.Sprintf("compression-%t", compress), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				dir := b.TempDir()
+				cfg := DefaultDBConfig()
+				cfg.DataDir = dir
+				cfg.MaxMemtableEntries = 2 * values
+				cfg.MaxMemtableBytes = 1 << 30
+				cfg.MemtableValueCompression = compress
+				wal, err := NewWriteAheadLog(filepath.Join(dir, "wal.log"))
+				if err != nil {
+					b.Fatal(err)
+				}
+				db := NewMemDBWithConfig(wal, cfg)
+				var before runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				b.StartTimer()
+
+				for j := 0; j < values; j++ {
+					value := bytes.Repeat([]byte(fmt.Sprintf(`{"id":%d,"name":"user"}`, j)), 1024/16)[:1024]
+					if err := db.Set([]byte(fmt.Sprintf("key%05d", j)), value); err != nil {
+						b.Fatal(err)
+					}
+				}
+
+				b.StopTimer()
+				var after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/(1<<20), "heap-MB")
+				db.Close()
+				wal.Close()
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+func TestHashFuncVectors(t *testing.T) {
+	tests := []struct {
+		data             string
+		xxhash, murmur64 uint64
+	}{
+		{"", 0xef46db3751d8e999, 0},
+		{"abc", 0x44bc2cf5ad770999, 0xb4963f3f3fad7867},
+		{"The quick brown fox jumps over the lazy dog", 0x0b242d361fda71bc, 0xe34bbc7bbc071b6c},
+	}
+	for _, test := range tests {
+		if got := xxhash64([]byte(test.data)); got != test.xxhash {
+			t.Errorf("xxhash64(%q) = %#x, expected %#x", test.data, got, test.xxhash)
+		}
+		if got := murmur3x64([]byte(test.data)); got != test.murmur64 {
+			t.Errorf("murmur3x64(%q) = %#x, expected %#x", test.data, got, test.murmur64)
+		}
+	}
+}
+
+func TestBloomFilterHashFuncs(t *testing.T) {
+	for name, hash := range hashFuncs {
+		filter := NewBloomFilter(10000, 0.01, hash)
+		for i := 0; i < 10000; i++ {
+			filter.Add([]byte(fmt.Sprintf("key%d", i)))
+		}
+		for i := 0; i < 10000; i++ {
+			if key := fmt.Sprintf("key%d", i); !filter.MayContain([]byte(key)) {
+				t.Fatalf("%s: false negative for %s", name, key)
+			}
+		}
+		falsePositives := 0
+		for i := 0; i < 10000; i++ {
+			if filter.MayContain([]byte(fmt.Sprintf("absent%d", i))) {
+				falsePositives++
+			}
+		}
+		if falsePositives > 300 {
+			t.Errorf("%s: %d false positives in 10000 lookups, expected about 100", name, falsePositives)
+		}
+
+		sketch := NewCountMinSketch(272, 7, hash)
+		for i := 0; i < 100; i++ {
+			sketch.Update([]byte("hot"))
+		}
+		if estimate := sketch.Estimate([]byte("hot")); estimate < 100 {
+			t.Errorf("%s: sketch undercounted: %d", name, estimate)
+		}
+	}
+}
+
+// BenchmarkBloomFilterHashFuncs reports the lookup throughput and false positive rate
+// of a 1M key filter for every hash function.
+func BenchmarkBloomFilterHashFuncs(b *testing.B) {
+	const keys = 1000000
+	for _, name := range []string{"fnv64", "xxhash64", "murmur3_64"} {
+		b.Run(name, func(b *testing.B) {
+			filter := NewBloomFilter(keys, 0.01, hashFuncs[name])
+			for i := 0; i < keys; i++ {
+				filter.Add([]byte(fmt.Sprintf("key%d", i)))
+			}
+			falsePositives := 0
+			for i := 0; i < 100000; i++ {
+				if filter.MayContain([]byte(fmt.Sprintf("absent%d", i))) {
+					falsePositives++
+				}
+			}
+
+			key := []byte("key123456789")
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				filter.MayContain(key)
+			}
+			b.ReportMetric(float64(falsePositives)/100000, "fp-rate")
+		})
+	}
+}
+
+func TestAlignedBlockRoundTrip(t *testing.T) {
+	var file bytes.Buffer
+	writer := NewAlignedBlockWriter(&file, 512)
+	blocks := [][]byte{[]byte("small"), bytes.Repeat([]byte("x"), 1500), {}}
+	for _, block := range blocks {
+		if err := writer.WriteBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		if file.Len()%512 != 0 {
+			t.Fatalf("Expected the file to stay 512-byte aligned, got %d bytes", file.Len())
+		}
+	}
+
+	reader := NewAlignedBlockReader(&file, 512)
+	for _, want := range blocks {
+		got, err := reader.ReadBlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Expected a block of %d bytes, got %d", len(want), len(got))
+		}
+	}
+	if _, err := reader.ReadBlock(); err != io.EOF {
+		t.Errorf("Expected io.EOF after the last block, got %v", err)
+	}
+}
+
+func TestSSTChecksumAlgorithms(t *testing.T) {
+	dir := t.TempDir()
+	data := []KeyValue{{Key: []byte("key1"), Value: []byte("value1")}, {Key: []byte("key2"), Value: []byte("value2")}}
+	for algorithm := range checksumFuncs {
+		cfg := DefaultDBConfig()
+		cfg.ChecksumAlgorithm = algorithm
+		fileName := filepath.Join(dir, fmt.Sprintf("file_%d.sst", algorithm))
+		if err := writeSSTFileWithConfig(fileName, data, cfg); err != nil {
+			t.Fatal(err)
+		}
+		header, err := readSSTFileHeader(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.checksumAlgorithm() != algorithm || header.formatVersion() != version {
+			t.Errorf("%s: header records %s and version %d", algorithm, header.checksumAlgorithm(), header.formatVersion())
+		}
+		if entries, err := readSSTEntries(fileName); err != nil || len(entries) != 2 {
+			t.Errorf("%s: expected 2 entries, got %v, %v", algorithm, entries, err)
+		}
+
+		contents, err := os.ReadFile(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[len(contents)-1] ^= 0xff // Last byte of the stored checksum
+		if err := os.WriteFile(fileName, contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readSSTEntries(fileName); !errors.Is(err, ErrChecksumMismatch) {
+			t.Errorf("%s: expected ErrChecksumMismatch, got %v", algorithm, err)
+		}
+	}
+}
+
+func TestXXHash32Streaming(t *testing.T) {
+	data := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(data)
+	for _, n := range []int{0, 3, 15, 16, 17, 100, 1000} {
+		digest := newXXHash32()
+		for rest := data[:n]; len(rest) > 0; {
+			chunk := min(len(rest), 7) // Pieces that never line up with a stripe
+			digest.Write(rest[:chunk])
+			rest = rest[chunk:]
+		}
+		if digest.Sum32() != xxhash32(data[:n]) {
+			t.Errorf("%d bytes: streaming digest %#x, expected %#x", n, digest.Sum32(), xxhash32(data[:n]))
+		}
+	}
+}
+
+// BenchmarkChecksumAlgorithms measures the throughput of every checksum on 100 MB.
+func BenchmarkChecksumAlgorithms(b *testing.B) {
+	data := make([]byte, 100<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	for _, algorithm := range []ChecksumAlgorithm{ChecksumCRC32IEEE, ChecksumCRC32C, ChecksumXXHash32, ChecksumAdler32} {
+		checksum := checksumFuncs[algorithm]
+		b.Run(algorithm.String(), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				checksum(data)
+			}
+		})
+	}
+}
+
+func TestCloseFlushesMemtable(t *testing.T) {
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "wal.log")
+	wal, err := NewWriteAheadLog(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	db := NewMemDBWithConfig(wal, cfg)
+	for i := 0; i < 10; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Errorf("Expected closing twice to succeed, got %v", err)
+	}
+	if err := db.Set([]byte("key10"), []byte("value10")); !errors.Is(err, ErrDatabaseClosed) {
+		t.Errorf("Expected ErrDatabaseClosed from Set, got %v", err)
+	}
+	if _, err := db.Get([]byte("key1")); !errors.Is(err, ErrDatabaseClosed) {
+		t.Errorf("Expected ErrDatabaseClosed from Get, got %v", err)
+	}
+
+	wal, err = NewWriteAheadLog(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	reopened := NewMemDBWithConfig(wal, cfg)
+	defer reopened.Close()
+	if n, err := reopened.ReplayWAL(); err != nil || n != 0 {
+		t.Errorf("Expected nothing to replay after Close, got %d, %v", n, err)
+	}
+	for i := 0; i < 10; i++ {
+		value, err := reopened.Get([]byte(fmt.Sprintf("key%d", i)))
+		if err != nil || string(value) != fmt.Sprintf("value%d", i) {
+			t.Errorf("key%d: expected value%d after reopening, got %s, %v", i, i, value, err)
+		}
+	}
+}
+
+func TestOpenDBRestoresState(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		if value, err := db.Get([]byte(key)); err != nil || string(value) != fmt.Sprintf("value%d", i) {
+			t.Fatalf("%s: expected value%d after reopening, got %s, %v", key, i, value, err)
+		}
+	}
+
+	// Entries that were only logged are replayed
+	if err := db.wal.AppendEntry(Set, KeyValue{Key: []byte("logged"), Value: []byte("only")}); err != nil {
+		t.Fatal(err)
+	}
+	db.wal.Close()
+	replayed, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replayed.Close()
+	if value, err := replayed.Get([]byte("logged")); err != nil || string(value) != "only" {
+		t.Errorf("Expected the logged entry to be replayed, got %s, %v", value, err)
+	}
+}
+
+func TestKeyTransformer(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	cfg.KeyTransformer = KeyNormalize
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Set([]byte(" Hello "), []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("hello"), []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := db.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || string(entries[0].Key) != "hello" || string(entries[0].Value) != "second" {
+		t.Fatalf("Expected a single entry hello=second, got %+v", entries)
+	}
+	if value, err := db.Get([]byte("HELLO\t")); err != nil || string(value) != "second" {
+		t.Errorf("Get(HELLO) = %q, %v; want second", value, err)
+	}
+
+	if err := db.Flush(nil); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get([]byte(" hello")); err != nil || string(value) != "second" {
+		t.Errorf("Get after flush = %q, %v; want second", value, err)
+	}
+	if _, err := db.Del([]byte("Hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get([]byte("hello")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected the key to be deleted, got %v", err)
+	}
+}
+
+func TestKeyTransformerWritePaths(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	cfg.KeyTransformer = KeyNormalize
+	cfg.MergeOperator = StringAppendMergeOperator{Delimiter: ","}
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	expectValue := func(path, key, want string) {
+		t.Helper()
+		if value, err := db.Get([]byte(key)); err != nil || string(value) != want {
+			t.Errorf("%s: Get(%s) = %q, %v; want %s", path, key, value, err, want)
+		}
+	}
+
+	ack := make(chan error, 1)
+	db.AsyncSet([]byte(" Async "), []byte("value"), ack)
+	if err := <-ack; err != nil {
+		t.Fatal(err)
+	}
+	expectValue("AsyncSet", "async", "value")
+
+	batch := db.NewWriteBatch()
+	batch.Set([]byte("BATCH"), []byte("value"))
+	batch.Set([]byte("Gone"), []byte("value"))
+	batch.Del([]byte(" GONE "))
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	expectValue("WriteBatch.Set", "batch", "value")
+	if _, err := db.Get([]byte("gone")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("WriteBatch.Del: expected gone to be deleted, got %v", err)
+	}
+
+	if err := db.Merge([]byte("List"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Merge([]byte(" LIST"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	expectValue("Merge", "list", "a,b")
+
+	if err := db.BatchSet([]KeyValue{{Key: []byte("Imported "), Value: []byte("value")}}); err != nil {
+		t.Fatal(err)
+	}
+	expectValue("BatchSet", "imported", "value")
+	entries, err := db.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range entries {
+		if !bytes.Equal(kv.Key, KeyNormalize(kv.Key)) {
+			t.Errorf("Expected only normalized keys in the memtable, got %q", kv.Key)
+		}
+	}
+}
+
+func TestValueValidator(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	cfg.ValueValidator = ValidateJSON
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Set([]byte("valid"), []byte(`{"name": "alice"}`)); err != nil {
+		t.Fatalf("Expected valid JSON to be accepted, got %v", err)
+	}
+	err = db.Set([]byte("invalid"), []byte(`{"name": `))
+	if !errors.Is(err, ErrValueValidationFailed) {
+		t.Fatalf("Expected ErrValueValidationFailed, got %v", err)
+	}
+	if _, err := db.Get([]byte("invalid")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected the rejected value not to be stored, got %v", err)
+	}
+	batch := db.NewWriteBatch()
+	batch.Set([]byte("batched"), []byte("not json"))
+	if err := batch.Commit(); !errors.Is(err, ErrValueValidationFailed) {
+		t.Errorf("Expected the batch to be rejected, got %v", err)
+	}
+
+	if err := ValidateNotEmpty(nil, nil); err == nil {
+		t.Error("Expected ValidateNotEmpty to reject an empty value")
+	}
+	if err := ValidateMaxLength(3)(nil, []byte("abcd")); err == nil {
+		t.Error("Expected ValidateMaxLength(3) to reject 4 bytes")
+	}
+	if err := ValidateMaxLength(3)(nil, []byte("abc")); err != nil {
+		t.Errorf("Expected ValidateMaxLength(3) to accept 3 bytes, got %v", err)
+	}
+}
+
+func TestEvictOldest(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Set([]byte("flushed"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"flushed", "a", "b", "c"} {
+		if err := db.Set([]byte(key), []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if evicted := db.EvictOldest(2); evicted != 2 {
+		t.Fatalf("Expected 2 entries evicted, got %d", evicted)
+	}
+	if value := db.memtableValue([]byte("flushed")); value != nil {
+		t.Errorf("Expected the evicted key to be gone from the memtable, got %q", value)
+	}
+	for _, key := range []string{"flushed", "a", "b"} {
+		if value, err := db.Get([]byte(key)); err != nil || string(value) != "new" {
+			t.Errorf("Expected the latest value of %s after eviction, got %q, %v", key, value, err)
+		}
+	}
+	if evicted := db.EvictOldest(10); evicted != 2 {
+		t.Errorf("Expected the 2 remaining entries evicted, got %d", evicted)
+	}
+
+	// Overwriting a key makes it the most recently written one
+	for _, key := range []string{"d", "e"} {
+		if err := db.Set([]byte(key), []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Set([]byte("d"), []byte("newer")); err != nil {
+		t.Fatal(err)
+	}
+	if evicted := db.EvictOldest(1); evicted != 1 {
+		t.Fatalf("Expected 1 entry evicted, got %d", evicted)
+	}
+	if value := db.memtableValue([]byte("d")); string(value) != "newer" {
+		t.Errorf("Expected the overwritten key to survive eviction, got %q", value)
+	}
+	if value := db.memtableValue([]byte("e")); value != nil {
+		t.Errorf("Expected the key written longest ago to be evicted, got %q", value)
+	}
+	if evicted := db.EvictOldest(10); evicted != 1 {
+		t.Errorf("Expected the remaining entry evicted, got %d", evicted)
+	}
+	if size := db.Size(); size != 0 {
+		t.Errorf("Expected an empty memtable, got %d bytes", size)
+	}
+
+	// The evicted values survive a restart
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"flushed", "a", "b", "c"} {
+		if value, err := db.Get([]byte(key)); err != nil || string(value) != "new" {
+			t.Errorf("Expected the latest value of %s after a restart, got %q, %v", key, value, err)
+		}
+	}
+}
+
+func TestSoftMemoryLimitEvictsBeforeFlushing(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	cfg.SoftMemoryLimit = 100
+	cfg.EvictionBatchSize = 1
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Each entry is 30 bytes, so the fourth one crosses the limit by 20
+	for i := 0; i < 4; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%d", i)), bytes.Repeat([]byte("v"), 26)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if size := db.Size(); size != 90 {
+		t.Errorf("Expected one entry evicted, leaving 90 bytes, got %d", size)
+	}
+	if value := db.memtableValue([]byte("key0")); value != nil {
+		t.Errorf("Expected the oldest key to be evicted, got %q", value)
+	}
+	if value, err := db.Get([]byte("key0")); err != nil || len(value) != 26 {
+		t.Errorf("Expected the evicted key to be read from its SST file, got %q, %v", value, err)
+	}
+	files, err := getSSTFileNames(cfg.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("Expected only the evicted entry to be flushed, got SST files %v", files)
+	}
+	entries, err := readSSTEntries(filepath.Join(cfg.DataDir, files[0]))
+	if err != nil || len(entries) != 1 || string(entries[0].Key) != "key0" {
+		t.Errorf("Expected the SST file to hold key0 only, got %+v, %v", entries, err)
+	}
+}
+
+func TestBloomSidecarSpeedsUpStartup(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	cfg.BlockCacheSize = 0 // Only the filters are loaded at startup
+	if err := os.MkdirAll(cfg.DataDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Version 4 files have no filter block, so without a sidecar the filter is rebuilt from the keys
+	var paths []string
+	for f := 0; f < 4; f++ {
+		data := make([]KeyValue, 20000)
+		for i := range data {
+			data[i] = KeyValue{Key: []byte(fmt.Sprintf("key%d_%05d", f, i)), Value: []byte(fmt.Sprintf("value%d", i))}
+		}
+		fileName := fmt.Sprintf("file_%d.sst", f)
+		if err := writeSSTFileVersion(filepath.Join(cfg.DataDir, fileName), data, nil, gzip.DefaultCompression, 4); err != nil {
+			t.Fatal(err)
+		}
+		if err := addToManifest(cfg.DataDir, SSTFileMeta{FileName: fileName, SequenceNumber: uint64(f)}); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, filepath.Join(cfg.DataDir, fileName))
+	}
+
+	open := func() time.Duration {
+		start := time.Now()
+		db, err := OpenDB(cfg)
+		elapsed := time.Since(start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		for f, path := range paths {
+			cached, ok := db.filters.Get(path)
+			if !ok || !cached.(*FilterBlock).MayContain([]byte(fmt.Sprintf("key%d_%05d", f, 123))) {
+				t.Errorf("Expected the filter of %s to be loaded", path)
+			}
+		}
+		return elapsed
+	}
+	rebuilt := open()
+	for _, path := range paths {
+		if _, err := os.Stat(bloomSidecarPath(path)); err != nil {
+			t.Fatalf("Expected a bloom sidecar after the first start: %s", err)
+		}
+	}
+	loaded := open()
+	t.Logf("startup took %s with bloom sidecars, %s without", loaded, rebuilt)
+	if loaded*10 > rebuilt {
+		t.Errorf("Expected startup with bloom sidecars to be at least 10x faster: %s with, %s without", loaded, rebuilt)
+	}
+
+	// A corrupt sidecar is ignored and rewritten
+	if err := os.WriteFile(bloomSidecarPath(paths[0]), []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	open()
+	if _, err := readBloomSidecar(paths[0], nil); err != nil {
+		t.Errorf("Expected the corrupt sidecar to be rewritten, got %v", err)
+	}
+}
+
+func TestBloomSidecarIntegrity(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	cfg.IntegrityKey = bytes.Repeat([]byte{0x42}, 32)
+	path := filepath.Join(dir, "file_1.sst")
+	if err := writeSSTFileWithConfig(path, []KeyValue{{Key: []byte("key1"), Value: []byte("value1")}}, cfg); err != nil {
+		t.Fatal(err)
+	}
+	first := NewMemDBWithConfig(nil, cfg)
+	first.loadSSTFilter(path)
+	first.Close()
+	if filter, err := readBloomSidecar(path, cfg.IntegrityKey); err != nil || !filter.MayContain([]byte("key1")) {
+		t.Fatalf("Expected a signed sidecar to be written, got %v", err)
+	}
+
+	// An empty filter written without the key would hide key1
+	if err := writeBloomSidecar(path, newSSTFilter(1, DefaultDBConfig()), 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readBloomSidecar(path, cfg.IntegrityKey); !errors.Is(err, ErrIntegrityViolation) {
+		t.Errorf("Expected ErrIntegrityViolation for an unsigned sidecar, got %v", err)
+	}
+	db := NewMemDBWithConfig(nil, cfg)
+	defer db.Close()
+	db.loadSSTFilter(path)
+	if cached, ok := db.filters.Get(path); !ok || !cached.(*FilterBlock).MayContain([]byte("key1")) {
+		t.Error("Expected the forged sidecar to be replaced by the filter of the file")
+	}
+	if _, err := readBloomSidecar(path, cfg.IntegrityKey); err != nil {
+		t.Errorf("Expected the sidecar to be rewritten signed, got %v", err)
+	}
+}
+
+func TestDeleteModes(t *testing.T) {
+	for _, mode := range []DeleteMode{DeleteLogical, DeletePhysical} {
+		t.Run(mode.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := DefaultDBConfig()
+			cfg.DataDir = dir
+			cfg.WALPath = filepath.Join(dir, "wal.log")
+			cfg.DeleteMode = mode
+			db, err := OpenDB(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Set([]byte("flushed"), []byte("old")); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Flush(nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Set([]byte("logged"), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, key := range []string{"flushed", "logged"} {
+				if _, err := db.Del([]byte(key)); err != nil {
+					t.Fatalf("Del(%s): %s", key, err)
+				}
+				if value, err := db.Get([]byte(key)); !errors.Is(err, ErrKeyNotFound) {
+					t.Errorf("Expected %s to be deleted, got %q, %v", key, value, err)
+				}
+			}
+			tombstones := 0
+			for _, kv := range db.data {
+				if kv.Operation == Delete {
+					tombstones++
+				}
+			}
+			if expected := map[DeleteMode]int{DeleteLogical: 2, DeletePhysical: 0}[mode]; tombstones != expected || len(db.data) != expected {
+				t.Errorf("Expected %d tombstones and no other entries in the memtable, got %d of %d entries", expected, tombstones, len(db.data))
+			}
+
+			// Once replayed from the WAL after a crash, then from the SST file Close flushes
+			for _, crash := range []bool{true, false} {
+				if crash {
+					db.wal.Close()
+				} else if err := db.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if db, err = OpenDB(cfg); err != nil {
+					t.Fatal(err)
+				}
+				for _, key := range []string{"flushed", "logged"} {
+					if value, err := db.Get([]byte(key)); !errors.Is(err, ErrKeyNotFound) {
+						t.Errorf("Expected %s to stay deleted after a restart (crash: %t), got %q, %v", key, crash, value, err)
+					}
+				}
+			}
+			db.Close()
+		})
+	}
+}
+
+func TestCloneTo(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 1000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cloneCfg := cfg
+	cloneCfg.DataDir = filepath.Join(dir, "clone")
+	if err := db.CloneTo(cloneCfg.DataDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("after"), []byte("clone")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CloneTo(cloneCfg.DataDir); err == nil {
+		t.Error("Expected cloning into a non-empty directory to fail")
+	}
+
+	clonedFiles, err := getSSTFileNames(cloneCfg.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing flushes, tiers or compacts the files of a clone
+	cloneCfg.FlushInterval = time.Millisecond
+	cloneCfg.ColdDataDir = filepath.Join(dir, "cold")
+	cloneCfg.TieringCheckInterval = time.Millisecond
+	clone, err := OpenClone(cloneCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clone.Close()
+	schedule, err := ParseSchedule("1ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clone.startCompactionSchedule(schedule)
+	if _, err := clone.Warmup(context.Background(), [][]byte{[]byte("key0000")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		if value, err := clone.Get([]byte(key)); err != nil || string(value) != fmt.Sprintf("value%d", i) {
+			t.Fatalf("%s: expected value%d in the clone, got %s, %v", key, i, value, err)
+		}
+	}
+	if value, err := clone.Get([]byte("after")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected a write after CloneTo to be missing from the clone, got %q, %v", value, err)
+	}
+	if err := clone.Set([]byte("key0000"), []byte("changed")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected Set on the clone to fail with ErrReadOnly, got %v", err)
+	}
+	if _, err := clone.Del([]byte("key0000")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected Del on the clone to fail with ErrReadOnly, got %v", err)
+	}
+	if _, err := OpenClone(cfg); err == nil {
+		t.Error("Expected opening a directory that is not a clone to fail")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := clone.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if files, err := getSSTFileNames(cloneCfg.DataDir); err != nil || fmt.Sprint(files) != fmt.Sprint(clonedFiles) {
+		t.Errorf("Expected the clone to keep its files %v, got %v, %v", clonedFiles, files, err)
+	}
+	if _, err := os.Stat(cloneCfg.ColdDataDir); !os.IsNotExist(err) {
+		t.Errorf("Expected no files moved to cold storage, got %v", err)
+	}
+}
+
+func TestWarmCacheOnStartup(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	for round := 0; round < 3; round++ { // Every Close flushes one SST file
+		db, err := OpenDB(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("key%d_%03d", round, i)), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg.WarmCacheOnStartup = true
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for !db.CacheWarm() {
+		if time.Now().After(deadline) {
+			t.Fatal("Block cache did not warm up")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Every lookup is served from the cache
+	var diskReads atomic.Int64
+	db.readSST = func(fileName string) ([]KeyValue, error) {
+		diskReads.Add(1)
+		return readSSTEntries(fileName)
+	}
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key%d_%03d", round, i)
+			if value, err := db.Get([]byte(key)); err != nil || string(value) != "value" {
+				t.Fatalf("%s: expected value, got %s, %v", key, value, err)
+			}
+		}
+	}
+	if n := diskReads.Load(); n != 0 {
+		t.Errorf("Expected no SST reads from disk after warmup, got %d", n)
+	}
+}
+
+func TestMaxKeyCount(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWriteAheadLog(filepath.Join(dir, "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	cfg.MaxKeyCount = 100
+	db := NewMemDBWithConfig(wal, cfg)
+
+	for i := 0; i < 100; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Overwriting an existing key does not need room for a new one
+	if err := db.Set([]byte("key000"), []byte("updated")); err != nil {
+		t.Errorf("Expected an overwrite to succeed at the limit, got %v", err)
+	}
+	if err := db.Set([]byte("key100"), []byte("value")); !errors.Is(err, ErrDatabaseFull) {
+		t.Fatalf("Expected ErrDatabaseFull for the 101st key, got %v", err)
+	}
+	if stats := db.Stats(); stats.KeyCount != 100 || stats.MaxKeyCount != 100 {
+		t.Errorf("Expected 100 of 100 keys in the stats, got %d of %d", stats.KeyCount, stats.MaxKeyCount)
+	}
+
+	if _, err := db.Del([]byte("key050")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("key100"), []byte("value")); err != nil {
+		t.Errorf("Expected the 101st key to fit after a delete, got %v", err)
+	}
+}
+
+func TestMaxKeyCountAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	cfg.MaxKeyCount = 10
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%02d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		if i == 5 {
+			if err := db.Flush(nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := db.Del([]byte("key03")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A limit set by a reload counts the keys already stored
+	unlimited := cfg
+	unlimited.MaxKeyCount = 0
+	db, err = OpenDB(unlimited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ReloadConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if count := db.Stats().KeyCount; count != 9 {
+		t.Errorf("Expected 9 keys counted once the limit is set, got %d", count)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The keys in the SST files and the replayed WAL count towards the limit
+	db, err = OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if count := db.Stats().KeyCount; count != 9 {
+		t.Errorf("Expected 9 keys counted after the restart, got %d", count)
+	}
+	if err := db.Set([]byte("key10"), []byte("value")); err != nil {
+		t.Fatalf("Expected the 10th key to fit, got %v", err)
+	}
+	if err := db.Set([]byte("key11"), []byte("value")); !errors.Is(err, ErrDatabaseFull) {
+		t.Errorf("Expected ErrDatabaseFull for the 11th key, got %v", err)
+	}
+}
+
+func TestCronSchedulerNext(t *testing.T) {
+	start := time.Date(2024, 3, 15, 10, 30, 20, 0, time.UTC) // A Friday
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, 3, 15, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 3, 15, 10, 45, 0, 0, time.UTC)},
+		{"0 2 * * *", time.Date(2024, 3, 16, 2, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 4 * * 0", time.Date(2024, 3, 17, 4, 30, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		cron, err := NewCronScheduler(test.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cron.Next(start); !got.Equal(test.want) {
+			t.Errorf("%s: expected %s, got %s", test.expr, test.want, got)
+		}
+	}
+
+	for _, expr := range []string{"* * * *", "60 * * * *", "*/0 * * * *", "a * * * *"} {
+		if _, err := NewCronScheduler(expr); err == nil {
+			t.Errorf("Expected an error for %q", expr)
+		}
+	}
+	if cron, _ := NewCronScheduler("0 0 30 2 *"); !cron.Next(start).IsZero() {
+		t.Error("Expected February 30 never to fire")
+	}
+}
+
+func TestCompactionScheduleRunsCompaction(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 3; i++ {
+		data := []KeyValue{{Key: []byte(fmt.Sprintf("key%d", i)), Value: []byte("value")}}
+		if err := writeSSTFile(filepath.Join(dir, fmt.Sprintf("file_%d.sst", i)), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	cfg.MaxSSTFiles = 2
+	cfg.CompactionSchedule = "* * * * *"
+	schedule, err := ParseSchedule(cfg.CompactionSchedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := NewMemDBWithConfig(nil, cfg)
+
+	startup := time.Now()
+	var waits []time.Time
+	defer func(original func(time.Time, <-chan struct{}) bool) { waitUntil = original }(waitUntil)
+	waitUntil = func(next time.Time, stop <-chan struct{}) bool {
+		waits = append(waits, next)
+		return len(waits) == 1 // Fire once, then stop
+	}
+	db.bgWG.Add(1)
+	db.compactOnSchedule(schedule, db.stopCh)
+
+	if len(waits) == 0 || waits[0].Sub(startup) > 90*time.Second {
+		t.Fatalf("Expected the first compaction within 90 seconds of startup, got %v", waits)
+	}
+	if stats := db.Stats(); stats.CompactionsTotal != 1 {
+		t.Errorf("Expected one compaction, got %d", stats.CompactionsTotal)
+	}
+}
+
+func TestGetIntoAndGetBytes(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	db := NewMemDBWithConfig(nil, cfg)
+	db.data = append(db.data, KeyValue{Key: []byte("key1"), Value: []byte("value1")})
+
+	buf := AcquireValueBuffer()
+	defer ReleaseValueBuffer(buf)
+	buf.WriteString("stale")
+	if err := db.GetInto([]byte("key1"), buf); err != nil || buf.String() != "value1" {
+		t.Errorf("Expected value1, got %q, %v", buf.String(), err)
+	}
+	if err := db.GetInto([]byte("missing"), buf); !errors.Is(err, ErrKeyNotFound) || buf.Len() != 0 {
+		t.Errorf("Expected ErrKeyNotFound and an empty buffer, got %q, %v", buf.String(), err)
+	}
+
+	value, err := db.GetBytes([]byte("key1"), make([]byte, 0, 2))
+	if err != nil || string(value) != "value1" {
+		t.Errorf("Expected value1, got %q, %v", value, err)
+	}
+	db.data[0].Value[0] = 'V' // The returned bytes are a copy
+	if string(value) != "value1" {
+		t.Errorf("Expected GetBytes to copy the value, got %q", value)
+	}
+}
+
+// BenchmarkGetMemtableHit compares Get, whose value callers copy before the memtable
+// changes, with GetInto and GetBytes reusing one buffer. Run with -benchmem.
+func BenchmarkGetMemtableHit(b *testing.B) {
+	cfg := DefaultDBConfig()
+	cfg.DataDir = b.TempDir()
+	db := NewMemDBWithConfig(nil, cfg)
+	for i := 0; i < 100; i++ {
+		db.data = append(db.data, KeyValue{Key: []byte(fmt.Sprintf("key%03d", i)), Value: []byte("value")})
+	}
+	key := []byte("key050")
+
+	b.Run("Get", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			value, _ := db.Get(key)
+			_ = bytes.Clone(value)
+		}
+	})
+	b.Run("GetInto", func(b *testing.B) {
+		b.ReportAllocs()
+		buf := AcquireValueBuffer()
+		defer ReleaseValueBuffer(buf)
+		for i := 0; i < b.N; i++ {
+			db.GetInto(key, buf)
+		}
+	})
+	b.Run("GetBytes", func(b *testing.B) {
+		b.ReportAllocs()
+		var buf []byte
+		for i := 0; i < b.N; i++ {
+			buf, _ = db.GetBytes(key, buf)
+		}
+	})
+}
+
+func TestStorageTiering(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = filepath.Join(dir, "hot")
+	cfg.WALPath = filepath.Join(cfg.DataDir, "wal.log")
+	cfg.BlockCacheSize = 0
+	if err := os.MkdirAll(cfg.DataDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for round := 0; round < 2; round++ { // Every Close flushes one SST file
+		db, err := OpenDB(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("key%d_%d", round, i)), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg.ColdDataDir = filepath.Join(dir, "cold")
+	cfg.ColdDataAge = time.Hour
+	cfg.PromoteColdFiles = true
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	manifest, err := ReadManifest(cfg.DataDir)
+	if err != nil || len(manifest) != 2 {
+		t.Fatalf("Expected 2 SST files in the manifest, got %v, %v", manifest, err)
+	}
+	coldFile := manifest[0].FileName
+	now := time.Now()
+	db.access.markAccessed(filepath.Join(cfg.DataDir, coldFile), now.Add(-2*time.Hour))
+	db.access.markAccessed(filepath.Join(cfg.DataDir, manifest[1].FileName), now)
+
+	if err := db.tierSSTFiles(now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.ColdDataDir, coldFile)); err != nil {
+		t.Errorf("Expected %s in the cold directory: %v", coldFile, err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.DataDir, coldFile)); !os.IsNotExist(err) {
+		t.Errorf("Expected %s to be gone from the data directory, got %v", coldFile, err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.DataDir, manifest[1].FileName)); err != nil {
+		t.Errorf("Expected the recently read file to stay: %v", err)
+	}
+
+	// Reads find the cold file through the manifest
+	for round := 0; round < 2; round++ {
+		key := fmt.Sprintf("key%d_0", round)
+		if value, err := db.Get([]byte(key)); err != nil || string(value) != "value" {
+			t.Fatalf("%s: expected value, got %s, %v", key, value, err)
+		}
+	}
+
+	// Once read again, the cold file is moved back
+	db.access.markAccessed(filepath.Join(cfg.ColdDataDir, coldFile), now)
+	if err := db.tierSSTFiles(now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.DataDir, coldFile)); err != nil {
+		t.Errorf("Expected %s back in the data directory: %v", coldFile, err)
+	}
+	if manifest, _ := ReadManifest(cfg.DataDir); manifest[0].FileName != coldFile {
+		t.Errorf("Expected the manifest to list %s again, got %s", coldFile, manifest[0].FileName)
+	}
+}
+
+func TestFlushProgress(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	db := NewMemDBWithConfig(nil, cfg)
+	defer db.Close()
+	for i := 0; i < 100000; i++ { // Filled directly, Set would flush at MaxMemtableEntries
+		db.data = append(db.data, KeyValue{Key: []byte(fmt.Sprintf("key%06d", i)), Value: []byte("value")})
+	}
+
+	var calls []int
+	db.SetFlushProgressFunc(func(flushed, total int) {
+		if total != 100000 {
+			t.Errorf("Expected a total of 100000, got %d", total)
+		}
+		calls = append(calls, flushed)
+	})
+	if err := db.Flush(nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) < 100 {
+		t.Fatalf("Expected at least 100 progress calls, got %d", len(calls))
+	}
+	for i := 1; i < len(calls); i++ {
+		if calls[i] <= calls[i-1] {
+			t.Fatalf("Expected increasing flushed counts, got %d after %d", calls[i], calls[i-1])
+		}
+	}
+	if last := calls[len(calls)-1]; last != 100000 {
+		t.Errorf("Expected the last call to report all entries, got %d", last)
+	}
+	if value, err := db.Get([]byte("key099999")); err != nil || string(value) != "value" {
+		t.Errorf("Expected the flushed entry, got %s, %v", value, err)
+	}
+}
+
+func TestIOSemaphoreYieldsToReads(t *testing.T) {
+	sem := NewIOSemaphore(1, 1, time.Second)
+	token := sem.AcquireWrite()
+	releaseRead := sem.AcquireRead()
+
+	// A second read queues until the first one is done
+	admitted := make(chan struct{})
+	go func() {
+		release := sem.AcquireRead()
+		close(admitted)
+		release()
+	}()
+	for sem.WaitingReads() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	token.lastCheck = time.Now().Add(-ioYieldCheckInterval)
+	yielded := make(chan time.Duration)
+	go func() {
+		start := time.Now()
+		token.Yield()
+		yielded <- time.Since(start)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case sem.writes <- struct{}{}: // The compaction gave its token back while reads wait
+		<-sem.writes
+	default:
+		t.Error("Expected the write token to be released while a read waits")
+	}
+	releaseRead()
+	<-admitted
+	if d := <-yielded; d >= time.Second {
+		t.Errorf("Expected the compaction to resume once the reads were admitted, waited %s", d)
+	}
+	token.Release()
+}
+
+func TestGetQueuesForReadTokenOutsideLock(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	cfg.IOSemaphore = NewIOSemaphore(1, 1, time.Second)
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Set([]byte("flushed"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A Get queued for the only read token must not stall writes
+	releaseRead := cfg.IOSemaphore.AcquireRead()
+	got := make(chan error)
+	go func() {
+		_, err := db.Get([]byte("flushed"))
+		got <- err
+	}()
+	for cfg.IOSemaphore.WaitingReads() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	written := make(chan error, 1)
+	go func() {
+		written <- db.Set([]byte("key"), []byte("value"))
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the Set to complete while a Get waits for a read token")
+	}
+	releaseRead()
+	if err := <-got; err != nil {
+		t.Errorf("Expected the Get to find the flushed key, got %v", err)
+	}
+
+	cfg.IOSemaphore = NewIOSemaphore(0, 1, time.Second)
+	if err := ValidateConfig(cfg); err == nil || !strings.Contains(err.Error(), "IOSemaphore") {
+		t.Errorf("Expected an error for an IOSemaphore without read tokens, got %v", err)
+	}
+}
+
+// BenchmarkIOSemaphoreReadLatency reports the p99 latency of SST reads while compactions
+// run, without and with an IOSemaphore.
+func BenchmarkIOSemaphoreReadLatency(b *testing.B) {
+	for _, withSemaphore := range []bool{false, true} {
+		name := "without semaphore"
+		if withSemaphore {
+			name = "with semaphore"
+		}
+		b.Run(name, func(b *testing.B) {
+			dir := b.TempDir()
+			cfg := DefaultDBConfig()
+			cfg.DataDir = dir
+			cfg.BlockCacheSize = 0
+			if withSemaphore {
+				cfg.IOSemaphore = NewIOSemaphore(2, 1, 50*time.Millisecond)
+			}
+			for i := 0; i < 10; i++ {
+				var data []KeyValue
+				for j := 0; j < 1000; j++ {
+					data = append(data, KeyValue{Key: []byte(fmt.Sprintf("key_%02d_%04d", i, j)), Value: []byte("value")})
+				}
+				fileName := fmt.Sprintf("file_%02d.sst", i)
+				if err := writeSSTFile(filepath.Join(dir, fileName), data); err != nil {
+					b.Fatal(err)
+				}
+				meta := SSTFileMeta{FileName: fileName, SmallestKey: data[0].Key, LargestKey: data[len(data)-1].Key}
+				if err := addToManifest(dir, meta); err != nil {
+					b.Fatal(err)
+				}
+			}
+			db := NewMemDBWithConfig(nil, cfg)
+			defer db.Close()
+
+			// Compactions of separate files run until the reads are done
+			compactionDir := filepath.Join(dir, "compaction")
+			if err := os.MkdirAll(compactionDir, 0755); err != nil {
+				b.Fatal(err)
+			}
+			stop := make(chan struct{})
+			var compactions sync.WaitGroup
+			compactions.Add(1)
+			go func() {
+				defer compactions.Done()
+				value := bytes.Repeat([]byte("v"), 1000)
+				for round := 0; ; round++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					var inputs []string
+					for i := 0; i < 4; i++ {
+						var data []KeyValue
+						for j := 0; j < 2000; j++ {
+							data = append(data, KeyValue{Key: []byte(fmt.Sprintf("c_%04d_%d", j, i)), Value: value})
+						}
+						input := filepath.Join(compactionDir, fmt.Sprintf("input_%d.sst", i))
+						if err := writeSSTFile(input, data); err != nil {
+							b.Error(err)
+							return
+						}
+						inputs = append(inputs, input)
+					}
+					if _, err := mergeSSTFiles(inputs, filepath.Join(compactionDir, "output.sst"), cfg, nil); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			}()
+
+			var mu sync.Mutex
+			var latencies []time.Duration
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+				var local []time.Duration
+				for pb.Next() {
+					key := []byte(fmt.Sprintf("key_%02d_%04d", rng.Intn(10), rng.Intn(1000)))
+					start := time.Now()
+					if _, err := db.Get(key); err != nil {
+						b.Errorf("Error reading %s: %s", key, err)
+						return
+					}
+					local = append(local, time.Since(start))
+				}
+				mu.Lock()
+				latencies = append(latencies, local...)
+				mu.Unlock()
+			})
+			b.StopTimer()
+			close(stop)
+			compactions.Wait()
+
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			if len(latencies) > 0 {
+				p99 := latencies[len(latencies)*99/100]
+				b.ReportMetric(float64(p99.Microseconds()), "p99-µs")
+			}
+		})
+	}
+}
+
+func TestSSTHeaderKeyRange(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "file_1.sst")
+	var data []KeyValue
+	for i := 0; i < 100; i++ {
+		data = append(data, KeyValue{Key: []byte(fmt.Sprintf("key%03d", i)), Value: []byte("value")})
+	}
+	if err := writeSSTFile(fileName, data); err != nil {
+		t.Fatal(err)
+	}
+	header, err := readSSTFileHeader(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.formatVersion() != version || header.EntryCount != uint32(len(data)) {
+		t.Fatalf("Expected version %d with %d entries, got %+v", version, len(data), header)
+	}
+	if string(header.SmallestKey) != "key000" || string(header.LargestKey) != "key099" {
+		t.Errorf("Expected keys key000 to key099 in the header, got %s to %s", header.SmallestKey, header.LargestKey)
+	}
+	info, err := os.Stat(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.ChecksumOffset != uint64(info.Size()-4) {
+		t.Errorf("Expected the checksum at offset %d, header says %d", info.Size()-4, header.ChecksumOffset)
+	}
+
+	// A file the manifest does not list gets its key range from the header
+	metas, err := compactionInputMetas([]string{fileName}, filepath.Dir(fileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(metas[0].SmallestKey) != "key000" || string(metas[0].LargestKey) != "key099" {
+		t.Errorf("Expected keys key000 to key099 for an unlisted file, got %s to %s", metas[0].SmallestKey, metas[0].LargestKey)
+	}
+}
+
+func TestSSTFilterBlock(t *testing.T) {
+	dir := t.TempDir()
+	var data []KeyValue
+	for i := 0; i < 1000; i++ {
+		data = append(data, KeyValue{Key: []byte(fmt.Sprintf("key%04d", i)), Value: []byte("value")})
+	}
+	fileName := filepath.Join(dir, "file_1.sst")
+	if err := writeSSTFile(fileName, data); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The footer points at the filter block, which sits right after the header
+	header, err := readSSTFileHeader(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filterOffset := binary.LittleEndian.Uint64(contents[len(contents)-footerSizeV5:])
+	if filterOffset != uint64(header.size()) {
+		t.Fatalf("Expected the filter block at offset %d, footer says %d", header.size(), filterOffset)
+	}
+	filter := newSSTFilter(len(data), DefaultDBConfig())
+	for _, kv := range data {
+		filter.Add(kv.Key)
+	}
+	serialized := filter.Serialize(binary.LittleEndian)
+	length := binary.LittleEndian.Uint32(contents[filterOffset:])
+	block := contents[filterOffset+4 : filterOffset+4+uint64(length)]
+	if !bytes.Equal(block, serialized) {
+		t.Fatalf("Expected the filter block at the footer's offset, got %d bytes that differ", len(block))
+	}
+	var read FilterBlock
+	if err := read.Deserialize(block, binary.LittleEndian); err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range data {
+		if !read.MayContain(kv.Key) {
+			t.Fatalf("Filter block misses %s", kv.Key)
+		}
+	}
+	if entries, err := readSSTEntries(fileName); err != nil || len(entries) != len(data) {
+		t.Fatalf("Expected %d entries, got %d, %v", len(data), len(entries), err)
+	}
+
+	// Lookups of missing keys only read the filter block
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	cfg.BlockCacheSize = 0
+	db := NewMemDBWithConfig(nil, cfg)
+	defer db.Close()
+	var reads int
+	db.readSST = func(fileName string) ([]KeyValue, error) {
+		reads++
+		return readSSTEntries(fileName)
+	}
+	for i := 0; i < 1000; i++ {
+		if _, found, err := db.lookupSST(fileName, []byte(fmt.Sprintf("missing%04d", i))); found || err != nil {
+			t.Fatalf("Expected missing%04d not to be found, got %v, %v", i, found, err)
+		}
+	}
+	if reads > 50 {
+		t.Errorf("Expected about 1%% of the missing keys to read the entries, got %d of 1000", reads)
+	}
+	if kv, found, err := db.lookupSST(fileName, []byte("key0500")); !found || err != nil || string(kv.Value) != "value" {
+		t.Errorf("Expected key0500 to be found, got %v, %v", found, err)
+	}
+}
+
+func TestAsyncSet(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWriteAheadLog(filepath.Join(dir, "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	cfg.MaxKeyCount = 150
+	db := NewMemDBWithConfig(wal, cfg)
+
+	acks := make(chan error, 300)
+	for i := 0; i < 200; i++ {
+		db.AsyncSet([]byte(fmt.Sprintf("key%d", i)), []byte("value"), acks)
+	}
+	db.AsyncSet([]byte("key0"), []byte("updated"), acks)
+	failed := 0
+	for i := 0; i < 201; i++ {
+		if err := <-acks; errors.Is(err, ErrDatabaseFull) {
+			failed++
+		} else if err != nil {
+			t.Fatalf("AsyncSet failed: %v", err)
+		}
+	}
+	if failed != 50 {
+		t.Errorf("Expected 50 writes refused by the key limit, got %d", failed)
+	}
+	if got := db.keyCount.Load(); got != 150 {
+		t.Errorf("Expected 150 keys, got %d", got)
+	}
+	if value, err := db.Get([]byte("key0")); err != nil || string(value) != "updated" {
+		t.Errorf("Expected the later AsyncSet to win, got %q, %v", value, err)
+	}
+
+	// Writes still queued at Close are logged before it returns
+	db.AsyncSet([]byte("key1"), []byte("late"), nil)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db.AsyncSet([]byte("closed"), []byte("value"), acks)
+	if err := <-acks; !errors.Is(err, ErrDatabaseClosed) {
+		t.Errorf("Expected ErrDatabaseClosed after Close, got %v", err)
+	}
+
+	reopened, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if value, err := reopened.Get([]byte("key1")); err != nil || string(value) != "late" {
+		t.Errorf("Expected the write queued before Close to persist, got %q, %v", value, err)
+	}
+}
+
+func TestDrainAsync(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	cfg.MaxMemtableEntries = 20000 // Keep every write in the memtable, where GetAll sees it
+	cfg.AsyncWriteBatchSize = 64
+	cfg.AsyncWriteFlushInterval = time.Hour // Only full batches and DrainAsync commit
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const count = 10000
+	for i := 0; i < count; i++ {
+		db.AsyncSet([]byte(fmt.Sprintf("key%05d", i)), []byte("value"), nil)
+	}
+	if err := db.DrainAsync(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := db.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != count {
+		t.Fatalf("Expected %d entries after DrainAsync, got %d", count, len(entries))
+	}
+
+	// A partial batch is committed by DrainAsync instead of waiting for the interval
+	db.AsyncSet([]byte("last"), []byte("value"), nil)
+	if err := db.DrainAsync(); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get([]byte("last")); err != nil || string(value) != "value" {
+		t.Errorf("Expected the drained write, got %q, %v", value, err)
+	}
+
+	// The first error among the drained writes is returned once
+	db.maxKeyCount.Store(count + 1)
+	db.AsyncSet([]byte("over1"), []byte("value"), nil)
+	db.AsyncSet([]byte("last"), []byte("overwritten"), nil)
+	db.AsyncSet([]byte("over2"), []byte("value"), nil)
+	if err := db.DrainAsync(); !errors.Is(err, ErrDatabaseFull) {
+		t.Errorf("Expected ErrDatabaseFull from the drained writes, got %v", err)
+	}
+	if err := db.DrainAsync(); err != nil {
+		t.Errorf("Expected no error without new writes, got %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DrainAsync(); !errors.Is(err, ErrDatabaseClosed) {
+		t.Errorf("Expected ErrDatabaseClosed after Close, got %v", err)
+	}
+}
+
+// BenchmarkAsyncSet compares AsyncSet, which logs the writes of all goroutines in group
+// commits, with Set, which logs each write on its own, with 8 goroutines writing.
+func BenchmarkAsyncSet(b *testing.B) {
+	run := func(b *testing.B, async bool) {
+		dir := b.TempDir()
+		wal, err := NewWriteAheadLog(filepath.Join(dir, "wal.log"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer wal.Close()
+		cfg := DefaultDBConfig()
+		cfg.DataDir = dir
+		db := NewMemDBWithConfig(wal, cfg)
+
+		var wg sync.WaitGroup
+		b.ResetTimer()
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				acks := make(chan error, 1024)
+				sent := 0
+				for i := g; i < b.N; i += 8 {
+					key := []byte(fmt.Sprintf("key%d", i%100))
+					if !async {
+						if err := db.Set(key, []byte("value")); err != nil {
+							b.Error(err)
+							return
+						}
+						continue
+					}
+					if sent == cap(acks) {
+						if err := <-acks; err != nil {
+							b.Error(err)
+							return
+						}
+						sent--
+					}
+					db.AsyncSet(key, []byte("value"), acks)
+					sent++
+				}
+				for ; sent > 0; sent-- {
+					if err := <-acks; err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+	}
+	b.Run("async", func(b *testing.B) { run(b, true) })
+	b.Run("sync", func(b *testing.B) { run(b, false) })
+}
+
+func TestRebuildIndex(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := ReadManifest(dir)
+	if err != nil || len(manifest) != 1 {
+		t.Fatalf("Expected one SST file, got %v, %v", manifest, err)
+	}
+	path := filepath.Join(dir, manifest[0].FileName)
+
+	// Damage the length of the filter block and some of its bits
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := readSSTFileHeader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents[header.size()] ^= 0xff
+	contents[header.size()+40] ^= 0xff
+	if err := os.WriteFile(path, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	result, err := InspectSST(path, cfg.IntegrityKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.IndexStatus != IndexCorrupt || !result.HasFilterBlock || result.EntryCount != 500 {
+		t.Fatalf("Expected a corrupt index in a file of 500 entries, got %+v", result)
+	}
+	if string(result.SmallestKey) != "key000" || string(result.LargestKey) != "key499" {
+		t.Errorf("Expected keys key000 to key499, got %s to %s", result.SmallestKey, result.LargestKey)
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(after, contents) {
+		t.Error("InspectSST modified the file")
+	}
+
+	db, err = OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if result, err := InspectSST(path, cfg.IntegrityKey); err != nil || result.IndexStatus != IndexOK {
+		t.Fatalf("Expected OpenDB to rebuild the index, got %+v, %v", result, err)
+	}
+	if entries, err := readSSTEntriesWithKey(path, cfg.IntegrityKey); err != nil || len(entries) != 500 {
+		t.Fatalf("Expected 500 entries, got %d, %v", len(entries), err)
+	}
+	for i := 0; i < 500; i++ {
+		if _, err := db.Get([]byte(fmt.Sprintf("key%03d", i))); err != nil {
+			t.Fatalf("key%03d: %v", i, err)
+		}
+	}
+}
+
+func TestRebuildIndexRefusedWithIntegrityKey(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	cfg.IntegrityKey = bytes.Repeat([]byte{0x42}, 32)
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := ReadManifest(dir)
+	if err != nil || len(manifest) != 1 {
+		t.Fatalf("Expected one SST file, got %v, %v", manifest, err)
+	}
+	path := filepath.Join(dir, manifest[0].FileName)
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := readSSTFileHeader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents[header.size()+10] ^= 0xff
+	if err := os.WriteFile(path, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rebuilding would sign entries the damaged HMAC no longer vouches for
+	if db, err := OpenDB(cfg); !errors.Is(err, ErrIntegrityViolation) {
+		if err == nil {
+			db.Close()
+		}
+		t.Fatalf("Expected OpenDB to fail with ErrIntegrityViolation, got %v", err)
+	}
+	if err := (&memDB{cfg: cfg}).RebuildIndex(path); !errors.Is(err, ErrIntegrityViolation) {
+		t.Errorf("Expected RebuildIndex to refuse, got %v", err)
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(after, contents) {
+		t.Error("Expected the file to be left as it is")
+	}
+}
+
+func TestCompactionDetectsOverlappingLevelFiles(t *testing.T) {
+	dir := t.TempDir()
+	var manifest []SSTFileMeta
+	for i, seq := range []uint64{2, 1} { // The first file is the newer one
+		var data []KeyValue
+		for k := i * 5; k < i*5+10; k++ {
+			data = append(data, KeyValue{Key: []byte(fmt.Sprintf("key%02d", k)), Value: []byte(fmt.Sprintf("seq%d", seq))})
+		}
+		fileName := fmt.Sprintf("file_%d.sst", i)
+		if err := writeSSTFile(filepath.Join(dir, fileName), data); err != nil {
+			t.Fatal(err)
+		}
+		manifest = append(manifest, SSTFileMeta{FileName: fileName, SequenceNumber: seq, Level: 1, MagicNumber: magicNumber})
+	}
+	if err := WriteManifest(dir, manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	metrics := NewMetricsCollector()
+	if err := compactSSTFiles(cfg, 1, metrics, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := metrics.Snapshot().CompactionAnomalies; got != 5 {
+		t.Errorf("Expected 5 anomalies for the overlapping keys, got %d", got)
+	}
+
+	fileNames, err := getSSTFileNames(dir)
+	if err != nil || len(fileNames) != 1 {
+		t.Fatalf("Expected one merged file, got %v, %v", fileNames, err)
+	}
+	entries, err := readSSTEntries(filepath.Join(dir, fileNames[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 15 {
+		t.Fatalf("Expected 15 merged keys, got %d", len(entries))
+	}
+	for _, kv := range entries[5:10] {
+		if string(kv.Value) != "seq2" {
+			t.Errorf("%s: expected the value of the higher sequence number, got %s", kv.Key, kv.Value)
+		}
+	}
+}
+
+func TestSSTByteOrder(t *testing.T) {
+	dir := t.TempDir()
+	var data []KeyValue
+	for i := 0; i < 100; i++ {
+		data = append(data, KeyValue{Key: []byte(fmt.Sprintf("key%03d", i)), Value: []byte("value"), ExpiresAt: int64(i + 1)})
+	}
+	little := filepath.Join(dir, "little.sst")
+	if err := writeSSTFile(little, data); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := os.ReadFile(little)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With the flag swapped, the fixed-size fields read big-endian are byte-swapped, and
+	// the header no longer reads as a valid one
+	swapped := append([]byte(nil), contents...)
+	swapped[4] |= uint8(sstBigEndianFlag >> 8) // The high byte of the version field, read big-endian
+	if binary.BigEndian.Uint16(swapped[4:])&sstBigEndianFlag == 0 {
+		t.Fatal("Expected the flag to read big-endian")
+	}
+	le, be := binary.LittleEndian, binary.BigEndian
+	for _, offset := range []int{0, 6, 10, 14} {
+		if be.Uint32(swapped[offset:]) != bits.ReverseBytes32(le.Uint32(contents[offset:])) {
+			t.Errorf("Header field at %d does not read byte-swapped", offset)
+		}
+	}
+	footer := swapped[len(swapped)-footerSizeV5:]
+	if be.Uint64(footer[8:]) != bits.ReverseBytes64(le.Uint64(footer[8:])) {
+		t.Error("Properties offset does not read byte-swapped")
+	}
+	if _, err := readSSTHeader(bytes.NewReader(swapped)); err == nil {
+		t.Error("Expected the header with the swapped flag to be rejected")
+	}
+
+	// A big-endian file stores every fixed-size field big-endian and reads back the same
+	cfg := DefaultDBConfig()
+	cfg.ByteOrder = binary.BigEndian
+	big := filepath.Join(dir, "big.sst")
+	if err := writeSSTFileWithConfig(big, data, cfg); err != nil {
+		t.Fatal(err)
+	}
+	contents, err = os.ReadFile(big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if be.Uint32(contents) != magicNumber || be.Uint32(contents[6:]) != uint32(len(data)) {
+		t.Errorf("Expected a big-endian header, got % x", contents[:headerSize])
+	}
+	header, err := readSSTFileHeader(big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if be.Uint64(contents[len(contents)-footerSizeV5:]) != uint64(header.size()) {
+		t.Errorf("Expected a big-endian filter block offset, got % x", contents[len(contents)-footerSizeV5:])
+	}
+	entries, err := readSSTEntries(big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	it, err := newSSTIterator(big, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	for i := 0; it.Next(); i++ {
+		if kv := it.Entry(); !bytes.Equal(kv.Key, data[i].Key) || kv.ExpiresAt != data[i].ExpiresAt {
+			t.Fatalf("Iterator read %s expiring at %d, expected %s at %d", kv.Key, kv.ExpiresAt, data[i].Key, data[i].ExpiresAt)
+		}
+	}
+	if it.Err() != nil || len(entries) != len(data) || string(entries[42].Key) != "key042" || entries[42].ExpiresAt != 43 {
+		t.Fatalf("Expected the big-endian entries to read back, got %d entries, %v", len(entries), it.Err())
+	}
+	if result, err := InspectSST(big, nil); err != nil || result.ByteOrder != "BigEndian" || result.IndexStatus != IndexOK || string(result.LargestKey) != "key099" {
+		t.Errorf("Unexpected inspection of the big-endian file: %+v, %v", result, err)
+	}
+}
+
+func TestTransformAllSSTs(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	cfg.TransformBytesPerSecond = 0
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const count = 10000
+	for i := 0; i < count; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%05d", i)), []byte(fmt.Sprintf("plain value %d", i))); err != nil {
+			t.Fatal(err)
+		}
+		if i%2500 == 2499 {
+			if err := db.Flush(nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	before, err := ReadManifest(cfg.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.TransformAllSSTs(context.Background(), func(kv KeyValue) (KeyValue, bool) {
+		encoded, err := json.Marshal(string(kv.Value))
+		if err != nil {
+			t.Error(err)
+		}
+		kv.Value = encoded
+		return kv, true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := ReadManifest(cfg.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Fatalf("Expected %d files in the manifest, got %d", len(before), len(after))
+	}
+	for _, file := range before {
+		if _, err := os.Stat(filepath.Join(cfg.DataDir, file.FileName)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Expected %s to be removed, got %v", file.FileName, err)
+		}
+	}
+
+	seen := 0
+	err = db.Export(func(kv KeyValue) error {
+		var value string
+		if err := json.Unmarshal(kv.Value, &value); err != nil {
+			return fmt.Errorf("value of %s is not valid JSON: %w", kv.Key, err)
+		}
+		seen++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen != count {
+		t.Errorf("Expected %d transformed values, got %d", count, seen)
+	}
+	if value, err := db.Get([]byte("key01234")); err != nil || string(value) != `"plain value 1234"` {
+		t.Errorf("Get(key01234) = %q, %v", value, err)
+	}
+}
+
+func TestTransformAllSSTsDropsOverwrittenKeys(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	cfg.TransformBytesPerSecond = 0
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, batch := range [][]string{{"dropped", "old", "renamed", "old"}, {"dropped", "new", "renamed", "new"}} {
+		for i := 0; i < len(batch); i += 2 {
+			if err := db.Set([]byte(batch[i]), []byte(batch[i+1])); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Flush(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the newest versions are dropped or renamed; the older file must not show through
+	err = db.TransformAllSSTs(context.Background(), func(kv KeyValue) (KeyValue, bool) {
+		if string(kv.Value) != "new" {
+			return kv, true
+		}
+		if string(kv.Key) == "dropped" {
+			return kv, false
+		}
+		kv.Key = []byte("target")
+		return kv, true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"dropped", "renamed"} {
+		if value, err := db.Get([]byte(key)); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected %s to be gone, got %q, %v", key, value, err)
+		}
+	}
+	if value, err := db.Get([]byte("target")); err != nil || string(value) != "new" {
+		t.Errorf("Expected the renamed entry under target, got %q, %v", value, err)
+	}
+}
+
+func TestTagsSurviveFlushAndCompaction(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags := map[string]string{"source_ip": "10.0.0.1", "content-type": "text/plain"}
+	if err := db.SetWithOptions([]byte("tagged"), []byte("value"), SetOptions{Tags: tags}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("plain"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	checkTags := func(stage string) {
+		t.Helper()
+		if got, err := db.GetMetadata([]byte("tagged")); err != nil || !maps.Equal(got, tags) {
+			t.Errorf("%s: GetMetadata(tagged) = %v, %v; want %v", stage, got, err, tags)
+		}
+		if got, err := db.GetMetadata([]byte("plain")); err != nil || got != nil {
+			t.Errorf("%s: GetMetadata(plain) = %v, %v; want no tags", stage, got, err)
+		}
+	}
+	checkTags("memtable")
+	if value, err := db.Get([]byte("tagged")); err != nil || string(value) != "value" {
+		t.Errorf("Get(tagged) = %q, %v", value, err)
+	}
+
+	// The tags are replayed from the WAL
+	db.Close()
+	if db, err = OpenDB(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkTags("WAL replay")
+
+	if err := db.Flush(nil); err != nil {
+		t.Fatal(err)
+	}
+	checkTags("SST file")
+	if _, err := db.GetMetadata([]byte("missing")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound for a missing key, got %v", err)
+	}
+
+	if err := db.Set([]byte("other"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := compactSSTFiles(cfg, 1, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	files, err := getSSTFileNames(cfg.DataDir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected a single merged file, got %v, %v", files, err)
+	}
+	entries, err := readSSTEntries(filepath.Join(cfg.DataDir, files[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, kv := range entries {
+		switch string(kv.Key) {
+		case "tagged":
+			found = true
+			if !maps.Equal(kv.Tags, tags) {
+				t.Errorf("Expected the merged file to keep the tags %v, got %v", tags, kv.Tags)
+			}
+		default:
+			if kv.Tags != nil {
+				t.Errorf("Expected no tags for %s, got %v", kv.Key, kv.Tags)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Expected the tagged key in the merged file, got %+v", entries)
+	}
+}
+
+func TestExportImportStream(t *testing.T) {
+	openDB := func(name string) *memDB {
+		dir := filepath.Join(t.TempDir(), name)
+		cfg := DefaultDBConfig()
+		cfg.DataDir = filepath.Join(dir, "data")
+		cfg.WALPath = filepath.Join(dir, "wal.log")
+		db, err := OpenDB(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return db
+	}
+	source := openDB("source")
+	const count = 100000
+	entries := make([]KeyValue, 0, importChunkSize)
+	for i := 0; i < count; i++ {
+		entries = append(entries, KeyValue{Key: []byte(fmt.Sprintf("key%06d", i)), Value: []byte(fmt.Sprintf("value %d", i))})
+		if len(entries) == importChunkSize {
+			if err := source.BatchSet(entries); err != nil {
+				t.Fatal(err)
+			}
+			entries = entries[:0]
+		}
+	}
+	if _, err := source.Del([]byte("key000042")); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.Set([]byte("key000043"), []byte("overwritten")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Expiry times and tags are carried over; expired entries are left out
+	expiresAt := time.Now().Add(time.Hour).UnixNano()
+	err := source.BatchSet([]KeyValue{
+		{Key: []byte("key000044"), Value: []byte("expiring"), ExpiresAt: expiresAt},
+		{Key: []byte("key000045"), Value: []byte("expired"), ExpiresAt: time.Now().Add(-time.Hour).UnixNano()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := source.SetWithOptions([]byte("key000046"), []byte("tagged"), SetOptions{Tags: map[string]string{"owner": "alice"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var stream bytes.Buffer
+	if err := source.ExportStream(context.Background(), &stream); err != nil {
+		t.Fatal(err)
+	}
+	target := openDB("target")
+	if err := target.ImportStream(context.Background(), &stream); err != nil {
+		t.Fatal(err)
+	}
+
+	collect := func(db *memDB) []KeyValue {
+		var all []KeyValue
+		if err := db.Export(func(kv KeyValue) error {
+			all = append(all, kv)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return all
+	}
+	want, got := collect(source), collect(target)
+	if len(want) != count-2 || len(got) != len(want) {
+		t.Fatalf("Expected %d entries in both databases, got %d and %d", count-2, len(want), len(got))
+	}
+	for i := range want {
+		if !bytes.Equal(want[i].Key, got[i].Key) || !bytes.Equal(want[i].Value, got[i].Value) ||
+			want[i].ExpiresAt != got[i].ExpiresAt || !maps.Equal(want[i].Tags, got[i].Tags) {
+			t.Fatalf("Entry %d differs: %+v exported, %+v imported", i, want[i], got[i])
+		}
+	}
+	if value, err := target.Get([]byte("key000043")); err != nil || string(value) != "overwritten" {
+		t.Errorf("Expected the overwritten value, got %q, %v", value, err)
+	}
+	if value, err := target.Get([]byte("key000045")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected the expired entry to be left out, got %q, %v", value, err)
+	}
+	if tags, err := target.GetMetadata([]byte("key000046")); err != nil || tags["owner"] != "alice" {
+		t.Errorf("Expected the tags to be imported, got %v, %v", tags, err)
+	}
+	if err := target.Flush(nil); err != nil {
+		t.Fatal(err)
+	}
+	if kvs := collect(target); len(kvs) != len(want) || kvs[43].ExpiresAt != expiresAt {
+		t.Errorf("Expected the expiry time to be flushed, got %d entries", len(kvs))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := source.ExportStream(ctx, io.Discard); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestExportSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 200; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		if i == 99 {
+			if err := db.Flush(nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := db.Del([]byte("key050")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes and flushes made while the export runs are not seen
+	var keys []string
+	err = db.Export(func(kv KeyValue) error {
+		if len(keys) == 0 {
+			if err := db.Set([]byte("key999"), []byte("late")); err != nil {
+				return err
+			}
+			if _, err := db.Del([]byte("key150")); err != nil {
+				return err
+			}
+			if err := db.Flush(nil); err != nil {
+				return err
+			}
+		}
+		keys = append(keys, string(kv.Key))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported := func(key string) bool {
+		i := sort.SearchStrings(keys, key)
+		return i < len(keys) && keys[i] == key
+	}
+	if len(keys) != 199 || !sort.StringsAreSorted(keys) || exported("key050") || exported("key999") || !exported("key150") {
+		t.Errorf("Expected the 199 keys live when the export started, in order, got %d: %v", len(keys), keys)
+	}
+
+	// A file listed in the manifest that is gone fails the export
+	files, err := ReadManifest(cfg.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(cfg.DataDir, files[0].FileName)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Export(func(KeyValue) error { return nil }); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected os.ErrNotExist for a missing SST file, got %v", err)
+	}
+}
+
+func TestSSTCrashMidWrite(t *testing.T) {
+	var entries []KeyValue
+	for i := 0; i < 100; i++ {
+		entries = append(entries, KeyValue{Key: []byte(fmt.Sprintf("new-%03d", i)), Value: []byte(fmt.Sprintf("value %d", i))})
+	}
+
+	// A file of the same entries tells where its regions start
+	cfg := DefaultDBConfig()
+	reference := filepath.Join(t.TempDir(), "reference.sst")
+	if err := writeSSTFileWithConfig(reference, entries, cfg); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := readSSTHeader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	footer, err := readSSTFooter(file, header, 0)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name  string
+		limit int64
+	}{
+		{"data block", (footer.dataOffset + footer.propertiesOffset) / 2},
+		{"filter block", footer.filterOffset + 8},
+		{"checksum", int64(header.ChecksumOffset) + 2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cfg.DataDir = filepath.Join(dir, "data")
+			cfg.WALPath = filepath.Join(dir, "wal.log")
+			db, err := OpenDB(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 100; i++ {
+				if err := db.Set([]byte(fmt.Sprintf("old-%03d", i)), []byte(fmt.Sprintf("value %d", i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.Flush(nil); err != nil {
+				t.Fatal(err)
+			}
+			for _, kv := range entries {
+				if err := db.Set(kv.Key, kv.Value); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Readers see every key with its value while the flush crashes
+			stop := make(chan struct{})
+			var readers sync.WaitGroup
+			for r := 0; r < 4; r++ {
+				readers.Add(1)
+				go func() {
+					defer readers.Done()
+					for i := 0; ; i = (i + 1) % 100 {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+						for _, prefix := range []string{"old", "new"} {
+							key := fmt.Sprintf("%s-%03d", prefix, i)
+							if value, err := db.Get([]byte(key)); err != nil || string(value) != fmt.Sprintf("value %d", i) {
+								t.Errorf("Reader got %q, %v for %s", value, err, key)
+								return
+							}
+						}
+					}
+				}()
+			}
+
+			originalOutput := sstFileOutput
+			sstFileOutput = func(file *os.File) io.Writer {
+				return &CrashWriter{W: file, Limit: int(test.limit), Panic: true}
+			}
+			if !crashed(func() { db.Flush(nil) }) {
+				t.Error("Expected the flush to crash")
+			}
+			sstFileOutput = originalOutput
+			close(stop)
+			readers.Wait()
+
+			// The partial file is not in the manifest and does not read as a valid file
+			manifest, err := ReadManifest(cfg.DataDir)
+			if err != nil || len(manifest) != 1 {
+				t.Fatalf("Expected only the first SST file in the manifest, got %v, %v", manifest, err)
+			}
+			paths, err := filepath.Glob(filepath.Join(cfg.DataDir, "*.sst"))
+			if err != nil || len(paths) != 2 {
+				t.Fatalf("Expected the first and the partial SST file, got %v, %v", paths, err)
+			}
+			for _, path := range paths {
+				if filepath.Base(path) == manifest[0].FileName {
+					continue
+				}
+				if info, err := os.Stat(path); err != nil || info.Size() != test.limit {
+					t.Errorf("Expected %d bytes in the partial file, got %v, %v", test.limit, info, err)
+				}
+				if entries, err := readSSTEntries(path); err == nil {
+					t.Errorf("Expected the partial file to be rejected, read %d entries", len(entries))
+				}
+			}
+
+			if err := db.Flush(nil); err != nil {
+				t.Fatal(err)
+			}
+			db.Close()
+			db, err = OpenDB(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			for i := 0; i < 100; i++ {
+				for _, prefix := range []string{"old", "new"} {
+					key := fmt.Sprintf("%s-%03d", prefix, i)
+					if value, err := db.Get([]byte(key)); err != nil || string(value) != fmt.Sprintf("value %d", i) {
+						t.Errorf("Expected %s after reopening, got %q, %v", key, value, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestGetRereadsManifestAfterCompaction(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, value := range []string{"old", "new"} {
+		if err := db.Set([]byte("key"), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Flush(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The files listed by the first manifest read are merged before they are looked up
+	reads := 0
+	defer func(original func(string) ([]SSTFileMeta, error)) { readCandidateManifest = original }(readCandidateManifest)
+	readCandidateManifest = func(dir string) ([]SSTFileMeta, error) {
+		reads++
+		files, err := ReadManifest(dir)
+		if reads == 1 && err == nil {
+			err = compactSSTFiles(cfg, 1, nil, nil)
+		}
+		return files, err
+	}
+	if value, err := db.Get([]byte("key")); err != nil || string(value) != "new" {
+		t.Errorf("Expected the merged value, got %q, %v", value, err)
+	}
+	if reads != 2 {
+		t.Errorf("Expected the manifest to be read again, got %d reads", reads)
+	}
+	if tags, err := db.GetMetadata([]byte("key")); err != nil || tags != nil {
+		t.Errorf("Expected the metadata of the merged entry, got %v, %v", tags, err)
+	}
+}
+
+func TestMinCompactionInterval(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	flushFiles := func(round int) {
+		for i := 0; i < 20; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("key-%d-%02d", round, i)), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Flush(nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var logs bytes.Buffer
+	originalLogger := logger
+	logger = slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	defer func() { logger = originalLogger }()
+
+	// A run with nothing to merge does not start the interval
+	if wait := db.compact(); wait != 0 {
+		t.Fatalf("Expected a compaction without files to run, got a wait of %s", wait)
+	}
+	flushFiles(0)
+	if wait := db.compact(); wait != 0 {
+		t.Fatalf("Expected the first compaction to run, got a wait of %s", wait)
+	}
+
+	// A burst of new files right after does not compact again
+	flushFiles(1)
+	wait := db.compact()
+	if wait <= 0 || wait > time.Minute {
+		t.Errorf("Expected the second compaction to wait up to a minute, got %s", wait)
+	}
+	if stats := db.metrics.Snapshot(); stats.CompactionsTotal != 1 {
+		t.Errorf("Expected one compaction run, got %d", stats.CompactionsTotal)
+	}
+	files, err := getSSTFileNames(cfg.DataDir)
+	if err != nil || len(files) != 21 {
+		t.Errorf("Expected the merged file and 20 new ones, got %v, %v", files, err)
+	}
+	if !strings.Contains(logs.String(), `"level":"DEBUG","msg":"compaction skipped`) || !strings.Contains(logs.String(), `"wait"`) {
+		t.Errorf("Expected a debug log of the skipped compaction, got %s", logs.String())
+	}
+}
+
+// lossyWriter keeps the first limit bytes written through it and drops the rest while
+// reporting success, like a disk that loses writes.
+type lossyWriter struct {
+	w     io.Writer
+	limit int
+}
+
+func (l *lossyWriter) Write(p []byte) (int, error) {
+	if keep := min(len(p), l.limit); keep > 0 {
+		if _, err := l.w.Write(p[:keep]); err != nil {
+			return 0, err
+		}
+		l.limit -= keep
+	}
+	return len(p), nil
+}
+
+func TestCompactionKeepsInputsOfTruncatedOutput(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	var inputs []string
+	var total int64
+	for f := 0; f < 3; f++ {
+		var data []KeyValue
+		for i := 0; i < 200; i++ {
+			data = append(data, KeyValue{Key: []byte(fmt.Sprintf("key-%d-%03d", f, i)), Value: []byte(fmt.Sprintf("value %d", i))})
+		}
+		path := filepath.Join(dir, fmt.Sprintf("file_%d.sst", f+1))
+		if err := writeSSTFileWithConfig(path, data, cfg); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inputs = append(inputs, path)
+		total += info.Size()
+	}
+	before := make(map[string][]byte)
+	for _, path := range inputs {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		before[path] = contents
+	}
+
+	originalOutput := sstFileOutput
+	sstFileOutput = func(file *os.File) io.Writer { return &lossyWriter{w: file, limit: int(total / 2)} }
+	err := compactSSTFiles(cfg, 1, nil, nil)
+	sstFileOutput = originalOutput
+	if !errors.Is(err, ErrInvalidMergedSST) {
+		t.Fatalf("Expected ErrInvalidMergedSST, got %v", err)
+	}
+
+	// The inputs are untouched and the truncated output is gone
+	for _, path := range inputs {
+		if contents, err := os.ReadFile(path); err != nil || !bytes.Equal(contents, before[path]) {
+			t.Errorf("Expected %s to be intact, got %v", path, err)
+		}
+	}
+	if merged, _ := filepath.Glob(filepath.Join(dir, "merged_sst_file_*")); len(merged) != 0 {
+		t.Errorf("Expected the truncated output to be removed, found %v", merged)
+	}
+
+	if err := compactSSTFiles(cfg, 1, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	merged, err := filepath.Glob(filepath.Join(dir, "merged_sst_file_*.sst"))
+	if err != nil || len(merged) != 1 {
+		t.Fatalf("Expected one merged file, got %v, %v", merged, err)
+	}
+	entries, err := readSSTEntries(merged[0])
+	if err != nil || len(entries) != 600 {
+		t.Errorf("Expected 600 entries in the merged file, got %d, %v", len(entries), err)
+	}
+}
+
+// jsonEntries returns count entries whose values are small JSON documents sharing their
+// field names, like the records of a user table.
+func jsonEntries(prefix string, count int) []KeyValue {
+	entries := make([]KeyValue, count)
+	for i := range entries {
+		entries[i] = KeyValue{
+			Key:   []byte(fmt.Sprintf("%s:user:%06d", prefix, i)),
+			Value: []byte(fmt.Sprintf(`{"user_id":%d,"created_at":"2026-01-%02dT10:%02d:00Z","status":"active","email":"user%d@example.com","preferences":{"newsletter":true,"theme":"dark"}}`, i, i%28+1, i%60, i)),
+		}
+	}
+	return entries
+}
+
+func TestSSTCompressionDictionary(t *testing.T) {
+	dir := t.TempDir()
+	sample := filepath.Join(dir, "sample.sst")
+	if err := writeSSTFile(sample, jsonEntries("sample", 500)); err != nil {
+		t.Fatal(err)
+	}
+	dict, err := BuildCompressionDictionary([]string{sample})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dict) == 0 || len(dict) > maxDictionarySize || !bytes.Contains(dict, []byte(`"created_at":"2026-01-`)) {
+		t.Fatalf("Expected the repeated field names in a dictionary of at most %d bytes, got %d bytes", maxDictionarySize, len(dict))
+	}
+
+	cfg := DefaultDBConfig()
+	cfg.CompressionDictionary = dict
+	data := jsonEntries("data", 20)
+	path := filepath.Join(dir, "file_1.sst")
+	if err := writeSSTFileWithConfig(path, data, cfg); err != nil {
+		t.Fatal(err)
+	}
+	header, err := readSSTFileHeader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Version&sstDictionaryFlag == 0 || header.DictionaryID != compressionDictionaryID(dict) {
+		t.Fatalf("Expected the dictionary ID %#x in the header, got %+v", compressionDictionaryID(dict), header)
+	}
+	// A file of few entries has little history of its own, so the dictionary shrinks it
+	plain := filepath.Join(dir, "plain.sst")
+	if err := writeSSTFileWithConfig(plain, data, DefaultDBConfig()); err != nil {
+		t.Fatal(err)
+	}
+	if plainBytes, dictBytes := sstCompressedBytes(t, plain), sstCompressedBytes(t, path); dictBytes >= plainBytes {
+		t.Errorf("Expected fewer compressed bytes with the dictionary, got %d with it and %d without", dictBytes, plainBytes)
+	}
+
+	// Files of an unknown dictionary cannot be read; once it is registered they can
+	if _, err := readSSTEntries(path); !errors.Is(err, ErrUnknownCompressionDictionary) {
+		t.Fatalf("Expected ErrUnknownCompressionDictionary, got %v", err)
+	}
+	id := RegisterCompressionDictionary(dict)
+	t.Cleanup(func() { compressionDictionaries.Delete(id) })
+	entries, err := readSSTEntries(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	it, err := newSSTIterator(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	for i, kv := range data {
+		if !it.Next() || !bytes.Equal(it.Entry().Value, kv.Value) || !bytes.Equal(entries[i].Value, kv.Value) {
+			t.Fatalf("Entry %d of the dictionary-compressed file differs: %v", i, it.Err())
+		}
+	}
+}
+
+func TestCompressionDictionarySampleLimit(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.sst")
+	if err := writeSSTFile(first, jsonEntries("first", 10)); err != nil {
+		t.Fatal(err)
+	}
+	// Each value repeats itself, so even one entry read from the second file would show
+	second := filepath.Join(dir, "second.sst")
+	var entries []KeyValue
+	for i := 0; i < 50; i++ {
+		entries = append(entries, KeyValue{Key: []byte(fmt.Sprintf("second:%06d", i)), Value: bytes.Repeat([]byte("only-in-the-second-sample-file|"), 2)})
+	}
+	if err := writeSSTFile(second, entries); err != nil {
+		t.Fatal(err)
+	}
+
+	dict, err := BuildCompressionDictionary([]string{first, second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(dict, []byte("-second-sample-")) {
+		t.Fatal("Expected the second sample in the dictionary under the default limit")
+	}
+
+	// The limit is reached within the first file, so the second one is not read
+	defer func(original int) { dictionarySampleBytes = original }(dictionarySampleBytes)
+	dictionarySampleBytes = 1000
+	dict, err = BuildCompressionDictionary([]string{first, second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(dict, []byte("second")) {
+		t.Errorf("Expected only the first sample in the dictionary, got %q", dict)
+	}
+	if !bytes.Contains(dict, []byte(`"created_at"`)) {
+		t.Errorf("Expected the first sample in the dictionary, got %q", dict)
+	}
+}
+
+func TestCompressionDictionaryStoredWithData(t *testing.T) {
+	dir := t.TempDir()
+	sample := filepath.Join(dir, "sample.sst")
+	if err := writeSSTFile(sample, jsonEntries("sample", 500)); err != nil {
+		t.Fatal(err)
+	}
+	dict, err := BuildCompressionDictionary([]string{sample})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := compressionDictionaryID(dict)
+	t.Cleanup(func() { compressionDictionaries.Delete(id) })
+
+	cfg := DefaultDBConfig()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	cfg.CompressionDictionary = dict
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range jsonEntries("data", 20) {
+		if err := db.Set(kv.Key, kv.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restarted process no longer configured with the dictionary still reads the files
+	compressionDictionaries.Delete(id)
+	cfg.CompressionDictionary = nil
+	db, err = OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, kv := range jsonEntries("data", 20) {
+		if value, err := db.Get(kv.Key); err != nil || !bytes.Equal(value, kv.Value) {
+			t.Fatalf("Expected %s readable without the configured dictionary, got %q, %v", kv.Key, value, err)
+		}
+	}
+
+	// A stored dictionary that does not match its ID is refused
+	bad := filepath.Join(cfg.DataDir, fmt.Sprintf(dictionaryFilePattern, id+1))
+	if err := os.WriteFile(bad, dict, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadCompressionDictionaries(cfg.DataDir, nil); err == nil {
+		t.Error("Expected an error for a dictionary stored under the wrong ID")
+	}
+}
+
+// sstCompressedBytes returns the size of the compressed entries of the SST file at path,
+// without the header, filter and footer.
+func sstCompressedBytes(tb testing.TB, path string) int {
+	tb.Helper()
+	properties, err := ReadSSTProperties(path, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	n, err := strconv.Atoi(properties["compressed_bytes"])
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return n
+}
+
+// BenchmarkSSTCompressionDictionary reports how much the dictionary shrinks files of
+// growing size; as it primes one stream per file, the gain fades as files grow.
+func BenchmarkSSTCompressionDictionary(b *testing.B) {
+	dir := b.TempDir()
+	sample := filepath.Join(dir, "sample.sst")
+	if err := writeSSTFile(sample, jsonEntries("sample", 2000)); err != nil {
+		b.Fatal(err)
+	}
+	dict, err := BuildCompressionDictionary([]string{sample})
+	if err != nil {
+		b.Fatal(err)
+	}
+	RegisterCompressionDictionary(dict)
+	for _, entries := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("entries=%d", entries), func(b *testing.B) {
+			data := jsonEntries("data", entries)
+			cfg := DefaultDBConfig()
+			dictCfg := cfg
+			dictCfg.CompressionDictionary = dict
+			plain, compressed := filepath.Join(dir, "plain.sst"), filepath.Join(dir, "dict.sst")
+			for i := 0; i < b.N; i++ {
+				if err := writeSSTFileWithConfig(plain, data, cfg); err != nil {
+					b.Fatal(err)
+				}
+				if err := writeSSTFileWithConfig(compressed, data, dictCfg); err != nil {
+					b.Fatal(err)
+				}
+			}
+			plainBytes, dictBytes := float64(sstCompressedBytes(b, plain)), float64(sstCompressedBytes(b, compressed))
+			b.ReportMetric(plainBytes, "plain-bytes")
+			b.ReportMetric(dictBytes, "dict-bytes")
+			b.ReportMetric(100*(1-dictBytes/plainBytes), "reduction-%")
+		})
+	}
+}
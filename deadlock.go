@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// goroutineID identifies a lock holder, typically a transaction.
+type goroutineID uint64
+
+// DeadlockDetector tracks which holders wait for which and aborts one holder of
+// every cycle it finds in that wait-for graph.
+type DeadlockDetector struct {
+	DetectionInterval time.Duration
+
+	mu       sync.Mutex
+	waitsFor map[goroutineID]goroutineID        // Waiter to the holder of the lock it waits for
+	aborts   map[goroutineID]context.CancelFunc // Cancels the context of a registered holder
+}
+
+func NewDeadlockDetector(interval time.Duration) *DeadlockDetector {
+	return &DeadlockDetector{
+		DetectionInterval: interval,
+		waitsFor:          make(map[goroutineID]goroutineID),
+		aborts:            make(map[goroutineID]context.CancelFunc),
+	}
+}
+
+// Register makes id eligible for being aborted by calling cancel.
+func (d *DeadlockDetector) Register(id goroutineID, cancel context.CancelFunc) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.aborts[id] = cancel
+}
+
+func (d *DeadlockDetector) Unregister(id goroutineID) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.aborts, id)
+	delete(d.waitsFor, id)
+}
+
+// waiting records that waiter blocks until holder releases a lock.
+func (d *DeadlockDetector) waiting(waiter, holder goroutineID) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.waitsFor[waiter] = holder
+}
+
+func (d *DeadlockDetector) doneWaiting(waiter goroutineID) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.waitsFor, waiter)
+}
+
+// startDeadlockDetector checks the wait-for graph every DetectionInterval until ctx is done.
+func (d *DeadlockDetector) startDeadlockDetector(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(d.DetectionInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				d.resolve()
+			}
+		}
+	}()
+}
+
+// resolve aborts the youngest holder, the one with the highest ID, of every cycle.
+func (d *DeadlockDetector) resolve() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for {
+		cycle := d.findCycle()
+		if cycle == nil {
+			return
+		}
+		victim := cycle[0]
+		for _, id := range cycle {
+			victim = max(victim, id)
+		}
+		logger.Error("deadlock detected", "cycle", cycle, "aborted", victim)
+
+		if abort, ok := d.aborts[victim]; ok {
+			abort()
+		}
+		delete(d.waitsFor, victim)
+	}
+}
+
+// findCycle returns the IDs of a cycle in the wait-for graph, or nil if there is none.
+// Every waiter waits for a single holder, so following the edges from each node is a DFS.
+func (d *DeadlockDetector) findCycle() []goroutineID {
+	visited := make(map[goroutineID]bool)
+	for start := range d.waitsFor {
+		if visited[start] {
+			continue
+		}
+		onPath := make(map[goroutineID]int)
+		path := make([]goroutineID, 0)
+		for id, ok := start, true; ok; id, ok = d.waitsFor[id] {
+			if i, seen := onPath[id]; seen {
+				return path[i:]
+			}
+			if visited[id] {
+				break
+			}
+			visited[id] = true
+			onPath[id] = len(path)
+			path = append(path, id)
+		}
+	}
+	return nil
+}
+
+// DetectedMutex is a mutex whose waiters are reported to a DeadlockDetector, so
+// that a deadlocked Lock returns once the detector aborts its context.
+type DetectedMutex struct {
+	detector *DeadlockDetector
+	sem      chan struct{}
+
+	mu    sync.Mutex
+	owner goroutineID
+}
+
+func NewDetectedMutex(detector *DeadlockDetector) *DetectedMutex {
+	return &DetectedMutex{detector: detector, sem: make(chan struct{}, 1)}
+}
+
+// Lock acquires the mutex for id, or returns ctx.Err() if ctx is done first.
+func (m *DetectedMutex) Lock(ctx context.Context, id goroutineID) error {
+	m.mu.Lock()
+	select {
+	case m.sem <- struct{}{}:
+		m.owner = id
+		m.mu.Unlock()
+		return nil
+	default:
+	}
+	holder := m.owner
+	m.mu.Unlock()
+
+	m.detector.waiting(id, holder)
+	defer m.detector.doneWaiting(id)
+
+	select {
+	case m.sem <- struct{}{}:
+		m.setOwner(id)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *DetectedMutex) Unlock() {
+	<-m.sem
+}
+
+func (m *DetectedMutex) setOwner(id goroutineID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.owner = id
+}
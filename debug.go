@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+const debugRequestInterval = time.Minute // Minimum time between two /debug snapshots
+
+// DebugState is a snapshot of the in-memory state of the database, served by /debug.
+type DebugState struct {
+	Memtable         []DebugEntry       `json:"memtable"`           // Entries of the memtable, tombstones included
+	SSTFiles         []SSTFileMeta      `json:"sst_files"`          // Files listed in the manifest
+	WALWatermark     WALWatermark       `json:"wal_watermark"`      // Position replay starts from
+	BloomFilterSizes map[string]int     `json:"bloom_filter_sizes"` // Serialized size of each cached filter block by SST file
+	BlockCache       BlockCacheStats    `json:"block_cache"`
+	Compaction       CompactionProgress `json:"compaction"`
+	Subscriptions    int                `json:"subscriptions"` // Active change event subscriptions and watches
+	CircuitBreaker   string             `json:"circuit_breaker"`
+	Shards           []DebugState       `json:"shards,omitempty"` // State of every shard of a ShardedDB
+}
+
+// DebugEntry is a memtable entry of a DebugState.
+type DebugEntry struct {
+	Key       []byte `json:"key"`
+	Value     []byte `json:"value"`
+	Operation string `json:"operation"`
+	ExpiresAt int64  `json:"expires_at,omitempty"` // Unix time in nanoseconds; 0 never expires
+}
+
+// WALWatermark is the segment and offset of the first WAL entry not yet in an SST file.
+type WALWatermark struct {
+	Segment  uint64 `json:"segment"`
+	Position int64  `json:"position"`
+}
+
+// BlockCacheStats describes the block cache of a DebugState.
+type BlockCacheStats struct {
+	Policy   string `json:"policy"`
+	Capacity int    `json:"capacity"` // 0 when the cache is disabled
+	Entries  int    `json:"entries"`
+}
+
+// Watermark returns the position the next replay starts from, as stored next to the log.
+// A nil or closed log has none.
+func (wal *WriteAheadLog) Watermark() WALWatermark {
+	if wal == nil {
+		return WALWatermark{}
+	}
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+	if wal.closed {
+		return WALWatermark{}
+	}
+	segment, position := readWALWatermark(wal.watermarkPath())
+	return WALWatermark{Segment: segment, Position: position}
+}
+
+// subscriptions returns the number of active subscriptions. A nil bus has none.
+func (b *ChangeEventBus) subscriptions() int {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subscribers)
+}
+
+// DebugState returns a snapshot of the memtable, manifest and caches. It copies the whole
+// memtable under the database lock, so it is meant for troubleshooting only.
+func (mem *memDB) DebugState() (DebugState, error) {
+	files, err := ReadManifest(mem.cfg.DataDir)
+	if err != nil {
+		return DebugState{}, fmt.Errorf("error reading manifest: %w", err)
+	}
+
+	mem.mu.Lock()
+	if mem.closed {
+		mem.mu.Unlock()
+		return DebugState{}, ErrDatabaseClosed
+	}
+	memtable := make([]DebugEntry, 0, len(mem.data)+len(mem.tombstones))
+	for _, entries := range [][]KeyValue{mem.data, mem.tombstones} {
+		for _, kv := range entries {
+			kv, _ := kv.decompressed()
+			memtable = append(memtable, DebugEntry{
+				Key:       bytes.Clone(kv.Key),
+				Value:     bytes.Clone(kv.Value),
+				Operation: kv.Operation.String(),
+				ExpiresAt: kv.ExpiresAt,
+			})
+		}
+	}
+	mem.mu.Unlock()
+
+	filterSizes := make(map[string]int)
+	if mem.filters != nil {
+		mem.filters.Range(func(fileName string, value interface{}) {
+			if filter, ok := value.(*FilterBlock); ok && filter != nil {
+				filterSizes[fileName] = filter.serializedSize()
+			}
+		})
+	}
+	blockCache := BlockCacheStats{Policy: mem.cfg.BlockCachePolicy}
+	if mem.blockCache != nil {
+		blockCache.Capacity = mem.cfg.BlockCacheSize
+		mem.blockCache.Range(func(string, interface{}) { blockCache.Entries++ })
+	}
+
+	return DebugState{
+		Memtable:         memtable,
+		SSTFiles:         files,
+		WALWatermark:     mem.wal.Watermark(),
+		BloomFilterSizes: filterSizes,
+		BlockCache:       blockCache,
+		Compaction:       mem.CompactionProgress(),
+		Subscriptions:    mem.events.subscriptions(),
+		CircuitBreaker:   mem.CircuitBreakerState(),
+	}, nil
+}
+
+// DebugState returns the state of the whole database; namespaces share it.
+func (ns *NamespacedDB) DebugState() (DebugState, error) {
+	return ns.db.DebugState()
+}
+
+// DebugState returns the state of every shard in Shards, with the compaction progress and
+// circuit breaker state combined as CompactionProgress and CircuitBreakerState do.
+func (s *ShardedDB) DebugState() (DebugState, error) {
+	state := DebugState{
+		Compaction:     s.CompactionProgress(),
+		CircuitBreaker: s.CircuitBreakerState(),
+		Shards:         make([]DebugState, len(s.shards)),
+	}
+	for i, shard := range s.shards {
+		shardState, err := shard.DebugState()
+		if err != nil {
+			return DebugState{}, fmt.Errorf("error reading state of shard %d: %w", i, err)
+		}
+		state.Shards[i] = shardState
+		state.Subscriptions += shardState.Subscriptions
+	}
+	return state, nil
+}
+
+// handleDebug serves the DebugState of the database. It is only registered when
+// DBConfig.Debug is set, answers clients sending DBConfig.DebugToken in the X-Debug-Token
+// header, or on the loopback interface when no token is set, and takes one snapshot per
+// debugRequestInterval.
+func (s *server) handleDebug(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.debugAllowed(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if allowed, wait := s.debugBucket.take(time.Now(), 1/debugRequestInterval.Seconds(), 1); !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	state, err := s.db.DebugState()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response, _ := json.Marshal(state)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(response)
+}
+
+// debugAllowed reports whether the request carries the debug token, or comes from the
+// loopback interface without one set; see peerAllowed.
+func (s *server) debugAllowed(r *http.Request) bool {
+	return s.peerAllowed(r, "X-Debug-Token", s.cfg.DebugToken)
+}
+
+// peerAllowed reports whether a request may use an endpoint guarded by token, sent in
+// header. Once a token is set, only requests carrying it are. Without one, only requests
+// from the loopback interface are, unless a proxy on the same host may have relayed them
+// from anywhere: they carry X-Forwarded-For, or TrustedProxies lists a loopback address.
+func (s *server) peerAllowed(r *http.Request, header, token string) bool {
+	if token != "" {
+		sent := r.Header.Get(header)
+		return sent != "" && subtle.ConstantTimeCompare([]byte(sent), []byte(token)) == 1
+	}
+	if r.Header.Get("X-Forwarded-For") != "" || s.behindLocalProxy() {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// behindLocalProxy reports whether TrustedProxies lists a loopback address. Invalid
+// entries count as one, as the proxies are then unknown.
+func (s *server) behindLocalProxy() bool {
+	proxies, err := parseTrustedProxies(s.cfg.TrustedProxies)
+	if err != nil {
+		return true
+	}
+	for _, prefix := range proxies {
+		if prefix.Addr().IsLoopback() || prefix.Contains(netip.AddrFrom4([4]byte{127, 0, 0, 1})) || prefix.Contains(netip.IPv6Loopback()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,28 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// openDirectFile opens path with O_DIRECT, so reads and writes bypass the page cache.
+// They must then use aligned buffers, offsets and lengths.
+func openDirectFile(path string, flag int, perm os.FileMode) (*os.File, error) {
+	fd, err := syscall.Open(path, flag|syscall.O_DIRECT|syscall.O_CLOEXEC, uint32(perm))
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// alignedBuffer returns size bytes of anonymous memory, which is page-aligned.
+// It must be released with freeAlignedBuffer.
+func alignedBuffer(size int) ([]byte, error) {
+	return syscall.Mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+}
+
+func freeAlignedBuffer(buf []byte) {
+	syscall.Munmap(buf)
+}
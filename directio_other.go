@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var errDirectIOUnsupported = errors.New("direct I/O is only supported on Linux")
+
+func openDirectFile(path string, flag int, perm os.FileMode) (*os.File, error) {
+	return nil, &os.PathError{Op: "open", Path: path, Err: errDirectIOUnsupported}
+}
+
+// alignedBuffer returns a plain buffer: without direct I/O, alignment does not matter.
+func alignedBuffer(size int) ([]byte, error) {
+	return make([]byte, size), nil
+}
+
+func freeAlignedBuffer(buf []byte) {}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Keys are compared as bytes, so "10" sorts before "9". The encodings below
+// produce fixed-width big-endian keys whose byte order matches numeric order.
+
+func EncodeUint64(v uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, v)
+}
+
+func DecodeUint64(b []byte) (uint64, error) {
+	if len(b) != 8 {
+		return 0, fmt.Errorf("encoded uint64 must be 8 bytes, got %d", len(b))
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// EncodeInt64 offsets v by MinInt64 so that negative values sort before positive ones.
+func EncodeInt64(v int64) []byte {
+	return EncodeUint64(uint64(v) ^ (1 << 63))
+}
+
+func DecodeInt64(b []byte) (int64, error) {
+	u, err := DecodeUint64(b)
+	if err != nil {
+		return 0, err
+	}
+	return int64(u ^ (1 << 63)), nil
+}
+
+// EncodeTimestamp encodes t with nanosecond precision.
+func EncodeTimestamp(t time.Time) []byte {
+	return EncodeInt64(t.UnixNano())
+}
+
+func DecodeTimestamp(b []byte) (time.Time, error) {
+	nanos, err := DecodeInt64(b)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, nanos), nil
+}
+
+// encodeKey converts a textual key to the binary form selected by the
+// ?encoding= parameter: "uint64", "int64" or "timestamp" (RFC 3339).
+// An empty encoding leaves the key unchanged.
+func encodeKey(encoding string, key []byte) ([]byte, error) {
+	switch encoding {
+	case "":
+		return key, nil
+	case "uint64":
+		v, err := strconv.ParseUint(string(key), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("key is not a uint64: %w", err)
+		}
+		return EncodeUint64(v), nil
+	case "int64":
+		v, err := strconv.ParseInt(string(key), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("key is not an int64: %w", err)
+		}
+		return EncodeInt64(v), nil
+	case "timestamp":
+		t, err := time.Parse(time.RFC3339Nano, string(key))
+		if err != nil {
+			return nil, fmt.Errorf("key is not an RFC 3339 timestamp: %w", err)
+		}
+		return EncodeTimestamp(t), nil
+	default:
+		return nil, fmt.Errorf("unknown key encoding %q", encoding)
+	}
+}
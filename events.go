@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"sync"
+)
+
+// ChangeEvent describes a write to a key.
+type ChangeEvent struct {
+	Op    string `json:"op"` // "set", "del" or "merge"
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// WatchEvent describes a write to a watched key. SequenceNumber orders the events
+// published by a database.
+type WatchEvent struct {
+	Op  Operation
+	Key []byte
+	// OldValue is the value of the key before the write. Del looks it up like Get; writes
+	// only check the memtable, so it is nil for a key whose value is in the SST files alone.
+	OldValue       []byte
+	NewValue       []byte
+	SequenceNumber uint64
+}
+
+// eventBufferSize is how many events a subscriber may fall behind before
+// further events are dropped for it.
+const eventBufferSize = 64
+
+// ChangeEventBus fans key changes out to subscribers.
+type ChangeEventBus struct {
+	mu          sync.Mutex
+	subscribers map[*eventSubscription]struct{}
+	seq         uint64 // Sequence number of the last published event
+}
+
+// eventSubscription receives the events of keys starting with prefix, with the
+// prefix removed. A non-nil key limits it to that single key. Watch subscriptions
+// receive WatchEvents on watch instead of ChangeEvents on events.
+type eventSubscription struct {
+	prefix []byte
+	key    []byte
+	events chan ChangeEvent
+	watch  chan WatchEvent
+	done   chan struct{} // Closed when a watch subscription ends
+}
+
+func NewChangeEventBus() *ChangeEventBus {
+	return &ChangeEventBus{subscribers: make(map[*eventSubscription]struct{})}
+}
+
+// subscribe returns a channel of matching events and a function that ends the subscription.
+func (b *ChangeEventBus) subscribe(prefix, key []byte) (<-chan ChangeEvent, func()) {
+	sub := &eventSubscription{prefix: prefix, key: key, events: make(chan ChangeEvent, eventBufferSize)}
+
+	b.mu.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return sub.events, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers, sub)
+			b.mu.Unlock()
+		})
+	}
+}
+
+// watch subscribes to the WatchEvents of key. The subscription lasts until unwatch is called.
+func (b *ChangeEventBus) watch(key []byte) *eventSubscription {
+	sub := &eventSubscription{key: bytes.Clone(key), watch: make(chan WatchEvent, eventBufferSize), done: make(chan struct{})}
+
+	b.mu.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.mu.Unlock()
+	return sub
+}
+
+// unwatch ends the watch subscription delivering to events and closes the channel.
+// Publish sends while holding the lock, so nothing sends on the closed channel.
+func (b *ChangeEventBus) unwatch(events <-chan WatchEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subscribers {
+		if sub.watch != nil && sub.watch == events {
+			delete(b.subscribers, sub)
+			close(sub.watch)
+			close(sub.done)
+			return
+		}
+	}
+}
+
+// Publish delivers an event to every matching subscriber without blocking.
+// oldValue is the value key held before the write, as far as the writer knows it; see
+// WatchEvent.OldValue. A nil bus has no subscribers.
+func (b *ChangeEventBus) Publish(op Operation, key, oldValue, value []byte) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	for sub := range b.subscribers {
+		if !bytes.HasPrefix(key, sub.prefix) {
+			continue
+		}
+		subKey := key[len(sub.prefix):]
+		if sub.key != nil && !bytes.Equal(subKey, sub.key) {
+			continue
+		}
+		if sub.watch != nil {
+			event := WatchEvent{Op: op, Key: bytes.Clone(key), OldValue: bytes.Clone(oldValue), NewValue: bytes.Clone(value), SequenceNumber: b.seq}
+			select {
+			case sub.watch <- event:
+			default:
+				logger.Warn("dropping watch event for slow watcher", "key", string(key))
+			}
+			continue
+		}
+		select {
+		case sub.events <- ChangeEvent{Op: changeEventOp(op), Key: string(subKey), Value: string(value)}:
+		default:
+			logger.Warn("dropping change event for slow subscriber", "key", string(key))
+		}
+	}
+}
+
+// changeEventOp returns the name of op used in ChangeEvents.
+func changeEventOp(op Operation) string {
+	switch op {
+	case Delete:
+		return "del"
+	case Merge:
+		return "merge"
+	default:
+		return "set"
+	}
+}
+
+// Subscribe streams the changes of key, or of every key when key is nil.
+func (mem *memDB) Subscribe(key []byte) (<-chan ChangeEvent, func()) {
+	return mem.events.subscribe(nil, key)
+}
+
+// Subscribe streams the changes of key inside the namespace, or of every key
+// in the namespace when key is nil.
+func (ns *NamespacedDB) Subscribe(key []byte) (<-chan ChangeEvent, func()) {
+	return ns.db.events.subscribe(ns.prefix, key)
+}
+
+// Watch streams the writes to key until ctx is done or Unwatch is called, and
+// then closes the channel. Every watcher receives its own copy of each event.
+func (mem *memDB) Watch(ctx context.Context, key []byte) <-chan WatchEvent {
+	sub := mem.events.watch(key)
+	go func() {
+		select {
+		case <-ctx.Done():
+			mem.events.unwatch(sub.watch)
+		case <-sub.done:
+		}
+	}()
+	return sub.watch
+}
+
+// Unwatch ends a watch started by Watch and closes its channel.
+func (mem *memDB) Unwatch(events <-chan WatchEvent) {
+	mem.events.unwatch(events)
+}
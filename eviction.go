@@ -0,0 +1,58 @@
+package main
+
+// flushIfFull flushes the memtable once it reaches one of its limits. Past
+// cfg.SoftMemoryLimit, the oldest cfg.EvictionBatchSize entries are evicted to an SST file
+// first and the whole memtable is only flushed if that does not bring it back under the limit.
+// The caller must hold mem.mu.
+func (mem *memDB) flushIfFull(size int64) {
+	if limit := mem.cfg.SoftMemoryLimit; limit > 0 && size > limit {
+		mem.evictOldest(mem.cfg.EvictionBatchSize)
+		if size = mem.size.Load(); size > limit {
+			if err := mem.createSSTFile(); err != nil {
+				logger.Error("error flushing memtable", "error", err)
+			}
+			return
+		}
+	}
+	if mem.memtableFull(size) {
+		if err := mem.createSSTFile(); err != nil {
+			logger.Error("error flushing memtable", "error", err)
+		}
+	}
+}
+
+// EvictOldest writes the n memtable entries whose last write is oldest to
+// an SST file of their own and removes them from the memtable. It returns how many it
+// removed. Evicted keys are then read from the SST files, with the value they had in the
+// memtable.
+func (mem *memDB) EvictOldest(n int) int {
+	if mem.readOnly {
+		return 0
+	}
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	if mem.closed {
+		return 0
+	}
+	mem.awaitPendingWrites()
+	return mem.evictOldest(n)
+}
+
+// evictOldest implements EvictOldest. Nothing is evicted if the SST file cannot be written.
+// The caller must hold mem.mu.
+func (mem *memDB) evictOldest(n int) int {
+	n = min(n, len(mem.data))
+	if n == 0 {
+		return 0
+	}
+	evicted := append([]KeyValue(nil), mem.data[:n]...)
+	if _, err := mem.writeEntriesSST(evicted, nil); err != nil {
+		logger.Error("error writing evicted memtable entries", "error", err)
+		return 0
+	}
+	for _, kv := range evicted {
+		mem.size.Add(-entrySize(kv))
+	}
+	mem.data = append(mem.data[:0], mem.data[n:]...)
+	return n
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// filterCacheSize is the number of SST files whose filter blocks are kept in memory.
+const filterCacheSize = 1024
+
+// FilterBlock is the bloom filter over the keys of an SST file. Files of version 5 and
+// later store it between the header and the entries, so a point lookup reads it first
+// and only reads the entries when the key may be in the file.
+type FilterBlock struct {
+	HashFuncName string
+	filter       *BloomFilter
+}
+
+// NewFilterBlock sizes a filter for expectedKeys keys with the given false positive rate,
+// hashing keys with the hash function named hashFuncName.
+func NewFilterBlock(expectedKeys int, falsePositiveRate float64, hashFuncName string) (*FilterBlock, error) {
+	hash, err := NewHashFunc(hashFuncName)
+	if err != nil {
+		return nil, err
+	}
+	return &FilterBlock{
+		HashFuncName: hashFuncName,
+		filter:       NewBloomFilter(expectedKeys, falsePositiveRate, hash),
+	}, nil
+}
+
+// newSSTFilter returns the filter block for a file of expectedKeys keys written with cfg.
+// Settings that are unset or invalid fall back to the defaults, as in NewMemDBWithConfig.
+func newSSTFilter(expectedKeys int, cfg DBConfig) *FilterBlock {
+	defaults := DefaultDBConfig()
+	rate, hashFuncName := cfg.BloomFalsePositiveRate, cfg.HashFuncName
+	if rate <= 0 || rate >= 1 {
+		rate = defaults.BloomFalsePositiveRate
+	}
+	if _, err := NewHashFunc(hashFuncName); err != nil {
+		hashFuncName = defaults.HashFuncName
+	}
+	filter, _ := NewFilterBlock(expectedKeys, rate, hashFuncName)
+	return filter
+}
+
+func (b *FilterBlock) Add(key []byte) {
+	b.filter.Add(key)
+}
+
+// MayContain reports whether key may be in the file. A nil block, as read from files
+// without one, may contain every key.
+func (b *FilterBlock) MayContain(key []byte) bool {
+	if b == nil {
+		return true
+	}
+	return b.filter.MayContain(key)
+}
+
+// serializedSize returns the length of what Serialize returns.
+func (b *FilterBlock) serializedSize() int {
+	return 2 + len(b.HashFuncName) + 8*len(b.filter.bits) + 4
+}
+
+// Serialize returns the number of hashes, the length-prefixed hash function name, the bits
+// of the filter and a CRC-32 of all of them, with the words and checksum in the given byte
+// order. Its size only depends on the expected keys and false positive rate the block was
+// created with.
+func (b *FilterBlock) Serialize(order appendByteOrder) []byte {
+	data := make([]byte, 0, b.serializedSize())
+	data = append(data, uint8(b.filter.hashes), uint8(len(b.HashFuncName)))
+	data = append(data, b.HashFuncName...)
+	for _, word := range b.filter.bits {
+		data = order.AppendUint64(data, word)
+	}
+	return order.AppendUint32(data, crc32.ChecksumIEEE(data))
+}
+
+// Deserialize replaces the block with the one Serialize returned as data in the given byte order.
+func (b *FilterBlock) Deserialize(data []byte, order binary.ByteOrder) error {
+	if len(data) < 6 {
+		return fmt.Errorf("%w: filter block of %d bytes", ErrInvalidSSTFormat, len(data))
+	}
+	sum := len(data) - 4
+	if crc32.ChecksumIEEE(data[:sum]) != order.Uint32(data[sum:]) {
+		return fmt.Errorf("%w: filter block", ErrChecksumMismatch)
+	}
+	hashes, nameLen := int(data[0]), int(data[1])
+	words := data[2:sum]
+	if hashes == 0 || len(words) < nameLen || (len(words)-nameLen)%8 != 0 || len(words) == nameLen {
+		return fmt.Errorf("%w: malformed filter block", ErrInvalidSSTFormat)
+	}
+	name := string(words[:nameLen])
+	hash, err := NewHashFunc(name)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSSTFormat, err)
+	}
+
+	words = words[nameLen:]
+	bits := make([]uint64, len(words)/8)
+	for i := range bits {
+		bits[i] = order.Uint64(words[8*i:])
+	}
+	b.HashFuncName = name
+	b.filter = &BloomFilter{bits: bits, hashes: hashes, hash: hash}
+	return nil
+}
+
+// readSSTFilter returns the filter block of an SST file, or nil for files written before
+// version 5. With integrityKey the HMAC, which covers the block, is checked first, as a
+// forged block with a valid checksum could hide keys; without one, the block's checksum
+// only catches corruption.
+func readSSTFilter(file sstSource, integrityKey []byte) (*FilterBlock, error) {
+	header, err := readSSTHeader(file)
+	if err != nil {
+		return nil, err
+	}
+	if header.formatVersion() < 5 {
+		return nil, nil
+	}
+	footer, err := readSSTFooter(file, header, sstTrailerSize(integrityKey))
+	if err != nil {
+		return nil, err
+	}
+	if integrityKey != nil {
+		if err := verifySSTHMAC(file, footer, integrityKey); err != nil {
+			return nil, err
+		}
+	}
+	data := make([]byte, footer.dataOffset-footer.filterOffset-4)
+	if _, err := file.ReadAt(data, footer.filterOffset+4); err != nil {
+		return nil, fmt.Errorf("error reading filter block: %w", unexpectedEOF(err))
+	}
+	filter := new(FilterBlock)
+	if err := filter.Deserialize(data, header.byteOrder()); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// sstMayContain reports whether the SST file may hold key, according to its filter block.
+// Filter blocks are cached. Files whose filter cannot be read may contain every key, so
+// the lookup reads the file and reports the error.
+func (mem *memDB) sstMayContain(fileName string, key []byte) bool {
+	if mem.filters == nil {
+		return true
+	}
+	if cached, ok := mem.filters.Get(fileName); ok {
+		return cached.(*FilterBlock).MayContain(key)
+	}
+
+	file, closeFile, err := openSSTSource(fileName, false, 0)
+	if err != nil {
+		return true
+	}
+	defer closeFile()
+	filter, err := readSSTFilter(file, mem.cfg.IntegrityKey)
+	if err != nil {
+		logger.Warn("error reading SST filter block", "file", fileName, "error", err)
+		return true
+	}
+	mem.filters.Put(fileName, filter)
+	return filter.MayContain(key)
+}
@@ -0,0 +1,71 @@
+//go:build !race
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func FuzzWALReplay(f *testing.F) {
+	// Seed the corpus with the records written by TestBasicOperations
+	walPath := filepath.Join(f.TempDir(), "seed_wal.log")
+	wal, err := NewWriteAheadLog(walPath)
+	if err != nil {
+		f.Fatal(err)
+	}
+	entry := KeyValue{Key: []byte("test_key"), Value: []byte("test_value")}
+	if err := wal.AppendEntry(Set, entry); err != nil {
+		f.Fatal(err)
+	}
+	if err := wal.AppendEntry(Delete, entry); err != nil {
+		f.Fatal(err)
+	}
+	wal.Close()
+
+	seed, err := os.ReadFile(walPath)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(seed)
+	f.Add(seed[:len(seed)/2])
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		entries, _ := readWALEntries(bytes.NewReader(data))
+		for _, kv := range entries {
+			if kv.Operation > BatchCommit {
+				t.Errorf("Replay returned invalid operation %d", kv.Operation)
+			}
+		}
+	})
+}
+
+func FuzzSSTLoad(f *testing.F) {
+	seedPath := filepath.Join(f.TempDir(), "seed.sst")
+	data := []KeyValue{
+		{Key: []byte("key1"), Value: []byte("value1")},
+		{Key: []byte("key2"), Value: []byte("value2")},
+	}
+	if err := writeSSTFile(seedPath, data); err != nil {
+		f.Fatal(err)
+	}
+	seed, err := os.ReadFile(seedPath)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(seed)
+	f.Add(seed[:headerSize])
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, contents []byte) {
+		fileName := filepath.Join(t.TempDir(), "fuzz.sst")
+		if err := os.WriteFile(fileName, contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+		readSSTEntries(fileName)
+		ReadSSTProperties(fileName, nil)
+	})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// valueBufferPool holds buffers for GetInto, so callers reading many values can
+// reuse them instead of allocating one per read.
+var valueBufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// AcquireValueBuffer returns an empty buffer from the pool.
+func AcquireValueBuffer() *bytes.Buffer {
+	buf := valueBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// ReleaseValueBuffer returns buf to the pool once nothing refers to its contents anymore.
+func ReleaseValueBuffer(buf *bytes.Buffer) {
+	valueBufferPool.Put(buf)
+}
+
+// GetInto copies the value of key into dst, replacing its contents. The copy is made
+// under the lock, so the value stays valid while the memtable changes.
+func (mem *memDB) GetInto(key []byte, dst *bytes.Buffer) error {
+	defer mem.lockRead()()
+
+	dst.Reset()
+	value, err := mem.getLocked(mem.transformKey(key))
+	if err != nil {
+		return err
+	}
+	dst.Write(value)
+	return nil
+}
+
+// GetBytes copies the value of key into buf[:0] and returns it, growing buf as append
+// does. Reading a memtable value into a buffer that is large enough does not allocate.
+func (mem *memDB) GetBytes(key []byte, buf []byte) ([]byte, error) {
+	defer mem.lockRead()()
+
+	value, err := mem.getLocked(mem.transformKey(key))
+	if err != nil {
+		return buf[:0], err
+	}
+	return append(buf[:0], value...), nil
+}
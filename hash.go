@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math/bits"
+)
+
+// HashFunc maps data to a 64-bit hash. The bloom filter, the access frequency
+// sketch and the shard ring derive all their hash values from one HashFunc.
+type HashFunc func(data []byte) uint64
+
+// hashFuncs holds the hash functions DBConfig.HashFuncName may name.
+var hashFuncs = map[string]HashFunc{
+	"fnv64":      fnv64,
+	"xxhash64":   xxhash64,
+	"murmur3_64": murmur3x64,
+}
+
+// NewHashFunc returns the hash function registered under name.
+func NewHashFunc(name string) (HashFunc, error) {
+	hash, ok := hashFuncs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash function %q", name)
+	}
+	return hash, nil
+}
+
+// splitHash derives the two hashes of Kirsch-Mitzenmacher double hashing from a
+// 64-bit hash; the i-th hash of a key is h1 + i*h2. h2 is odd so it never stays on one slot.
+func splitHash(h uint64) (uint64, uint64) {
+	return h & 0xffffffff, h>>32 | 1
+}
+
+func fnv64(data []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64()
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// xxhash64 is XXH64 with seed 0.
+func xxhash64(data []byte) uint64 {
+	n := len(data)
+	var h uint64
+	if n >= 32 {
+		v3 := uint64(0) // The seed; the lanes start at offsets from it that wrap around
+		v1 := v3 + xxPrime1 + xxPrime2
+		v2 := v3 + xxPrime2
+		v4 := v3 - xxPrime1
+		for len(data) >= 32 {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(data))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(data[8:]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(data[16:]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(data[24:]))
+			data = data[32:]
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) + bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxMergeRound(h, v1)
+		h = xxMergeRound(h, v2)
+		h = xxMergeRound(h, v3)
+		h = xxMergeRound(h, v4)
+	} else {
+		h = xxPrime5
+	}
+	h += uint64(n)
+
+	for ; len(data) >= 8; data = data[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(data))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(data) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(data)) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		data = data[4:]
+	}
+	for _, b := range data {
+		h ^= uint64(b) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
+
+func xxRound(acc, lane uint64) uint64 {
+	acc += lane * xxPrime2
+	return bits.RotateLeft64(acc, 31) * xxPrime1
+}
+
+func xxMergeRound(acc, val uint64) uint64 {
+	acc ^= xxRound(0, val)
+	return acc*xxPrime1 + xxPrime4
+}
+
+const (
+	murmurC1 uint64 = 0x87c37b91114253d5
+	murmurC2 uint64 = 0x4cf5ad432745937f
+)
+
+// murmur3x64 returns the first half of MurmurHash3 x64_128 with seed 0.
+func murmur3x64(data []byte) uint64 {
+	n := len(data)
+	var h1, h2 uint64
+	for ; len(data) >= 16; data = data[16:] {
+		k1 := binary.LittleEndian.Uint64(data)
+		k2 := binary.LittleEndian.Uint64(data[8:])
+
+		h1 ^= murmurMixK1(k1)
+		h1 = bits.RotateLeft64(h1, 27) + h2
+		h1 = h1*5 + 0x52dce729
+
+		h2 ^= murmurMixK2(k2)
+		h2 = bits.RotateLeft64(h2, 31) + h1
+		h2 = h2*5 + 0x38495ab5
+	}
+
+	var k1, k2 uint64
+	for i := len(data) - 1; i >= 8; i-- {
+		k2 = k2<<8 | uint64(data[i])
+	}
+	for i := min(len(data), 8) - 1; i >= 0; i-- {
+		k1 = k1<<8 | uint64(data[i])
+	}
+	if len(data) > 8 {
+		h2 ^= murmurMixK2(k2)
+	}
+	if len(data) > 0 {
+		h1 ^= murmurMixK1(k1)
+	}
+
+	h1 ^= uint64(n)
+	h2 ^= uint64(n)
+	h1 += h2
+	h2 += h1
+	h1 = murmurFmix64(h1)
+	h2 = murmurFmix64(h2)
+	return h1 + h2
+}
+
+func murmurMixK1(k uint64) uint64 {
+	return bits.RotateLeft64(k*murmurC1, 31) * murmurC2
+}
+
+func murmurMixK2(k uint64) uint64 {
+	return bits.RotateLeft64(k*murmurC2, 33) * murmurC1
+}
+
+func murmurFmix64(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
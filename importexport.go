@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const importChunkSize = 1000 // Entries /import writes per BatchSet
+
+// exportRecord is a line of the format Export writes and /import reads. Keys and values are
+// base64 encoded; the expiry time and the tags are left out for entries without them.
+type exportRecord struct {
+	Key       []byte            `json:"key"`
+	Value     []byte            `json:"value"`
+	ExpiresAt int64             `json:"expires_at,omitempty"` // Unix time in nanoseconds
+	Tags      map[string]string `json:"tags,omitempty"`
+}
+
+func newExportRecord(kv KeyValue) exportRecord {
+	return exportRecord{Key: kv.Key, Value: kv.Value, ExpiresAt: kv.ExpiresAt, Tags: kv.Tags}
+}
+
+func (rec exportRecord) entry() KeyValue {
+	return KeyValue{Key: rec.Key, Value: rec.Value, Operation: Set, ExpiresAt: rec.ExpiresAt, Tags: rec.Tags}
+}
+
+// BatchSet writes the entries as one WriteBatch, with their tags and expiry times.
+func (mem *memDB) BatchSet(entries []KeyValue) error {
+	batch := mem.NewWriteBatch()
+	for _, kv := range entries {
+		batch.setEntry(kv)
+	}
+	return batch.Commit()
+}
+
+// Export calls fn with every live entry of the database in key order. The manifest and the
+// memtable are captured together under the lock, with the SST files opened then, and the
+// entries are streamed from them by an exportIterator. Deleted and expired keys are left out
+// and merge operands are resolved. fn is called without holding the database lock and may
+// keep the entries.
+func (mem *memDB) Export(fn func(KeyValue) error) error {
+	it, err := mem.newExportIterator()
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	for it.Next() {
+		if err := fn(it.Entry()); err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+// newExportIterator opens the SST files of the manifest and copies the memtable, holding
+// compactionMu and mem.mu so no file is removed or moved before it is open. A file listed in
+// the manifest that cannot be opened fails the export.
+func (mem *memDB) newExportIterator() (*exportIterator, error) {
+	mem.compactionMu.Lock()
+	defer mem.compactionMu.Unlock()
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	if mem.closed {
+		return nil, ErrDatabaseClosed
+	}
+	mem.awaitPendingWrites()
+
+	files, err := ReadManifest(mem.cfg.DataDir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].SequenceNumber < files[j].SequenceNumber
+	})
+	it := &exportIterator{mem: mem, now: time.Now()}
+	for _, file := range files {
+		f, err := os.Open(filepath.Join(mem.cfg.DataDir, file.FileName))
+		if err != nil {
+			it.Close()
+			return nil, fmt.Errorf("error opening %s: %w", file.FileName, err)
+		}
+		it.files = append(it.files, f)
+		it.names = append(it.names, file.FileName)
+	}
+
+	// The tombstones go first, so a key written again after its delete was flushed is kept
+	snapshot := make([]KeyValue, 0, len(mem.tombstones)+len(mem.data))
+	snapshot = append(snapshot, mem.tombstones...)
+	for _, kv := range mem.data {
+		kv, err := kv.decompressed()
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		kv.Key = bytes.Clone(kv.Key)
+		kv.Value = bytes.Clone(kv.Value)
+		kv.Tags = maps.Clone(kv.Tags)
+		snapshot = append(snapshot, kv)
+	}
+	sort.SliceStable(snapshot, func(i, j int) bool {
+		return bytes.Compare(snapshot[i].Key, snapshot[j].Key) < 0
+	})
+	it.memtable = snapshot
+	return it, nil
+}
+
+// exportIterator merges the SST files opened by newExportIterator, oldest first, and the
+// memtable snapshot into the live entries in key order, holding only the current entry of
+// every input. Versions of a key are folded the way mergeSSTFiles folds them.
+type exportIterator struct {
+	mem      *memDB
+	files    []*os.File // Opened under the lock, turned into inputs by the first Next
+	names    []string   // Manifest names of the files, for errors
+	memtable []KeyValue
+	inputs   []compactionInput
+	entries  mergeHeap
+	entry    KeyValue
+	now      time.Time
+	started  bool
+	err      error
+}
+
+// start opens an input per file, and one for the memtable after them.
+func (it *exportIterator) start() error {
+	it.started = true
+	for i, file := range it.files {
+		source, closeFile, err := sstSourceOf(file)
+		it.files[i] = nil // The input owns it now
+		if err == nil {
+			var input *sstIterator
+			if input, err = openSSTIterator(source, it.mem.cfg.IntegrityKey); err == nil {
+				input.closeFile = closeFile
+				it.inputs = append(it.inputs, input)
+				continue
+			}
+			closeFile()
+		}
+		return fmt.Errorf("error reading %s: %w", it.names[i], err)
+	}
+	it.names = append(it.names, "memtable")
+	it.inputs = append(it.inputs, &sliceInput{entries: it.memtable, pos: -1})
+	for i := range it.inputs {
+		if err := it.advance(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// advance moves input i to its next entry.
+func (it *exportIterator) advance(i int) error {
+	if it.inputs[i].Next() {
+		heap.Push(&it.entries, mergeItem{kv: it.inputs[i].Entry(), source: i})
+		return nil
+	}
+	if err := it.inputs[i].Err(); err != nil {
+		return fmt.Errorf("error reading %s: %w", it.names[i], err)
+	}
+	return nil
+}
+
+func (it *exportIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if !it.started {
+		if it.err = it.start(); it.err != nil {
+			return false
+		}
+	}
+	op := it.mem.cfg.MergeOperator
+	for it.entries.Len() > 0 {
+		item := heap.Pop(&it.entries).(mergeItem)
+		if it.err = it.advance(item.source); it.err != nil {
+			return false
+		}
+		kv := item.kv
+		for it.entries.Len() > 0 && bytes.Equal(it.entries[0].kv.Key, kv.Key) {
+			newer := heap.Pop(&it.entries).(mergeItem)
+			if it.err = it.advance(newer.source); it.err != nil {
+				return false
+			}
+			if op != nil && newer.kv.Operation == Merge {
+				switch {
+				case kv.Operation == Merge:
+					newer.kv.Value = op.PartialMerge(kv.Key, kv.Value, newer.kv.Value)
+				case kv.Operation == Set && !kv.expired(it.now):
+					newer.kv = KeyValue{Key: kv.Key, Value: op.FullMerge(kv.Key, kv.Value, [][]byte{newer.kv.Value}), Operation: Set, Tags: kv.Tags}
+				}
+			}
+			kv = newer.kv
+		}
+
+		switch {
+		case kv.Operation == Delete, kv.Operation == BatchBegin, kv.Operation == BatchCommit:
+			continue
+		case kv.expired(it.now):
+			continue
+		case kv.Operation == Merge && op != nil:
+			kv.Value = op.FullMerge(kv.Key, nil, [][]byte{kv.Value})
+		}
+		it.entry = KeyValue{Key: kv.Key, Value: kv.Value, Operation: Set, ExpiresAt: kv.ExpiresAt, Tags: kv.Tags}
+		return true
+	}
+	return false
+}
+
+// Entry returns the current entry, with merge operands resolved into a Set. Its expiry
+// time and tags are those of the newest version.
+func (it *exportIterator) Entry() KeyValue {
+	return it.entry
+}
+
+// Err returns the error that ended the iteration early, if any.
+func (it *exportIterator) Err() error {
+	return it.err
+}
+
+// Close closes the files and inputs still open.
+func (it *exportIterator) Close() error {
+	for _, file := range it.files {
+		if file != nil {
+			file.Close()
+		}
+	}
+	for _, input := range it.inputs {
+		input.Close()
+	}
+	return nil
+}
+
+// sliceInput streams sorted entries held in memory as a compactionInput.
+type sliceInput struct {
+	entries []KeyValue
+	pos     int
+}
+
+func (in *sliceInput) Next() bool {
+	if in.pos < len(in.entries) {
+		in.pos++
+	}
+	return in.pos < len(in.entries)
+}
+
+func (in *sliceInput) Entry() KeyValue { return in.entries[in.pos] }
+
+func (in *sliceInput) Err() error { return nil }
+
+func (in *sliceInput) Close() error { return nil }
+
+// ExportStream writes every live entry to w in the format /import reads, one exportRecord
+// per line in key order, without compression.
+// Nothing is staged on disk, so w can be a network connection. Entries are collected the
+// way Export does, and ctx is checked before each one is written.
+func (mem *memDB) ExportStream(ctx context.Context, w io.Writer) error {
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+	err := mem.Export(func(kv KeyValue) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return encoder.Encode(newExportRecord(kv))
+	})
+	if err != nil {
+		return fmt.Errorf("error exporting entries: %w", err)
+	}
+	return buffered.Flush()
+}
+
+// ImportStream writes the entries ExportStream wrote to r with BatchSet, in chunks of
+// importChunkSize. Unlike /import, a record that cannot be decoded fails the import;
+// the chunks written before it are kept.
+func (mem *memDB) ImportStream(ctx context.Context, r io.Reader) error {
+	chunk := make([]KeyValue, 0, importChunkSize)
+	writeChunk := func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := mem.BatchSet(chunk); err != nil {
+			return fmt.Errorf("error importing entries: %w", err)
+		}
+		chunk = chunk[:0]
+		return nil
+	}
+
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("error reading line %d: %w", line, err)
+		}
+		if record := bytes.TrimSpace(data); len(record) > 0 {
+			var rec exportRecord
+			if err := json.Unmarshal(record, &rec); err != nil {
+				return fmt.Errorf("error decoding line %d: %w", line, err)
+			}
+			if len(rec.Key) == 0 {
+				return fmt.Errorf("error decoding line %d: key is required", line)
+			}
+			chunk = append(chunk, rec.entry())
+		}
+		if len(chunk) == importChunkSize || (err == io.EOF && len(chunk) > 0) {
+			if err := writeChunk(); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+func (ns *NamespacedDB) BatchSet(entries []KeyValue) error {
+	prefixed := make([]KeyValue, len(entries))
+	for i, kv := range entries {
+		prefixed[i] = KeyValue{Key: ns.key(kv.Key), Value: kv.Value, Operation: Set, ExpiresAt: kv.ExpiresAt, Tags: kv.Tags}
+	}
+	return ns.db.BatchSet(prefixed)
+}
+
+// Export calls fn with every live entry of the namespace, with the prefix removed.
+func (ns *NamespacedDB) Export(fn func(KeyValue) error) error {
+	return ns.db.Export(func(kv KeyValue) error {
+		if !bytes.HasPrefix(kv.Key, ns.prefix) {
+			return nil
+		}
+		kv.Key = kv.Key[len(ns.prefix):]
+		return fn(kv)
+	})
+}
+
+// BatchSet writes the entries of each shard as one WriteBatch. The batches of different
+// shards are committed one after the other, so a failure may leave earlier shards written.
+func (s *ShardedDB) BatchSet(entries []KeyValue) error {
+	batches := make(map[*memDB][]KeyValue)
+	for _, kv := range entries {
+		shard := s.shardFor(kv.Key)
+		batches[shard] = append(batches[shard], kv)
+	}
+	for i, shard := range s.shards {
+		if err := shard.BatchSet(batches[shard]); err != nil {
+			return fmt.Errorf("error writing batch to shard %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Export calls fn with the live entries of every shard, shard by shard. Keys are in order
+// within a shard only.
+func (s *ShardedDB) Export(fn func(KeyValue) error) error {
+	for i, shard := range s.shards {
+		if err := shard.Export(fn); err != nil {
+			return fmt.Errorf("error exporting shard %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// handleImport bulk loads the gzip-compressed file in the "file" field of a multipart form.
+// The file holds one exportRecord per line, written with BatchSet in chunks of
+// importChunkSize, so expiry times and tags are kept. The progress is streamed as one JSON object per line,
+// {"processed": n, "total": -1}, as the uncompressed size is not known upfront. A record that
+// cannot be decoded is reported as {"line": n, "error": "..."} and skipped. The stream ends
+// with {"done": true, "processed": n, "skipped": m} or {"error": "..."}.
+func (s *server) handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	file, err := multipartFile(r, "file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	gzReader, err := gzip.NewReader(file)
+	if err != nil {
+		http.Error(w, "file is not gzip-compressed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer gzReader.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	storage := s.storage(r)
+	processed, skipped := 0, 0
+	chunk := make([]KeyValue, 0, importChunkSize)
+	writeChunk := func() error {
+		if err := storage.BatchSet(chunk); err != nil {
+			return err
+		}
+		processed += len(chunk)
+		chunk = chunk[:0]
+		_ = encoder.Encode(map[string]int{"processed": processed, "total": -1})
+		flusher.Flush()
+		return nil
+	}
+
+	reader := bufio.NewReader(gzReader)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			_ = encoder.Encode(map[string]string{"error": fmt.Sprintf("error reading line %d: %s", line, err)})
+			return
+		}
+		if record := bytes.TrimSpace(data); len(record) > 0 {
+			var rec exportRecord
+			if decodeErr := json.Unmarshal(record, &rec); decodeErr != nil || len(rec.Key) == 0 {
+				if decodeErr == nil {
+					decodeErr = errors.New("key is required")
+				}
+				_ = encoder.Encode(map[string]interface{}{"line": line, "error": decodeErr.Error()})
+				skipped++
+			} else {
+				chunk = append(chunk, rec.entry())
+			}
+		}
+		if len(chunk) == importChunkSize || (err == io.EOF && len(chunk) > 0) {
+			if err := writeChunk(); err != nil {
+				_ = encoder.Encode(map[string]string{"error": err.Error()})
+				return
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	_ = encoder.Encode(map[string]interface{}{"done": true, "processed": processed, "skipped": skipped})
+}
+
+// multipartFile returns the content of the field called name of a multipart form, without
+// buffering the parts before it.
+func multipartFile(r *http.Request, name string) (io.Reader, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, fmt.Errorf("missing %q field", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == name {
+			return part, nil
+		}
+	}
+}
+
+// handleExport streams every live key-value pair as a gzip-compressed file in the format
+// /import reads. An error after the response started cuts the stream short, which the
+// client sees as a truncated gzip file.
+func (s *server) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if format := r.URL.Query().Get("format"); format != "" && format != "json.gz" {
+		http.Error(w, "unsupported format: "+format, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="export.json.gz"`)
+	w.WriteHeader(http.StatusOK)
+	gzWriter := gzip.NewWriter(w)
+	encoder := json.NewEncoder(gzWriter)
+	err := s.storage(r).Export(func(kv KeyValue) error {
+		return encoder.Encode(newExportRecord(kv))
+	})
+	if err != nil {
+		logger.Error("error exporting key-value pairs", "error", err)
+		return
+	}
+	if err := gzWriter.Close(); err != nil {
+		logger.Error("error exporting key-value pairs", "error", err)
+	}
+}
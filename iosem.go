@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ioYieldCheckInterval is the time between checks of a compaction for waiting reads.
+const ioYieldCheckInterval = 100 * time.Millisecond
+
+// IOSemaphore gives foreground SST reads priority over compaction. Reads and compactions
+// take tokens from separate pools, so reads beyond the read pool queue without blocking
+// compactions. A compaction that sees queued reads gives its write token back for up to
+// YieldDuration, so the disk serves the reads first. A nil IOSemaphore admits everything.
+type IOSemaphore struct {
+	reads         chan struct{}
+	writes        chan struct{}
+	waitingReads  atomic.Int64
+	YieldDuration time.Duration // Longest time a compaction pauses for queued reads
+}
+
+// NewIOSemaphore allows readTokens reads and writeTokens compactions at a time. Both must
+// be at least 1, which ValidateConfig checks, or every read or compaction blocks forever.
+func NewIOSemaphore(readTokens, writeTokens int, yieldDuration time.Duration) *IOSemaphore {
+	return &IOSemaphore{
+		reads:         make(chan struct{}, readTokens),
+		writes:        make(chan struct{}, writeTokens),
+		YieldDuration: yieldDuration,
+	}
+}
+
+// AcquireRead blocks until a read token is free and returns the function releasing it.
+func (s *IOSemaphore) AcquireRead() func() {
+	if s == nil {
+		return func() {}
+	}
+	select {
+	case s.reads <- struct{}{}:
+	default:
+		s.waitingReads.Add(1)
+		s.reads <- struct{}{}
+		s.waitingReads.Add(-1)
+	}
+	return func() { <-s.reads }
+}
+
+// AcquireWrite blocks until a write token is free and returns the token. The holder calls
+// Yield regularly and Release once done.
+func (s *IOSemaphore) AcquireWrite() *writeToken {
+	if s == nil {
+		return nil
+	}
+	s.writes <- struct{}{}
+	return &writeToken{sem: s, lastCheck: time.Now()}
+}
+
+// WaitingReads returns the number of reads queued for a token.
+func (s *IOSemaphore) WaitingReads() int64 {
+	if s == nil {
+		return 0
+	}
+	return s.waitingReads.Load()
+}
+
+// writeToken is a write token held by a compaction.
+type writeToken struct {
+	sem       *IOSemaphore
+	lastCheck time.Time
+}
+
+// Yield checks for queued reads every ioYieldCheckInterval. When there are some, the token
+// is released until the reads were admitted or YieldDuration passed, and then reacquired.
+func (t *writeToken) Yield() {
+	if t == nil || time.Since(t.lastCheck) < ioYieldCheckInterval {
+		return
+	}
+	if t.sem.WaitingReads() > 0 {
+		<-t.sem.writes
+		deadline := time.Now().Add(t.sem.YieldDuration)
+		for t.sem.WaitingReads() > 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		t.sem.writes <- struct{}{}
+	}
+	t.lastCheck = time.Now()
+}
+
+// Release gives the token back.
+func (t *writeToken) Release() {
+	if t != nil {
+		<-t.sem.writes
+	}
+}
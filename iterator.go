@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+)
+
+// Iterator walks key-value pairs in ascending key order. It starts before the
+// first entry; call Next to move to it.
+type Iterator interface {
+	Seek(key []byte) // Positions the iterator before the first key >= key
+	Next() bool      // Advances to the next entry and reports whether there is one
+	Key() []byte
+	Value() []byte
+}
+
+// sliceIterator iterates over a sorted snapshot of entries.
+type sliceIterator struct {
+	entries []KeyValue
+	pos     int
+}
+
+func newSliceIterator(entries []KeyValue) *sliceIterator {
+	return &sliceIterator{entries: entries, pos: -1}
+}
+
+func (it *sliceIterator) Seek(key []byte) {
+	it.pos = sort.Search(len(it.entries), func(i int) bool {
+		return bytes.Compare(it.entries[i].Key, key) >= 0
+	}) - 1
+}
+
+func (it *sliceIterator) Next() bool {
+	if it.pos < len(it.entries) {
+		it.pos++
+	}
+	return it.pos < len(it.entries)
+}
+
+func (it *sliceIterator) Key() []byte {
+	return it.entries[it.pos].Key
+}
+
+func (it *sliceIterator) Value() []byte {
+	return it.entries[it.pos].Value
+}
+
+// GetByPrefix returns an iterator over the memtable entries whose keys start with prefix.
+func (mem *memDB) GetByPrefix(prefix []byte) (Iterator, error) {
+	entries, err := mem.GetRange(prefix, prefixEnd(prefix))
+	if err != nil {
+		return nil, err
+	}
+	return newSliceIterator(entries), nil
+}
+
+// GetByPrefix returns an iterator over the namespace entries whose keys start
+// with prefix, with the namespace prefix removed.
+func (ns *NamespacedDB) GetByPrefix(prefix []byte) (Iterator, error) {
+	entries, err := ns.GetRange(prefix, prefixEnd(prefix))
+	if err != nil {
+		return nil, err
+	}
+	return newSliceIterator(entries), nil
+}
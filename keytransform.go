@@ -0,0 +1,48 @@
+package main
+
+import "bytes"
+
+// KeyToLower is a KeyTransformer that lowercases keys.
+func KeyToLower(key []byte) []byte {
+	return bytes.ToLower(key)
+}
+
+// KeyTrimSpace is a KeyTransformer that removes leading and trailing white space from keys.
+func KeyTrimSpace(key []byte) []byte {
+	return bytes.TrimSpace(key)
+}
+
+// KeyNormalize is a KeyTransformer that trims and lowercases keys.
+func KeyNormalize(key []byte) []byte {
+	return bytes.ToLower(bytes.TrimSpace(key))
+}
+
+// transformKey returns key as cfg.KeyTransformer normalizes it.
+func (mem *memDB) transformKey(key []byte) []byte {
+	if mem.cfg.KeyTransformer == nil {
+		return key
+	}
+	return mem.cfg.KeyTransformer(key)
+}
+
+// transformMemtableKeys applies cfg.KeyTransformer to the memtable keys before a flush,
+// which matters for entries loaded from SST files written without it. Of entries whose
+// keys become equal, the later one is kept. The caller must hold mem.mu.
+func (mem *memDB) transformMemtableKeys() {
+	if mem.cfg.KeyTransformer == nil {
+		return
+	}
+	index := make(map[string]int, len(mem.data))
+	data := mem.data[:0]
+	for _, kv := range mem.data {
+		kv.Key = mem.transformKey(kv.Key)
+		if i, ok := index[string(kv.Key)]; ok {
+			mem.size.Add(-entrySize(data[i]))
+			data[i] = kv
+			continue
+		}
+		index[string(kv.Key)] = len(data)
+		data = append(data, kv)
+	}
+	mem.data = data
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logger receives the structured log events of the database at logLevel and above.
+var logger = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+
+// logLevel is the level of logger, which SetLogLevel changes while the server runs.
+var logLevel = new(slog.LevelVar)
+
+// logOutput is the output logger writes to, for reports that are not log events.
+var logOutput io.Writer = os.Stderr
+
+// logFlushInterval is how long buffered file log output may wait before it is written.
+const logFlushInterval = time.Second
+
+// ConfigureLogging points logger at cfg.LogOutput: "stdout", "stderr" (the default),
+// "file:<path>" or "syslog:<facility>". Closing the returned value flushes and
+// releases the output.
+func ConfigureLogging(cfg DBConfig) (io.Closer, error) {
+	if err := SetLogLevel(cfg.LogLevel); err != nil {
+		return nil, err
+	}
+	output, err := openLogOutput(cfg)
+	if err != nil {
+		return nil, err
+	}
+	logger = slog.New(slog.NewJSONHandler(output, &slog.HandlerOptions{Level: logLevel}))
+	logOutput = output
+	return output, nil
+}
+
+// SetLogLevel makes logger drop the events less severe than level, one of "debug",
+// "info", "warn" or "error". An empty level is "info".
+func SetLogLevel(level string) error {
+	parsed, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(parsed)
+	return nil
+}
+
+func parseLogLevel(level string) (slog.Level, error) {
+	if level == "" {
+		return slog.LevelInfo, nil
+	}
+	var parsed slog.Level
+	if err := parsed.UnmarshalText([]byte(level)); err != nil {
+		return 0, fmt.Errorf("invalid LogLevel %q: %w", level, err)
+	}
+	return parsed, nil
+}
+
+func openLogOutput(cfg DBConfig) (io.WriteCloser, error) {
+	switch {
+	case cfg.LogOutput == "" || cfg.LogOutput == "stderr":
+		return nopCloser{os.Stderr}, nil
+	case cfg.LogOutput == "stdout":
+		return nopCloser{os.Stdout}, nil
+	case strings.HasPrefix(cfg.LogOutput, "file:"):
+		return openLogFile(strings.TrimPrefix(cfg.LogOutput, "file:"), int64(cfg.LogMaxSizeMB)<<20)
+	case strings.HasPrefix(cfg.LogOutput, "syslog:"):
+		return openSyslog(strings.TrimPrefix(cfg.LogOutput, "syslog:"))
+	default:
+		return nil, fmt.Errorf("unknown log output %q", cfg.LogOutput)
+	}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// logFile buffers log output to a file, writing it every logFlushInterval or when
+// the buffer is full. Once the file exceeds maxSize it is renamed to path+".1"
+// and a new file is started; a maxSize of 0 disables rotation.
+type logFile struct {
+	path    string
+	maxSize int64
+
+	mu     sync.Mutex
+	file   *os.File
+	buf    *bufio.Writer
+	size   int64
+	stop   chan struct{}
+	closed bool
+}
+
+func openLogFile(path string, maxSize int64) (*logFile, error) {
+	l := &logFile{path: path, maxSize: maxSize, stop: make(chan struct{})}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		ticker := time.NewTicker(logFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.stop:
+				return
+			case <-ticker.C:
+				l.mu.Lock()
+				l.buf.Flush()
+				l.mu.Unlock()
+			}
+		}
+	}()
+	return l, nil
+}
+
+func (l *logFile) open() error {
+	file, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.buf = bufio.NewWriter(file)
+	l.size = info.Size()
+	return nil
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return 0, os.ErrClosed
+	}
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(p)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := l.buf.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside and starts a new one.
+func (l *logFile) rotate() error {
+	if err := l.buf.Flush(); err != nil {
+		return err
+	}
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return fmt.Errorf("error rotating log file: %w", err)
+	}
+	return l.open()
+}
+
+func (l *logFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	close(l.stop)
+	if err := l.buf.Flush(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
@@ -1,31 +1,55 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
-const maxEntriesBeforeSST = 1000 // Define the threshold
-const maxSSTFiles = 10
-
 func main() {
-	// Create a WriteAheadLog
-	wal, err := NewWriteAheadLog("newal.log")
-	watermarkPosition := int64(50)
+	configPath := flag.String("config", "", "JSON file overriding the default settings")
+	flag.Parse()
+
+	// Settings come from the defaults, then the config file, then the environment
+	cfg := DefaultDBConfig()
+	var err error
+	if *configPath != "" {
+		if cfg, err = LoadConfigFile(*configPath, cfg); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if cfg, err = LoadConfigFromEnv(cfg); err != nil {
+		log.Fatal(err)
+	}
+	if err := ValidateConfig(cfg); err != nil {
+		log.Fatalf("Invalid configuration: %s", err)
+	}
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Args(), cfg, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	logOutput, err := ConfigureLogging(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer wal.Close()
+	defer logOutput.Close()
 
-	// Create a memDB instance with the WriteAheadLog
-	db := NewMemDB(wal)
-	go db.periodicFlush()
+	// Restore the database from its SST files and write-ahead log
+	db, handler, err := openServer(cfg, *configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
 
 	// Create a WaitGroup for handling graceful shutdown
 	var wg sync.WaitGroup
@@ -33,74 +57,32 @@ func main() {
 
 	// Set up HTTP server with graceful shutdown
 	server := &http.Server{
-		Addr: ":8080",
+		Addr:    ":8080",
+		Handler: handler,
 	}
 
-	http.HandleFunc("/set", func(w http.ResponseWriter, r *http.Request) {
-		key := r.URL.Query().Get("key")
-		value := r.URL.Query().Get("value")
-
-		if key == "" || value == "" {
-			http.Error(w, "Both key and value are required", http.StatusBadRequest)
-			return
-		}
-
-		err := db.Set([]byte(key), []byte(value))
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		w.WriteHeader(http.StatusOK)
-		fmt.Println("Set endpoint called with key:", key, "and value:", value)
-	})
-
-	http.HandleFunc("/del", func(w http.ResponseWriter, r *http.Request) {
-		key := r.URL.Query().Get("key")
-
-		if key == "" {
-			http.Error(w, "Key is required", http.StatusBadRequest)
-			return
-		}
-
-		deletedValue, err := db.Del([]byte(key))
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusNotFound)
-			return
-		}
-
-		response, _ := json.Marshal(map[string]string{"key": string(key), "deleted_value": string(deletedValue)})
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write(response)
-		fmt.Println("DEL endpoint called with key:", key, "and value:", string(deletedValue))
+	// Graceful shutdown handler: flush and close the database, then stop the server
+	var shutdownOnce sync.Once
+	handler.mux.HandleFunc("/shutdown", func(w http.ResponseWriter, r *http.Request) {
+		shutdownOnce.Do(func() {
+			if err := db.Close(); err != nil {
+				logger.Error("error closing database", "error", err)
+			}
+			wg.Done() // Signal the WaitGroup to finish the server gracefully
+		})
 	})
 
-	http.HandleFunc("/get", func(w http.ResponseWriter, r *http.Request) {
-		key := r.URL.Query().Get("key")
-
-		if key == "" {
-			http.Error(w, "Key is required", http.StatusBadRequest)
-			return
-		}
-
-		value, err := db.Get([]byte(key))
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusNotFound)
-			return
+	// SIGHUP reloads the config file, like POST /config/reload
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+	go func() {
+		for range hangups {
+			if err := handler.reloadConfig(); err != nil {
+				logger.Error("error reloading configuration", "error", err)
+			}
 		}
-
-		response, _ := json.Marshal(map[string]string{"key": string(key), "value": string(value)})
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write(response)
-		fmt.Println("Get endpoint called with key:", key, "and value:", string(value))
-	})
-
-	// Graceful shutdown handler
-	http.HandleFunc("/shutdown", func(w http.ResponseWriter, r *http.Request) {
-		wg.Done() // Signal the WaitGroup to finish the server gracefully
-	})
+	}()
 
 	fmt.Println("Server running on port 8080")
 	go func() {
@@ -109,69 +91,39 @@ func main() {
 		}
 	}()
 
-	go func() {
-		ticker := time.NewTicker(5 * time.Minute)
-		defer ticker.Stop()
-
-		for range ticker.C {
-			sstFiles, err := getSSTFileNames()
-			if err != nil {
-				log.Fatalf("Error getting SST file names: %s\n", err)
-			}
-
-			if len(sstFiles) >= maxSSTFiles {
-				fileNames, err := getSSTFileNames()
-				if err != nil {
-					log.Fatalf("Error getting SST file names: %s\n", err)
-				}
-
-				for _, fileName := range fileNames {
-					if err := os.Remove(fileName); err != nil {
-						log.Printf("Error removing SST file: %s\n", err)
-					}
-				}
-			}
-
-			log.Println("Performing additional periodic checks or tasks...")
-		}
-	}()
-
-	go func() {
-		ticker := time.NewTicker(30 * time.Minute) // Adjust the duration as needed
-		defer ticker.Stop()
-
-		for range ticker.C {
-			err := compactSSTFiles(maxSSTFiles)
-			if err != nil {
-				log.Fatalf("error during compaction: %s\n", err)
-			}
-
-			log.Println("Compaction process completed.")
-		}
-	}()
 	// Wait for graceful shutdown signal
 	wg.Wait()
 
 	// Shutdown server gracefully
 	fmt.Println("Shutting down the server...")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Println("Error shutting down the server:", err)
+	}
+	fmt.Println("Server gracefully stopped.")
+}
 
-	// Flush remaining data to SST file before exit
-	fmt.Println("Flushing remaining data to SST file before exit...")
-	if err := db.createSSTFile(); err != nil {
-		log.Fatalf("Error creating SST file: %s\n", err)
+// openServer opens the database of cfg and the server in front of it, and starts their
+// background work. SST files are only merged by the compaction schedule, which keeps the
+// manifest in step.
+func openServer(cfg DBConfig, configPath string) (*memDB, *server, error) {
+	schedule, err := ParseSchedule(cfg.CompactionSchedule)
+	if err != nil {
+		return nil, nil, err
 	}
-	// Trigger cleanup after SST creation
-	err = wal.CleanupAfterSSTCreation(watermarkPosition)
+	db, err := OpenDB(cfg)
 	if err != nil {
-		fmt.Println("Error cleaning up WAL:", err)
-		return
+		return nil, nil, err
 	}
-	fmt.Println("WAL cleaned up successfully up to position", watermarkPosition)
-	fmt.Println("Server gracefully stopped.")
+	handler := newServer(db, cfg)
+	handler.configPath = configPath
+	handler.sstSizes.start(5 * time.Minute)
+	db.startCompactionSchedule(schedule)
+	return db, handler, nil
 }
-func getSSTFileNames() ([]string, error) {
-	dir := "./GO_PROJECT" 
 
+func getSSTFileNames(dir string) ([]string, error) {
 	files, err := os.ReadDir(dir)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const manifestFileName = "MANIFEST"
+
+// SSTFileMeta describes one SST file tracked by the manifest.
+type SSTFileMeta struct {
+	FileName       string `json:"file_name"`
+	SequenceNumber uint64 `json:"sequence_number"`
+	Level          uint8  `json:"level"`
+	CreationTime   int64  `json:"creation_time"`
+	SmallestKey    []byte `json:"smallest_key"`
+	LargestKey     []byte `json:"largest_key"`
+	Checksum       uint32 `json:"checksum"`
+	MagicNumber    uint32 `json:"magic_number"`          // Expected magic number of the file header
+	WALPosition    int64  `json:"wal_position"`          // WAL size when the file was flushed
+	WALSegment     uint64 `json:"wal_segment,omitempty"` // Segment the WAL was in when the file was flushed
+	FileSize       int64  `json:"file_size,omitempty"`   // Size of the file; filled in when compaction selects files
+}
+
+// manifestWriter wraps the temporary file written by atomicWriteFile; tests replace it to inject failures.
+var manifestWriter = func(file *os.File) io.Writer { return file }
+
+const (
+	manifestFormatVersion uint8 = 2
+	manifestRecordSize          = 47 // Fixed-size part of a binary manifest record
+	manifestRecordSizeV1        = 39 // Version 1 records end before WALSegment
+)
+
+// manifestRecord is the fixed-size part of a binary manifest record. It is followed by
+// the smallest key, the largest key and the file name.
+type manifestRecord struct {
+	SequenceNumber uint64
+	Level          uint8
+	CreationTime   int64
+	SmallestKeyLen uint16
+	LargestKeyLen  uint16
+	FileNameLen    uint16
+	Checksum       uint32
+	MagicNumber    uint32
+	WALPosition    int64
+	WALSegment     uint64
+}
+
+// MarshalManifest encodes files as a format version byte, a 4-byte file count and one record per file.
+func MarshalManifest(files []SSTFileMeta) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(manifestFormatVersion)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(files)))
+
+	for _, file := range files {
+		if len(file.SmallestKey) > 0xffff || len(file.LargestKey) > 0xffff || len(file.FileName) > 0xffff {
+			return nil, fmt.Errorf("manifest entry %s has a field longer than 65535 bytes", file.FileName)
+		}
+		record := manifestRecord{
+			SequenceNumber: file.SequenceNumber,
+			Level:          file.Level,
+			CreationTime:   file.CreationTime,
+			SmallestKeyLen: uint16(len(file.SmallestKey)),
+			LargestKeyLen:  uint16(len(file.LargestKey)),
+			FileNameLen:    uint16(len(file.FileName)),
+			Checksum:       file.Checksum,
+			MagicNumber:    file.MagicNumber,
+			WALPosition:    file.WALPosition,
+			WALSegment:     file.WALSegment,
+		}
+		binary.Write(&buf, binary.LittleEndian, record)
+		buf.Write(file.SmallestKey)
+		buf.Write(file.LargestKey)
+		buf.WriteString(file.FileName)
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalManifest decodes a manifest written by MarshalManifest, or by the version 1
+// format, whose files have no WALSegment.
+func UnmarshalManifest(data []byte) ([]SSTFileMeta, error) {
+	if len(data) < 5 {
+		return nil, errors.New("truncated manifest header")
+	}
+	recordSize := manifestRecordSize
+	switch data[0] {
+	case manifestFormatVersion:
+	case 1:
+		recordSize = manifestRecordSizeV1
+	default:
+		return nil, fmt.Errorf("unsupported manifest format version %d", data[0])
+	}
+	count := binary.LittleEndian.Uint32(data[1:5])
+	data = data[5:]
+
+	files := make([]SSTFileMeta, 0, min(int(count), len(data)/recordSize))
+	for i := uint32(0); i < count; i++ {
+		if len(data) < recordSize {
+			return nil, fmt.Errorf("truncated manifest record %d", i)
+		}
+		le := binary.LittleEndian
+		record := manifestRecord{
+			SequenceNumber: le.Uint64(data[0:]),
+			Level:          data[8],
+			CreationTime:   int64(le.Uint64(data[9:])),
+			SmallestKeyLen: le.Uint16(data[17:]),
+			LargestKeyLen:  le.Uint16(data[19:]),
+			FileNameLen:    le.Uint16(data[21:]),
+			Checksum:       le.Uint32(data[23:]),
+			MagicNumber:    le.Uint32(data[27:]),
+			WALPosition:    int64(le.Uint64(data[31:])),
+		}
+		if recordSize == manifestRecordSize {
+			record.WALSegment = le.Uint64(data[39:])
+		}
+		data = data[recordSize:]
+
+		variableLen := int(record.SmallestKeyLen) + int(record.LargestKeyLen) + int(record.FileNameLen)
+		if len(data) < variableLen {
+			return nil, fmt.Errorf("truncated manifest record %d", i)
+		}
+		smallestKey := data[:record.SmallestKeyLen]
+		data = data[record.SmallestKeyLen:]
+		largestKey := data[:record.LargestKeyLen]
+		data = data[record.LargestKeyLen:]
+		fileName := string(data[:record.FileNameLen])
+		data = data[record.FileNameLen:]
+
+		files = append(files, SSTFileMeta{
+			FileName:       fileName,
+			SequenceNumber: record.SequenceNumber,
+			Level:          record.Level,
+			CreationTime:   record.CreationTime,
+			SmallestKey:    bytes.Clone(smallestKey),
+			LargestKey:     bytes.Clone(largestKey),
+			Checksum:       record.Checksum,
+			MagicNumber:    record.MagicNumber,
+			WALPosition:    record.WALPosition,
+			WALSegment:     record.WALSegment,
+		})
+	}
+	if len(data) != 0 {
+		return nil, fmt.Errorf("%d unexpected bytes after the last manifest record", len(data))
+	}
+	return files, nil
+}
+
+// WriteManifest replaces the manifest in dir with files.
+func WriteManifest(dir string, files []SSTFileMeta) error {
+	data, err := MarshalManifest(files)
+	if err != nil {
+		return fmt.Errorf("error encoding manifest: %w", err)
+	}
+	return atomicWriteFile(filepath.Join(dir, manifestFileName), data)
+}
+
+// ReadManifest returns the SST files listed in the manifest of dir, or nil if there is none yet.
+func ReadManifest(dir string) ([]SSTFileMeta, error) {
+	data, err := os.ReadFile(filepath.Join(dir, manifestFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Manifests written before the binary format are JSON arrays
+	if len(data) > 0 && (data[0] == '[' || data[0] == 'n') {
+		var files []SSTFileMeta
+		if err := json.Unmarshal(data, &files); err != nil {
+			return nil, fmt.Errorf("error decoding manifest: %w", err)
+		}
+		return files, nil
+	}
+
+	files, err := UnmarshalManifest(data)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding manifest: %w", err)
+	}
+	return files, nil
+}
+
+// walPosition returns the point of the WAL the file was flushed at.
+func (m SSTFileMeta) walPosition() walPosition {
+	return walPosition{segment: m.WALSegment, offset: m.WALPosition}
+}
+
+// manifestMu serializes the updates that read the manifest and write it back, so a
+// compaction completing during a flush does not drop the flushed file.
+var manifestMu sync.Mutex
+
+// addToManifest appends meta to the manifest of dir, assigning it the next sequence number.
+func addToManifest(dir string, meta SSTFileMeta) error {
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+	files, err := ReadManifest(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.SequenceNumber >= meta.SequenceNumber {
+			meta.SequenceNumber = file.SequenceNumber + 1
+		}
+	}
+	return WriteManifest(dir, append(files, meta))
+}
+
+// replaceInManifest removes the files at paths from the manifest of dir and adds added,
+// unless it is nil, in a single write, so readers see either the old files or the new one.
+func replaceInManifest(dir string, paths []string, added *SSTFileMeta) error {
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+	files, err := ReadManifest(dir)
+	if err != nil {
+		return err
+	}
+	removed := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		removed[filepath.Clean(path)] = true
+	}
+	updated := make([]SSTFileMeta, 0, len(files)+1)
+	for _, file := range files {
+		if !removed[filepath.Clean(filepath.Join(dir, file.FileName))] {
+			updated = append(updated, file)
+		}
+	}
+	if added != nil {
+		updated = append(updated, *added)
+	}
+	return WriteManifest(dir, updated)
+}
+
+// atomicWriteFile writes data to path+".tmp", syncs it and renames it over path,
+// so a crash leaves either the old or the new contents but never a partial file.
+func atomicWriteFile(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := manifestWriter(file).Write(data); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("error writing %s: %w", tmpPath, err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("error syncing %s: %w", tmpPath, err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDirectory(filepath.Dir(path))
+}
+
+// syncDirectory makes the entries of dir, such as a freshly renamed file, durable.
+func syncDirectory(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
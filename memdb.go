@@ -1,173 +1,1063 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"errors"
-	"time"
-	"sync"
 	"fmt"
+	"maps"
 	"os"
-	"bufio"
-	"encoding/binary"
-	"io"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+var (
+	ErrKeyNotFound  = errors.New("key not found")
+	ErrDatabaseFull = errors.New("database holds the maximum number of keys")
+)
 
 type memDB struct {
-	data []KeyValue
-	wal  *WriteAheadLog
-	mu   sync.Mutex 
-	flushInterval time.Duration
-	sstFileLoaded  bool
-    setData   []KeyValue // Store Set operation data
-	deleteData []KeyValue // Store Delete operation data
+	data          []KeyValue
+	wal           *WriteAheadLog
+	mu            sync.Mutex
+	flushInterval time.Duration // Time between periodic flushes, changed with SetFlushInterval
+	sstFileLoaded bool
+	setData       []KeyValue                       // Store Set operation data
+	deleteData    []KeyValue                       // Store Delete operation data
+	breaker       *CircuitBreaker                  // Guards SST reads against a failing disk
+	readSST       func(string) ([]KeyValue, error) // Reads the entries of an SST file
+	metrics       *MetricsCollector
+	compaction    *compactionTracker // Progress of the running or last compaction
+	cfg           DBConfig
+	size          atomic.Int64    // Sum of key and value lengths in data
+	blockCache    CachePolicy     // Decoded SST files by file name; nil when disabled
+	blockPool     *BlockPool      // Buffers for decoding SST files that are not cached
+	filters       CachePolicy     // Filter blocks of SST files by file name
+	sketch        *CountMinSketch // Approximate access counts of keys
+	events        *ChangeEventBus // Notifies subscribers of writes
+	tombstones    []KeyValue      // Keys deleted in the loaded SST file
+	pending       []*pendingWrite // Sets being logged, in the order they were issued
+	statsDone     chan struct{}   // Stops the stats file writer; nil when it does not run
+	statsWG       sync.WaitGroup  // Tracks the stats file writer
+	stopCh        chan struct{}   // Closed by Close to stop the background goroutines
+	bgWG          sync.WaitGroup  // Tracks the background goroutines stopped by stopCh
+	closed        bool            // Set by Close; operations then fail with ErrDatabaseClosed
+	readOnly      bool            // Set by OpenClone; writes then fail with ErrReadOnly
+
+	sstFilesOpened atomic.Int64      // SST files read by Get, for measuring the lookup
+	cacheWarm      atomic.Bool       // Set once OpenDB loaded the SST files into the block cache
+	keyCount       atomic.Int64      // Live keys while MaxKeyCount is set; without it, overwrites of SST keys count as new keys
+	access         *sstAccessTracker // Last reads of the SST files, for moving cold ones to ColdDataDir
+	flushProgress  FlushProgressFunc // Called with the progress of memtable flushes; may be nil
+	asyncWriter    *asyncWriter      // Queue of AsyncSet writes; nil makes AsyncSet synchronous
+
+	flushIntervalChanged chan struct{} // Wakes periodicFlush to pick up a new flush interval
+	maxKeyCount          atomic.Int64  // cfg.MaxKeyCount, as changed by ReloadConfig
+	scheduleMu           sync.Mutex    // Guards scheduleSpec and scheduleStop
+	scheduleSpec         string        // cfg.CompactionSchedule, as changed by ReloadConfig
+	scheduleStop         chan struct{} // Stops the compaction schedule goroutine; nil when none runs
+	compactionMu         sync.Mutex    // Serializes compactions, tiering and clones, and guards lastCompaction
+	lastCompaction       time.Time     // When the last compaction that merged files completed; zero before the first
 }
+
+// SetFlushInterval changes the time between periodic flushes, starting from now.
 func (mem *memDB) SetFlushInterval(interval time.Duration) {
+	mem.mu.Lock()
 	mem.flushInterval = interval
+	mem.mu.Unlock()
+	select {
+	case mem.flushIntervalChanged <- struct{}{}:
+	default: // periodicFlush already has a change to pick up
+	}
+}
+
+// FlushInterval returns the time between periodic flushes.
+func (mem *memDB) FlushInterval() time.Duration {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	return mem.flushInterval
 }
 func (mem *memDB) loadSSTFile(fileName string) error {
 	if mem.sstFileLoaded {
-        return nil
-    }
-    file, err := os.Open(fileName)
-    if err != nil {
-        return err
-    }
-    defer file.Close()
-
-    reader := bufio.NewReader(file)
-	 // Read checksum from the end of the SST file
-	 checksum := calculateChecksum(mem.data)
-	 _, err = file.Seek(-int64(binary.Size(checksum)), io.SeekEnd)
-	 if err != nil {
-		 return fmt.Errorf("error seeking checksum in SST file: %s", err)
-	 }
- 
-	 var storedChecksum uint32
-	 if err := binary.Read(file, binary.LittleEndian, &storedChecksum); err != nil {
-		 return fmt.Errorf("error reading stored checksum from SST file: %s", err)
-	 }
- 
-	 // Reset file offset to the beginning for reading key-value pairs
-	 _, err = file.Seek(0, io.SeekStart)
-	 if err != nil {
-		 return fmt.Errorf("error resetting file offset in SST file: %s", err)
-	 }
- 
-    for {
-        // Read key length
-        keyLenBytes := make([]byte, 4)
-        _, err := reader.Read(keyLenBytes)
-        if err != nil {
-            break // Break loop at the end of the file or on error
-        }
-        keyLen := binary.LittleEndian.Uint32(keyLenBytes)
-
-        // Read key data
-        keyData := make([]byte, keyLen)
-        _, err = reader.Read(keyData)
-        if err != nil {
-            break // Break loop at the end of the file or on error
-        }
-
-        // Read value length
-        valueLenBytes := make([]byte, 4)
-        _, err = reader.Read(valueLenBytes)
-        if err != nil {
-            break // Break loop at the end of the file or on error
-        }
-        valueLen := binary.LittleEndian.Uint32(valueLenBytes)
-
-        // Read value data
-        valueData := make([]byte, valueLen)
-        _, err = reader.Read(valueData)
-        if err != nil {
-            break // Break loop at the end of the file or on error
-        }
-
-        // Append KeyValue pairs to mem.data
-        mem.data = append(mem.data, KeyValue{
-            Key:   keyData,
-            Value: valueData,
-        })
-    }
-	// Calculate checksum of loaded key-value pairs
-    loadedChecksum := calculateChecksum(mem.data)
-
-    // Compare checksums to validate file integrity
-    if loadedChecksum != storedChecksum {
-        return fmt.Errorf("SST file integrity check failed: checksums do not match")
-    }
+		return nil
+	}
+	entries, err := mem.readSSTFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	// Append KeyValue pairs to mem.data, keeping tombstones apart
+	for _, kv := range entries {
+		if kv.Operation == Delete {
+			mem.tombstones = append(mem.tombstones, kv)
+			continue
+		}
+		mem.data = append(mem.data, kv)
+		mem.size.Add(entrySize(kv))
+	}
 	mem.sstFileLoaded = true
-    return nil
+	return nil
+}
+
+// readSSTFile returns the entries of an SST file, from the block cache when possible. It
+// takes a read token of cfg.IOSemaphore, so the caller must not hold mem.mu.
+func (mem *memDB) readSSTFile(fileName string) ([]KeyValue, error) {
+	release := mem.cfg.IOSemaphore.AcquireRead()
+	defer release()
+	entries, _, err := mem.readSSTFileInto(fileName, nil)
+	return entries, err
+}
+
+// readSSTFileInto returns the entries of an SST file like readSSTFile, decoding them into buf
+// when they are not cached. It also returns the buffer the caller may give back to the block
+// pool once it is done with the entries, or nil when the block cache now owns it. The
+// caller holds a read token, taken by readSSTFile or lockRead.
+func (mem *memDB) readSSTFileInto(fileName string, buf []byte) ([]KeyValue, []byte, error) {
+	mem.access.Touch(fileName)
+	if mem.blockCache != nil {
+		if cached, ok := mem.blockCache.Get(fileName); ok {
+			return cached.([]KeyValue), buf, nil
+		}
+	}
+
+	var entries []KeyValue
+	err := mem.breaker.Execute(func() error {
+		return withRetry(context.Background(), mem.cfg.SSTReadRetryPolicy, func() error {
+			var err error
+			if mem.readSST != nil {
+				entries, err = mem.readSST(fileName)
+			} else {
+				entries, buf, err = mem.decodeSSTFile(fileName, buf)
+			}
+			return err
+		})
+	})
+	if isCorruptSST(err) && mem.cfg.ReplicaHTTPAddr != "" {
+		entries, err = mem.repairSSTFile(fileName)
+	}
+	if err != nil {
+		return nil, buf, err
+	}
+
+	if mem.blockCache != nil {
+		mem.blockCache.Put(fileName, entries)
+		return entries, nil, nil
+	}
+	return entries, buf, nil
 }
+
+// OpenDB restores the database stored in cfg.DataDir and cfg.WALPath: it registers the
+// compression dictionaries stored with the data, checks the SST files listed in the
+// manifest, rebuilding the filter blocks that are corrupt unless an IntegrityKey is set,
+// loads them into the block cache while it has room, replays the WAL entries logged after
+// the watermark and, with a MaxKeyCount, counts the live keys.
+func OpenDB(cfg DBConfig) (*memDB, error) {
+	if err := os.MkdirAll(cfg.DataDir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := ReadManifest(cfg.DataDir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+	if err := loadCompressionDictionaries(cfg.DataDir, cfg.CompressionDictionary); err != nil {
+		return nil, err
+	}
+	wal, err := NewWriteAheadLog(cfg.WALPath)
+	if err != nil {
+		return nil, err
+	}
+	mem := NewMemDBWithConfig(wal, cfg)
+
+	// Newest files first, so those are the ones left in the cache
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].SequenceNumber > files[j].SequenceNumber
+	})
+	var cached []string
+	for i, file := range files {
+		path := filepath.Join(cfg.DataDir, file.FileName)
+		if _, err := readSSTFileHeader(path); err != nil {
+			mem.Close()
+			return nil, fmt.Errorf("error opening %s: %w", file.FileName, err)
+		}
+		if err := mem.rebuildCorruptIndex(path); err != nil {
+			mem.Close()
+			return nil, fmt.Errorf("error opening %s: %w", file.FileName, err)
+		}
+		mem.loadSSTFilter(path)
+		if mem.blockCache != nil && i < cfg.BlockCacheSize {
+			cached = append(cached, path)
+		}
+	}
+	if cfg.WarmCacheOnStartup {
+		mem.cacheWarm.Store(false)
+		mem.bgWG.Add(1)
+		go mem.warmCache(cached)
+	} else {
+		for _, path := range cached {
+			if _, err := mem.readSSTFile(path); err != nil {
+				mem.Close()
+				return nil, fmt.Errorf("error loading %s: %w", filepath.Base(path), err)
+			}
+		}
+	}
+
+	if n, err := mem.ReplayWAL(); err != nil {
+		logger.Warn("WAL replay stopped early", "entries", n, "error", err)
+	}
+	if cfg.MaxKeyCount > 0 {
+		if err := mem.seedKeyCount(); err != nil {
+			mem.Close()
+			return nil, err
+		}
+	}
+	return mem, nil
+}
+
+// warmCache loads the SST files into the block cache and then marks it warm. Close
+// stops it early, leaving the cache partly filled. A file that cannot be read is left
+// for the first Get to report.
+func (mem *memDB) warmCache(paths []string) {
+	defer mem.bgWG.Done()
+	start := time.Now()
+	for _, path := range paths {
+		select {
+		case <-mem.stopCh:
+			return
+		default:
+		}
+		if _, err := mem.readSSTFile(path); err != nil {
+			logger.Warn("error warming block cache", "file", path, "error", err)
+		}
+	}
+	mem.cacheWarm.Store(true)
+	logger.Info("block cache warm", "files", len(paths), "duration_ms", time.Since(start).Milliseconds())
+}
+
+// CacheWarm reports whether the block cache holds the SST files OpenDB loads into it.
+func (mem *memDB) CacheWarm() bool {
+	return mem.cacheWarm.Load()
+}
+
+// decodeSSTFile opens an SST file, through direct I/O if configured, and decodes it into buf.
+func (mem *memDB) decodeSSTFile(fileName string, buf []byte) ([]KeyValue, []byte, error) {
+	file, closeFile, err := openSSTSource(fileName, mem.cfg.UseDirectIO, mem.cfg.IOAlignment)
+	if err != nil {
+		return nil, buf, err
+	}
+	defer closeFile()
+	return decodeSSTFile(file, mem.cfg.IntegrityKey, buf)
+}
+
 func NewMemDB(wal *WriteAheadLog) *memDB {
+	return NewMemDBWithConfig(wal, DefaultDBConfig())
+}
+
+func NewMemDBWithConfig(wal *WriteAheadLog, cfg DBConfig) *memDB {
+	mem := newMemDB(wal, cfg)
+	mem.startBackground()
+	return mem
+}
+
+// newMemDB returns the database for cfg without starting its background goroutines.
+func newMemDB(wal *WriteAheadLog, cfg DBConfig) *memDB {
 	mem := &memDB{
-		data: make([]KeyValue, 0),
-		wal:  wal,
+		data:        make([]KeyValue, 0),
+		wal:         wal,
+		breaker:     NewCircuitBreaker(5, 30*time.Second),
+		metrics:     NewMetricsCollector(),
+		compaction:  newCompactionTracker(),
+		cfg:         cfg,
+		events:      NewChangeEventBus(),
+		stopCh:      make(chan struct{}),
+		access:      newSSTAccessTracker(),
+		filters:     NewLRUCache(filterCacheSize),
+		asyncWriter: newAsyncWriter(),
+
+		flushInterval:        cfg.FlushInterval,
+		flushIntervalChanged: make(chan struct{}, 1),
+		scheduleSpec:         cfg.CompactionSchedule,
+	}
+	mem.maxKeyCount.Store(cfg.MaxKeyCount)
+	mem.cacheWarm.Store(true) // Only OpenDB has SST files to warm the cache with
+	if cfg.BlockCacheSize != 0 {
+		blockCache, err := NewCachePolicy(cfg.BlockCachePolicy, cfg.BlockCacheSize)
+		if err != nil {
+			logger.Warn("invalid block cache configuration, falling back to LRU", "error", err)
+			blockCache = NewLRUCache(DefaultDBConfig().BlockCacheSize)
+		}
+		mem.blockCache = blockCache
+	}
+	hash, err := NewHashFunc(cfg.HashFuncName)
+	if err != nil {
+		logger.Warn("invalid hash function, falling back to fnv64", "error", err)
+		hash = fnv64
+	}
+	mem.sketch = NewCountMinSketch(cfg.SketchWidth, cfg.SketchDepth, hash)
+	if cfg.SSTBlockSize > 0 {
+		mem.blockPool = NewBlockPool(cfg.SSTBlockSize)
+	}
+	if wal != nil {
+		wal.MaxSize = cfg.MaxWALSize
+		wal.Format = cfg.WALFormat
+		wal.ByteOrder = cfg.ByteOrder
+		wal.Timestamps = cfg.EntryTimestamp
+		wal.SyncPolicy = cfg.WALSyncPolicy
+		if cfg.WALErrorRateThreshold > 0 {
+			wal.syncMonitor = newWALSyncMonitor(cfg.WALErrorRateThreshold, cfg.WALSyncRecoveryWindow)
+		}
+	}
+	if cfg.ReplicaAddr != "" && wal != nil {
+		wal.replica = NewReplicationClient(cfg.ReplicaAddr)
+	}
+	if len(cfg.CompressionDictionary) > 0 {
+		RegisterCompressionDictionary(cfg.CompressionDictionary)
+	}
+	if backend, err := newLogShippingBackend(cfg); err != nil {
+		logger.Warn("WAL shipping disabled", "error", err)
+	} else if backend != nil && wal != nil {
+		wal.shipper = NewWALShipper(backend, cfg.WALShippingPrefix)
 	}
-	go mem.periodicFlush()
 	return mem
 }
 
+// startBackground starts the background goroutines. A read-only database only samples and
+// reports its stats; the goroutines that write are left out.
+func (mem *memDB) startBackground() {
+	mem.bgWG.Add(1)
+	go mem.sampleWriteRates(ioRateInterval)
+	if mem.cfg.StatsReportInterval > 0 {
+		mem.bgWG.Add(1)
+		go mem.reportStatsPeriodically()
+	}
+	if mem.readOnly {
+		return
+	}
+	mem.bgWG.Add(2)
+	go mem.periodicFlush()
+	go mem.runAsyncWriter()
+	if mem.cfg.ColdDataDir != "" && mem.cfg.TieringCheckInterval > 0 {
+		mem.bgWG.Add(1)
+		go mem.runStorageTierer()
+	}
+	if mem.cfg.StatsFlushInterval > 0 {
+		mem.statsDone = make(chan struct{})
+		mem.statsWG.Add(1)
+		go mem.flushStatsPeriodically(mem.statsDone)
+	}
+}
+
+// Set logs the entry without holding the lock, so other operations proceed while the
+// WAL write is in flight, and then moves it to the memtable. A failed WAL append
+// leaves the memtable untouched.
 func (mem *memDB) Set(key, value []byte) error {
+	return mem.SetWithOptions(key, value, SetOptions{})
+}
+
+// SetWithOptions writes the entry like Set, storing opts.Tags alongside it.
+func (mem *memDB) SetWithOptions(key, value []byte, opts SetOptions) error {
+	if mem.readOnly {
+		return ErrReadOnly
+	}
+	key = mem.transformKey(key)
+	if err := mem.validateValue(key, value); err != nil {
+		return err
+	}
+	unlock := mem.lockReserve()
+	if mem.closed {
+		unlock()
+		return ErrDatabaseClosed
+	}
+	mem.sketch.Update(key)
+	added, err := mem.reserveKey(key)
+	if err != nil {
+		unlock()
+		return err
+	}
+	write, prev := mem.queueWrite(KeyValue{Key: key, Value: value, Tags: maps.Clone(opts.Tags)})
+	write.addedKey = added
+	unlock()
+
+	mem.logWrite(write, prev)
+
 	mem.mu.Lock()
 	defer mem.mu.Unlock()
+	size := mem.applyPendingWrites()
+	if write.err != nil {
+		return write.err
+	}
+
+	mem.flushIfFull(size)
+	return nil
+}
+
+// reserveKey counts key if Set adds it to the database and reports whether it did. A new
+// key fails with ErrDatabaseFull once cfg.MaxKeyCount keys exist. With a limit, keys missing
+// from the memtable are looked up in the SST files, so overwrites of flushed keys are not
+// counted. The caller must hold mem.mu.
+func (mem *memDB) reserveKey(key []byte) (bool, error) {
+	for _, write := range mem.pending {
+		if bytes.Equal(write.kv.Key, key) {
+			return false, nil
+		}
+	}
+	deleted := false
+	for _, kv := range mem.data {
+		if bytes.Equal(kv.Key, key) {
+			if kv.Operation != Delete {
+				return false, nil
+			}
+			deleted = true
+			break
+		}
+	}
+	limit := mem.maxKeyCount.Load()
+	if limit > 0 && !deleted && !mem.tombstoned(key) {
+		if _, err := mem.getFromSST(key, nil); err == nil {
+			return false, nil
+		} else if !errors.Is(err, ErrKeyNotFound) {
+			return false, err
+		}
+	}
+
+	count := mem.keyCount.Add(1)
+	if limit <= 0 {
+		return true, nil
+	}
+	if count > limit {
+		mem.keyCount.Add(-1)
+		return false, ErrDatabaseFull
+	}
+	if warning := int64(float64(limit) * mem.cfg.SoftWarningThreshold); count > warning && count-1 <= warning {
+		logger.Warn("key count approaching the limit", "key_count", count, "max_key_count", limit)
+	}
+	return true, nil
+}
 
-	entry := KeyValue{Key: key, Value: value}
-	mem.wal.AppendEntry(Set, entry)
-	mem.data = append(mem.data, entry)
+// seedKeyCount sets the key count to the number of live keys in the SST files and the
+// memtable, so MaxKeyCount counts the keys written before a restart. It reads every SST
+// file, so it only runs once a limit is set.
+func (mem *memDB) seedKeyCount() error {
+	count, err := mem.liveKeyCount()
+	if err != nil {
+		return err
+	}
+	mem.keyCount.Store(count)
+	return nil
+}
+
+// liveKeyCount returns the number of live keys in the SST files and the memtable.
+func (mem *memDB) liveKeyCount() (int64, error) {
+	var count int64
+	if err := mem.Export(func(KeyValue) error {
+		count++
+		return nil
+	}); err != nil {
+		return 0, fmt.Errorf("error counting keys: %w", err)
+	}
+	return count, nil
+}
+
+// appendWAL logs an operation, retrying transient write errors such as a full disk. Records
+// written partially or in full before the error are not retried; see ErrUnsyncedWALWrite.
+// The caller must not hold mem.mu, as the retries may take WALWriteRetryPolicy.MaxRetryDuration.
+func (mem *memDB) appendWAL(operation Operation, kv KeyValue) error {
+	attempts := 0
+	var lastErr error
+	err := withRetry(context.Background(), mem.cfg.WALWriteRetryPolicy, func() error {
+		attempts++
+		if attempts == 2 {
+			logger.Warn("WAL append failed, retrying", "key", string(kv.Key), "error", lastErr)
+		}
+		lastErr = mem.wal.AppendEntry(operation, kv)
+		return lastErr
+	})
+	if err != nil && attempts > 1 {
+		logger.Error("WAL append failed after retries", "key", string(kv.Key), "retries", attempts-1, "error", err)
+	} else if attempts > 1 {
+		logger.Info("WAL append succeeded after retries", "key", string(kv.Key), "retries", attempts-1)
+	}
+	return err
+}
+
+// appendWALLocked logs an operation for a caller holding mem.mu. It fails fast on the first
+// error, as waiting between retries with the lock held would stall every read and write.
+func (mem *memDB) appendWALLocked(operation Operation, kv KeyValue) error {
+	return mem.wal.AppendEntry(operation, kv)
+}
+
+// upsert replaces the entry for kv.Key, or appends kv if the key is new, and
+// returns the new memtable size. Set values are compressed first if configured.
+func (mem *memDB) upsert(kv KeyValue) int64 {
+	kv = mem.compressEntry(kv)
+	for i := range mem.data {
+		if string(mem.data[i].Key) == string(kv.Key) {
+			// Move the key to the end so mem.data stays in order of last write,
+			// which is the order evictOldest evicts in
+			mem.size.Add(-entrySize(mem.data[i]))
+			mem.data = append(mem.data[:i], mem.data[i+1:]...)
+			break
+		}
+	}
+	mem.data = append(mem.data, kv)
+	return mem.size.Add(entrySize(kv))
+}
+
+// applyEntry applies a logged operation to the memtable and returns the new
+// memtable size. A delete leaves a tombstone in the memtable, or in mem.tombstones
+// with DeletePhysical, so the next flush hides older values of the key in SST files.
+// The caller must hold mem.mu.
+func (mem *memDB) applyEntry(kv KeyValue) int64 {
+	switch kv.Operation {
+	case Delete:
+		tombstone := KeyValue{Key: kv.Key, Operation: Delete}
+		if mem.cfg.DeleteMode != DeletePhysical {
+			return mem.upsert(tombstone)
+		}
+		for i := range mem.data {
+			if string(mem.data[i].Key) == string(kv.Key) {
+				mem.size.Add(-entrySize(mem.data[i]))
+				mem.data = append(mem.data[:i], mem.data[i+1:]...)
+				break
+			}
+		}
+		mem.tombstones = append(mem.tombstones, tombstone)
+		return mem.size.Load()
+	case Merge:
+		op := mem.cfg.MergeOperator
+		if op == nil {
+			return mem.upsert(kv)
+		}
+		for _, existing := range mem.data {
+			if string(existing.Key) != string(kv.Key) {
+				continue
+			}
+			if existing.Operation == Merge {
+				kv.Value = op.PartialMerge(kv.Key, existing.Value, kv.Value)
+			} else if existing, err := existing.decompressed(); err != nil {
+				logger.Error("error reading memtable value", "error", err)
+			} else {
+				kv = KeyValue{Key: kv.Key, Value: op.FullMerge(kv.Key, existing.Value, [][]byte{kv.Value}), Tags: existing.Tags}
+			}
+			break
+		}
+		return mem.upsert(kv)
+	case BatchBegin, BatchCommit:
+		return mem.size.Load()
+	default:
+		return mem.upsert(kv)
+	}
+}
+
+// memtableFull reports whether the memtable reached one of its configured limits.
+func (mem *memDB) memtableFull(size int64) bool {
+	if mem.cfg.MaxMemtableEntries > 0 && len(mem.data) >= mem.cfg.MaxMemtableEntries {
+		return true
+	}
+	if mem.cfg.MaxSSTFileSize > 0 && size+sstEntryOverhead*int64(len(mem.data)) >= mem.cfg.MaxSSTFileSize {
+		return true
+	}
+	return mem.cfg.MaxMemtableBytes > 0 && size >= mem.cfg.MaxMemtableBytes
+}
+
+// sstEntryOverhead estimates the bytes an SST record needs besides its key and value.
+const sstEntryOverhead = 8
+
+// Size returns the number of key and value bytes held in the memtable.
+func (mem *memDB) Size() int64 {
+	return mem.size.Load()
+}
+
+// memtableValue returns the value of key held in the memtable, or nil. The SST files are not
+// read, so writes do not pay for a disk lookup to publish their events. The caller must hold
+// mem.mu.
+func (mem *memDB) memtableValue(key []byte) []byte {
+	for _, kv := range mem.data {
+		if string(kv.Key) == string(key) {
+			kv, _ = kv.decompressed()
+			return kv.Value
+		}
+	}
 	return nil
 }
 
+func entrySize(kv KeyValue) int64 {
+	size := len(kv.Key) + len(kv.Value)
+	for name, value := range kv.Tags {
+		size += len(name) + len(value)
+	}
+	return int64(size)
+}
+
 func (mem *memDB) Del(key []byte) ([]byte, error) {
+	if mem.readOnly {
+		return nil, ErrReadOnly
+	}
+	key = mem.transformKey(key)
+	defer mem.lockRead()()
+	if mem.closed {
+		return nil, ErrDatabaseClosed
+	}
+	mem.awaitPendingWrites()
+
+	deletedValue, err := mem.getLocked(key)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, errors.New("key doesn't exist")
+	}
+	if err != nil {
+		return nil, err
+	}
+	tombstone := KeyValue{Key: key, Operation: Delete}
+	if err := mem.appendWALLocked(Delete, tombstone); err != nil {
+		return nil, err
+	}
+	size := mem.applyEntry(tombstone)
+	mem.keyCount.Add(-1)
+	mem.events.Publish(Delete, key, deletedValue, nil)
+
+	mem.flushIfFull(size)
+	return deletedValue, nil
+}
+
+func (mem *memDB) Get(key []byte) ([]byte, error) {
+	defer mem.lockRead()()
+	return mem.getLocked(mem.transformKey(key))
+}
+
+// lockRead takes a read token of cfg.IOSemaphore, then mem.mu, and returns the function
+// releasing both. Lookups that may read SST files under mem.mu lock through it, so they
+// never queue for a token while holding the lock and stalling the writes.
+func (mem *memDB) lockRead() func() {
+	release := mem.cfg.IOSemaphore.AcquireRead()
 	mem.mu.Lock()
-	defer mem.mu.Unlock()
+	return func() {
+		mem.mu.Unlock()
+		release()
+	}
+}
 
-	for i, kv := range mem.data {
+// lockReserve locks mem.mu for reserveKey, through lockRead when a key limit makes it look
+// keys up in the SST files.
+func (mem *memDB) lockReserve() func() {
+	if mem.maxKeyCount.Load() > 0 {
+		return mem.lockRead()
+	}
+	mem.mu.Lock()
+	return mem.mu.Unlock
+}
+
+// getLocked looks key up like Get. The value may point into the memtable, so it is
+// only valid while the caller holds mem.mu.
+func (mem *memDB) getLocked(key []byte) ([]byte, error) {
+	if mem.closed {
+		return nil, ErrDatabaseClosed
+	}
+
+	mem.sketch.Update(key)
+
+	// Check if the key exists in the in-memory data
+	var operands [][]byte // Merge operands, newest first
+	for _, kv := range mem.data {
 		if string(kv.Key) == string(key) {
-			deletedValue := kv.Value
-			mem.wal.AppendEntry(Delete, kv)
-			mem.data = append(mem.data[:i], mem.data[i+1:]...)
-			return deletedValue, nil
+			switch kv.Operation {
+			case Merge:
+				operands = append(operands, kv.Value)
+			case Delete:
+				return mem.resolveMerge(key, nil, false, operands)
+			default:
+				if kv.expired(time.Now()) {
+					return mem.resolveMerge(key, nil, false, operands)
+				}
+				kv, err := kv.decompressed()
+				return kv.Value, err
+			}
+			break
 		}
 	}
-	return nil, errors.New("key doesn't exist")
+
+	// A tombstone hides older versions of the key
+	if mem.tombstoned(key) {
+		return mem.resolveMerge(key, nil, false, operands)
+	}
+
+	// Key not found in in-memory data, search the SST files that may hold it
+	return mem.getFromSST(key, operands)
 }
 
-func (mem *memDB) Get(key []byte) ([]byte, error) {
-    mem.mu.Lock()
-    defer mem.mu.Unlock()
-
-    // Check if the key exists in the in-memory data
-    for _, kv := range mem.data {
-        if string(kv.Key) == string(key) {
-            return kv.Value, nil
-        }
-    }
-
-    // Key not found in in-memory data, attempt to load from SST file if not already loaded
-    if !mem.sstFileLoaded {
-        fileName := fmt.Sprintf("file_%d.sst", time.Now().Unix()) 
-        err := mem.loadSSTFile(fileName)
-        if err != nil {
-            return nil, err
-        }
-    }
-
-    // Search the loaded SST file data for the key
-    for _, kv := range mem.data {
-        if string(kv.Key) == string(key) {
-            return kv.Value, nil
-        }
-    }
-
-    // Key not found in SST file data either
-    return nil, errors.New("key not found")
+// getFromSST looks key up in the SST files that may hold it, in the order of sstCandidates.
+func (mem *memDB) getFromSST(key []byte, operands [][]byte) ([]byte, error) {
+	entries, err := mem.sstEntries(key)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, kv := range entries {
+		switch kv.Operation {
+		case Merge:
+			operands = append(operands, kv.Value)
+		case Delete:
+			return mem.resolveMerge(key, nil, false, operands)
+		default:
+			if kv.expired(time.Now()) {
+				return mem.resolveMerge(key, nil, false, operands)
+			}
+			return mem.resolveMerge(key, kv.Value, true, operands)
+		}
+	}
+	return mem.resolveMerge(key, nil, false, operands)
+}
+
+// manifestRetries is how often sstEntries reads the manifest before giving up on files
+// compacted away while it looked them up.
+const manifestRetries = 3
+
+// sstEntries returns the entries of key in the SST files that may hold it, in the order of
+// sstCandidates, up to the first one that is not a merge operand. A file compacted away
+// since the manifest was read is not skipped, as its entry may only be in the merged file,
+// which that manifest did not list: the lookup starts over from the current manifest.
+func (mem *memDB) sstEntries(key []byte) ([]KeyValue, error) {
+	for attempt := 1; ; attempt++ {
+		entries, err := mem.sstEntriesOnce(key)
+		if errors.Is(err, os.ErrNotExist) && attempt < manifestRetries {
+			continue
+		}
+		return entries, err
+	}
+}
+
+func (mem *memDB) sstEntriesOnce(key []byte) ([]KeyValue, error) {
+	files, err := mem.sstCandidates(key)
+	if err != nil {
+		return nil, err
+	}
+	var entries []KeyValue
+	for _, file := range files {
+		mem.sstFilesOpened.Add(1)
+		kv, found, err := mem.lookupSST(filepath.Join(mem.cfg.DataDir, file.FileName), key)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			continue
+		}
+		entries = append(entries, kv)
+		if kv.Operation != Merge {
+			break
+		}
+	}
+	return entries, nil
+}
+
+// readCandidateManifest reads the manifest for sstCandidates. Tests replace it to compact
+// the files between the read and their lookups.
+var readCandidateManifest = ReadManifest
+
+// sstCandidates returns the files listed in the manifest whose key range contains key, in
+// the order they must be searched: the overlapping L0 files newest first, then at most
+// one file per deeper level.
+func (mem *memDB) sstCandidates(key []byte) ([]SSTFileMeta, error) {
+	manifest, err := readCandidateManifest(mem.cfg.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	files := FindL0Candidates(key, manifest)
+	var deeper []SSTFileMeta
+	for _, file := range manifest {
+		if file.Level > 0 && keyInFile(key, file) {
+			deeper = append(deeper, file)
+		}
+	}
+	sort.Slice(deeper, func(i, j int) bool {
+		if deeper[i].Level != deeper[j].Level {
+			return deeper[i].Level < deeper[j].Level
+		}
+		return deeper[i].SequenceNumber > deeper[j].SequenceNumber
+	})
+	return append(files, deeper...), nil
+}
+
+// FindL0Candidates returns the level 0 files of manifest whose key range contains key,
+// newest first. Unlike deeper levels, level 0 files may overlap, so all of them must be searched.
+func FindL0Candidates(key []byte, manifest []SSTFileMeta) []SSTFileMeta {
+	var candidates []SSTFileMeta
+	for _, file := range manifest {
+		if file.Level == 0 && keyInFile(key, file) {
+			candidates = append(candidates, file)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].SequenceNumber > candidates[j].SequenceNumber
+	})
+	return candidates
+}
+
+func keyInFile(key []byte, file SSTFileMeta) bool {
+	return bytes.Compare(key, file.SmallestKey) >= 0 && bytes.Compare(key, file.LargestKey) <= 0
+}
+
+// lookupSST returns the entry of key in an SST file. The file is decoded into a buffer
+// from the block pool, so the value is copied before the buffer is given back.
+func (mem *memDB) lookupSST(fileName string, key []byte) (KeyValue, bool, error) {
+	if !mem.sstMayContain(fileName, key) {
+		return KeyValue{}, false, nil
+	}
+	entries, buf, err := mem.readSSTFileInto(fileName, mem.blockPool.Get())
+	defer mem.blockPool.Put(buf)
+	if err != nil {
+		return KeyValue{}, false, err
+	}
+
+	i := sort.Search(len(entries), func(i int) bool {
+		return bytes.Compare(entries[i].Key, key) >= 0
+	})
+	if i == len(entries) || !bytes.Equal(entries[i].Key, key) {
+		return KeyValue{}, false, nil
+	}
+	kv := entries[i]
+	kv.Key = key
+	kv.Value = bytes.Clone(kv.Value)
+	return kv, true, nil
+}
+
+// resolveMerge combines the newest-first merge operands of key with its base value.
+func (mem *memDB) resolveMerge(key, base []byte, found bool, operands [][]byte) ([]byte, error) {
+	if len(operands) == 0 {
+		if !found {
+			return nil, ErrKeyNotFound
+		}
+		return base, nil
+	}
+	oldestFirst := make([][]byte, len(operands))
+	for i, operand := range operands {
+		oldestFirst[len(operands)-1-i] = operand
+	}
+	return mem.cfg.MergeOperator.FullMerge(key, base, oldestFirst), nil
 }
 
+func (mem *memDB) tombstoned(key []byte) bool {
+	for _, kv := range mem.tombstones {
+		if string(kv.Key) == string(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetAll returns a copy of the memtable entries that stays valid while the memtable changes.
+// Tombstones are left out.
 func (mem *memDB) GetAll() ([]KeyValue, error) {
 	mem.mu.Lock()
 	defer mem.mu.Unlock()
 
-	return mem.data, nil
+	entries := make([]KeyValue, 0, len(mem.data))
+	for _, kv := range mem.data {
+		if kv.Operation == Delete {
+			continue
+		}
+		kv, err := kv.decompressed()
+		if err != nil {
+			return nil, err
+		}
+		kv.Key = bytes.Clone(kv.Key)
+		kv.Value = bytes.Clone(kv.Value)
+		entries = append(entries, kv)
+	}
+	return entries, nil
+}
+
+// GetAllSorted returns a copy of the memtable entries sorted by key.
+func (mem *memDB) GetAllSorted() ([]KeyValue, error) {
+	entries, err := mem.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].Key, entries[j].Key) < 0
+	})
+	return entries, nil
+}
+
+// GetRange returns the memtable entries whose keys fall in [start, end), sorted by key,
+// without tombstones. A nil end means no upper bound.
+func (mem *memDB) GetRange(start, end []byte) ([]KeyValue, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	result := make([]KeyValue, 0)
+	for _, kv := range mem.data {
+		if kv.Operation != Delete && inRange(kv.Key, start, end) {
+			kv, err := kv.decompressed()
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, kv)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return bytes.Compare(result[i].Key, result[j].Key) < 0
+	})
+	return result, nil
+}
+
+// Keys returns all keys held in the memtable, sorted.
+func (mem *memDB) Keys() ([][]byte, error) {
+	entries, err := mem.GetRange(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([][]byte, len(entries))
+	for i, kv := range entries {
+		keys[i] = kv.Key
+	}
+	return keys, nil
+}
+
+// errEndOfRange stops an Export once it passed the end of a range.
+var errEndOfRange = errors.New("end of range")
+
+// DelRange deletes every live key in [start, end), in the memtable and the SST files, and
+// returns how many were removed. Each key gets a Delete tombstone like Del, so its flushed
+// values do not come back.
+func (mem *memDB) DelRange(start, end []byte) (int, error) {
+	if mem.readOnly {
+		return 0, ErrReadOnly
+	}
+	// The SST files are read before taking mem.mu; keys written since are in the memtable
+	values := make(map[string][]byte)
+	err := mem.Export(func(kv KeyValue) error {
+		if end != nil && bytes.Compare(kv.Key, end) >= 0 {
+			return errEndOfRange
+		}
+		if inRange(kv.Key, start, end) {
+			values[string(kv.Key)] = kv.Value
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errEndOfRange) {
+		return 0, err
+	}
+
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	if mem.closed {
+		return 0, ErrDatabaseClosed
+	}
+	mem.awaitPendingWrites()
+	for _, kv := range mem.data {
+		if !inRange(kv.Key, start, end) {
+			continue
+		}
+		if kv.Operation == Delete {
+			delete(values, string(kv.Key)) // Deleted since the export
+			continue
+		}
+		value, err := kv.decompressed()
+		if err != nil {
+			return 0, err
+		}
+		values[string(kv.Key)] = value.Value
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		if !mem.tombstoned([]byte(key)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	deleted := 0
+	size := mem.size.Load()
+	for _, key := range keys {
+		tombstone := KeyValue{Key: []byte(key), Operation: Delete}
+		if err := mem.appendWALLocked(Delete, tombstone); err != nil {
+			return deleted, err
+		}
+		size = mem.applyEntry(tombstone)
+		mem.keyCount.Add(-1)
+		mem.events.Publish(Delete, tombstone.Key, values[key], nil)
+		deleted++
+	}
+	mem.flushIfFull(size)
+	return deleted, nil
+}
+
+func inRange(key, start, end []byte) bool {
+	return bytes.Compare(key, start) >= 0 && (end == nil || bytes.Compare(key, end) < 0)
+}
+
+func (mem *memDB) SetContext(ctx context.Context, key, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return mem.Set(key, value)
+}
+
+func (mem *memDB) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return mem.Get(key)
+}
+
+func (mem *memDB) DelContext(ctx context.Context, key []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return mem.Del(key)
+}
+
+// Close stops the background goroutines, flushes the memtable to an SST file, moves
+// the WAL watermark past the flushed entries and closes the WAL. Writes queued by
+// AsyncSet are logged first. Later Set, Get and Del calls fail with ErrDatabaseClosed.
+// Closing a closed database does nothing.
+func (mem *memDB) Close() error {
+	mem.mu.Lock()
+	if mem.closed {
+		mem.mu.Unlock()
+		return nil
+	}
+	mem.closed = true
+	close(mem.stopCh)
+	mem.mu.Unlock()
+
+	// The goroutines may need the lock to finish their current run
+	mem.stopCompactionSchedule()
+	mem.stopAsyncWriter()
+	mem.bgWG.Wait()
+	mem.stopStatsFlush()
+
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	if mem.readOnly {
+		return nil // Values copied by Warmup are in the clone's files already
+	}
+	if err := mem.createSSTFile(); err != nil {
+		return fmt.Errorf("error flushing memtable: %w", err)
+	}
+	if mem.wal == nil {
+		return nil
+	}
+	position, err := mem.wal.Position()
+	if err != nil {
+		return err
+	}
+	if err := mem.wal.CleanupAfterSSTCreation(position); err != nil {
+		return fmt.Errorf("error cleaning up WAL: %w", err)
+	}
+	return mem.wal.Close()
+}
+
+func (mem *memDB) CircuitBreakerState() string {
+	return mem.breaker.State()
+}
+
+func (mem *memDB) Stats() DBStats {
+	stats := mem.metrics.Snapshot()
+	stats.ReplicationLagSeconds = mem.ReplicationLag().Seconds()
+	stats.KeyCount = mem.keyCount.Load()
+	stats.MaxKeyCount = mem.maxKeyCount.Load()
+	stats.WALSyncPolicy = mem.wal.EffectiveSyncPolicy().String()
+	return stats
 }
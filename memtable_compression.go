@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// CompressedFlag is set in KeyValue.Flags when the value is gzip-compressed. Only memtable
+// entries are compressed; values are decompressed before they leave the memtable.
+const CompressedFlag uint8 = 1 << 0
+
+// compressEntry gzip-compresses the value of a Set entry at BestSpeed when memtable value
+// compression is enabled and the value is at least cfg.MinCompressionSize bytes long.
+// Values that do not shrink are kept as they are.
+func (mem *memDB) compressEntry(kv KeyValue) KeyValue {
+	if !mem.cfg.MemtableValueCompression || kv.Operation != Set || kv.Flags&CompressedFlag != 0 || len(kv.Value) < mem.cfg.MinCompressionSize {
+		return kv
+	}
+	var buf bytes.Buffer
+	gz, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	if _, err := gz.Write(kv.Value); err != nil {
+		return kv
+	}
+	if err := gz.Close(); err != nil || buf.Len() >= len(kv.Value) {
+		return kv
+	}
+	kv.Value = buf.Bytes()
+	kv.Flags |= CompressedFlag
+	return kv
+}
+
+// decompressed returns kv with its value decompressed if it is compressed.
+func (kv KeyValue) decompressed() (KeyValue, error) {
+	if kv.Flags&CompressedFlag == 0 {
+		return kv, nil
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(kv.Value))
+	if err != nil {
+		return kv, fmt.Errorf("error decompressing value of %q: %w", kv.Key, err)
+	}
+	value, err := io.ReadAll(gz)
+	if err != nil {
+		return kv, fmt.Errorf("error decompressing value of %q: %w", kv.Key, err)
+	}
+	kv.Value = value
+	kv.Flags &^= CompressedFlag
+	return kv, nil
+}
+
+// decompressEntries returns entries with every value decompressed. The slice is returned
+// as is when none of them is compressed.
+func decompressEntries(entries []KeyValue) ([]KeyValue, error) {
+	compressed := false
+	for _, kv := range entries {
+		if kv.Flags&CompressedFlag != 0 {
+			compressed = true
+			break
+		}
+	}
+	if !compressed {
+		return entries, nil
+	}
+	result := make([]KeyValue, len(entries))
+	for i, kv := range entries {
+		var err error
+		if result[i], err = kv.decompressed(); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+)
+
+// MergeOperator combines successive writes to the same key instead of letting the
+// newest value replace the older ones, e.g. for counters or append-only lists.
+type MergeOperator interface {
+	// PartialMerge combines two operands, left being the older one, without the base value.
+	PartialMerge(key, left, right []byte) []byte
+	// FullMerge applies operands, oldest first, to the existing value, which is nil if the key has none.
+	FullMerge(key, existingValue []byte, operands [][]byte) []byte
+}
+
+// StringAppendMergeOperator appends every operand to the value, separated by Delimiter.
+type StringAppendMergeOperator struct {
+	Delimiter string
+}
+
+func (op StringAppendMergeOperator) PartialMerge(key, left, right []byte) []byte {
+	merged := make([]byte, 0, len(left)+len(op.Delimiter)+len(right))
+	merged = append(merged, left...)
+	merged = append(merged, op.Delimiter...)
+	return append(merged, right...)
+}
+
+func (op StringAppendMergeOperator) FullMerge(key, existingValue []byte, operands [][]byte) []byte {
+	values := operands
+	if existingValue != nil {
+		values = append([][]byte{existingValue}, operands...)
+	}
+	return bytes.Join(values, []byte(op.Delimiter))
+}
+
+var ErrNoMergeOperator = errors.New("no merge operator configured")
+
+// Merge records operand for key. The configured MergeOperator combines it with the
+// key's earlier value and operands when the key is read or compacted.
+func (mem *memDB) Merge(key, operand []byte) error {
+	if mem.readOnly {
+		return ErrReadOnly
+	}
+	op := mem.cfg.MergeOperator
+	if op == nil {
+		return ErrNoMergeOperator
+	}
+	key = mem.transformKey(key)
+
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	mem.awaitPendingWrites()
+
+	entry := KeyValue{Key: key, Value: operand, Operation: Merge}
+	if err := mem.appendWALLocked(Merge, entry); err != nil {
+		return err
+	}
+
+	oldValue := mem.memtableValue(key)
+	size := mem.applyEntry(entry)
+	mem.events.Publish(Merge, key, oldValue, operand)
+
+	mem.flushIfFull(size)
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ioRateInterval is how often the WAL and SST write rates are sampled.
+const ioRateInterval = 10 * time.Second
+
+// sstBytesWritten and sstBytesRead count the bytes of SST files written and read by the
+// process. SST files are written by free functions, so the counters are shared by every database.
+var sstBytesWritten, sstBytesRead atomic.Uint64
+
+// CountingWriter adds the number of bytes written through it to Count.
+type CountingWriter struct {
+	W     io.Writer
+	Count *atomic.Uint64
+}
+
+func (c CountingWriter) Write(p []byte) (int, error) {
+	n, err := c.W.Write(p)
+	c.Count.Add(uint64(n))
+	return n, err
+}
+
+// CountingReader adds the number of bytes read through it to Count.
+type CountingReader struct {
+	R     io.Reader
+	Count *atomic.Uint64
+}
+
+func (c CountingReader) Read(p []byte) (int, error) {
+	n, err := c.R.Read(p)
+	c.Count.Add(uint64(n))
+	return n, err
+}
+
+// CompactionStats describes a single compaction run.
+type CompactionStats struct {
+	FilesMerged           int           `json:"files_merged_count"`
+	InputBytes            int64         `json:"total_input_bytes"`
+	OutputBytes           int64         `json:"total_output_bytes"`
+	Duration              time.Duration `json:"duration_ns"`
+	KeysTotal             int           `json:"keys_total"`
+	KeysDroppedTombstones int           `json:"keys_dropped_tombstones"`
+	KeysDroppedExpired    int           `json:"keys_dropped_expired"`
+	KeysDroppedFilter     int           `json:"keys_dropped_filter"`
+	Anomalies             int           `json:"anomalies"` // Keys found in more than one input of the same level above 0
+}
+
+// WriteAmplification is the ratio of bytes written to bytes read by the run.
+func (s CompactionStats) WriteAmplification() float64 {
+	if s.InputBytes == 0 {
+		return 0
+	}
+	return float64(s.OutputBytes) / float64(s.InputBytes)
+}
+
+// DBStats is the snapshot served by /stats and /metrics.
+type DBStats struct {
+	CompactionsTotal               uint64           `json:"compactions_total"`
+	CompactionBytesWrittenTotal    uint64           `json:"compaction_bytes_written_total"`
+	CompactionDurationSecondsTotal float64          `json:"compaction_duration_seconds_total"`
+	CompactionAnomalies            uint64           `json:"compaction_anomalies"`
+	LastCompaction                 *CompactionStats `json:"last_compaction,omitempty"`
+	ReplicationLagSeconds          float64          `json:"replication_lag_seconds"`
+	WALWriteBytesPerSec            float64          `json:"wal_write_bytes_per_sec"`
+	SSTWriteBytesPerSec            float64          `json:"sst_write_bytes_per_sec"`
+	KeyCount                       int64            `json:"key_count"`
+	MaxKeyCount                    int64            `json:"max_key_count"`       // 0 is unlimited
+	WALSyncPolicy                  string           `json:"wal_sync_policy"`     // Policy WAL appends currently follow
+	RequestQueueDepth              int              `json:"request_queue_depth"` // HTTP requests being handled; set by the server
+}
+
+// MetricsCollector accumulates the counters reported by the database.
+type MetricsCollector struct {
+	mu    sync.Mutex
+	stats DBStats
+}
+
+func NewMetricsCollector() *MetricsCollector {
+	return &MetricsCollector{}
+}
+
+// RecordCompaction adds a compaction run to the totals. A nil collector ignores it.
+func (m *MetricsCollector) RecordCompaction(stats CompactionStats) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.stats.CompactionsTotal++
+	m.stats.CompactionBytesWrittenTotal += uint64(stats.OutputBytes)
+	m.stats.CompactionDurationSecondsTotal += stats.Duration.Seconds()
+	m.stats.CompactionAnomalies += uint64(stats.Anomalies)
+	m.stats.LastCompaction = &stats
+}
+
+// SetWriteRates stores the WAL and SST write rates measured over the last sampling
+// interval. A nil collector ignores them.
+func (m *MetricsCollector) SetWriteRates(walBytesPerSec, sstBytesPerSec float64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.stats.WALWriteBytesPerSec = walBytesPerSec
+	m.stats.SSTWriteBytesPerSec = sstBytesPerSec
+}
+
+func (m *MetricsCollector) Snapshot() DBStats {
+	if m == nil {
+		return DBStats{}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snapshot := m.stats
+	if snapshot.LastCompaction != nil {
+		last := *snapshot.LastCompaction
+		snapshot.LastCompaction = &last
+	}
+	return snapshot
+}
+
+// writePrometheus renders stats in the Prometheus text exposition format.
+func writePrometheus(w io.Writer, stats DBStats) error {
+	metrics := []struct {
+		name  string
+		help  string
+		kind  string
+		value float64
+	}{
+		{"compactions_total", "Number of completed compactions.", "counter", float64(stats.CompactionsTotal)},
+		{"compaction_bytes_written_total", "Bytes written by compactions.", "counter", float64(stats.CompactionBytesWrittenTotal)},
+		{"compaction_duration_seconds_total", "Time spent compacting SST files.", "counter", stats.CompactionDurationSecondsTotal},
+		{"compaction_anomalies_total", "Keys compactions found in overlapping files of the same level.", "counter", float64(stats.CompactionAnomalies)},
+		{"replication_lag_seconds", "Round trip of the last WAL entry acknowledged by the replica.", "gauge", stats.ReplicationLagSeconds},
+		{"wal_write_bytes_per_sec", "Bytes appended to the WAL per second over the last sampling interval.", "gauge", stats.WALWriteBytesPerSec},
+		{"sst_write_bytes_per_sec", "Bytes of SST files written per second over the last sampling interval.", "gauge", stats.SSTWriteBytesPerSec},
+	}
+
+	for _, metric := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n",
+			metric.name, metric.help, metric.name, metric.kind, metric.name, metric.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sampleWriteRates stores the WAL and SST write rates in the metrics every interval until the
+// database is closed.
+func (mem *memDB) sampleWriteRates(interval time.Duration) {
+	defer mem.bgWG.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastWAL uint64
+	if mem.wal != nil {
+		lastWAL = mem.wal.BytesWritten.Load()
+	}
+	lastSST := sstBytesWritten.Load()
+	last := time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			var walBytes uint64
+			if mem.wal != nil {
+				walBytes = mem.wal.BytesWritten.Load()
+			}
+			sstBytes := sstBytesWritten.Load()
+			elapsed := now.Sub(last).Seconds()
+			mem.metrics.SetWriteRates(float64(walBytes-lastWAL)/elapsed, float64(sstBytes-lastSST)/elapsed)
+			lastWAL, lastSST, last = walBytes, sstBytes, now
+		case <-mem.stopCh:
+			return
+		}
+	}
+}
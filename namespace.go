@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+)
+
+// NamespacedDB is a view of a memDB in which every key is transparently prefixed
+// with "<name><separator>", so tenants sharing a database cannot see each other's keys.
+type NamespacedDB struct {
+	db     *memDB
+	prefix []byte
+}
+
+var _ Storage = (*NamespacedDB)(nil)
+
+func (mem *memDB) Namespace(name string) *NamespacedDB {
+	return &NamespacedDB{
+		db:     mem,
+		prefix: []byte(name + mem.namespaceSeparator()),
+	}
+}
+
+// DropNamespace deletes every key stored in the namespace.
+func (mem *memDB) DropNamespace(name string) error {
+	prefix := []byte(name + mem.namespaceSeparator())
+	_, err := mem.DelRange(prefix, prefixEnd(prefix))
+	return err
+}
+
+func (mem *memDB) namespaceSeparator() string {
+	if mem.cfg.NamespaceSeparator == "" {
+		return ":"
+	}
+	return mem.cfg.NamespaceSeparator
+}
+
+// prefixEnd returns the smallest key greater than every key starting with prefix,
+// or nil if there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+func (ns *NamespacedDB) key(key []byte) []byte {
+	return append(bytes.Clone(ns.prefix), key...)
+}
+
+// Namespace returns a namespace nested inside this one.
+func (ns *NamespacedDB) Namespace(name string) *NamespacedDB {
+	return &NamespacedDB{
+		db:     ns.db,
+		prefix: ns.key([]byte(name + ns.db.namespaceSeparator())),
+	}
+}
+
+func (ns *NamespacedDB) Set(key, value []byte) error {
+	return ns.db.Set(ns.key(key), value)
+}
+
+func (ns *NamespacedDB) Get(key []byte) ([]byte, error) {
+	return ns.db.Get(ns.key(key))
+}
+
+func (ns *NamespacedDB) Del(key []byte) ([]byte, error) {
+	return ns.db.Del(ns.key(key))
+}
+
+// GetRange returns the entries of the namespace in [start, end), with the prefix removed.
+func (ns *NamespacedDB) GetRange(start, end []byte) ([]KeyValue, error) {
+	rangeEnd := prefixEnd(ns.prefix)
+	if end != nil {
+		rangeEnd = ns.key(end)
+	}
+	entries, err := ns.db.GetRange(ns.key(start), rangeEnd)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		entries[i].Key = entries[i].Key[len(ns.prefix):]
+	}
+	return entries, nil
+}
+
+func (ns *NamespacedDB) Keys() ([][]byte, error) {
+	entries, err := ns.GetRange(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([][]byte, len(entries))
+	for i, kv := range entries {
+		keys[i] = kv.Key
+	}
+	return keys, nil
+}
+
+func (ns *NamespacedDB) SetContext(ctx context.Context, key, value []byte) error {
+	return ns.db.SetContext(ctx, ns.key(key), value)
+}
+
+func (ns *NamespacedDB) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	return ns.db.GetContext(ctx, ns.key(key))
+}
+
+func (ns *NamespacedDB) DelContext(ctx context.Context, key []byte) ([]byte, error) {
+	return ns.db.DelContext(ctx, ns.key(key))
+}
+
+func (ns *NamespacedDB) Frequency(key []byte) uint64 {
+	return ns.db.Frequency(ns.key(key))
+}
+
+func (ns *NamespacedDB) CircuitBreakerState() string {
+	return ns.db.CircuitBreakerState()
+}
+
+func (ns *NamespacedDB) Stats() DBStats {
+	return ns.db.Stats()
+}
+
+func (ns *NamespacedDB) CompactionProgress() CompactionProgress {
+	return ns.db.CompactionProgress()
+}
+
+func (ns *NamespacedDB) CacheWarm() bool {
+	return ns.db.CacheWarm()
+}
+
+// Flush flushes the memtable of the whole database; namespaces share it.
+func (ns *NamespacedDB) Flush(progress FlushProgressFunc) error {
+	return ns.db.Flush(progress)
+}
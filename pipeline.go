@@ -0,0 +1,69 @@
+package main
+
+// pendingWrite is a Set whose WAL record is being written without holding mem.mu.
+// Its entry moves to the memtable once it and every write queued before it are logged.
+type pendingWrite struct {
+	kv     KeyValue
+	logged chan struct{} // Closed when the WAL append finished, successfully or not
+	err    error         // Result of the WAL append, set before logged is closed
+
+	addedKey bool // The write counted its key as new in mem.keyCount
+}
+
+// queueWrite adds kv to the pending writes and returns it with the write queued
+// before it, if that one may still be logging. The caller must hold mem.mu.
+func (mem *memDB) queueWrite(kv KeyValue) (*pendingWrite, *pendingWrite) {
+	var prev *pendingWrite
+	if n := len(mem.pending); n > 0 {
+		prev = mem.pending[n-1]
+	}
+	write := &pendingWrite{kv: kv, logged: make(chan struct{})}
+	mem.pending = append(mem.pending, write)
+	return write, prev
+}
+
+// logWrite appends write to the WAL after prev was logged, so the log keeps the
+// order in which writes were queued. The caller must not hold mem.mu.
+func (mem *memDB) logWrite(write, prev *pendingWrite) {
+	if prev != nil {
+		<-prev.logged
+	}
+	write.err = mem.appendWAL(Set, write.kv)
+	close(write.logged)
+}
+
+// applyPendingWrites moves the logged writes at the front of the queue to the
+// memtable, dropping the ones whose WAL append failed, and returns the memtable
+// size. The caller must hold mem.mu.
+func (mem *memDB) applyPendingWrites() int64 {
+	for len(mem.pending) > 0 {
+		write := mem.pending[0]
+		select {
+		case <-write.logged:
+		default:
+			return mem.size.Load()
+		}
+		mem.pending[0] = nil
+		mem.pending = mem.pending[1:]
+		if write.err != nil {
+			if write.addedKey {
+				mem.keyCount.Add(-1)
+			}
+			continue
+		}
+		oldValue := mem.memtableValue(write.kv.Key)
+		mem.upsert(write.kv)
+		mem.events.Publish(Set, write.kv.Key, oldValue, write.kv.Value)
+	}
+	return mem.size.Load()
+}
+
+// awaitPendingWrites waits for the queued writes to be logged and applies them, so
+// an operation logging while it holds mem.mu comes after them in both the WAL and
+// the memtable. The caller must hold mem.mu.
+func (mem *memDB) awaitPendingWrites() {
+	if n := len(mem.pending); n > 0 {
+		<-mem.pending[n-1].logged
+	}
+	mem.applyPendingWrites()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// CompactionProgress reports how far the running or most recent compaction got.
+type CompactionProgress struct {
+	FilesTotal              int       `json:"files_total"`
+	FilesProcessed          int       `json:"files_processed"`
+	BytesTotal              int64     `json:"bytes_total"`
+	BytesProcessed          int64     `json:"bytes_processed"`
+	EstimatedCompletionTime time.Time `json:"estimated_completion_time"`
+}
+
+// Percent returns the share of input bytes processed so far. With nothing to
+// compact there is nothing left to do, so it is 100.
+func (p CompactionProgress) Percent() float64 {
+	if p.BytesTotal == 0 {
+		if p.FilesTotal == 0 {
+			return 100
+		}
+		return 100 * float64(p.FilesProcessed) / float64(p.FilesTotal)
+	}
+	return 100 * float64(p.BytesProcessed) / float64(p.BytesTotal)
+}
+
+// compactionTracker records the progress of compactions. A nil tracker ignores updates.
+type compactionTracker struct {
+	mu       sync.Mutex
+	progress CompactionProgress
+	started  time.Time
+}
+
+func newCompactionTracker() *compactionTracker {
+	return &compactionTracker{}
+}
+
+// start resets the progress for a compaction of files holding bytes in total.
+func (t *compactionTracker) start(files int, bytes int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.progress = CompactionProgress{FilesTotal: files, BytesTotal: bytes}
+	t.started = time.Now()
+}
+
+// fileDone records that an input file of the given size was processed and
+// extrapolates the completion time from the throughput so far.
+func (t *compactionTracker) fileDone(bytes int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.progress.FilesProcessed++
+	t.progress.BytesProcessed += bytes
+	if t.progress.BytesProcessed > 0 {
+		elapsed := time.Since(t.started)
+		remaining := float64(t.progress.BytesTotal-t.progress.BytesProcessed) / float64(t.progress.BytesProcessed)
+		t.progress.EstimatedCompletionTime = time.Now().Add(time.Duration(float64(elapsed) * remaining))
+	}
+}
+
+// Snapshot returns the current progress. A nil tracker has nothing to report.
+func (t *compactionTracker) Snapshot() CompactionProgress {
+	if t == nil {
+		return CompactionProgress{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.progress
+}
+
+// logEvery logs the progress at debug level every interval until the returned function is called.
+func (t *compactionTracker) logEvery(interval time.Duration) func() {
+	if t == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				progress := t.Snapshot()
+				logger.Debug("compaction progress",
+					"files_processed", progress.FilesProcessed,
+					"files_total", progress.FilesTotal,
+					"bytes_processed", progress.BytesProcessed,
+					"bytes_total", progress.BytesTotal,
+					"percent", progress.Percent(),
+					"estimated_completion_time", progress.EstimatedCompletionTime,
+				)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// CompactionProgress returns the progress of the running or most recent compaction.
+func (mem *memDB) CompactionProgress() CompactionProgress {
+	return mem.compaction.Snapshot()
+}
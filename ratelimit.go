@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	rateLimitIdleTimeout   = 5 * time.Minute // Buckets unused for this long are evicted
+	rateLimitSweepInterval = time.Minute     // Time between scans for idle buckets
+)
+
+// tokenBucket allows rate requests per second on average and bursts of up to burst requests.
+type tokenBucket struct {
+	mu       sync.Mutex
+	tokens   float64
+	lastFill time.Time
+	lastUsed time.Time
+}
+
+// take removes a token if there is one. Otherwise it returns the time until the next token.
+func (b *tokenBucket) take(now time.Time, rate, burst float64) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.lastFill).Seconds()*rate)
+	b.lastFill = now
+	b.lastUsed = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+func (b *tokenBucket) idleSince(cutoff time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.lastUsed.Before(cutoff)
+}
+
+// IPRateLimiter keeps a token bucket per client IP address. Buckets idle for
+// rateLimitIdleTimeout are evicted while checking requests, at most once per sweep interval.
+type IPRateLimiter struct {
+	mu        sync.RWMutex
+	buckets   map[string]*tokenBucket
+	rate      float64
+	burst     float64
+	lastSweep time.Time
+
+	trustedProxies []netip.Prefix // Proxies whose X-Forwarded-For header is believed; see clientIP
+}
+
+func NewIPRateLimiter(requestsPerSecond, burst int) *IPRateLimiter {
+	return &IPRateLimiter{
+		buckets:   make(map[string]*tokenBucket),
+		rate:      float64(requestsPerSecond),
+		burst:     float64(burst),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow reports whether a request from ip may proceed, and if not, how long the client
+// should wait before retrying.
+func (l *IPRateLimiter) Allow(ip string) (bool, time.Duration) {
+	now := time.Now()
+	l.evictIdle(now)
+	return l.bucket(ip, now).take(now, l.rate, l.burst)
+}
+
+func (l *IPRateLimiter) bucket(ip string, now time.Time) *tokenBucket {
+	l.mu.RLock()
+	b, ok := l.buckets[ip]
+	l.mu.RUnlock()
+	if ok {
+		return b
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.buckets[ip]; ok {
+		return b
+	}
+	b = &tokenBucket{tokens: l.burst, lastFill: now, lastUsed: now}
+	l.buckets[ip] = b
+	return b
+}
+
+// evictIdle removes the buckets not used within rateLimitIdleTimeout before now.
+func (l *IPRateLimiter) evictIdle(now time.Time) {
+	l.mu.RLock()
+	due := now.Sub(l.lastSweep) >= rateLimitSweepInterval
+	l.mu.RUnlock()
+	if !due {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lastSweep = now
+	cutoff := now.Add(-rateLimitIdleTimeout)
+	for ip, b := range l.buckets {
+		if b.idleSince(cutoff) {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// parseTrustedProxies parses the addresses and CIDR ranges of DBConfig.TrustedProxies.
+func parseTrustedProxies(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid TrustedProxies range %q: %w", entry, err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TrustedProxies address %q: %w", entry, err)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+	return prefixes, nil
+}
+
+// trusted reports whether ip is one of the trusted proxies.
+func trusted(proxies []netip.Prefix, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range proxies {
+		if prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the host of RemoteAddr. When that is a trusted proxy, it returns the
+// last address of X-Forwarded-For that is not one instead, as the addresses before it
+// were set by the client and may be forged.
+func clientIP(r *http.Request, proxies []netip.Prefix) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trusted(proxies, host) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(hops[i])
+		if ip == "" {
+			continue
+		}
+		host = ip
+		if !trusted(proxies, ip) {
+			break
+		}
+	}
+	return host
+}
+
+// rateLimitMiddleware responds 429 Too Many Requests to clients that exceed their rate,
+// with a Retry-After header in whole seconds.
+func rateLimitMiddleware(limiter *IPRateLimiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if allowed, wait := limiter.Allow(clientIP(r, limiter.trustedProxies)); !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
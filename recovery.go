@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ReplayUntilSequence rebuilds the memtable as it was after the WAL record with sequence
+// number seq, and returns it with the position in the log where the last record it
+// applied ends. Records are numbered from 1 in the order they were appended; batch markers
+// are not counted, and a batch is only applied if all of its records are within seq.
+// Deleted keys are kept as tombstones so SnapshotAtWALPosition can hide older SST values.
+// The log is opened read-only and its watermark is left untouched.
+func ReplayUntilSequence(wal *WriteAheadLog, seq uint64) (*memDB, walPosition, error) {
+	var reached walPosition
+	files, err := wal.filesFrom(0)
+	if err != nil {
+		return nil, reached, err
+	}
+
+	db := NewMemDB(nil)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var sequence uint64
+	var batch []KeyValue
+	inBatch := false
+	for _, segment := range files {
+		file, err := os.Open(segment.path)
+		if err != nil {
+			return nil, reached, err
+		}
+		var read atomic.Uint64
+		reader := bufio.NewReader(CountingReader{R: file, Count: &read})
+		for {
+			kv, err := readWALRecord(reader)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				file.Close()
+				return nil, reached, fmt.Errorf("error reading WAL: %w", err)
+			}
+			end := walPosition{segment: segment.sequence, offset: int64(read.Load()) - int64(reader.Buffered())}
+			switch {
+			case kv.Operation == BatchBegin:
+				batch, inBatch = batch[:0], true
+			case kv.Operation == BatchCommit:
+				for _, op := range batch {
+					db.replayEntry(op)
+				}
+				batch, inBatch, reached = batch[:0], false, end
+			case sequence >= seq:
+				file.Close()
+				return db, reached, nil
+			case inBatch:
+				sequence++
+				batch = append(batch, kv)
+			default:
+				sequence++
+				db.replayEntry(kv)
+				reached = end
+			}
+		}
+		file.Close()
+	}
+	return db, reached, nil
+}
+
+// replayEntry applies kv to the memtable and remembers deletes as tombstones.
+func (mem *memDB) replayEntry(kv KeyValue) {
+	if kv.Operation == Delete {
+		mem.tombstones = append(mem.tombstones, kv)
+	}
+	mem.applyEntry(kv)
+}
+
+// SnapshotAtWALPosition returns a memDB holding the merged state of the SST files in db's
+// manifest flushed at or before position in the WAL, overlaid with db's tombstones and
+// memtable. Files flushed later may hold writes logged after position, which the snapshot
+// must not see; the writes they hold from before position are replayed from the log.
+func SnapshotAtWALPosition(db *memDB, position walPosition) (*memDB, error) {
+	files, err := ReadManifest(db.cfg.DataDir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].SequenceNumber < files[j].SequenceNumber
+	})
+
+	// Deleted keys are removed rather than kept as tombstones, so the memtable holds only live entries
+	cfg := db.cfg
+	cfg.DeleteMode = DeletePhysical
+	cfg.MemtableValueCompression = false
+	snapshot := NewMemDBWithConfig(nil, cfg)
+	snapshot.mu.Lock()
+	defer snapshot.mu.Unlock()
+	for _, file := range files {
+		if file.walPosition().after(position) {
+			continue
+		}
+		entries, err := db.readSSTFile(filepath.Join(db.cfg.DataDir, file.FileName))
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", file.FileName, err)
+		}
+		for _, kv := range entries {
+			snapshot.applyEntry(kv)
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, kv := range db.tombstones {
+		snapshot.applyEntry(kv)
+	}
+	for _, kv := range db.data {
+		kv, err := kv.decompressed()
+		if err != nil {
+			return nil, err
+		}
+		snapshot.applyEntry(kv)
+	}
+	return snapshot, nil
+}
+
+// recoverToSequence writes the state of the database at WAL sequence number seq
+// to a single SST file in dataDir and returns the number of keys written.
+func recoverToSequence(cfg DBConfig, seq uint64, dataDir string) (int, error) {
+	wal, err := NewWriteAheadLog(cfg.WALPath)
+	if err != nil {
+		return 0, err
+	}
+	defer wal.Close()
+
+	replayed, position, err := ReplayUntilSequence(wal, seq)
+	if err != nil {
+		return 0, err
+	}
+	replayed.cfg = cfg
+	snapshot, err := SnapshotAtWALPosition(replayed, position)
+	if err != nil {
+		return 0, err
+	}
+
+	data := snapshot.data
+	if len(data) == 0 {
+		return 0, nil
+	}
+	sort.Slice(data, func(i, j int) bool {
+		return bytes.Compare(data[i].Key, data[j].Key) < 0
+	})
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return 0, err
+	}
+	fileName := newSSTFileName(dataDir)
+	if err := writeSSTFileWithConfig(filepath.Join(dataDir, fileName), data, cfg); err != nil {
+		return 0, err
+	}
+	meta := SSTFileMeta{
+		FileName:     fileName,
+		MagicNumber:  magicNumber,
+		SmallestKey:  data[0].Key,
+		LargestKey:   data[len(data)-1].Key,
+		Checksum:     calculateChecksum(data),
+		CreationTime: time.Now().UnixNano(),
+	}
+	if err := addToManifest(dataDir, meta); err != nil {
+		return 0, fmt.Errorf("error recording SST file in manifest: %w", err)
+	}
+	return len(data), nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+)
+
+var (
+	ErrNoConfigFile  = errors.New("server was started without a config file")
+	ErrInvalidConfig = errors.New("invalid configuration")
+)
+
+// ReloadConfig applies the settings of cfg that can change while the database is open:
+// FlushInterval, CompactionSchedule and MaxKeyCount. Changes to DataDir and WALPath are
+// logged and ignored; every other setting keeps the value the database was opened with.
+func (mem *memDB) ReloadConfig(cfg DBConfig) error {
+	schedule, err := ParseSchedule(cfg.CompactionSchedule)
+	if err != nil {
+		return fmt.Errorf("invalid CompactionSchedule: %w", err)
+	}
+	if cfg.DataDir != mem.cfg.DataDir {
+		logger.Warn("DataDir cannot change without a restart, ignoring it", "current", mem.cfg.DataDir, "configured", cfg.DataDir)
+	}
+	if cfg.WALPath != mem.cfg.WALPath {
+		logger.Warn("WALPath cannot change without a restart, ignoring it", "current", mem.cfg.WALPath, "configured", cfg.WALPath)
+	}
+
+	if cfg.FlushInterval != mem.FlushInterval() {
+		mem.SetFlushInterval(cfg.FlushInterval)
+		logger.Info("flush interval changed", "flush_interval", cfg.FlushInterval.String())
+	}
+	if cfg.MaxKeyCount > 0 && mem.maxKeyCount.Load() <= 0 {
+		// Without a limit new keys were not told apart from overwrites
+		if err := mem.seedKeyCount(); err != nil {
+			return err
+		}
+	}
+	if previous := mem.maxKeyCount.Swap(cfg.MaxKeyCount); previous != cfg.MaxKeyCount {
+		logger.Info("maximum key count changed", "max_key_count", cfg.MaxKeyCount)
+	}
+	mem.rescheduleCompaction(cfg.CompactionSchedule, schedule)
+	return nil
+}
+
+// ReloadConfig applies cfg to the database the namespace belongs to.
+func (ns *NamespacedDB) ReloadConfig(cfg DBConfig) error {
+	return ns.db.ReloadConfig(cfg)
+}
+
+// ReloadConfig applies cfg to every shard, with the directories NewShardedDB gave them.
+func (s *ShardedDB) ReloadConfig(cfg DBConfig) error {
+	for i, shard := range s.shards {
+		if err := shard.ReloadConfig(shardConfig(cfg, i)); err != nil {
+			return fmt.Errorf("error reloading configuration of shard %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// reloadConfig reads the config file the server was started with, overlaid with the
+// environment like at startup, and applies the settings that can change while it runs:
+// those of Storage.ReloadConfig, LogLevel and MaxConcurrentRequests.
+func (s *server) reloadConfig() error {
+	if s.configPath == "" {
+		return ErrNoConfigFile
+	}
+	cfg, err := LoadConfigFile(s.configPath, DefaultDBConfig())
+	if err == nil {
+		cfg, err = LoadConfigFromEnv(cfg)
+	}
+	var pathErr *fs.PathError
+	if err != nil && errors.As(err, &pathErr) {
+		return err // The file could not be read, its content is not to blame
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+	if err := ValidateConfig(cfg); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+
+	if err := s.db.ReloadConfig(cfg); err != nil {
+		return err
+	}
+	if err := SetLogLevel(cfg.LogLevel); err != nil {
+		return err
+	}
+	s.requests.Resize(cfg.MaxConcurrentRequests)
+	logger.Info("configuration reloaded", "path", s.configPath)
+	return nil
+}
+
+// handleConfigReload reloads the config file like SIGHUP does. A config file that does
+// not parse or fails ValidateConfig is answered with 422 Unprocessable Entity.
+func (s *server) handleConfigReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := s.reloadConfig(); err != nil {
+		logger.Error("error reloading configuration", "error", err)
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, ErrNoConfigFile):
+			status = http.StatusConflict
+		case errors.Is(err, ErrInvalidConfig):
+			status = http.StatusUnprocessableEntity
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	response, _ := json.Marshal(map[string]bool{"reloaded": true})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(response)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// repairClient fetches SST data from the replica during read-repair.
+var repairClient = &http.Client{Timeout: 10 * time.Second}
+
+// isCorruptSST reports whether err means the contents of an SST file are damaged,
+// as opposed to the file being missing or unreadable.
+func isCorruptSST(err error) bool {
+	var corrupt flate.CorruptInputError
+	return errors.Is(err, ErrChecksumMismatch) || errors.Is(err, ErrIntegrityViolation) ||
+		errors.Is(err, ErrInvalidSSTFormat) || errors.Is(err, gzip.ErrChecksum) ||
+		errors.Is(err, gzip.ErrHeader) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &corrupt)
+}
+
+// repairSSTFile replaces a corrupt SST file with the copy served by the replica at
+// cfg.ReplicaHTTPAddr and returns its entries. The fetched copy is verified before it
+// replaces the local file, so a corrupt replica cannot make things worse.
+func (mem *memDB) repairSSTFile(fileName string) ([]KeyValue, error) {
+	// The checksum covers the whole file, so the whole file is repaired. Its length is the
+	// replica's, as the local copy may be truncated.
+	var offset int64
+	logger.Warn("corrupt SST file, repairing from replica",
+		"file", fileName, "offset", offset, "replica", mem.cfg.ReplicaHTTPAddr)
+
+	data, err := fetchSSTBlock(mem.cfg.ReplicaHTTPAddr, mem.cfg.RepairToken, filepath.Base(fileName), offset, -1)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching %s from replica: %w", fileName, err)
+	}
+
+	repairPath := fileName + ".repair"
+	if err := os.WriteFile(repairPath, data, 0644); err != nil {
+		return nil, err
+	}
+	entries, err := readSSTEntriesWithKey(repairPath, mem.cfg.IntegrityKey)
+	if err != nil {
+		os.Remove(repairPath)
+		return nil, fmt.Errorf("replica copy of %s is invalid: %w", fileName, err)
+	}
+	if err := os.Rename(repairPath, fileName); err != nil {
+		os.Remove(repairPath)
+		return nil, err
+	}
+	return entries, nil
+}
+
+// fetchSSTBlock requests length bytes at offset of an SST file from the /internal/block
+// endpoint of the server at addr, or the rest of the file when length is negative. It sends
+// token unless it is empty.
+func fetchSSTBlock(addr, token, fileName string, offset, length int64) ([]byte, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	query := url.Values{
+		"file":   {fileName},
+		"offset": {strconv.FormatInt(offset, 10)},
+	}
+	if length >= 0 {
+		query.Set("len", strconv.FormatInt(length, 10))
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(addr, "/")+"/internal/block?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("X-Repair-Token", token)
+	}
+	resp, err := repairClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("replica responded with status %d", resp.StatusCode)
+	}
+
+	if length < 0 && resp.ContentLength < 0 {
+		return io.ReadAll(resp.Body) // The caller verifies the file
+	}
+	if length < 0 {
+		length = resp.ContentLength // Set by handleInternalBlock, so a cut transfer is noticed
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, length+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != length {
+		return nil, fmt.Errorf("replica returned %d bytes, expected %d", len(data), length)
+	}
+	return data, nil
+}
+
+// handleInternalBlock serves a byte range of an SST file so peers can repair their copy.
+// Without ?len= it serves the file from ?offset= to its end. Only requests carrying
+// DBConfig.RepairToken in X-Repair-Token, or from localhost without a token set, are
+// served, as the range may hold any data of the database; see peerAllowed.
+func (s *server) handleInternalBlock(w http.ResponseWriter, r *http.Request) {
+	if !s.peerAllowed(r, "X-Repair-Token", s.cfg.RepairToken) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	query := r.URL.Query()
+	fileName := query.Get("file")
+	if fileName == "" || fileName != filepath.Base(fileName) || !strings.HasSuffix(fileName, ".sst") {
+		http.Error(w, "invalid file", http.StatusBadRequest)
+		return
+	}
+	offset, err := strconv.ParseInt(query.Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "invalid offset", http.StatusBadRequest)
+		return
+	}
+	length := int64(-1)
+	if query.Has("len") {
+		length, err = strconv.ParseInt(query.Get("len"), 10, 64)
+		if err != nil || length < 0 {
+			http.Error(w, "invalid len", http.StatusBadRequest)
+			return
+		}
+	}
+
+	file, err := os.Open(filepath.Join(s.cfg.DataDir, fileName))
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if offset > info.Size() || length > info.Size()-offset {
+		http.Error(w, "range exceeds the file", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if length < 0 {
+		length = info.Size() - offset
+	}
+	data := make([]byte, length)
+	if _, err := file.ReadAt(data, offset); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+	logger.Info("internal block endpoint called", "file", fileName, "offset", offset, "len", length)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	replicationNoAck   byte = 0 // The primary does not wait for this record
+	replicationWantAck byte = 1 // The replica must confirm the record once applied
+	replicationAck     byte = 1 // Sent by the replica after applying a record
+)
+
+var errReplicationNack = errors.New("replica did not acknowledge WAL entry")
+
+// ReplicationClient sends WAL records to a replica over a persistent TCP connection.
+type ReplicationClient struct {
+	addr        string
+	dialTimeout time.Duration
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+
+	lag atomic.Int64 // Round trip of the last acknowledged record, in nanoseconds
+}
+
+func NewReplicationClient(addr string) *ReplicationClient {
+	return &ReplicationClient{
+		addr:        addr,
+		dialTimeout: 5 * time.Second,
+	}
+}
+
+// Replicate sends a raw WAL record followed by an ACK request and waits for the
+// replica to confirm it. The connection is dialed on first use and redialed after
+// an error.
+func (c *ReplicationClient) Replicate(record []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		conn, err := net.DialTimeout("tcp", c.addr, c.dialTimeout)
+		if err != nil {
+			return fmt.Errorf("error connecting to replica %s: %w", c.addr, err)
+		}
+		c.conn = conn
+		c.reader = bufio.NewReader(conn)
+	}
+
+	start := time.Now()
+	err := c.send(record)
+	if err != nil {
+		c.conn.Close()
+		c.conn = nil
+		return err
+	}
+	c.lag.Store(int64(time.Since(start)))
+	return nil
+}
+
+func (c *ReplicationClient) send(record []byte) error {
+	message := make([]byte, 0, len(record)+1)
+	message = append(message, record...)
+	message = append(message, replicationWantAck)
+	if _, err := c.conn.Write(message); err != nil {
+		return err
+	}
+
+	ack, err := c.reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	if ack != replicationAck {
+		return errReplicationNack
+	}
+	return nil
+}
+
+// Lag returns the round trip of the last acknowledged record. A nil client has no lag.
+func (c *ReplicationClient) Lag() time.Duration {
+	if c == nil {
+		return 0
+	}
+	return time.Duration(c.lag.Load())
+}
+
+func (c *ReplicationClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// ReplicationLag returns how long the replica took to acknowledge the last WAL entry.
+func (mem *memDB) ReplicationLag() time.Duration {
+	if mem.wal == nil {
+		return 0
+	}
+	return mem.wal.replica.Lag()
+}
+
+// StartReplicaServer accepts WAL records from a primary on port and applies them
+// to this database. Port 0 picks a free port; the returned listener reports it
+// and stops the server when closed.
+func (mem *memDB) StartReplicaServer(port int) (net.Listener, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("error starting replica server: %w", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go mem.serveReplication(conn)
+		}
+	}()
+	return listener, nil
+}
+
+// serveReplication applies the records sent on conn until the primary disconnects.
+func (mem *memDB) serveReplication(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	for {
+		kv, err := readWALRecord(reader)
+		if err != nil {
+			if err != io.EOF {
+				logger.Error("error reading replicated WAL entry", "error", err)
+			}
+			return
+		}
+		ackFlag, err := reader.ReadByte()
+		if err != nil {
+			logger.Error("error reading replication ACK flag", "error", err)
+			return
+		}
+
+		if err := mem.applyReplicated(kv); err != nil {
+			logger.Error("error applying replicated WAL entry", "error", err)
+			return
+		}
+		if ackFlag == replicationWantAck {
+			if _, err := conn.Write([]byte{replicationAck}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (mem *memDB) applyReplicated(kv KeyValue) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	mem.awaitPendingWrites()
+
+	if err := mem.appendWALLocked(kv.Operation, kv); err != nil {
+		return err
+	}
+	size := mem.applyEntry(kv)
+
+	mem.flushIfFull(size)
+	return nil
+}
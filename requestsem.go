@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// RequestSemaphore bounds the HTTP requests handled at once. Requests beyond the bound
+// are rejected rather than queued, so a traffic spike does not pile goroutines up on the
+// database lock. A nil RequestSemaphore admits everything.
+type RequestSemaphore struct {
+	mu     sync.Mutex
+	size   int // Requests allowed at a time; 0 is unlimited
+	active int // Requests being handled
+}
+
+// NewRequestSemaphore allows size requests at a time, or any number when size is 0.
+func NewRequestSemaphore(size int) *RequestSemaphore {
+	return &RequestSemaphore{size: size}
+}
+
+// TryAcquire takes a slot if one is free and reports whether it did.
+func (s *RequestSemaphore) TryAcquire() bool {
+	if s == nil {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.size > 0 && s.active >= s.size {
+		return false
+	}
+	s.active++
+	return true
+}
+
+// Release frees a slot taken by TryAcquire.
+func (s *RequestSemaphore) Release() {
+	if s != nil {
+		s.mu.Lock()
+		s.active--
+		s.mu.Unlock()
+	}
+}
+
+// Resize allows size requests at a time from now on. Requests already handled beyond a
+// smaller size finish, but no new ones are admitted until enough of them released their slot.
+func (s *RequestSemaphore) Resize(size int) {
+	if s != nil {
+		s.mu.Lock()
+		s.size = size
+		s.mu.Unlock()
+	}
+}
+
+// QueueDepth returns the number of requests being handled.
+func (s *RequestSemaphore) QueueDepth() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active
+}
+
+// unlimitedPaths are served without a slot of the RequestSemaphore: probes and metrics must
+// answer while the server is busy, and streams would hold a slot for as long as they run.
+var unlimitedPaths = map[string]bool{
+	"/health/ready": true,
+	"/metrics":      true,
+	"/events":       true,
+	"/export":       true,
+	"/import":       true,
+	"/warmup":       true,
+}
+
+// concurrencyLimitMiddleware responds 503 Service Unavailable with {"error": "server busy"}
+// when every slot of sem is taken. Requests to unlimitedPaths are always served.
+func concurrencyLimitMiddleware(sem *RequestSemaphore, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unlimitedPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !sem.TryAcquire() {
+			response, _ := json.Marshal(map[string]string{"error": "server busy"})
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write(response)
+			return
+		}
+		defer sem.Release()
+		next.ServeHTTP(w, r)
+	})
+}
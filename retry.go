@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy controls how often an I/O operation is retried after a transient error.
+type RetryPolicy struct {
+	MaxAttempts       int           // Total attempts, including the first one; values below 1 mean a single attempt
+	InitialBackoff    time.Duration // Wait before the second attempt
+	BackoffMultiplier float64       // Growth of the wait after each failed attempt
+	MaxBackoff        time.Duration // Upper bound of the wait between attempts
+	MaxRetryDuration  time.Duration // No attempt starts later than this after the first one; 0 leaves MaxAttempts as the only limit
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:       3,
+		InitialBackoff:    10 * time.Millisecond,
+		BackoffMultiplier: 2,
+		MaxBackoff:        time.Second,
+	}
+}
+
+// DefaultWALRetryPolicy retries WAL appends for up to a second, long enough for another
+// process to free space after a brief disk-full event.
+func DefaultWALRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:       math.MaxInt,
+		InitialBackoff:    10 * time.Millisecond,
+		BackoffMultiplier: 2,
+		MaxBackoff:        time.Second,
+		MaxRetryDuration:  time.Second,
+	}
+}
+
+// withRetry calls fn until it succeeds, fails with an error that is not
+// transient, runs out of attempts or time, or ctx is done.
+func withRetry(ctx context.Context, policy RetryPolicy, fn func() error) error {
+	backoff := policy.InitialBackoff
+	var deadline time.Time
+	if policy.MaxRetryDuration > 0 {
+		deadline = time.Now().Add(policy.MaxRetryDuration)
+	}
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= policy.MaxAttempts || !isTransientIOError(err) {
+			return err
+		}
+		if !deadline.IsZero() {
+			if remaining := time.Until(deadline); remaining <= 0 {
+				return err
+			} else if backoff > remaining {
+				backoff = remaining
+			}
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+
+		if policy.BackoffMultiplier > 0 {
+			backoff = time.Duration(float64(backoff) * policy.BackoffMultiplier)
+		}
+		if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
+
+// isTransientIOError reports whether err may go away when the operation is retried.
+func isTransientIOError(err error) bool {
+	if errors.Is(err, ErrInvalidSSTFormat) || errors.Is(err, ErrKeyNotFound) || errors.Is(err, ErrPartialWALWrite) || errors.Is(err, ErrUnsyncedWALWrite) {
+		return false
+	}
+	// A full disk is often freed again shortly, e.g. by another process removing files
+	if os.IsTimeout(err) || errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.ENOSPC) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return true
+		}
+		if temporary, ok := netErr.(interface{ Temporary() bool }); ok && temporary.Temporary() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule decides when a recurring background task runs next.
+type Schedule interface {
+	// Next returns the first run after t, or the zero time if there is none.
+	Next(t time.Time) time.Time
+}
+
+// ParseSchedule accepts either a duration such as "30m", to run at that interval,
+// or a 5-field cron expression such as "0 2 * * *".
+func ParseSchedule(spec string) (Schedule, error) {
+	if interval, err := time.ParseDuration(spec); err == nil {
+		if interval <= 0 {
+			return nil, fmt.Errorf("schedule interval must be positive, got %s", spec)
+		}
+		return intervalSchedule(interval), nil
+	}
+	return NewCronScheduler(spec)
+}
+
+type intervalSchedule time.Duration
+
+func (s intervalSchedule) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(s))
+}
+
+// CronScheduler runs at the minutes matching a cron expression of the fields minute,
+// hour, day of month, month and day of week. Each field is *, a number or */n. As in
+// cron, when both day fields are restricted a day matching either of them matches.
+type CronScheduler struct {
+	minute, hour, dayOfMonth, month, dayOfWeek uint64 // Bit i is set when value i matches
+	domAny, dowAny                             bool
+}
+
+func NewCronScheduler(expr string) (*CronScheduler, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields, got %d", expr, len(fields))
+	}
+	ranges := [5]struct{ min, max int }{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	var sets [5]uint64
+	for i, field := range fields {
+		set, err := parseCronField(field, ranges[i].min, ranges[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %w", expr, err)
+		}
+		sets[i] = set
+	}
+	// Both 0 and 7 mean Sunday
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+	return &CronScheduler{
+		minute:     sets[0],
+		hour:       sets[1],
+		dayOfMonth: sets[2],
+		month:      sets[3],
+		dayOfWeek:  sets[4],
+		domAny:     fields[2] == "*",
+		dowAny:     fields[4] == "*",
+	}, nil
+}
+
+// parseCronField returns the set of values between min and max that field matches.
+func parseCronField(field string, min, max int) (uint64, error) {
+	step := 1
+	if rest, ok := strings.CutPrefix(field, "*/"); ok {
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("invalid step in %q", field)
+		}
+		step = n
+	} else if field != "*" {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("%q is not a number between %d and %d", field, min, max)
+		}
+		return 1 << n, nil
+	}
+
+	var set uint64
+	for v := min; v <= max; v += step {
+		set |= 1 << v
+	}
+	return set, nil
+}
+
+// Next returns the first matching minute after t. Expressions that never match,
+// such as February 30, return the zero time.
+func (c *CronScheduler) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c *CronScheduler) dayMatches(t time.Time) bool {
+	dom := c.dayOfMonth&(1<<uint(t.Day())) != 0
+	dow := c.dayOfWeek&(1<<uint(t.Weekday())) != 0
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// waitUntil blocks until t or until stop is closed, and reports whether t was
+// reached. Tests replace it to skip the wait.
+var waitUntil = func(t time.Time, stop <-chan struct{}) bool {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// startCompactionSchedule compacts the SST files at the times of schedule until Close,
+// replacing the schedule started before, if any.
+func (mem *memDB) startCompactionSchedule(schedule Schedule) {
+	mem.scheduleMu.Lock()
+	defer mem.scheduleMu.Unlock()
+	mem.startCompactionScheduleLocked(schedule)
+}
+
+func (mem *memDB) startCompactionScheduleLocked(schedule Schedule) {
+	if mem.readOnly {
+		return // A clone's files may be shared with the source database
+	}
+	if mem.scheduleStop != nil {
+		close(mem.scheduleStop)
+	}
+	mem.scheduleStop = make(chan struct{})
+	mem.bgWG.Add(1)
+	go mem.compactOnSchedule(schedule, mem.scheduleStop)
+}
+
+// rescheduleCompaction replaces the running compaction schedule with schedule, parsed from
+// spec, unless spec is the current one. Without a running schedule it only records spec.
+func (mem *memDB) rescheduleCompaction(spec string, schedule Schedule) {
+	mem.scheduleMu.Lock()
+	defer mem.scheduleMu.Unlock()
+	if spec == mem.scheduleSpec {
+		return
+	}
+	mem.scheduleSpec = spec
+	if mem.scheduleStop != nil {
+		mem.startCompactionScheduleLocked(schedule)
+		logger.Info("compaction rescheduled", "schedule", spec)
+	}
+}
+
+// stopCompactionSchedule stops the schedule started by startCompactionSchedule, if any.
+func (mem *memDB) stopCompactionSchedule() {
+	mem.scheduleMu.Lock()
+	defer mem.scheduleMu.Unlock()
+	if mem.scheduleStop != nil {
+		close(mem.scheduleStop)
+		mem.scheduleStop = nil
+	}
+}
+
+// compactOnSchedule compacts the SST files at the times of schedule until stop is closed.
+func (mem *memDB) compactOnSchedule(schedule Schedule, stop <-chan struct{}) {
+	defer mem.bgWG.Done()
+	for {
+		next := schedule.Next(time.Now())
+		if next.IsZero() {
+			logger.Warn("compaction schedule never fires again")
+			return
+		}
+		if !waitUntil(next, stop) {
+			return
+		}
+		for wait := mem.compact(); wait > 0; wait = mem.compact() {
+			if !waitUntil(time.Now().Add(wait), stop) {
+				return
+			}
+		}
+	}
+}
+
+// compact compacts the SST files unless the last compaction that merged files completed
+// less than cfg.MinCompactionIntervalSec ago. It then skips the run and returns the time left
+// before one may run, or 0 once it ran.
+func (mem *memDB) compact() time.Duration {
+	mem.compactionMu.Lock()
+	defer mem.compactionMu.Unlock()
+	interval := time.Duration(mem.cfg.MinCompactionIntervalSec) * time.Second
+	if !mem.lastCompaction.IsZero() {
+		if wait := time.Until(mem.lastCompaction.Add(interval)); wait > 0 {
+			logger.Debug("compaction skipped, the last one completed too recently", "wait", wait)
+			return wait
+		}
+	}
+	merged, err := mergeCompactionFiles(mem.cfg, mem.cfg.MaxSSTFiles, mem.metrics, mem.compaction)
+	if err != nil {
+		logger.Error("error during compaction", "error", err)
+	}
+	if merged {
+		// Runs with nothing to merge do not hold back the next one
+		mem.lastCompaction = time.Now()
+	}
+	return 0
+}
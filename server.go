@@ -0,0 +1,559 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Storage is the set of database operations used by the HTTP handlers.
+type Storage interface {
+	SetContext(ctx context.Context, key, value []byte) error
+	SetWithOptions(key, value []byte, opts SetOptions) error
+	GetMetadata(key []byte) (map[string]string, error)
+	GetContext(ctx context.Context, key []byte) ([]byte, error)
+	DelContext(ctx context.Context, key []byte) ([]byte, error)
+	GetByPrefix(prefix []byte) (Iterator, error)
+	Frequency(key []byte) uint64
+	Subscribe(key []byte) (<-chan ChangeEvent, func())
+	CircuitBreakerState() string
+	Stats() DBStats
+	CompactionProgress() CompactionProgress
+	CacheWarm() bool
+	Flush(progress FlushProgressFunc) error
+	BatchSet(entries []KeyValue) error
+	Export(fn func(KeyValue) error) error
+	Warmup(ctx context.Context, keys [][]byte, progress WarmupProgressFunc) (int, error)
+	DebugState() (DebugState, error)
+	ReloadConfig(cfg DBConfig) error
+	Namespace(name string) *NamespacedDB
+}
+
+type server struct {
+	db       Storage
+	cfg      DBConfig
+	mux      *http.ServeMux
+	sstSizes *sstSizeCache
+	limiter  *IPRateLimiter    // Nil when rate limiting is disabled
+	requests *RequestSemaphore // Admits everything when MaxConcurrentRequests is 0
+
+	configPath string // Config file /config/reload reads; empty when the server has none
+
+	debugBucket *tokenBucket // Limits /debug to one snapshot per debugRequestInterval
+
+	warmup *warmupStatus // Progress of the last warmup requested through /warmup
+}
+
+func newServer(db Storage, cfg DBConfig) *server {
+	s := &server{
+		db:       db,
+		cfg:      cfg,
+		mux:      http.NewServeMux(),
+		sstSizes: &sstSizeCache{dir: cfg.DataDir},
+		warmup:   &warmupStatus{state: "not started"},
+	}
+	s.mux.HandleFunc("/set", s.handleSet)
+	s.mux.HandleFunc("/del", s.handleDel)
+	s.mux.HandleFunc("/get", s.handleGet)
+	s.mux.HandleFunc("/keys", s.handleKeys)
+	s.mux.HandleFunc("/frequency", s.handleFrequency)
+	s.mux.HandleFunc("/events", s.handleEvents)
+	s.mux.HandleFunc("/sststats", s.handleSSTStats)
+	s.mux.HandleFunc("/health/ready", s.handleReady)
+	s.mux.HandleFunc("/stats", s.handleStats)
+	s.mux.HandleFunc("/compaction/progress", s.handleCompactionProgress)
+	s.mux.HandleFunc("/flush", s.handleFlush)
+	s.mux.HandleFunc("/import", s.handleImport)
+	s.mux.HandleFunc("/export", s.handleExport)
+	s.mux.HandleFunc("/warmup", s.handleWarmup)
+	s.mux.HandleFunc("/warmup/status", s.handleWarmupStatus)
+	s.mux.HandleFunc("/metrics", s.handleMetrics)
+	s.mux.HandleFunc("/version", s.handleVersion)
+	s.mux.HandleFunc("/internal/block", s.handleInternalBlock)
+	s.mux.HandleFunc("/config/reload", s.handleConfigReload)
+	if cfg.Debug {
+		s.debugBucket = &tokenBucket{tokens: 1, lastFill: time.Now()}
+		s.mux.HandleFunc("/debug", s.handleDebug)
+	}
+	if cfg.MaxRequestsPerSecondPerIP > 0 {
+		s.limiter = NewIPRateLimiter(cfg.MaxRequestsPerSecondPerIP, cfg.BurstSize)
+		proxies, err := parseTrustedProxies(cfg.TrustedProxies)
+		if err != nil {
+			logger.Warn("invalid trusted proxies, ignoring X-Forwarded-For", "error", err)
+		}
+		s.limiter.trustedProxies = proxies
+	}
+	// Created even without a limit, so reloading the configuration can set one
+	s.requests = NewRequestSemaphore(cfg.MaxConcurrentRequests)
+	return s
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var handler http.Handler = concurrencyLimitMiddleware(s.requests, s.mux)
+	if s.limiter != nil {
+		handler = rateLimitMiddleware(s.limiter, handler)
+	}
+	withBuildHeaders(handler).ServeHTTP(w, r)
+}
+
+// withBuildHeaders tags every response with the version of the running binary.
+func withBuildHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-DB-Version", Version)
+		w.Header().Set("X-DB-GitCommit", GitCommit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// storage returns the database the request operates on, scoped to the
+// namespace given by the optional ?namespace= parameter.
+func (s *server) storage(r *http.Request) Storage {
+	if namespace := r.URL.Query().Get("namespace"); namespace != "" {
+		return s.db.Namespace(namespace)
+	}
+	return s.db
+}
+
+// callWithTimeout runs fn and returns ctx.Err() as soon as ctx expires,
+// even if fn itself does not honour the context.
+func callWithTimeout(ctx context.Context, fn func(ctx context.Context) error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func writeTimeout(w http.ResponseWriter, timeout time.Duration) {
+	response, _ := json.Marshal(map[string]interface{}{
+		"error":      "request timed out",
+		"timeout_ms": timeout.Milliseconds(),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusGatewayTimeout)
+	_, _ = w.Write(response)
+}
+
+// kvRequest is the JSON body accepted by /set, /get and /del. encoding/json
+// base64-encodes []byte fields, so keys and values may hold arbitrary bytes.
+type kvRequest struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// isJSONRequest reports whether the request carries its key and value in a JSON
+// body rather than in the query parameters.
+func isJSONRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// readKVRequest reads the key and value of a request from whichever input the
+// Content-Type selects, and reports whether it was a JSON request.
+// An ?encoding= parameter converts a numeric or timestamp key with encodeKey.
+func readKVRequest(r *http.Request) (kvRequest, bool, error) {
+	query := r.URL.Query()
+	jsonRequest := isJSONRequest(r)
+
+	var req kvRequest
+	if jsonRequest {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return req, true, fmt.Errorf("invalid JSON body: %w", err)
+		}
+	} else {
+		req = kvRequest{Key: []byte(query.Get("key")), Value: []byte(query.Get("value"))}
+	}
+
+	if len(req.Key) > 0 {
+		key, err := encodeKey(query.Get("encoding"), req.Key)
+		if err != nil {
+			return req, jsonRequest, err
+		}
+		req.Key = key
+	}
+	return req, jsonRequest, nil
+}
+
+// writeKVResponse writes fields as JSON, base64-encoded for JSON requests and as
+// plain strings for query parameter requests.
+func writeKVResponse(w http.ResponseWriter, jsonRequest bool, fields map[string][]byte) {
+	var response []byte
+	if jsonRequest {
+		response, _ = json.Marshal(fields)
+	} else {
+		plain := make(map[string]string, len(fields))
+		for name, value := range fields {
+			plain[name] = string(value)
+		}
+		response, _ = json.Marshal(plain)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(response)
+}
+
+func (s *server) handleSet(w http.ResponseWriter, r *http.Request) {
+	req, _, err := readKVRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Key) == 0 || len(req.Value) == 0 {
+		http.Error(w, "Both key and value are required", http.StatusBadRequest)
+		return
+	}
+	tags, err := requestTags(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db := s.storage(r)
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.SetTimeout)
+	defer cancel()
+
+	err = callWithTimeout(ctx, func(ctx context.Context) error {
+		if tags != nil {
+			return db.SetWithOptions(req.Key, req.Value, SetOptions{Tags: tags})
+		}
+		return db.SetContext(ctx, req.Key, req.Value)
+	})
+	if errors.Is(err, context.DeadlineExceeded) {
+		writeTimeout(w, s.cfg.SetTimeout)
+		return
+	}
+	if errors.Is(err, ErrValueValidationFailed) {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	logger.Info("set endpoint called", "key", string(req.Key), "value", string(req.Value))
+}
+
+func (s *server) handleDel(w http.ResponseWriter, r *http.Request) {
+	req, jsonRequest, err := readKVRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Key) == 0 {
+		http.Error(w, "Key is required", http.StatusBadRequest)
+		return
+	}
+
+	db := s.storage(r)
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.DelTimeout)
+	defer cancel()
+
+	var deletedValue []byte
+	err = callWithTimeout(ctx, func(ctx context.Context) error {
+		var err error
+		deletedValue, err = db.DelContext(ctx, req.Key)
+		return err
+	})
+	if errors.Is(err, context.DeadlineExceeded) {
+		writeTimeout(w, s.cfg.DelTimeout)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	writeKVResponse(w, jsonRequest, map[string][]byte{"key": req.Key, "deleted_value": deletedValue})
+	logger.Info("del endpoint called", "key", string(req.Key), "value", string(deletedValue))
+}
+
+func (s *server) handleGet(w http.ResponseWriter, r *http.Request) {
+	req, jsonRequest, err := readKVRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Key) == 0 {
+		http.Error(w, "Key is required", http.StatusBadRequest)
+		return
+	}
+
+	db := s.storage(r)
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.GetTimeout)
+	defer cancel()
+
+	var value []byte
+	err = callWithTimeout(ctx, func(ctx context.Context) error {
+		var err error
+		value, err = db.GetContext(ctx, req.Key)
+		return err
+	})
+	if errors.Is(err, context.DeadlineExceeded) {
+		writeTimeout(w, s.cfg.GetTimeout)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	writeKVResponse(w, jsonRequest, map[string][]byte{"key": req.Key, "value": value})
+	logger.Info("get endpoint called", "key", string(req.Key), "value", string(value))
+}
+
+const (
+	defaultKeysLimit = 1000
+	maxKeysLimit     = 10000
+)
+
+// keysResponse is a page of /keys. NextCursor is set when more keys follow and
+// is passed back as ?cursor= to fetch the next page.
+type keysResponse struct {
+	Keys       [][]byte `json:"keys"`
+	NextCursor string   `json:"next_cursor,omitempty"`
+}
+
+// handleKeys lists keys with an optional ?prefix=, in pages of at most ?limit= keys.
+// The cursor is the base64-encoded last key of the previous page.
+func (s *server) handleKeys(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit := defaultKeysLimit
+	if raw := query.Get("limit"); raw != "" {
+		var err error
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit < 1 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	limit = min(limit, maxKeysLimit)
+
+	var cursor []byte
+	if raw := query.Get("cursor"); raw != "" {
+		var err error
+		cursor, err = base64.StdEncoding.DecodeString(raw)
+		if err != nil {
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	it, err := s.storage(r).GetByPrefix([]byte(query.Get("prefix")))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if cursor != nil {
+		it.Seek(cursor)
+	}
+
+	page := keysResponse{Keys: make([][]byte, 0)}
+	for it.Next() {
+		if cursor != nil && string(it.Key()) == string(cursor) {
+			continue
+		}
+		if len(page.Keys) == limit {
+			page.NextCursor = base64.StdEncoding.EncodeToString(page.Keys[limit-1])
+			break
+		}
+		page.Keys = append(page.Keys, it.Key())
+	}
+
+	response, _ := json.Marshal(page)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(response)
+}
+
+// handleFrequency returns the estimated number of reads and writes of a key.
+func (s *server) handleFrequency(w http.ResponseWriter, r *http.Request) {
+	req, _, err := readKVRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Key) == 0 {
+		http.Error(w, "Key is required", http.StatusBadRequest)
+		return
+	}
+
+	response, _ := json.Marshal(map[string]uint64{"estimated_count": s.storage(r).Frequency(req.Key)})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(response)
+}
+
+// handleEvents streams key changes as Server-Sent Events until the client
+// disconnects. ?key= limits the stream to a single key.
+func (s *server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var key []byte
+	if r.URL.Query().Has("key") {
+		key = []byte(r.URL.Query().Get("key"))
+	}
+	events, unsubscribe := s.storage(r).Subscribe(key)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprint(w, ": subscribed\n\n")
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-events:
+			data, _ := json.Marshal(event)
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// handleFlush writes the memtable to an SST file. The progress is streamed as one JSON
+// object per line, {"flushed": n, "total": m}, followed by {"done": true} or {"error": "..."}.
+func (s *server) handleFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	err := s.db.Flush(func(flushed, total int) {
+		_ = encoder.Encode(map[string]int{"flushed": flushed, "total": total})
+		flusher.Flush()
+	})
+	if err != nil {
+		_ = encoder.Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	_ = encoder.Encode(map[string]bool{"done": true})
+}
+
+func (s *server) handleSSTStats(w http.ResponseWriter, r *http.Request) {
+	fileNames, err := getSSTFileNames(s.cfg.DataDir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	files := make(map[string]map[string]string)
+	for _, fileName := range fileNames {
+		properties, err := ReadSSTProperties(filepath.Join(s.cfg.DataDir, fileName), s.cfg.IntegrityKey)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error reading properties of %s: %s", fileName, err), http.StatusInternalServerError)
+			return
+		}
+		files[fileName] = properties
+	}
+
+	sizes, err := s.sstSizes.get()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error reading SST file sizes: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	response, _ := json.Marshal(map[string]interface{}{
+		"files":          files,
+		"file_sizes":     sizes.Sizes,
+		"min_file_size":  sizes.MinFileSize,
+		"max_file_size":  sizes.MaxFileSize,
+		"mean_file_size": sizes.MeanFileSize,
+		"p50_file_size":  sizes.P50FileSize,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(response)
+}
+
+func (s *server) handleReady(w http.ResponseWriter, r *http.Request) {
+	state := s.db.CircuitBreakerState()
+	status := http.StatusOK
+	ready := "ready"
+	if state == Open.String() {
+		status = http.StatusServiceUnavailable
+		ready = "not ready"
+	}
+	cache := "warm"
+	if !s.db.CacheWarm() {
+		cache = "warming"
+		if s.cfg.RequireWarmCacheForReady {
+			status = http.StatusServiceUnavailable
+			ready = "not ready"
+		}
+	}
+
+	response, _ := json.Marshal(map[string]string{"status": ready, "circuit_breaker": state, "block_cache": cache})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(response)
+}
+
+func (s *server) handleStats(w http.ResponseWriter, r *http.Request) {
+	stats := s.db.Stats()
+	stats.RequestQueueDepth = s.requests.QueueDepth()
+	response, _ := json.Marshal(stats)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(response)
+}
+
+func (s *server) handleCompactionProgress(w http.ResponseWriter, r *http.Request) {
+	progress := s.db.CompactionProgress()
+	response, _ := json.Marshal(struct {
+		CompactionProgress
+		Percent float64 `json:"percent"`
+	}{progress, progress.Percent()})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(response)
+}
+
+func (s *server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	_ = writePrometheus(w, s.db.Stats())
+}
+
+func (s *server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	response, _ := json.Marshal(currentBuildInfo())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(response)
+}
@@ -0,0 +1,1343 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockingStorage is a Storage whose reads take longer than the handler allows.
+type blockingStorage struct {
+	Storage
+	delay time.Duration
+}
+
+func (b *blockingStorage) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	time.Sleep(b.delay)
+	return []byte("value"), nil
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	cfg := DefaultDBConfig()
+	cfg.GetTimeout = 100 * time.Millisecond
+	srv := newServer(&blockingStorage{delay: 500 * time.Millisecond}, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "/get?key=slow", nil)
+	rec := httptest.NewRecorder()
+
+	start := time.Now()
+	srv.ServeHTTP(rec, req)
+	elapsed := time.Since(start)
+
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("Expected status %d, got %d", http.StatusGatewayTimeout, rec.Code)
+	}
+	if elapsed >= 500*time.Millisecond {
+		t.Errorf("Handler waited for the backend instead of timing out: %s", elapsed)
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Error decoding response: %s", err)
+	}
+	if body["error"] != "request timed out" {
+		t.Errorf("Unexpected error message: %v", body["error"])
+	}
+	if body["timeout_ms"] != float64(100) {
+		t.Errorf("Unexpected timeout_ms: %v", body["timeout_ms"])
+	}
+}
+
+func TestHandlerNamespaceParameter(t *testing.T) {
+	wal, err := NewWriteAheadLog(filepath.Join(t.TempDir(), "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	db := NewMemDB(wal)
+	srv := newServer(db, DefaultDBConfig())
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/set?namespace=tenant&key=k&value=v", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Set failed with status %d", rec.Code)
+	}
+
+	if value, err := db.Get([]byte("tenant:k")); err != nil || string(value) != "v" {
+		t.Errorf("Expected the key to be stored under the namespace, got %q, %v", value, err)
+	}
+}
+
+func TestHandlerJSONBinaryKeys(t *testing.T) {
+	wal, err := NewWriteAheadLog(filepath.Join(t.TempDir(), "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	srv := newServer(NewMemDB(wal), DefaultDBConfig())
+
+	key := []byte{0x00, 0xff, 0x10, 0x00}
+	value := []byte{0xfe, 0x00, 0x80, 0x7f}
+	do := func(method, path string, body kvRequest) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, path, bytes.NewReader(data))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodPost, "/set", kvRequest{Key: key, Value: value}); rec.Code != http.StatusOK {
+		t.Fatalf("Set failed with status %d: %s", rec.Code, rec.Body)
+	}
+
+	rec := do(http.MethodGet, "/get", kvRequest{Key: key})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Get failed with status %d: %s", rec.Code, rec.Body)
+	}
+	var response map[string][]byte
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Response is not base64-encoded JSON: %s", err)
+	}
+	if !bytes.Equal(response["key"], key) || !bytes.Equal(response["value"], value) {
+		t.Errorf("Expected %x=%x, got %x=%x", key, value, response["key"], response["value"])
+	}
+
+	rec = do(http.MethodDelete, "/del", kvRequest{Key: key})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Del failed with status %d: %s", rec.Code, rec.Body)
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil || !bytes.Equal(response["deleted_value"], value) {
+		t.Errorf("Unexpected delete response %s: %v", rec.Body, err)
+	}
+
+	if rec := do(http.MethodPost, "/set", kvRequest{}); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a missing key, got %d", rec.Code)
+	}
+}
+
+func TestHandlerKeysPagination(t *testing.T) {
+	wal, err := NewWriteAheadLog(filepath.Join(t.TempDir(), "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	db := NewMemDB(wal)
+	for _, key := range []string{"user5", "user1", "other", "user3", "user2", "user4"} {
+		if err := db.Set([]byte(key), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := newServer(db, DefaultDBConfig())
+
+	page := func(cursor string) ([]string, string) {
+		path := "/keys?prefix=user&limit=2"
+		if cursor != "" {
+			path += "&cursor=" + url.QueryEscape(cursor)
+		}
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Keys failed with status %d: %s", rec.Code, rec.Body)
+		}
+		var response keysResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		keys := make([]string, len(response.Keys))
+		for i, key := range response.Keys {
+			keys[i] = string(key)
+		}
+		return keys, response.NextCursor
+	}
+
+	keys, cursor := page("")
+	if strings.Join(keys, ",") != "user1,user2" || cursor == "" {
+		t.Fatalf("Unexpected first page %v, cursor %q", keys, cursor)
+	}
+	keys, cursor = page(cursor)
+	if strings.Join(keys, ",") != "user3,user4" || cursor == "" {
+		t.Fatalf("Unexpected second page %v, cursor %q", keys, cursor)
+	}
+	keys, cursor = page(cursor)
+	if strings.Join(keys, ",") != "user5" || cursor != "" {
+		t.Fatalf("Unexpected last page %v, cursor %q", keys, cursor)
+	}
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/keys?cursor=not-base64!", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid cursor, got %d", rec.Code)
+	}
+}
+
+func TestHandlerBuildHeaders(t *testing.T) {
+	srv := newServer(&blockingStorage{}, DefaultDBConfig())
+
+	for _, path := range []string{"/version", "/get?key=k", "/unknown"} {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if got := rec.Header().Get("X-DB-Version"); got != Version {
+			t.Errorf("%s: expected X-DB-Version %q, got %q", path, Version, got)
+		}
+		if got := rec.Header().Get("X-DB-GitCommit"); got != GitCommit {
+			t.Errorf("%s: expected X-DB-GitCommit %q, got %q", path, GitCommit, got)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+	var info BuildInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != Version || info.GoVersion == "" {
+		t.Errorf("Unexpected build info %+v", info)
+	}
+}
+
+func TestHandlerReadyWaitsForWarmCache(t *testing.T) {
+	db := NewMemDB(nil)
+	db.cacheWarm.Store(false)
+	cfg := DefaultDBConfig()
+
+	ready := func(cfg DBConfig) int {
+		rec := httptest.NewRecorder()
+		newServer(db, cfg).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health/ready", nil))
+		return rec.Code
+	}
+	if code := ready(cfg); code != http.StatusOK {
+		t.Errorf("Expected ready during warmup unless required, got %d", code)
+	}
+	cfg.RequireWarmCacheForReady = true
+	if code := ready(cfg); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected not ready during warmup, got %d", code)
+	}
+	db.cacheWarm.Store(true)
+	if code := ready(cfg); code != http.StatusOK {
+		t.Errorf("Expected ready once the cache is warm, got %d", code)
+	}
+}
+
+func TestHandlerRateLimit(t *testing.T) {
+	cfg := DefaultDBConfig()
+	cfg.MaxRequestsPerSecondPerIP = 100
+	cfg.BurstSize = 50
+	cfg.TrustedProxies = []string{"192.0.2.1", "10.0.0.0/8"}
+	s := newServer(NewMemDB(nil), cfg)
+
+	throttled := 0
+	for i := 0; i < 200; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/version", nil)
+		req.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		if rec.Code == http.StatusTooManyRequests {
+			throttled++
+			if rec.Header().Get("Retry-After") == "" {
+				t.Fatal("Expected a Retry-After header on throttled responses")
+			}
+		}
+	}
+	if throttled < 100 {
+		t.Errorf("Expected at least 100 throttled requests, got %d", throttled)
+	}
+
+	// Other clients have their own bucket
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected another client to be served, got %d", rec.Code)
+	}
+
+	// Clients that are not trusted proxies cannot pick their bucket with the header
+	req := httptest.NewRequest(http.MethodGet, "/version", nil)
+	req.RemoteAddr = "198.51.100.9:4321"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected a forged X-Forwarded-For to be ignored, got %d", rec.Code)
+	}
+
+	proxies, err := parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.7, 10.0.0.2")
+	if ip := clientIP(req, proxies); ip != "198.51.100.9" {
+		t.Errorf("Expected the address of an untrusted peer, got %s", ip)
+	}
+	req.RemoteAddr = "10.1.2.3:4321"
+	if ip := clientIP(req, proxies); ip != "203.0.113.7" {
+		t.Errorf("Expected the last address before the trusted proxies, got %s", ip)
+	}
+	cfg.TrustedProxies = []string{"10.0.0.0/33"}
+	if err := ValidateConfig(cfg); err == nil || !strings.Contains(err.Error(), "TrustedProxies") {
+		t.Errorf("Expected an invalid trusted proxy range to be rejected, got %v", err)
+	}
+}
+
+func TestHandlerFlushStreamsProgress(t *testing.T) {
+	cfg := DefaultDBConfig()
+	cfg.DataDir = t.TempDir()
+	db := NewMemDBWithConfig(nil, cfg)
+	defer db.Close()
+	for i := 0; i < 2500; i++ {
+		db.data = append(db.data, KeyValue{Key: []byte(fmt.Sprintf("key%04d", i)), Value: []byte("value")})
+	}
+
+	rec := httptest.NewRecorder()
+	newServer(db, cfg).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/flush", nil))
+	expected := `{"flushed":1000,"total":2500}
+{"flushed":2000,"total":2500}
+{"flushed":2500,"total":2500}
+{"done":true}
+`
+	if rec.Code != http.StatusOK || rec.Body.String() != expected {
+		t.Errorf("Expected status 200 with\n%s, got %d with\n%s", expected, rec.Code, rec.Body.String())
+	}
+}
+
+func TestHandlerImportExport(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWriteAheadLog(filepath.Join(dir, "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	db := NewMemDBWithConfig(wal, cfg)
+	defer db.Close()
+	srv := newServer(db, cfg)
+
+	var records bytes.Buffer
+	gzWriter := gzip.NewWriter(&records)
+	for i := 0; i < 2500; i++ {
+		if i == 1200 {
+			fmt.Fprintln(gzWriter, `{"key": not json}`)
+		}
+		line, _ := json.Marshal(kvRequest{Key: []byte(fmt.Sprintf("key%04d", i)), Value: []byte(fmt.Sprintf("value%d", i))})
+		fmt.Fprintf(gzWriter, "%s\n", line)
+	}
+	gzWriter.Close()
+
+	var form bytes.Buffer
+	formWriter := multipart.NewWriter(&form)
+	part, err := formWriter.CreateFormFile("file", "data.json.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(records.Bytes())
+	formWriter.Close()
+	req := httptest.NewRequest(http.MethodPost, "/import", &form)
+	req.Header.Set("Content-Type", formWriter.FormDataContentType())
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	expected := []string{
+		`{"processed":1000,"total":-1}`,
+		`{"error":"invalid character 'o' in literal null (expecting 'u')","line":1201}`,
+		`{"processed":2000,"total":-1}`,
+		`{"processed":2500,"total":-1}`,
+		`{"done":true,"processed":2500,"skipped":1}`,
+	}
+	if rec.Code != http.StatusOK || strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Expected status 200 with\n%s, got %d with\n%s", strings.Join(expected, "\n"), rec.Code, rec.Body.String())
+	}
+
+	// Export what is split between an SST file and the memtable
+	if err := db.Flush(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("key0000"), []byte("updated")); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/export?format=json.gz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Export failed with status %d", rec.Code)
+	}
+	gzReader, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder := json.NewDecoder(gzReader)
+	var exported []kvRequest
+	for {
+		var kv kvRequest
+		if err := decoder.Decode(&kv); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		exported = append(exported, kv)
+	}
+	if len(exported) != 2500 {
+		t.Fatalf("Expected 2500 exported pairs, got %d", len(exported))
+	}
+	if string(exported[0].Key) != "key0000" || string(exported[0].Value) != "updated" {
+		t.Errorf("Expected the memtable value to win, got %q=%q", exported[0].Key, exported[0].Value)
+	}
+	if string(exported[1].Key) != "key0001" || string(exported[1].Value) != "value1" {
+		t.Errorf("Unexpected second pair %q=%q", exported[1].Key, exported[1].Value)
+	}
+	if string(exported[2499].Key) != "key2499" {
+		t.Errorf("Expected the pairs in key order, last is %q", exported[2499].Key)
+	}
+}
+
+func TestHandlerWarmup(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWriteAheadLog(filepath.Join(dir, "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	cfg.BlockCacheSize = 0 // Every Get decodes the SST file, as on a fresh instance
+	cfg.MaxMemtableEntries = 0
+	db := NewMemDBWithConfig(wal, cfg)
+	defer db.Close()
+	srv := newServer(db, cfg)
+
+	var keys bytes.Buffer
+	for i := 0; i < 1500; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		if err := db.Set([]byte(key), []byte("value"+key)); err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintln(&keys, key)
+	}
+	if err := db.Flush(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	status := func() string {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/warmup/status", nil))
+		return strings.TrimSpace(rec.Body.String())
+	}
+	if got := status(); got != `{"status":"not started"}` {
+		t.Errorf("Expected warmup not started, got %s", got)
+	}
+
+	// sstReads returns the number of SST files Get opened to read every key
+	sstReads := func() int64 {
+		before := db.sstFilesOpened.Load()
+		for i := 0; i < 1500; i++ {
+			key := []byte(fmt.Sprintf("key%04d", i))
+			if value, err := db.Get(key); err != nil || string(value) != "value"+string(key) {
+				t.Fatalf("Expected value of %s, got %q, %v", key, value, err)
+			}
+		}
+		return db.sstFilesOpened.Load() - before
+	}
+	if reads := sstReads(); reads != 1500 {
+		t.Errorf("Expected every Get to read the SST file before the warmup, got %d reads", reads)
+	}
+
+	var form bytes.Buffer
+	formWriter := multipart.NewWriter(&form)
+	part, err := formWriter.CreateFormFile("keys", "keys.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(keys.Bytes())
+	formWriter.Close()
+	req := httptest.NewRequest(http.MethodPost, "/warmup", &form)
+	req.Header.Set("Content-Type", formWriter.FormDataContentType())
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+
+	expected := `{"total":1500,"warmed":1000}
+{"total":1500,"warmed":1500}
+{"done":true,"loaded":1500}
+`
+	if rec.Code != http.StatusOK || rec.Body.String() != expected {
+		t.Fatalf("Expected status 200 with\n%s, got %d with\n%s", expected, rec.Code, rec.Body.String())
+	}
+	if got := status(); got != `{"loaded":1500,"status":"complete","total":1500,"warmed":1500}` {
+		t.Errorf("Expected warmup complete, got %s", got)
+	}
+
+	if reads := sstReads(); reads != 0 {
+		t.Errorf("Expected the warmed keys to be served from the memtable, got %d SST reads", reads)
+	}
+
+	// Lists beyond WarmupMaxKeys are refused
+	srv.cfg.WarmupMaxKeys = 100
+	req = httptest.NewRequest(http.MethodPost, "/warmup?prefix=key", nil)
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status %d for too many keys, got %d", http.StatusRequestEntityTooLarge, rec.Code)
+	}
+}
+
+// BenchmarkWarmupGetLatency reports the p99 latency of Get on keys flushed to an SST file,
+// before and after Warmup copied them into the memtable.
+func BenchmarkWarmupGetLatency(b *testing.B) {
+	for _, warm := range []bool{false, true} {
+		name := "cold"
+		if warm {
+			name = "warm"
+		}
+		b.Run(name, func(b *testing.B) {
+			dir := b.TempDir()
+			wal, err := NewWriteAheadLog(filepath.Join(dir, "wal.log"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer wal.Close()
+			cfg := DefaultDBConfig()
+			cfg.DataDir = dir
+			cfg.BlockCacheSize = 0 // Every Get decodes the SST file, as on a fresh instance
+			cfg.MaxMemtableEntries = 0
+			db := NewMemDBWithConfig(wal, cfg)
+			defer db.Close()
+			keys := make([][]byte, 1500)
+			for i := range keys {
+				keys[i] = []byte(fmt.Sprintf("key%04d", i))
+				if err := db.Set(keys[i], []byte("value")); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := db.Flush(nil); err != nil {
+				b.Fatal(err)
+			}
+			if warm {
+				if _, err := db.Warmup(context.Background(), keys, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			latencies := make([]time.Duration, 0, b.N)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				if _, err := db.Get(keys[i%len(keys)]); err != nil {
+					b.Fatal(err)
+				}
+				latencies = append(latencies, time.Since(start))
+			}
+			b.StopTimer()
+
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			p99 := latencies[len(latencies)*99/100]
+			b.ReportMetric(float64(p99.Microseconds()), "p99-µs")
+		})
+	}
+}
+
+func TestHandlerSSTSizeHistogram(t *testing.T) {
+	dir := t.TempDir()
+	rng := rand.New(rand.NewSource(1))
+	var sizes []int64
+	for i := 0; i < 20; i++ {
+		value := make([]byte, (i+1)*500)
+		rng.Read(value)
+		fileName := filepath.Join(dir, fmt.Sprintf("file_%d.sst", i))
+		if err := writeSSTFile(fileName, []KeyValue{{Key: []byte("key"), Value: value}}); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, info.Size())
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	srv := newServer(&blockingStorage{}, cfg)
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sststats", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("SST stats failed with status %d: %s", rec.Code, rec.Body)
+	}
+
+	var response SSTSizeStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Sizes) != 20 {
+		t.Errorf("Expected 20 files in the histogram, got %d", len(response.Sizes))
+	}
+	if response.MinFileSize != sizes[0] || response.MaxFileSize != sizes[19] {
+		t.Errorf("Expected min %d and max %d, got %d and %d", sizes[0], sizes[19], response.MinFileSize, response.MaxFileSize)
+	}
+	if response.MeanFileSize != float64(total)/20 {
+		t.Errorf("Expected mean %g, got %g", float64(total)/20, response.MeanFileSize)
+	}
+	if response.P50FileSize != sizes[9] {
+		t.Errorf("Expected p50 %d, got %d", sizes[9], response.P50FileSize)
+	}
+}
+
+// streamRecorder is a ResponseRecorder that also hands every write to the test
+// while the handler is still running.
+type streamRecorder struct {
+	*httptest.ResponseRecorder
+	writes chan string
+}
+
+func (s *streamRecorder) Write(p []byte) (int, error) {
+	s.writes <- string(p)
+	return len(p), nil
+}
+
+func TestHandlerEventsStream(t *testing.T) {
+	wal, err := NewWriteAheadLog(filepath.Join(t.TempDir(), "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	db := NewMemDB(wal)
+	srv := newServer(db, DefaultDBConfig())
+
+	ctx, disconnect := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "/events?key=watched", nil).WithContext(ctx)
+	rec := &streamRecorder{ResponseRecorder: httptest.NewRecorder(), writes: make(chan string, 16)}
+	done := make(chan struct{})
+	go func() {
+		srv.ServeHTTP(rec, req)
+		close(done)
+	}()
+
+	if first := <-rec.writes; !strings.HasPrefix(first, ":") {
+		t.Fatalf("Expected a comment once subscribed, got %q", first)
+	}
+	go func() {
+		for i := 0; i < 5; i++ {
+			db.Set([]byte("other"), []byte("ignored"))
+			db.Set([]byte("watched"), []byte(fmt.Sprintf("value%d", i)))
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		select {
+		case write := <-rec.writes:
+			var event ChangeEvent
+			if err := json.Unmarshal([]byte(strings.TrimSuffix(strings.TrimPrefix(write, "data: "), "\n\n")), &event); err != nil {
+				t.Fatalf("Invalid SSE event %q: %s", write, err)
+			}
+			want := ChangeEvent{Op: "set", Key: "watched", Value: fmt.Sprintf("value%d", i)}
+			if event != want {
+				t.Errorf("Event %d: expected %+v, got %+v", i, want, event)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Received only %d of 5 events", i)
+		}
+	}
+	if rec.Header().Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Unexpected Content-Type %q", rec.Header().Get("Content-Type"))
+	}
+
+	disconnect()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Handler did not return after the client disconnected")
+	}
+	if len(db.events.subscribers) != 0 {
+		t.Error("Subscription was not removed after the client disconnected")
+	}
+}
+
+func TestFileLogging(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.LogOutput = "file:" + filepath.Join(dir, "db.log")
+
+	originalLogger := logger
+	defer func() { logger = originalLogger }()
+	output, err := ConfigureLogging(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err := NewWriteAheadLog(filepath.Join(dir, "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	srv := newServer(NewMemDB(wal), cfg)
+	for i := 0; i < 5; i++ {
+		for _, path := range []string{"/set?key=k%d&value=v", "/get?key=k%d"} {
+			rec := httptest.NewRecorder()
+			srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf(path, i), nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("%s failed with status %d", path, rec.Code)
+			}
+		}
+	}
+	if err := output.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "db.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 10 {
+		t.Fatalf("Expected 10 log entries, got %d:\n%s", len(lines), data)
+	}
+	for _, line := range lines {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Errorf("Log entry is not JSON: %q", line)
+		} else if entry["key"] == nil || entry["level"] != "INFO" {
+			t.Errorf("Unexpected log entry %v", entry)
+		}
+	}
+
+	rotating, err := openLogFile(filepath.Join(dir, "small.log"), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		rotating.Write([]byte(strings.Repeat("x", 59) + "\n"))
+	}
+	rotating.Close()
+	if _, err := os.Stat(filepath.Join(dir, "small.log.1")); err != nil {
+		t.Errorf("Expected the log file to be rotated: %s", err)
+	}
+}
+
+func TestHandlerShardedDB(t *testing.T) {
+	cfg := DefaultDBConfig()
+	cfg.DataDir = t.TempDir()
+	db, err := NewShardedDB(cfg, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, shard := range db.shards {
+		defer shard.wal.Close()
+	}
+	srv := newServer(db, cfg)
+
+	for i := 0; i < 20; i++ {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/set?key=key%d&value=value%d", i, i), nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/get?key=key7", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "value7") {
+		t.Errorf("Unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+	if _, err := db.shardFor([]byte("key7")).Get([]byte("key7")); err != nil {
+		t.Errorf("key7 is not stored on the shard it hashes to: %v", err)
+	}
+}
+
+func TestHandlerCompactionProgress(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 100; i++ {
+		data := []KeyValue{{Key: []byte(fmt.Sprintf("key%03d", i)), Value: []byte("value")}}
+		if err := writeSSTFile(filepath.Join(dir, fmt.Sprintf("file_%03d.sst", i)), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wal, err := NewWriteAheadLog(filepath.Join(dir, "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	db := NewMemDBWithConfig(wal, cfg)
+	srv := newServer(db, cfg)
+
+	// Pause the compaction halfway through its input files
+	halfway, resume := make(chan struct{}), make(chan struct{})
+	read := 0
+	originalOpen := openCompactionInput
+	openCompactionInput = func(fileName string, integrityKey []byte) (compactionInput, error) {
+		input, err := originalOpen(fileName, integrityKey)
+		return &exhaustHook{compactionInput: input, done: func() {
+			if read++; read == 51 {
+				close(halfway)
+				<-resume
+			}
+		}}, err
+	}
+	defer func() { openCompactionInput = originalOpen }()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- compactSSTFiles(cfg, 1, db.metrics, db.compaction)
+	}()
+
+	percent := func() float64 {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/compaction/progress", nil))
+		var body struct {
+			FilesProcessed int     `json:"files_processed"`
+			Percent        float64 `json:"percent"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Error decoding response: %s", err)
+		}
+		return body.Percent
+	}
+
+	<-halfway
+	if p := percent(); p <= 0 || p >= 100 {
+		t.Errorf("Expected progress between 0%% and 100%% during compaction, got %.1f%%", p)
+	}
+	close(resume)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if p := percent(); p != 100 {
+		t.Errorf("Expected 100%% after compaction, got %.1f%%", p)
+	}
+}
+
+func TestReadRepairFromReplica(t *testing.T) {
+	data := []KeyValue{{Key: []byte("key1"), Value: []byte("value1")}, {Key: []byte("key2"), Value: []byte("value2")}}
+	newDB := func(dir string) *memDB {
+		if err := writeSSTFile(filepath.Join(dir, "file_1.sst"), data); err != nil {
+			t.Fatal(err)
+		}
+		if err := addToManifest(dir, SSTFileMeta{FileName: "file_1.sst", SmallestKey: []byte("key1"), LargestKey: []byte("key2")}); err != nil {
+			t.Fatal(err)
+		}
+		wal, err := NewWriteAheadLog(filepath.Join(dir, "wal.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { wal.Close() })
+		cfg := DefaultDBConfig()
+		cfg.DataDir = dir
+		return NewMemDBWithConfig(wal, cfg)
+	}
+
+	replica := newDB(t.TempDir())
+	replica.cfg.RepairToken = "repair-secret"
+	replicaServer := httptest.NewServer(newServer(replica, replica.cfg))
+	defer replicaServer.Close()
+
+	// Peers other than localhost need the token
+	for token, expected := range map[string]int{"": http.StatusForbidden, "wrong": http.StatusForbidden, "repair-secret": http.StatusOK} {
+		req := httptest.NewRequest(http.MethodGet, "/internal/block?file=file_1.sst&offset=0&len=1", nil)
+		if token != "" {
+			req.Header.Set("X-Repair-Token", token)
+		}
+		rec := httptest.NewRecorder()
+		newServer(replica, replica.cfg).ServeHTTP(rec, req)
+		if rec.Code != expected {
+			t.Errorf("Expected status %d with token %q, got %d", expected, token, rec.Code)
+		}
+	}
+
+	// Localhost needs the token too once one is set, and may be a proxy without one
+	blockStatus := func(cfg DBConfig, forwarded string) int {
+		req := httptest.NewRequest(http.MethodGet, "/internal/block?file=file_1.sst&offset=0&len=1", nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		if forwarded != "" {
+			req.Header.Set("X-Forwarded-For", forwarded)
+		}
+		rec := httptest.NewRecorder()
+		newServer(replica, cfg).ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := blockStatus(replica.cfg, ""); code != http.StatusForbidden {
+		t.Errorf("Expected status 403 from localhost without the token, got %d", code)
+	}
+	tokenless := replica.cfg
+	tokenless.RepairToken = ""
+	if code := blockStatus(tokenless, ""); code != http.StatusOK {
+		t.Errorf("Expected status 200 from localhost without a token set, got %d", code)
+	}
+	if code := blockStatus(tokenless, "203.0.113.7"); code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a request relayed by a local proxy, got %d", code)
+	}
+	tokenless.TrustedProxies = []string{"127.0.0.1"}
+	if code := blockStatus(tokenless, ""); code != http.StatusForbidden {
+		t.Errorf("Expected status 403 behind a trusted local proxy, got %d", code)
+	}
+
+	corruptions := map[string]func([]byte) []byte{
+		// Flip the stored checksum so the local copy fails verification
+		"checksum": func(contents []byte) []byte {
+			contents[len(contents)-1] ^= 0xff
+			return contents
+		},
+		// A truncated copy is shorter than the one to fetch
+		"truncated": func(contents []byte) []byte {
+			return contents[:len(contents)/2]
+		},
+	}
+	for name, corrupt := range corruptions {
+		dir := t.TempDir()
+		db := newDB(dir)
+		db.cfg.ReplicaHTTPAddr = replicaServer.URL
+		db.cfg.RepairToken = "repair-secret"
+
+		fileName := filepath.Join(dir, "file_1.sst")
+		contents, err := os.ReadFile(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fileName, corrupt(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		value, err := db.Get([]byte("key2"))
+		if err != nil {
+			t.Fatalf("%s: error reading through read-repair: %v", name, err)
+		}
+		if string(value) != "value2" {
+			t.Errorf("%s: expected value2, got %q", name, value)
+		}
+		if _, err := readSSTEntries(fileName); err != nil {
+			t.Errorf("%s: local SST file was not repaired: %v", name, err)
+		}
+	}
+}
+
+// exhaustHook calls done when its input runs out of entries.
+type exhaustHook struct {
+	compactionInput
+	done func()
+}
+
+func (h *exhaustHook) Next() bool {
+	if h.compactionInput.Next() {
+		return true
+	}
+	h.done()
+	return false
+}
+
+func TestHandlerDebug(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	cfg.Debug = true
+	cfg.DebugToken = "secret"
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Set([]byte("flushed"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get([]byte("flushed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("a"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("b"), []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Del([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	_, unsubscribe := db.Subscribe([]byte("b"))
+	defer unsubscribe()
+
+	request := func(remoteAddr, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/debug", nil)
+		req.RemoteAddr = remoteAddr
+		if token != "" {
+			req.Header.Set("X-Debug-Token", token)
+		}
+		rec := httptest.NewRecorder()
+		newServer(db, cfg).ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := request("192.0.2.1:1234", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a remote client, got %d", rec.Code)
+	}
+	if rec := request("192.0.2.1:1234", "wrong"); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a wrong token, got %d", rec.Code)
+	}
+	if rec := request("192.0.2.1:1234", "secret"); rec.Code != http.StatusOK {
+		t.Errorf("Expected status 200 for the debug token, got %d", rec.Code)
+	}
+	// A proxy on the same host relays requests from anywhere through localhost
+	if rec := request("127.0.0.1:1234", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 from localhost without the token, got %d", rec.Code)
+	}
+	tokenless := cfg
+	tokenless.DebugToken = ""
+	req := httptest.NewRequest(http.MethodGet, "/debug", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	rec := httptest.NewRecorder()
+	newServer(db, tokenless).ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a request relayed by a local proxy, got %d", rec.Code)
+	}
+
+	srv := newServer(db, tokenless)
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/debug", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	srv.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"memtable", "sst_files", "wal_watermark", "bloom_filter_sizes", "block_cache", "compaction", "subscriptions", "circuit_breaker"} {
+		if _, ok := fields[name]; !ok {
+			t.Errorf("Missing field %q in %s", name, rec.Body.String())
+		}
+	}
+	var state DebugState
+	if err := json.Unmarshal(rec.Body.Bytes(), &state); err != nil {
+		t.Fatal(err)
+	}
+	operations := make(map[string]string)
+	for _, entry := range state.Memtable {
+		operations[string(entry.Key)] = entry.Operation
+	}
+	if len(operations) != 2 || operations["a"] != Delete.String() || operations["b"] != Set.String() {
+		t.Errorf("Expected a deleted and b set in the memtable, got %v", operations)
+	}
+	if len(state.SSTFiles) != 1 || len(state.BloomFilterSizes) != 1 {
+		t.Errorf("Expected 1 SST file with a cached filter, got %d files and %v", len(state.SSTFiles), state.BloomFilterSizes)
+	}
+	if state.Subscriptions != 1 || state.CircuitBreaker != Closed.String() || state.BlockCache.Capacity != cfg.BlockCacheSize {
+		t.Errorf("Unexpected state: %+v", state)
+	}
+
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected a second request within a minute to be rate limited, got %d", rec.Code)
+	}
+
+	cfg.Debug = false
+	rec = httptest.NewRecorder()
+	newServer(db, cfg).ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 with Debug disabled, got %d", rec.Code)
+	}
+}
+
+func TestHandlerSetValidationFailed(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	cfg.ValueValidator = ValidateJSON
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	srv := newServer(db, cfg)
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/set?key=k&value="+url.QueryEscape(`[1, 2]`), nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected status 200 for valid JSON, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/set?key=k&value=oops", nil))
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), "not valid JSON") {
+		t.Errorf("Expected status 422 with the validation error, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHandlerSetTags(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	srv := newServer(db, cfg)
+
+	req := httptest.NewRequest(http.MethodPost, "/set?key=header&value=v", nil)
+	req.Header.Set("X-Tags", `{"user_id": "42"}`)
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/set?key=query&value=v&tags="+url.QueryEscape(`{"source": "import"}`), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if tags, err := db.GetMetadata([]byte("header")); err != nil || tags["user_id"] != "42" {
+		t.Errorf("GetMetadata(header) = %v, %v", tags, err)
+	}
+	if tags, err := db.GetMetadata([]byte("query")); err != nil || tags["source"] != "import" {
+		t.Errorf("GetMetadata(query) = %v, %v", tags, err)
+	}
+
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/set?key=k&value=v&tags=oops", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for invalid tags, got %d", rec.Code)
+	}
+}
+
+func TestHandlerConfigReload(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	configPath := filepath.Join(dir, "config.json")
+	writeConfig := func(settings map[string]interface{}) {
+		t.Helper()
+		settings["DataDir"] = cfg.DataDir
+		settings["WALPath"] = cfg.WALPath
+		data, err := json.Marshal(settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(configPath, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(map[string]interface{}{"FlushInterval": 30 * time.Minute})
+	flushed := make(chan struct{}, 1)
+	defer func(original func(*memDB)) { periodicFlushTick = original }(periodicFlushTick)
+	periodicFlushTick = func(mem *memDB) {
+		select {
+		case flushed <- struct{}{}:
+		default:
+		}
+	}
+	cfg, err := LoadConfigFile(configPath, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	srv := newServer(db, cfg)
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/config/reload", nil))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 without a config file, got %d", rec.Code)
+	}
+
+	srv.configPath = configPath
+	defer SetLogLevel("info")
+	writeConfig(map[string]interface{}{
+		"FlushInterval":         50 * time.Millisecond,
+		"MaxKeyCount":           100,
+		"MaxConcurrentRequests": 1,
+		"LogLevel":              "warn",
+	})
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/config/reload", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if interval := db.FlushInterval(); interval != 50*time.Millisecond {
+		t.Errorf("Expected a flush interval of 50ms after the reload, got %s", interval)
+	}
+	// The periodic flush runs at the new interval, not after the 30 minutes it started with
+	select {
+	case <-flushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a flush at the reloaded interval")
+	}
+	if stats := db.Stats(); stats.MaxKeyCount != 100 {
+		t.Errorf("Expected MaxKeyCount 100 after the reload, got %d", stats.MaxKeyCount)
+	}
+	if logLevel.Level() != slog.LevelWarn {
+		t.Errorf("Expected log level WARN after the reload, got %s", logLevel.Level())
+	}
+	if !srv.requests.TryAcquire() || srv.requests.TryAcquire() {
+		t.Errorf("Expected a single request slot after the reload")
+	}
+	srv.requests.Release()
+
+	// Invalid settings leave the configuration as it was
+	writeConfig(map[string]interface{}{"FlushInterval": -1})
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/config/reload", nil))
+	if rec.Code != http.StatusUnprocessableEntity || db.FlushInterval() != 50*time.Millisecond {
+		t.Errorf("Expected an invalid config to be rejected with 422, got %d and a flush interval of %s", rec.Code, db.FlushInterval())
+	}
+	if err := os.WriteFile(configPath, []byte("{not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/config/reload", nil))
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status 422 for a config file that does not parse, got %d", rec.Code)
+	}
+}
+
+func TestOpenServerKeepsSSTFiles(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	cfg.MaxSSTFiles = 2
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Flush(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	before, err := getSSTFileNames(cfg.DataDir)
+	if err != nil || len(before) != 4 {
+		t.Fatalf("Expected 4 SST files, got %v, %v", before, err)
+	}
+
+	// More files than MaxSSTFiles are left to the compaction schedule
+	db, handler, err := openServer(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	after, err := getSSTFileNames(cfg.DataDir)
+	if err != nil || fmt.Sprint(after) != fmt.Sprint(before) {
+		t.Errorf("Expected the SST files %v to be kept, got %v, %v", before, after, err)
+	}
+	for i := 0; i < 4; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/get?key=key%d", i), nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("Expected key%d to be served after the setup, got %d", i, rec.Code)
+		}
+	}
+}
+
+// gatedStorage is a Storage whose reads wait until release is closed.
+type gatedStorage struct {
+	Storage
+	started chan struct{}
+	release chan struct{}
+}
+
+func (g *gatedStorage) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	g.started <- struct{}{}
+	<-g.release
+	return []byte("value"), nil
+}
+
+func (g *gatedStorage) Stats() DBStats { return DBStats{} }
+
+func (g *gatedStorage) CircuitBreakerState() string { return Closed.String() }
+
+func (g *gatedStorage) CacheWarm() bool { return true }
+
+func TestHandlerMaxConcurrentRequests(t *testing.T) {
+	const limit, extra = 20, 50
+	cfg := DefaultDBConfig()
+	cfg.MaxConcurrentRequests = limit
+	cfg.MaxRequestsPerSecondPerIP = 0
+	storage := &gatedStorage{started: make(chan struct{}, limit), release: make(chan struct{})}
+	srv := newServer(storage, cfg)
+
+	codes := make(chan int, limit+extra)
+	get := func() {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/get?key=k", nil))
+		codes <- rec.Code
+	}
+	for i := 0; i < limit; i++ {
+		go get()
+	}
+	for i := 0; i < limit; i++ {
+		<-storage.started
+	}
+	if depth := srv.requests.QueueDepth(); depth != limit {
+		t.Errorf("Expected a queue depth of %d, got %d", limit, depth)
+	}
+
+	// Probes and metrics are answered while every slot is taken
+	for _, path := range []string{"/health/ready", "/metrics"} {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("Expected %s to be served while busy, got %d", path, rec.Code)
+		}
+	}
+
+	for i := 0; i < extra; i++ {
+		go get()
+	}
+	busy := 0
+	for i := 0; i < extra; i++ {
+		if code := <-codes; code == http.StatusServiceUnavailable {
+			busy++
+		}
+	}
+	close(storage.release)
+	succeeded := 0
+	for i := 0; i < limit; i++ {
+		if code := <-codes; code == http.StatusOK {
+			succeeded++
+		}
+	}
+	if busy != extra || succeeded != limit {
+		t.Errorf("Expected %d requests rejected and %d served, got %d and %d", extra, limit, busy, succeeded)
+	}
+
+	// The /stats request is the only one being handled
+	srv.db = &ShardedDB{}
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var stats DBStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil || stats.RequestQueueDepth != 1 {
+		t.Errorf("Expected /stats to report a queue depth of 1, got %s (%v)", rec.Body.String(), err)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// virtualNodesPerShard is the number of points each shard owns on the hash ring.
+// More points spread the keys more evenly between the shards.
+const virtualNodesPerShard = 160
+
+// ShardedDB spreads keys over a fixed number of memDB instances using a
+// consistent hash ring. Namespaces are placed on a single shard chosen by their name.
+type ShardedDB struct {
+	shards []*memDB
+	points []uint32 // Sorted hash points of the ring
+	owners []int    // owners[i] is the shard owning points[i]
+	hash   HashFunc
+	keyFn  func([]byte) []byte // Extracts the routing part of keys; nil routes by the whole key
+}
+
+var _ Storage = (*ShardedDB)(nil)
+
+// NewShardedDB creates shardCount databases in subdirectories of cfg.DataDir,
+// each with its own write-ahead log. Keys are placed with cfg.HashFuncName, by the part
+// cfg.ShardKeyFn extracts when it is set.
+func NewShardedDB(cfg DBConfig, shardCount int) (*ShardedDB, error) {
+	if shardCount < 1 {
+		return nil, fmt.Errorf("shard count must be at least 1, got %d", shardCount)
+	}
+	hash, err := NewHashFunc(cfg.HashFuncName)
+	if err != nil {
+		return nil, err
+	}
+
+	shards := make([]*memDB, shardCount)
+	for i := range shards {
+		shardCfg := shardConfig(cfg, i)
+		if err := os.MkdirAll(shardCfg.DataDir, 0755); err != nil {
+			return nil, fmt.Errorf("error creating shard directory: %w", err)
+		}
+		wal, err := NewWriteAheadLog(shardCfg.WALPath)
+		if err != nil {
+			return nil, fmt.Errorf("error opening WAL of shard %d: %w", i, err)
+		}
+		shards[i] = NewMemDBWithConfig(wal, shardCfg)
+	}
+	sharded := newShardedDB(shards, hash)
+	sharded.keyFn = cfg.ShardKeyFn
+	return sharded, nil
+}
+
+// shardConfig returns the configuration of shard i of a ShardedDB configured with cfg,
+// which keeps its files in a subdirectory of cfg.DataDir and ships its WAL segments under
+// its own prefix.
+func shardConfig(cfg DBConfig, i int) DBConfig {
+	cfg.WALPath = filepath.Join(cfg.DataDir, fmt.Sprintf("shard-%d", i), filepath.Base(cfg.WALPath))
+	cfg.DataDir = filepath.Join(cfg.DataDir, fmt.Sprintf("shard-%d", i))
+	cfg.WALShippingPrefix += fmt.Sprintf("shard-%d/", i)
+	return cfg
+}
+
+func newShardedDB(shards []*memDB, hash HashFunc) *ShardedDB {
+	type point struct {
+		hash  uint32
+		owner int
+	}
+	ring := make([]point, 0, len(shards)*virtualNodesPerShard)
+	for i := range shards {
+		for v := 0; v < virtualNodesPerShard; v++ {
+			ring = append(ring, point{hash: ringHash(hash, []byte(fmt.Sprintf("shard-%d#%d", i, v))), owner: i})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+
+	sharded := &ShardedDB{shards: shards, hash: hash}
+	for _, p := range ring {
+		sharded.points = append(sharded.points, p.hash)
+		sharded.owners = append(sharded.owners, p.owner)
+	}
+	return sharded
+}
+
+// ringHash returns the position of key on the ring. FNV leaves similar keys close
+// together, so the bits are mixed to spread them around the ring.
+func ringHash(hash HashFunc, key []byte) uint32 {
+	return uint32(murmurFmix64(hash(key)))
+}
+
+// shardFor returns the shard key is placed on, routed by the part s.keyFn extracts.
+func (s *ShardedDB) shardFor(key []byte) *memDB {
+	if s.keyFn != nil {
+		key = s.keyFn(key)
+	}
+	return s.shardOnRing(key)
+}
+
+// shardOnRing returns the shard owning the first ring point at or after the hash of key.
+func (s *ShardedDB) shardOnRing(key []byte) *memDB {
+	hash := ringHash(s.hash, key)
+	i := sort.Search(len(s.points), func(i int) bool {
+		return s.points[i] >= hash
+	})
+	if i == len(s.points) {
+		i = 0
+	}
+	return s.shards[s.owners[i]]
+}
+
+func (s *ShardedDB) Set(key, value []byte) error {
+	return s.shardFor(key).Set(key, value)
+}
+
+func (s *ShardedDB) Get(key []byte) ([]byte, error) {
+	return s.shardFor(key).Get(key)
+}
+
+func (s *ShardedDB) Del(key []byte) ([]byte, error) {
+	return s.shardFor(key).Del(key)
+}
+
+// GetAll returns the memtable entries of every shard, sorted by key.
+func (s *ShardedDB) GetAll() ([]KeyValue, error) {
+	var all []KeyValue
+	for _, shard := range s.shards {
+		entries, err := shard.GetAll()
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, entries...)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return bytes.Compare(all[i].Key, all[j].Key) < 0
+	})
+	return all, nil
+}
+
+func (s *ShardedDB) SetContext(ctx context.Context, key, value []byte) error {
+	return s.shardFor(key).SetContext(ctx, key, value)
+}
+
+func (s *ShardedDB) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	return s.shardFor(key).GetContext(ctx, key)
+}
+
+func (s *ShardedDB) DelContext(ctx context.Context, key []byte) ([]byte, error) {
+	return s.shardFor(key).DelContext(ctx, key)
+}
+
+// GetByPrefix returns an iterator over the matching entries of every shard.
+func (s *ShardedDB) GetByPrefix(prefix []byte) (Iterator, error) {
+	var entries []KeyValue
+	for _, shard := range s.shards {
+		shardEntries, err := shard.GetRange(prefix, prefixEnd(prefix))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, shardEntries...)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].Key, entries[j].Key) < 0
+	})
+	return newSliceIterator(entries), nil
+}
+
+func (s *ShardedDB) Frequency(key []byte) uint64 {
+	return s.shardFor(key).Frequency(key)
+}
+
+// Subscribe streams the changes of key, or of every key on every shard when key is nil.
+func (s *ShardedDB) Subscribe(key []byte) (<-chan ChangeEvent, func()) {
+	if key != nil {
+		return s.shardFor(key).Subscribe(key)
+	}
+
+	merged := make(chan ChangeEvent, eventBufferSize)
+	done := make(chan struct{})
+	cancels := make([]func(), len(s.shards))
+	for i, shard := range s.shards {
+		events, cancel := shard.Subscribe(nil)
+		cancels[i] = cancel
+		go func() {
+			for {
+				select {
+				case event := <-events:
+					select {
+					case merged <- event:
+					case <-done:
+						return
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	var once sync.Once
+	return merged, func() {
+		once.Do(func() {
+			for _, cancel := range cancels {
+				cancel()
+			}
+			close(done)
+		})
+	}
+}
+
+// CircuitBreakerState reports the least healthy state of the shards' breakers.
+func (s *ShardedDB) CircuitBreakerState() string {
+	state := Closed.String()
+	for _, shard := range s.shards {
+		switch shardState := shard.CircuitBreakerState(); shardState {
+		case Open.String():
+			return shardState
+		case HalfOpen.String():
+			state = shardState
+		}
+	}
+	return state
+}
+
+// Stats sums the counters of every shard. The replication lag is the largest one, and
+// the SST write rate is shared by the shards, so it is taken from any of them. The WAL
+// sync policy is SyncPerEntry if any shard follows it.
+func (s *ShardedDB) Stats() DBStats {
+	var total DBStats
+	for _, shard := range s.shards {
+		stats := shard.Stats()
+		total.CompactionsTotal += stats.CompactionsTotal
+		total.CompactionBytesWrittenTotal += stats.CompactionBytesWrittenTotal
+		total.CompactionDurationSecondsTotal += stats.CompactionDurationSecondsTotal
+		total.CompactionAnomalies += stats.CompactionAnomalies
+		total.ReplicationLagSeconds = max(total.ReplicationLagSeconds, stats.ReplicationLagSeconds)
+		total.WALWriteBytesPerSec += stats.WALWriteBytesPerSec
+		total.SSTWriteBytesPerSec = max(total.SSTWriteBytesPerSec, stats.SSTWriteBytesPerSec)
+		total.KeyCount += stats.KeyCount
+		total.MaxKeyCount += stats.MaxKeyCount
+		if total.WALSyncPolicy != SyncPerEntry.String() {
+			total.WALSyncPolicy = stats.WALSyncPolicy
+		}
+	}
+	return total
+}
+
+// CompactionProgress adds up the progress of the shards' compactions. The estimated
+// completion time is the latest one.
+func (s *ShardedDB) CompactionProgress() CompactionProgress {
+	var total CompactionProgress
+	for _, shard := range s.shards {
+		progress := shard.CompactionProgress()
+		total.FilesTotal += progress.FilesTotal
+		total.FilesProcessed += progress.FilesProcessed
+		total.BytesTotal += progress.BytesTotal
+		total.BytesProcessed += progress.BytesProcessed
+		if progress.EstimatedCompletionTime.After(total.EstimatedCompletionTime) {
+			total.EstimatedCompletionTime = progress.EstimatedCompletionTime
+		}
+	}
+	return total
+}
+
+// CacheWarm reports whether the block caches of all shards are warm.
+func (s *ShardedDB) CacheWarm() bool {
+	for _, shard := range s.shards {
+		if !shard.CacheWarm() {
+			return false
+		}
+	}
+	return true
+}
+
+// Flush flushes the shards one after another. The progress counts the entries of all
+// shards flushed so far; the total includes the shards flushed so far and the current one.
+func (s *ShardedDB) Flush(progress FlushProgressFunc) error {
+	offset := 0
+	for i, shard := range s.shards {
+		var shardProgress FlushProgressFunc
+		flushed := 0
+		if progress != nil {
+			shardProgress = func(n, total int) {
+				flushed = n
+				progress(offset+n, offset+total)
+			}
+		}
+		if err := shard.Flush(shardProgress); err != nil {
+			return fmt.Errorf("error flushing shard %d: %w", i, err)
+		}
+		offset += flushed
+	}
+	return nil
+}
+
+// Namespace returns the namespace on the shard its name hashes to.
+func (s *ShardedDB) Namespace(name string) *NamespacedDB {
+	return s.shardOnRing([]byte(name)).Namespace(name)
+}
+
+// DebugShardDistribution returns the number of live keys on each shard, by shard index.
+// It reads every SST file of every shard.
+func (s *ShardedDB) DebugShardDistribution() (map[int]int, error) {
+	distribution := make(map[int]int, len(s.shards))
+	for i, shard := range s.shards {
+		count, err := shard.liveKeyCount()
+		if err != nil {
+			return nil, fmt.Errorf("error counting keys of shard %d: %w", i, err)
+		}
+		distribution[i] = int(count)
+	}
+	return distribution, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import "sync"
+
+// CountMinSketch estimates how often keys were seen in a fixed amount of memory.
+// Estimates never undercount; with width ceil(e/ε) and depth ceil(ln(1/δ)) they
+// overcount by more than ε times the total count with probability at most δ.
+type CountMinSketch struct {
+	mu     sync.Mutex
+	counts [][]uint32 // depth rows of width counters
+	hash   HashFunc
+}
+
+func NewCountMinSketch(width, depth int, hash HashFunc) *CountMinSketch {
+	counts := make([][]uint32, depth)
+	for i := range counts {
+		counts[i] = make([]uint32, width)
+	}
+	return &CountMinSketch{counts: counts, hash: hash}
+}
+
+// index returns the counter of key in the given row, from the two halves of the
+// key's hash combined as h1 + row*h2 so every row uses a different hash.
+func (s *CountMinSketch) index(row int, h1, h2 uint64) int {
+	return int((h1 + uint64(row)*h2) % uint64(len(s.counts[row])))
+}
+
+// Update counts one occurrence of key. A nil sketch ignores it.
+func (s *CountMinSketch) Update(key []byte) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h1, h2 := splitHash(s.hash(key))
+	for row := range s.counts {
+		i := s.index(row, h1, h2)
+		if s.counts[row][i] < ^uint32(0) {
+			s.counts[row][i]++
+		}
+	}
+}
+
+// Estimate returns the approximate number of times key was updated.
+func (s *CountMinSketch) Estimate(key []byte) uint64 {
+	if s == nil || len(s.counts) == 0 {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h1, h2 := splitHash(s.hash(key))
+	estimate := ^uint64(0)
+	for row := range s.counts {
+		estimate = min(estimate, uint64(s.counts[row][s.index(row, h1, h2)]))
+	}
+	return estimate
+}
+
+// Frequency returns the estimated number of Get and Set calls for key.
+func (mem *memDB) Frequency(key []byte) uint64 {
+	return mem.sketch.Estimate(key)
+}
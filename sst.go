@@ -1,15 +1,18 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
 	"compress/gzip"
+	"container/heap"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"os"
+	"path/filepath"
 	"sort"
 	"time"
 )
@@ -18,103 +21,769 @@ type KeyValue struct {
 	Key       []byte    `json:"Key"`
 	Value     []byte    `json:"Value"`
 	Operation Operation `json:"Operation"`
+	ExpiresAt int64     `json:"ExpiresAt"`           // Unix time in nanoseconds after which the entry is dropped; 0 never expires
+	Timestamp int64     `json:"Timestamp,omitempty"` // Unix time in nanoseconds the WAL record was appended, if it has one; not stored in SST files
+	Flags     uint8     `json:"-"`                   // CompressedFlag for memtable entries; not stored in the WAL or SST files
+
+	Tags map[string]string `json:"Tags,omitempty"` // Metadata set with SetWithOptions, returned by GetMetadata rather than Get
+}
+
+// expired reports whether the entry has a TTL that ended before now.
+func (kv KeyValue) expired(now time.Time) bool {
+	return kv.ExpiresAt != 0 && now.UnixNano() > kv.ExpiresAt
 }
 
 func (mem *memDB) periodicFlush() {
-	ticker := time.NewTicker(30 * time.Minute) // Adjust the duration
+	defer mem.bgWG.Done()
+	ticker := time.NewTicker(periodicFlushInterval(mem.FlushInterval()))
 	defer ticker.Stop()
 
-	for range ticker.C {
-		mem.flushToSST(Set)    // Flush Set operation data
-		mem.flushToSST(Delete) // Flush Delete operation data
+	for {
+		select {
+		case <-mem.flushIntervalChanged:
+			ticker.Reset(periodicFlushInterval(mem.FlushInterval()))
+		case <-ticker.C:
+			periodicFlushTick(mem)
+		case <-mem.stopCh:
+			return
+		}
+	}
+}
+
+// periodicFlushTick is the work periodicFlush does on each tick.
+var periodicFlushTick = func(mem *memDB) {
+	mem.flushToSST(Set)    // Flush Set operation data
+	mem.flushToSST(Delete) // Flush Delete operation data
+	mem.compactWALIfLarge()
+	if err := mem.wal.RemoveFlushedSegments(); err != nil {
+		logger.Warn("error removing flushed WAL segments", "error", err)
+	}
+}
+
+// periodicFlushInterval returns interval, or 30 minutes when it is not set.
+func periodicFlushInterval(interval time.Duration) time.Duration {
+	if interval <= 0 {
+		return 30 * time.Minute
+	}
+	return interval
+}
+
+// compactWALIfLarge compacts the WAL once it grew beyond cfg.WALCompactionThresholdBytes.
+func (mem *memDB) compactWALIfLarge() {
+	threshold := mem.cfg.WALCompactionThresholdBytes
+	if threshold <= 0 || mem.wal == nil {
+		return
+	}
+	size, err := mem.wal.Position()
+	if err != nil || size <= threshold {
+		return
+	}
+	if err := mem.wal.CompactWAL(); err != nil {
+		logger.Error("error compacting WAL", "error", err)
 	}
 }
 
 const (
-	magicNumber    uint32 = 0x12345678
-	version        uint16 = 1
-	checksumOffset        = 14 // Offset for checksum in the file
+	magicNumber  uint32 = 0x12345678
+	version      uint16 = 6  // Version 3 adds the expiry time to every record, version 4 the operation type, version 5 the filter block, version 6 the key range in the header
+	headerSize          = 18 // magic, version, entry count and key lengths; version 6 headers also hold the keys and the checksum offset
+	footerSize          = 12 // properties offset and checksum
+	footerSizeV5        = 20 // filter block offset, properties offset and checksum
+	hmacSize            = sha256.Size
 )
 
+// flushProgressInterval is the number of entries written between calls of a FlushProgressFunc.
+const flushProgressInterval = 1000
+
+// FlushProgressFunc is called while the memtable is written to an SST file, every
+// flushProgressInterval entries and once all total entries are written.
+type FlushProgressFunc func(flushed, total int)
+
+// SetFlushProgressFunc sets the function called with the progress of every memtable flush.
+func (mem *memDB) SetFlushProgressFunc(progress FlushProgressFunc) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	mem.flushProgress = progress
+}
+
+// Flush writes the memtable to an SST file, reporting the progress to progress, or to the
+// function set with SetFlushProgressFunc when it is nil.
+func (mem *memDB) Flush(progress FlushProgressFunc) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	if mem.closed {
+		return ErrDatabaseClosed
+	}
+	if progress == nil {
+		progress = mem.flushProgress
+	}
+	return mem.createSSTFileWithProgress(progress)
+}
+
 func (mem *memDB) createSSTFile() error {
+	return mem.createSSTFileWithProgress(mem.flushProgress)
+}
+
+func (mem *memDB) createSSTFileWithProgress(progress FlushProgressFunc) error {
+	// Queued writes are logged before the WAL position is recorded, so they must be in the file
+	mem.awaitPendingWrites()
+	mem.moveTombstonesToMemtable()
+	mem.transformMemtableKeys()
 	if len(mem.data) == 0 {
 		fmt.Println("No data to create SST file")
 		return nil
 	}
 
+	fileName, err := mem.writeEntriesSST(mem.data, progress)
+	if err != nil {
+		return err
+	}
+
+	mem.data = make([]KeyValue, 0)
+	mem.size.Store(0)
+
+	fmt.Println("SST file created successfully:", fileName)
+	return nil
+}
+
+// writeEntriesSST sorts data, memtable entries, writes them to a new SST file and records it
+// in the manifest. It returns the name of the file. The caller must hold mem.mu.
+func (mem *memDB) writeEntriesSST(data []KeyValue, progress FlushProgressFunc) (string, error) {
 	// Sort the data before flushing
-	sort.Slice(mem.data, func(i, j int) bool {
-		return string(mem.data[i].Key) < string(mem.data[j].Key)
+	sort.Slice(data, func(i, j int) bool {
+		return string(data[i].Key) < string(data[j].Key)
 	})
 
-	fileName := fmt.Sprintf("file_%d.sst", time.Now().Unix())
-	file, err := os.Create(fileName)
+	entries, err := decompressEntries(data)
+	if err != nil {
+		return "", err
+	}
+	fileName := newSSTFileName(mem.cfg.DataDir)
+	if err := writeMemtableSST(filepath.Join(mem.cfg.DataDir, fileName), entries, mem.cfg, progress); err != nil {
+		return "", err
+	}
+	if mem.cfg.SyncDirectory {
+		if err := syncDirectory(mem.cfg.DataDir); err != nil {
+			return "", fmt.Errorf("error syncing data directory: %w", err)
+		}
+	}
+
+	walEnd, err := mem.wal.end()
+	if err != nil {
+		return "", err
+	}
+	meta := SSTFileMeta{
+		FileName:     fileName,
+		MagicNumber:  magicNumber,
+		CreationTime: time.Now().UnixNano(),
+		SmallestKey:  data[0].Key,
+		LargestKey:   data[len(data)-1].Key,
+		Checksum:     calculateChecksum(entries),
+		WALPosition:  walEnd.offset,
+		WALSegment:   walEnd.segment,
+	}
+	if err := addToManifest(mem.cfg.DataDir, meta); err != nil {
+		return "", fmt.Errorf("error recording SST file in manifest: %w", err)
+	}
+	return fileName, nil
+}
+
+// moveTombstonesToMemtable adds the tombstones kept aside by DeletePhysical to the memtable,
+// so they are flushed with it, unless the key was written again since.
+func (mem *memDB) moveTombstonesToMemtable() {
+	if len(mem.tombstones) == 0 {
+		return
+	}
+	inMemtable := make(map[string]bool, len(mem.data))
+	for _, kv := range mem.data {
+		inMemtable[string(kv.Key)] = true
+	}
+	for _, kv := range mem.tombstones {
+		if !inMemtable[string(kv.Key)] {
+			inMemtable[string(kv.Key)] = true
+			mem.data = append(mem.data, KeyValue{Key: kv.Key, Operation: Delete})
+			mem.size.Add(entrySize(kv))
+		}
+	}
+	mem.tombstones = nil
+}
+
+// Operation types of SST records. They are independent of the WAL operation codes.
+const (
+	sstOpSet        uint8 = 0
+	sstOpDelete     uint8 = 1 // Tombstone: the key was deleted
+	sstOpSetWithTTL uint8 = 2 // Set whose record carries an expiry time
+	sstOpMerge      uint8 = 3
+
+	sstTagsFlag uint8 = 0x80 // Set on the operation type of records whose value is followed by their tags
+)
+
+func sstOpType(kv KeyValue) uint8 {
+	opType := sstOpSet
+	switch {
+	case kv.Operation == Delete:
+		opType = sstOpDelete
+	case kv.Operation == Merge:
+		opType = sstOpMerge
+	case kv.ExpiresAt != 0:
+		opType = sstOpSetWithTTL
+	}
+	if len(kv.Tags) > 0 {
+		opType |= sstTagsFlag
+	}
+	return opType
+}
+
+func operationFromSST(opType uint8) (Operation, error) {
+	switch opType &^ sstTagsFlag {
+	case sstOpSet, sstOpSetWithTTL:
+		return Set, nil
+	case sstOpDelete:
+		return Delete, nil
+	case sstOpMerge:
+		return Merge, nil
+	default:
+		return 0, fmt.Errorf("%w: unknown record operation %d", ErrInvalidSSTFormat, opType)
+	}
+}
+
+// newSSTFileName returns a name for a new SST file in dir based on the current time.
+// Files flushed within the same second get a numeric suffix instead of overwriting each other.
+func newSSTFileName(dir string) string {
+	return uniqueSSTFileName(dir, "file")
+}
+
+// uniqueSSTFileName returns a name starting with prefix for a new SST file in dir, like
+// newSSTFileName.
+func uniqueSSTFileName(dir, prefix string) string {
+	now := time.Now().Unix()
+	fileName := fmt.Sprintf("%s_%d.sst", prefix, now)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(filepath.Join(dir, fileName)); errors.Is(err, os.ErrNotExist) {
+			return fileName
+		}
+		fileName = fmt.Sprintf("%s_%d_%d.sst", prefix, now, i)
+	}
+}
+
+// writeSSTFile writes data, which must be sorted by key, to a new SST file laid out as
+// header | gzip-compressed entries | properties block | footer.
+func writeSSTFile(fileName string, data []KeyValue) error {
+	return writeSSTFileWithKey(fileName, data, nil)
+}
+
+// writeSSTFileWithKey writes an SST file like writeSSTFile. When integrityKey is set, an
+// HMAC-SHA256 of the compressed entries is appended as a trailer after the footer.
+func writeSSTFileWithKey(fileName string, data []KeyValue, integrityKey []byte) error {
+	return writeSSTFileVersion(fileName, data, integrityKey, gzip.DefaultCompression, version)
+}
+
+// writeSSTFileWithConfig writes an SST file with the integrity key and gzip level of cfg.
+// With cfg.UseDirectIO the file is written as one aligned block through direct I/O.
+func writeSSTFileWithConfig(fileName string, data []KeyValue, cfg DBConfig) error {
+	filter := newSSTFilter(len(data), cfg)
+	image, err := encodeSSTFile(data, cfg.IntegrityKey, cfg.GzipCompressionLevel, version, cfg.ChecksumAlgorithm, filter, cfg.ByteOrder, cfg.CompressionDictionary)
+	if err != nil {
+		return err
+	}
+	if cfg.UseDirectIO {
+		err = writeDirectFile(fileName, image, cfg.IOAlignment)
+	} else {
+		err = writeCountedFile(fileName, image)
+	}
+	if err != nil {
+		return fmt.Errorf("error creating SST file: %w", err)
+	}
+	return nil
+}
+
+// writeMemtableSST writes an SST file like writeSSTFileWithConfig, streaming the entries so
+// progress can be reported while they are written. progress may be nil.
+func writeMemtableSST(fileName string, data []KeyValue, cfg DBConfig, progress FlushProgressFunc) error {
+	fw, err := createSSTFileWriter(fileName, cfg, len(data))
+	if err != nil {
+		return err
+	}
+	for i, kv := range data {
+		if err := fw.Add(kv); err != nil {
+			fw.Abort()
+			return err
+		}
+		if progress != nil && (i+1)%flushProgressInterval == 0 && i+1 < len(data) {
+			progress(i+1, len(data))
+		}
+	}
+	if err := fw.Close(); err != nil {
+		return err
+	}
+	if progress != nil {
+		progress(len(data), len(data))
+	}
+	return nil
+}
+
+// writeSSTFileVersion writes an SST file in the layout of formatVersion 2 or later, compressing
+// the entries at the given gzip level. Versions before 3 have no expiry times, versions
+// before 4 no operation types and versions before 5 no filter block.
+func writeSSTFileVersion(fileName string, data []KeyValue, integrityKey []byte, compressionLevel int, formatVersion uint16) error {
+	filter := newSSTFilter(len(data), DefaultDBConfig())
+	image, err := encodeSSTFile(data, integrityKey, compressionLevel, formatVersion, ChecksumCRC32IEEE, filter, binary.LittleEndian, nil)
 	if err != nil {
+		return err
+	}
+	if err := writeCountedFile(fileName, image); err != nil {
 		return fmt.Errorf("error creating SST file: %w", err)
 	}
-	defer file.Close()
-	gzWriter := gzip.NewWriter(file)
-	defer gzWriter.Close()
+	return nil
+}
+
+// writeCountedFile writes an SST file image like os.WriteFile and counts its bytes in sstBytesWritten.
+func writeCountedFile(fileName string, image []byte) error {
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := (CountingWriter{W: file, Count: &sstBytesWritten}).Write(image); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// encodeSSTFile returns the contents of an SST file holding data, as writeSSTFileVersion writes it.
+// Files of version 4 and later store their checksum with the given algorithm; older ones use CRC32.
+// Files of version 5 and later store filter, sized for the entries of data, and files of
+// version 6 and later are compressed with dict when it is set.
+func encodeSSTFile(data []KeyValue, integrityKey []byte, compressionLevel int, formatVersion uint16, checksumAlgorithm ChecksumAlgorithm, filter *FilterBlock, order binary.ByteOrder, dict []byte) ([]byte, error) {
+	file := new(bytes.Buffer)
+	sw, err := newSSTWriter(file, new(bytes.Buffer), integrityKey, compressionLevel, formatVersion, checksumAlgorithm, filter, order, dict)
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range data {
+		if err := sw.Add(kv); err != nil {
+			return nil, err
+		}
+	}
+	if err := sw.Finish(); err != nil {
+		return nil, err
+	}
+	return file.Bytes(), nil
+}
+
+// writeSSTProperties writes the properties as a block prefixed with its 4-byte length.
+// Each property is stored as a 2-byte length-prefixed name followed by its value.
+// The lengths are stored in the given byte order.
+func writeSSTProperties(w io.Writer, properties map[string]string, order binary.ByteOrder) error {
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-	entryCount := uint32(len(mem.data))
-	smallestKey := mem.data[0].Key
-	largestKey := mem.data[len(mem.data)-1].Key
+	var block bytes.Buffer
+	for _, name := range names {
+		binary.Write(&block, order, uint16(len(name)))
+		block.WriteString(name)
+		binary.Write(&block, order, uint16(len(properties[name])))
+		block.WriteString(properties[name])
+	}
 
-	if err := binary.Write(file, binary.LittleEndian, magicNumber); err != nil {
-		return fmt.Errorf("error writing magic number: %w", err)
+	if err := binary.Write(w, order, uint32(block.Len())); err != nil {
+		return err
 	}
-	if err := binary.Write(file, binary.LittleEndian, version); err != nil {
-		return fmt.Errorf("error writing version: %w", err)
+	_, err := w.Write(block.Bytes())
+	return err
+}
+
+// sstTrailerSize returns the number of bytes following the footer of SST files written with integrityKey.
+func sstTrailerSize(integrityKey []byte) int64 {
+	if integrityKey == nil {
+		return 0
 	}
+	return hmacSize
+}
 
-	if err := binary.Write(file, binary.LittleEndian, entryCount); err != nil {
-		return fmt.Errorf("error writing entry count: %w", err)
+// sstFooter locates the blocks of a file of version 2 or later. The compressed entries
+// span from dataOffset to propertiesOffset.
+type sstFooter struct {
+	filterOffset     int64 // Start of the length-prefixed filter block; 0 before version 5
+	dataOffset       int64
+	propertiesOffset int64
+	checksum         uint32
+}
+
+// readSSTFooter reads the footer stored in front of trailerSize bytes at the end of an SST
+// file. The entries of version 5 files start after the filter block, whose length is read.
+func readSSTFooter(file sstSource, header sstHeader, trailerSize int64) (sstFooter, error) {
+	var footer sstFooter
+	order := header.byteOrder()
+	size := int64(footerSize)
+	if header.formatVersion() >= 5 {
+		size = footerSizeV5
+	}
+	footerOffset, err := file.Seek(-size-trailerSize, io.SeekEnd)
+	if err != nil {
+		return footer, fmt.Errorf("error seeking SST footer: %w", err)
 	}
-	if err := binary.Write(file, binary.LittleEndian, uint32(len(smallestKey))); err != nil {
-		return fmt.Errorf("error writing smallest key length: %w", err)
+	if header.formatVersion() >= 5 {
+		var filterOffset uint64
+		if err := binary.Read(file, order, &filterOffset); err != nil {
+			return footer, fmt.Errorf("error reading filter block offset: %w", err)
+		}
+		if filterOffset < uint64(header.size()) || filterOffset > uint64(footerOffset) {
+			return footer, fmt.Errorf("%w: filter block offset %d out of range", ErrInvalidSSTFormat, filterOffset)
+		}
+		footer.filterOffset = int64(filterOffset)
 	}
-	if err := binary.Write(file, binary.LittleEndian, uint32(len(largestKey))); err != nil {
-		return fmt.Errorf("error writing largest key length: %w", err)
+	var propertiesOffset uint64
+	if err := binary.Read(file, order, &propertiesOffset); err != nil {
+		return footer, fmt.Errorf("error reading properties offset: %w", err)
 	}
-	placeholder := uint32(0)
-	if err := binary.Write(file, binary.LittleEndian, placeholder); err != nil {
-		return fmt.Errorf("error writing entry count placeholder: %w", err)
+	if err := binary.Read(file, order, &footer.checksum); err != nil {
+		return footer, fmt.Errorf("error reading stored checksum: %w", err)
 	}
-	if err := binary.Write(file, binary.LittleEndian, placeholder); err != nil {
-		return fmt.Errorf("error writing smallest key length placeholder: %w", err)
+	if propertiesOffset < uint64(header.size()) || propertiesOffset > uint64(footerOffset) {
+		return footer, fmt.Errorf("%w: properties offset %d out of range", ErrInvalidSSTFormat, propertiesOffset)
 	}
-	if err := binary.Write(file, binary.LittleEndian, placeholder); err != nil {
-		return fmt.Errorf("error writing largest key length placeholder: %w", err)
+	footer.propertiesOffset = int64(propertiesOffset)
+	if header.formatVersion() >= 6 && header.ChecksumOffset != uint64(footerOffset+size-4) {
+		return footer, fmt.Errorf("%w: checksum offset %d in header, footer ends at %d", ErrInvalidSSTFormat, header.ChecksumOffset, footerOffset+size)
 	}
 
-	for _, kv := range mem.data {
-		if err := binary.Write(file, binary.LittleEndian, uint32(len(kv.Key))); err != nil {
-			return fmt.Errorf("error writing key length: %w", err)
+	footer.dataOffset = header.size()
+	if footer.filterOffset != 0 {
+		var length [4]byte
+		if _, err := file.ReadAt(length[:], footer.filterOffset); err != nil {
+			return footer, fmt.Errorf("error reading filter block length: %w", unexpectedEOF(err))
 		}
-		if _, err := file.Write(kv.Key); err != nil {
-			return fmt.Errorf("error writing key data: %w", err)
+		footer.dataOffset = footer.filterOffset + 4 + int64(order.Uint32(length[:]))
+		if footer.dataOffset > footer.propertiesOffset {
+			return footer, fmt.Errorf("%w: filter block length %d out of range", ErrInvalidSSTFormat, order.Uint32(length[:]))
 		}
-		if err := binary.Write(file, binary.LittleEndian, uint32(len(kv.Value))); err != nil {
-			return fmt.Errorf("error writing value length: %w", err)
+	}
+	return footer, nil
+}
+
+// ReadSSTProperties returns the properties block of an SST file without reading its entries.
+// integrityKey is the key the file was written with, or nil.
+func ReadSSTProperties(path string, integrityKey []byte) (map[string]string, error) {
+	file, closeFile, err := openSSTSource(path, false, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFile()
+
+	header, err := readSSTHeader(file)
+	if err != nil {
+		return nil, err
+	}
+	footer, err := readSSTFooter(file, header, sstTrailerSize(integrityKey))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(footer.propertiesOffset, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("error seeking properties block: %w", err)
+	}
+
+	order := header.byteOrder()
+	block, err := readSSTField(file, order)
+	if err != nil {
+		return nil, fmt.Errorf("error reading properties block: %w", err)
+	}
+
+	properties := make(map[string]string)
+	for len(block) > 0 {
+		name, rest, err := readPropertyString(block, order)
+		if err != nil {
+			return nil, err
 		}
-		if _, err := file.Write(kv.Value); err != nil {
-			return fmt.Errorf("error writing value data: %w", err)
+		value, rest, err := readPropertyString(rest, order)
+		if err != nil {
+			return nil, err
 		}
+		properties[name] = value
+		block = rest
 	}
-	if _, err := file.Seek(checksumOffset, io.SeekStart); err != nil {
-		return fmt.Errorf("error seeking to checksum offset: %w", err)
+	return properties, nil
+}
+
+func readPropertyString(block []byte, order binary.ByteOrder) (string, []byte, error) {
+	if len(block) < 2 {
+		return "", nil, errors.New("truncated SST properties block")
 	}
-	checksum := calculateChecksum(mem.data)
-	if err := binary.Write(file, binary.LittleEndian, checksum); err != nil {
-		return fmt.Errorf("error writing checksum: %w", err)
+	n := int(order.Uint16(block))
+	if len(block) < 2+n {
+		return "", nil, errors.New("truncated SST properties block")
 	}
+	return string(block[2 : 2+n]), block[2+n:], nil
+}
 
-	mem.data = make([]KeyValue, 0)
+var (
+	ErrInvalidSSTFormat   = errors.New("invalid SST file format")
+	ErrChecksumMismatch   = errors.New("SST file integrity check failed: checksums do not match")
+	ErrIntegrityViolation = errors.New("SST file integrity check failed: HMAC does not match")
+	ErrInvalidMergedSST   = errors.New("merged SST file failed validation")
+)
 
-	fmt.Println("SST file created successfully:", fileName)
+// sstHeader is the header at the start of an SST file. Before version 6 it holds the
+// lengths of the smallest and largest keys only. From version 6 the keys follow their
+// lengths, and the header ends with the offset of the checksum in the footer, followed
+// by the dictionary ID when the entries were compressed with a dictionary:
+//
+//	magic (4) | version (2) | entry count (4) | smallest key length (4) | smallest key |
+//	largest key length (4) | largest key | checksum offset (8) | dictionary ID (4)
+type sstHeader struct {
+	Magic          uint32
+	Version        uint16 // Format version in the low byte, checksum algorithm and byte order flag in the high byte
+	EntryCount     uint32
+	SmallestKeyLen uint32
+	LargestKeyLen  uint32
+	SmallestKey    []byte // Nil before version 6
+	LargestKey     []byte // Nil before version 6
+	ChecksumOffset uint64 // Offset of the checksum stored in the footer; 0 before version 6
+	DictionaryID   uint32 // ID of the compression dictionary, when sstDictionaryFlag is set
+}
+
+// size returns the number of bytes the header takes at the start of the file.
+func (h sstHeader) size() int64 {
+	if h.formatVersion() < 6 {
+		return headerSize
+	}
+	size := headerSize + int64(len(h.SmallestKey)+len(h.LargestKey)) + 8
+	if h.Version&sstDictionaryFlag != 0 {
+		size += 4
+	}
+	return size
+}
+
+// appendTo appends the encoded header to b in the byte order of the header.
+func (h sstHeader) appendTo(b []byte) []byte {
+	order := h.byteOrder()
+	b = order.AppendUint32(b, h.Magic)
+	b = order.AppendUint16(b, h.Version)
+	b = order.AppendUint32(b, h.EntryCount)
+	b = order.AppendUint32(b, h.SmallestKeyLen)
+	if h.formatVersion() < 6 {
+		return order.AppendUint32(b, h.LargestKeyLen)
+	}
+	b = append(b, h.SmallestKey...)
+	b = order.AppendUint32(b, h.LargestKeyLen)
+	b = append(b, h.LargestKey...)
+	b = order.AppendUint64(b, h.ChecksumOffset)
+	if h.Version&sstDictionaryFlag != 0 {
+		b = order.AppendUint32(b, h.DictionaryID)
+	}
+	return b
+}
+
+// sstBigEndianFlag is set in the version field of files whose fixed-size fields are
+// big-endian. The field has room for it next to the checksum algorithm, so the header
+// keeps its size.
+const sstBigEndianFlag uint16 = 0x8000
+
+// sstDictionaryFlag is set in the version field of version 6 files whose entries are
+// compressed with zlib and a preset dictionary, whose ID ends the header.
+const sstDictionaryFlag uint16 = 0x4000
+
+func (h sstHeader) formatVersion() uint16 {
+	return h.Version & 0xff
+}
+
+func (h sstHeader) checksumAlgorithm() ChecksumAlgorithm {
+	return ChecksumAlgorithm((h.Version &^ (sstBigEndianFlag | sstDictionaryFlag)) >> 8)
+}
+
+// byteOrder returns the order of the fixed-size fields of the file.
+func (h sstHeader) byteOrder() appendByteOrder {
+	if h.Version&sstBigEndianFlag != 0 {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// appendByteOrder is a byte order that also appends, as binary.LittleEndian and
+// binary.BigEndian do.
+type appendByteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// byteOrderOrDefault returns binary.BigEndian for order binary.BigEndian, and
+// binary.LittleEndian otherwise, including when order is nil.
+func byteOrderOrDefault(order binary.ByteOrder) appendByteOrder {
+	if order == binary.BigEndian {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// readSSTHeader reads the header at the start of file and rejects files that
+// are not SST files or whose version has no reader in sstReaders. The magic number
+// only reads as magicNumber in the byte order of the file, which must match its flag.
+func readSSTHeader(file sstSource) (sstHeader, error) {
+	var header sstHeader
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return header, err
+	}
+	raw := make([]byte, headerSize)
+	if _, err := io.ReadFull(file, raw); err != nil {
+		return header, fmt.Errorf("%w: error reading header: %s", ErrInvalidSSTFormat, err)
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if binary.BigEndian.Uint32(raw) == magicNumber {
+		order = binary.BigEndian
+	}
+	header.Magic = order.Uint32(raw)
+	header.Version = order.Uint16(raw[4:])
+	header.EntryCount = order.Uint32(raw[6:])
+	header.SmallestKeyLen = order.Uint32(raw[10:])
+	header.LargestKeyLen = order.Uint32(raw[14:])
+	if header.Magic != magicNumber {
+		return header, fmt.Errorf("%w: magic number %#x, expected %#x", ErrInvalidSSTFormat, header.Magic, magicNumber)
+	}
+	if header.byteOrder() != order {
+		return header, fmt.Errorf("%w: byte order flag does not match the magic number", ErrInvalidSSTFormat)
+	}
+	if _, ok := sstReaders[header.formatVersion()]; !ok {
+		return header, fmt.Errorf("%w: %d", ErrUnsupportedSSTVersion, header.formatVersion())
+	}
+	if _, ok := checksumFuncs[header.checksumAlgorithm()]; !ok {
+		return header, fmt.Errorf("%w: unknown checksum algorithm %d", ErrInvalidSSTFormat, header.checksumAlgorithm())
+	}
+	if header.formatVersion() >= 6 {
+		if err := readSSTHeaderKeys(file, &header, order); err != nil {
+			return header, fmt.Errorf("%w: error reading header: %s", ErrInvalidSSTFormat, err)
+		}
+	} else if header.Version&sstDictionaryFlag != 0 {
+		return header, fmt.Errorf("%w: dictionary flag in a version %d file", ErrInvalidSSTFormat, header.formatVersion())
+	}
+	return header, nil
+}
+
+// readSSTHeaderKeys reads the key range, checksum offset and dictionary ID of a version 6
+// header, which follow its fixed-size fields up to the smallest key length.
+func readSSTHeaderKeys(file sstSource, header *sstHeader, order binary.ByteOrder) error {
+	if _, err := file.Seek(10, io.SeekStart); err != nil {
+		return err
+	}
+	var err error
+	if header.SmallestKey, err = readSSTField(file, order); err != nil {
+		return fmt.Errorf("error reading smallest key: %w", unexpectedEOF(err))
+	}
+	if header.LargestKey, err = readSSTField(file, order); err != nil {
+		return fmt.Errorf("error reading largest key: %w", unexpectedEOF(err))
+	}
+	header.LargestKeyLen = uint32(len(header.LargestKey))
+	if err := binary.Read(file, order, &header.ChecksumOffset); err != nil {
+		return fmt.Errorf("error reading checksum offset: %w", unexpectedEOF(err))
+	}
+	if header.Version&sstDictionaryFlag != 0 {
+		if err := binary.Read(file, order, &header.DictionaryID); err != nil {
+			return fmt.Errorf("error reading dictionary ID: %w", unexpectedEOF(err))
+		}
+	}
+	return nil
+}
+
+// readSSTEntries reads and verifies all key-value pairs stored in an SST file.
+func readSSTEntries(fileName string) ([]KeyValue, error) {
+	return readSSTEntriesWithKey(fileName, nil)
+}
+
+// readSSTEntriesWithKey reads an SST file like readSSTEntries. When integrityKey is set,
+// the HMAC trailer is verified before the entries are decompressed.
+func readSSTEntriesWithKey(fileName string, integrityKey []byte) ([]KeyValue, error) {
+	file, closeFile, err := openSSTSource(fileName, false, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFile()
+	entries, _, err := decodeSSTFile(file, integrityKey, nil)
+	return entries, err
+}
+
+// decodeSSTFile reads and verifies the entries of an SST file, decompressing them into buf.
+// The keys and values of the entries point into the returned buffer, which is buf grown as needed.
+func decodeSSTFile(file sstSource, integrityKey []byte, buf []byte) ([]KeyValue, []byte, error) {
+	header, err := readSSTHeader(file)
+	if err != nil {
+		return nil, buf, err
+	}
+	// The readers go through the whole file, so its size is what is read
+	offset, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, buf, err
+	}
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, buf, err
+	}
+	sstBytesRead.Add(uint64(size))
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, buf, err
+	}
+
+	return sstReaders[header.formatVersion()](file, header, integrityKey, buf)
+}
+
+// sliceSSTField splits a 4-byte length followed by that many bytes off the front of data.
+// The field is capped to its length so appending to it cannot overwrite the next field.
+func sliceSSTField(data []byte, order binary.ByteOrder) ([]byte, []byte, error) {
+	if len(data) < 4 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	length := order.Uint32(data)
+	data = data[4:]
+	if uint64(len(data)) < uint64(length) {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	return data[:length:length], data[length:], nil
+}
+
+// verifySSTHMAC compares the HMAC trailer at the end of file with the HMAC of the
+// compressed entries followed by the filter block, if there is one.
+func verifySSTHMAC(file sstSource, footer sstFooter, integrityKey []byte) error {
+	if _, err := file.Seek(-hmacSize, io.SeekEnd); err != nil {
+		return fmt.Errorf("error seeking HMAC: %w", err)
+	}
+	stored := make([]byte, hmacSize)
+	if _, err := io.ReadFull(file, stored); err != nil {
+		return fmt.Errorf("error reading HMAC: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, integrityKey)
+	if _, err := io.Copy(mac, io.NewSectionReader(file, footer.dataOffset, footer.propertiesOffset-footer.dataOffset)); err != nil {
+		return fmt.Errorf("error reading SST entries: %w", err)
+	}
+	if footer.filterOffset != 0 {
+		if _, err := io.Copy(mac, io.NewSectionReader(file, footer.filterOffset, footer.dataOffset-footer.filterOffset)); err != nil {
+			return fmt.Errorf("error reading filter block: %w", err)
+		}
+	}
+	if !hmac.Equal(mac.Sum(nil), stored) {
+		return ErrIntegrityViolation
+	}
 	return nil
 }
 
+// readSSTField reads a 4-byte length followed by that many bytes. The buffer only grows
+// as data actually arrives, so a corrupt length cannot trigger a huge allocation.
+func readSSTField(reader io.Reader, order binary.ByteOrder) ([]byte, error) {
+	var length uint32
+	if err := binary.Read(reader, order, &length); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(reader, int64(length)))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != int(length) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return data, nil
+}
+
 func (mem *memDB) flushToSST(operation Operation) error {
 	var dataToFlush []KeyValue
 
@@ -138,68 +807,18 @@ func (mem *memDB) flushToSST(operation Operation) error {
 	})
 
 	fileName := fmt.Sprintf("file%d.sst", time.Now().Unix())
-	file, err := os.Create(fileName)
-	
-	if err != nil {
-		return err
+	for i := range dataToFlush {
+		dataToFlush[i].Operation = operation
 	}
-	defer file.Close()
-
-	entryCount := uint32(len(mem.data))
-	smallestKey := mem.data[0].Key
-	largestKey := mem.data[len(mem.data)-1].Key
-
-	// Writing magic number and version to the file
-	if err := binary.Write(file, binary.LittleEndian, magicNumber); err != nil {
+	if err := writeSSTFileWithConfig(fileName, dataToFlush, mem.cfg); err != nil {
 		return err
 	}
-	if err := binary.Write(file, binary.LittleEndian, version); err != nil {
-		return err
-	}
-	if err := binary.Write(file, binary.LittleEndian, magicNumber); err != nil {
-		return err
-	}
-	if err := binary.Write(file, binary.LittleEndian, version); err != nil {
-		return err
-	}
-
-	if err := binary.Write(file, binary.LittleEndian, entryCount); err != nil {
-		return err
-	}
-	if err := binary.Write(file, binary.LittleEndian, uint32(len(smallestKey))); err != nil {
-		return err
-	}
-	if err := binary.Write(file, binary.LittleEndian, uint32(len(largestKey))); err != nil {
-		return err
-	}
-
-	for _, kv := range mem.data {
-		kv.Operation = operation
-
-		if err := binary.Write(file, binary.LittleEndian, uint32(len(kv.Key))); err != nil {
-			return err
-		}
-		if _, err := file.Write(kv.Key); err != nil {
-			return err
-		}
-		if err := binary.Write(file, binary.LittleEndian, uint32(len(kv.Value))); err != nil {
-			return err
-		}
-		if _, err := file.Write(kv.Value); err != nil {
-			return err
-		}
-	}
 
-	if len(mem.data) >= maxEntriesBeforeSST {
+	if mem.memtableFull(mem.Size()) {
 		if err := mem.createSSTFile(); err != nil {
 			return err
 		}
 	}
-	// Calculate a simple checksum (for demonstration purposes)
-	checksum := calculateChecksum(mem.data)
-	if err := binary.Write(file, binary.LittleEndian, checksum); err != nil {
-		return err
-	}
 
 	// Clear memtable after flushing to SST file
 
@@ -223,118 +842,457 @@ func (mem *memDB) flushToSST(operation Operation) error {
 // Calculate a simple checksum (for demonstration purposes)
 
 func calculateChecksum(data []KeyValue) uint32 {
-	hash := crc32.NewIEEE()
+	return sstChecksum(crc32.ChecksumIEEE, data)
+}
 
+// calculateChecksumV3 is the checksum of SST files before version 4, which did
+// not cover the operation type.
+func calculateChecksumV3(data []KeyValue) uint32 {
+	hash := crc32.NewIEEE()
 	for _, kv := range data {
 		hash.Write(kv.Key)
 		hash.Write(kv.Value)
 	}
-
 	return hash.Sum32()
 }
-func mergeSSTFiles(fileNames []string, newFileName string) error {
-	// Open the new file for writing merged data
-	newFile, err := os.Create(newFileName)
+
+// openCompactionInput opens a file being compacted; tests replace it to pause compactions.
+var openCompactionInput = func(fileName string, integrityKey []byte) (compactionInput, error) {
+	return newSSTIterator(fileName, integrityKey)
+}
+
+// mergeSSTFiles combines fileNames, oldest first, into newFileName with a k-way merge, so
+// only the current entry of every input is held in memory. Merge operands are folded into
+// the older version of their key with cfg.MergeOperator when one is configured; otherwise
+// the newest version wins.
+// Files of the same level above 0 must not overlap: a key found in two of them is counted
+// as an anomaly and logged, and the version from the file with the higher sequence number
+// in the manifest wins. The manifest of the directory of newFileName then lists it in place
+// of the inputs, with the sequence number of the newest one, before the inputs are removed.
+func mergeSSTFiles(fileNames []string, newFileName string, cfg DBConfig, progress *compactionTracker) (CompactionStats, error) {
+	stats := CompactionStats{FilesMerged: len(fileNames)}
+
+	sizes := make([]int64, len(fileNames))
+	expectedKeys := 0 // Sizes the filter of the output; versions of the same key are counted for each
+	for i, fileName := range fileNames {
+		info, err := os.Stat(fileName)
+		if err != nil {
+			return stats, err
+		}
+		sizes[i] = info.Size()
+		stats.InputBytes += info.Size()
+		header, err := readSSTFileHeader(fileName)
+		if err != nil {
+			return stats, fmt.Errorf("error reading %s: %w", fileName, err)
+		}
+		expectedKeys += int(header.EntryCount)
+	}
+	dir := filepath.Dir(newFileName)
+	metas, err := compactionInputMetas(fileNames, dir)
 	if err != nil {
-		return err
+		return stats, err
+	}
+	// Tombstones and expired entries hide older versions of their keys in files left out
+	bottommost, err := includesOldestFiles(fileNames, metas, dir)
+	if err != nil {
+		return stats, err
+	}
+	progress.start(len(fileNames), stats.InputBytes)
+	token := cfg.IOSemaphore.AcquireWrite()
+	defer token.Release()
+	if !cfg.UseDirectIO { // Direct I/O bypasses the page cache
+		preWarmCompactionInputs(fileNames)
 	}
-	defer newFile.Close()
-
-	mergedData := make(map[string]string) // Map to hold merged key-value pairs
 
-	// Iterate through each smaller SST file
+	inputs := make([]compactionInput, 0, len(fileNames))
+	defer func() {
+		for _, input := range inputs {
+			input.Close()
+		}
+	}()
 	for _, fileName := range fileNames {
-		// Open the smaller SST file
-		file, err := os.Open(fileName)
+		input, err := openCompactionInput(fileName, cfg.IntegrityKey)
 		if err != nil {
-			return err
+			return stats, fmt.Errorf("error reading %s: %w", fileName, err)
 		}
-		defer file.Close()
+		inputs = append(inputs, input)
+	}
 
-		scanner := bufio.NewScanner(file)
+	// advance moves input i to its next entry, or records that it was read completely
+	entries := &mergeHeap{}
+	advance := func(i int) error {
+		if inputs[i].Next() {
+			heap.Push(entries, mergeItem{kv: inputs[i].Entry(), source: i})
+			stats.KeysTotal++
+			return nil
+		}
+		if err := inputs[i].Err(); err != nil {
+			return fmt.Errorf("error reading %s: %w", fileNames[i], err)
+		}
+		progress.fileDone(sizes[i])
+		return nil
+	}
+	for i := range inputs {
+		if err := advance(i); err != nil {
+			return stats, err
+		}
+	}
 
-		// Process each line in the SST file
-		for scanner.Scan() {
-			line := scanner.Text()
+	var output *sstFileWriter
+	checksum := crc32.NewIEEE() // Of the written entries, as calculateChecksum computes it
+	now := time.Now()
+	for entries.Len() > 0 {
+		token.Yield()
 
-			var keyValue KeyValue
-			if err := json.Unmarshal([]byte(line), &keyValue); err != nil {
-				return err // Handle parsing error
+		// Fold the versions of the smallest key, from the oldest input to the newest
+		item := heap.Pop(entries).(mergeItem)
+		if err := advance(item.source); err != nil {
+			discardSSTFileWriter(output)
+			return stats, err
+		}
+		kv := item.kv
+		for entries.Len() > 0 && bytes.Equal((*entries)[0].kv.Key, kv.Key) {
+			newer := heap.Pop(entries).(mergeItem)
+			if err := advance(newer.source); err != nil {
+				discardSSTFileWriter(output)
+				return stats, err
+			}
+			if prev, next := metas[item.source], metas[newer.source]; prev.Level > 0 && prev.Level == next.Level {
+				stats.Anomalies++
+				logger.Warn("key found in overlapping SST files of the same level",
+					"key", string(kv.Key), "level", prev.Level, "file", fileNames[item.source], "other_file", fileNames[newer.source])
+				if prev.SequenceNumber > next.SequenceNumber {
+					continue
+				}
+				item, kv = newer, newer.kv
+				continue
+			}
+			if op := cfg.MergeOperator; op != nil && newer.kv.Operation == Merge {
+				switch {
+				case kv.Operation == Merge:
+					newer.kv.Value = op.PartialMerge(kv.Key, kv.Value, newer.kv.Value)
+				case kv.Operation == Set && !kv.expired(now):
+					newer.kv = KeyValue{Key: kv.Key, Value: op.FullMerge(kv.Key, kv.Value, [][]byte{newer.kv.Value}), Tags: kv.Tags}
+				default: // A deleted or expired base leaves the operand alone
+					newer.kv = KeyValue{Key: kv.Key, Value: op.FullMerge(kv.Key, nil, [][]byte{newer.kv.Value})}
+				}
 			}
+			item, kv = newer, newer.kv
+		}
 
-			// For simplicity, it just updates or appends keys in mergedData
-			mergedData[string(keyValue.Key)] = string(keyValue.Value)
+		switch filter := cfg.CompactionFilter; {
+		case kv.Operation == Delete:
+			if bottommost {
+				stats.KeysDroppedTombstones++
+				continue
+			}
+		case kv.expired(now):
+			if bottommost {
+				stats.KeysDroppedExpired++
+				continue
+			}
+		case filter != nil && !filter.ShouldKeep(kv.Key, kv.Value):
+			stats.KeysDroppedFilter++
+			if bottommost {
+				continue
+			}
+			kv = KeyValue{Key: kv.Key, Operation: Delete}
+		case filter != nil:
+			kv.Value = filter.Transform(kv.Key, kv.Value)
 		}
 
-		if err := scanner.Err(); err != nil {
-			return err // Handle scanner error
+		// The new file is only created once there is an entry to write
+		if output == nil {
+			var err error
+			if output, err = createSSTFileWriter(newFileName, cfg, expectedKeys); err != nil {
+				return stats, err
+			}
+		}
+		if err := output.Add(kv); err != nil {
+			output.Abort()
+			return stats, err
 		}
+		checksum.Write([]byte{sstOpType(kv)})
+		checksum.Write(kv.Key)
+		checksum.Write(kv.Value)
+	}
 
-		// Remove the smaller file after merging 
-		if err := os.Remove(fileName); err != nil {
-			return err
+	var merged *SSTFileMeta
+	if output != nil {
+		if err := output.Close(); err != nil {
+			return stats, err
 		}
+		// The inputs are the only copy of the data until the output is known to be complete
+		if err := validateMergedSST(newFileName, fileNames, cfg.IntegrityKey); err != nil {
+			os.Remove(newFileName)
+			os.Remove(bloomSidecarPath(newFileName))
+			return stats, err
+		}
+		info, err := os.Stat(newFileName)
+		if err != nil {
+			return stats, err
+		}
+		stats.OutputBytes = info.Size()
+		if merged, err = mergedSSTMeta(newFileName, metas, checksum.Sum32()); err != nil {
+			os.Remove(newFileName)
+			os.Remove(bloomSidecarPath(newFileName))
+			return stats, err
+		}
+	}
+	if err := replaceInManifest(filepath.Dir(newFileName), fileNames, merged); err != nil {
+		os.Remove(newFileName)
+		os.Remove(bloomSidecarPath(newFileName))
+		return stats, fmt.Errorf("error recording merged SST file in manifest: %w", err)
 	}
 
-	// Write the merged key-value pairs to the new larger SST file
-	for key, value := range mergedData {
-		// Convert key and value to bytes
-		keyBytes := []byte(key)
-		valueBytes := []byte(value)
+	// Remove the smaller files after merging
+	for _, fileName := range fileNames {
+		if err := os.Remove(fileName); err != nil {
+			return stats, err
+		}
+		if err := os.Remove(bloomSidecarPath(fileName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Warn("error removing bloom sidecar", "file", fileName, "error", err)
+		}
+	}
+	return stats, nil
+}
 
-		// Write key length to file
-		keyLen := make([]byte, 4)
-		binary.LittleEndian.PutUint32(keyLen, uint32(len(keyBytes)))
-		if _, err := newFile.Write(keyLen); err != nil {
-			return err
+// validateMergedSST checks that the SST file at mergedPath is a complete merge of
+// inputFiles: it holds at most as many entries as the inputs together, its key range lies
+// within theirs, and every entry reads back with a matching checksum. Dropped tombstones
+// and expired keys can narrow the range, so it need not span the inputs. The key ranges
+// are only compared when every file stores them in its header.
+func validateMergedSST(mergedPath string, inputFiles []string, integrityKey []byte) error {
+	merged, err := readSSTFileHeader(mergedPath)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidMergedSST, err)
+	}
+	var inputEntries uint64
+	var smallest, largest []byte
+	haveRange := merged.formatVersion() >= 6
+	for i, fileName := range inputFiles {
+		header, err := readSSTFileHeader(fileName)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", fileName, err)
+		}
+		inputEntries += uint64(header.EntryCount)
+		if header.formatVersion() < 6 {
+			haveRange = false
+			continue
+		}
+		if i == 0 || bytes.Compare(header.SmallestKey, smallest) < 0 {
+			smallest = header.SmallestKey
+		}
+		if i == 0 || bytes.Compare(header.LargestKey, largest) > 0 {
+			largest = header.LargestKey
 		}
+	}
+	if uint64(merged.EntryCount) > inputEntries {
+		return fmt.Errorf("%w: %d entries, the inputs hold %d", ErrInvalidMergedSST, merged.EntryCount, inputEntries)
+	}
+	if haveRange && (bytes.Compare(merged.SmallestKey, smallest) < 0 || bytes.Compare(merged.LargestKey, largest) > 0) {
+		return fmt.Errorf("%w: keys %q to %q outside of the inputs' %q to %q",
+			ErrInvalidMergedSST, merged.SmallestKey, merged.LargestKey, smallest, largest)
+	}
 
-		// Write key to file
-		if _, err := newFile.Write(keyBytes); err != nil {
-			return err
+	it, err := newSSTIterator(mergedPath, integrityKey)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidMergedSST, err)
+	}
+	defer it.Close()
+	var count uint32
+	for it.Next() {
+		count++
+	}
+	if err := it.Err(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidMergedSST, err)
+	}
+	if count != merged.EntryCount {
+		return fmt.Errorf("%w: read %d of %d entries", ErrInvalidMergedSST, count, merged.EntryCount)
+	}
+	return nil
+}
+
+// includesOldestFiles reports whether the manifest of dir lists no file older than the
+// inputs fileNames, described by metas, besides them. Tombstones and expired entries can
+// then be dropped, as no older version of their keys remains.
+func includesOldestFiles(fileNames []string, metas []SSTFileMeta, dir string) (bool, error) {
+	manifest, err := ReadManifest(dir)
+	if err != nil {
+		return false, fmt.Errorf("error reading manifest: %w", err)
+	}
+	inputs := make(map[string]bool, len(fileNames))
+	for _, fileName := range fileNames {
+		inputs[filepath.Clean(fileName)] = true
+	}
+	oldest := metas[0].SequenceNumber
+	for _, meta := range metas {
+		oldest = min(oldest, meta.SequenceNumber)
+	}
+	for _, file := range manifest {
+		if !inputs[filepath.Clean(filepath.Join(dir, file.FileName))] && file.SequenceNumber < oldest {
+			return false, nil
 		}
+	}
+	return true, nil
+}
 
-		// Write value length to file
-		valueLen := make([]byte, 4)
-		binary.LittleEndian.PutUint32(valueLen, uint32(len(valueBytes)))
-		if _, err := newFile.Write(valueLen); err != nil {
-			return err
+// mergedSSTMeta returns the manifest entry of the merged file at path, which takes the
+// place of the inputs described by metas: it is as recent as the newest of them.
+func mergedSSTMeta(path string, metas []SSTFileMeta, checksum uint32) (*SSTFileMeta, error) {
+	header, err := readSSTFileHeader(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+	meta := &SSTFileMeta{
+		FileName:     filepath.Base(path),
+		CreationTime: time.Now().UnixNano(),
+		SmallestKey:  header.SmallestKey,
+		LargestKey:   header.LargestKey,
+		Checksum:     checksum,
+		MagicNumber:  magicNumber,
+	}
+	for _, input := range metas {
+		meta.SequenceNumber = max(meta.SequenceNumber, input.SequenceNumber)
+		meta.Level = max(meta.Level, input.Level)
+		if input.walPosition().after(meta.walPosition()) {
+			meta.WALSegment, meta.WALPosition = input.WALSegment, input.WALPosition
 		}
+	}
+	return meta, nil
+}
 
-		// Write value to file
-		if _, err := newFile.Write(valueBytes); err != nil {
-			return err
+// compactionInputMetas returns the manifest entry of each of fileNames, or a zero entry,
+// at level 0, for the files the manifest in dataDir does not list. The key range of such
+// a file is taken from its header when the format stores it there.
+func compactionInputMetas(fileNames []string, dataDir string) ([]SSTFileMeta, error) {
+	manifest, err := ReadManifest(dataDir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+	byPath := make(map[string]SSTFileMeta, len(manifest))
+	for _, meta := range manifest {
+		byPath[filepath.Clean(filepath.Join(dataDir, meta.FileName))] = meta
+	}
+	metas := make([]SSTFileMeta, len(fileNames))
+	for i, fileName := range fileNames {
+		meta, ok := byPath[filepath.Clean(fileName)]
+		if !ok {
+			if header, err := readSSTFileHeader(fileName); err == nil {
+				meta.SmallestKey = header.SmallestKey
+				meta.LargestKey = header.LargestKey
+			}
 		}
+		metas[i] = meta
 	}
-	return nil
+	return metas, nil
 }
 
-func compactSSTFiles(maxSSTFiles int) error {
-	sstFiles, err := getSSTFileNames()
+// compactionCandidates returns the manifest entries of the SST files at paths, with FileName
+// set to the path and FileSize to the current size of the file.
+func compactionCandidates(paths []string, dataDir string) ([]SSTFileMeta, error) {
+	metas, err := compactionInputMetas(paths, dataDir)
 	if err != nil {
-		return fmt.Errorf("error getting SST file names: %w", err)
+		return nil, err
+	}
+	for i, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading size of %s: %w", path, err)
+		}
+		metas[i].FileName = path
+		metas[i].FileSize = info.Size()
 	}
+	return metas, nil
+}
 
-	if len(sstFiles) <= maxSSTFiles {
-		return nil // No need for compaction, files count within limits
+// consecutiveFiles reports whether selected is a run of consecutive files of files.
+func consecutiveFiles(files, selected []SSTFileMeta) bool {
+	for i, file := range files {
+		if file.FileName != selected[0].FileName {
+			continue
+		}
+		if i+len(selected) > len(files) {
+			return false
+		}
+		for j := range selected {
+			if files[i+j].FileName != selected[j].FileName {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func compactSSTFiles(cfg DBConfig, maxSSTFiles int, metrics *MetricsCollector, progress *compactionTracker) error {
+	_, err := mergeCompactionFiles(cfg, maxSSTFiles, metrics, progress)
+	return err
+}
+
+// mergeCompactionFiles runs a compaction like compactSSTFiles and reports whether the
+// strategy selected files to merge and they were merged.
+func mergeCompactionFiles(cfg DBConfig, maxSSTFiles int, metrics *MetricsCollector, progress *compactionTracker) (bool, error) {
+	dir := cfg.DataDir
+	sstFiles, err := getSSTFileNames(dir)
+	if err != nil {
+		return false, fmt.Errorf("error getting SST file names: %w", err)
 	}
 
 	// Sort SST file names to ensure the order
 	sort.Strings(sstFiles)
+	for i, fileName := range sstFiles {
+		sstFiles[i] = filepath.Join(dir, fileName)
+	}
 
-	// Merge smaller SST files into a larger one
-	newSSTFileName := fmt.Sprintf("merged_sst_file_%d.sst", time.Now().Unix()) // Change the filename as needed
-	err = mergeSSTFiles(sstFiles, newSSTFileName)
+	strategy := cfg.CompactionStrategy
+	if strategy == nil {
+		strategy = MergeAllStrategy{}
+	}
+	candidates, err := compactionCandidates(sstFiles, dir)
 	if err != nil {
-		return fmt.Errorf("error during compaction: %w", err)
+		return false, err
+	}
+	// Oldest first, as the strategies expect; files with the same sequence number keep the order of their names
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].SequenceNumber < candidates[j].SequenceNumber
+	})
+	selected := strategy.SelectFiles(candidates, maxSSTFiles)
+	if len(selected) == 0 {
+		return false, nil // No need for compaction, files count within limits
+	}
+	if !consecutiveFiles(candidates, selected) {
+		return false, fmt.Errorf("compaction strategy selected files that are not consecutive")
+	}
+	sstFiles = make([]string, len(selected))
+	for i, meta := range selected {
+		sstFiles[i] = meta.FileName
 	}
 
-	// Remove the smaller SST files after successful compaction
-	for _, fileName := range sstFiles {
-		if err := os.Remove(fileName); err != nil {
-			return fmt.Errorf("error removing SST file: %w", err)
-		}
+	// Merge smaller SST files into a larger one
+	start := time.Now()
+	newSSTFileName := filepath.Join(dir, uniqueSSTFileName(dir, "merged_sst_file")) // Not one of the inputs, even within the same second
+	stopLogging := progress.logEvery(5 * time.Second)
+	stats, err := mergeSSTFiles(sstFiles, newSSTFileName, cfg, progress)
+	stopLogging()
+	if err != nil {
+		return false, fmt.Errorf("error during compaction: %w", err)
 	}
+	stats.Duration = time.Since(start)
 
-	return nil
+	logger.Info("compaction completed",
+		"files_merged_count", stats.FilesMerged,
+		"total_input_bytes", stats.InputBytes,
+		"total_output_bytes", stats.OutputBytes,
+		"duration_ms", stats.Duration.Milliseconds(),
+		"keys_total", stats.KeysTotal,
+		"keys_dropped_tombstones", stats.KeysDroppedTombstones,
+		"keys_dropped_expired", stats.KeysDroppedExpired,
+		"keys_dropped_filter", stats.KeysDroppedFilter,
+		"anomalies", stats.Anomalies,
+		"write_amplification_this_run", stats.WriteAmplification(),
+	)
+	metrics.RecordCompaction(stats)
+
+	return true, nil
 }
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+// Index block states reported by InspectSST.
+const (
+	IndexOK      = "ok"
+	IndexMissing = "missing" // Files before version 5 have no filter block
+	IndexCorrupt = "corrupt"
+)
+
+// SSTInspectionResult describes an SST file as InspectSST found it.
+type SSTInspectionResult struct {
+	FormatVersion     uint16 `json:"format_version"`
+	ChecksumAlgorithm string `json:"checksum_algorithm"`
+	ByteOrder         string `json:"byte_order"`
+	EntryCount        uint32 `json:"entry_count"`
+	SmallestKey       []byte `json:"smallest_key"` // Nil for version 1 files, which have no properties block
+	LargestKey        []byte `json:"largest_key"`
+	HasFilterBlock    bool   `json:"has_filter_block"`
+	IndexStatus       string `json:"index_status"`
+	IndexError        string `json:"index_error,omitempty"` // Why the index is corrupt
+}
+
+// InspectSST reads the header, properties and filter block of the SST file at path without
+// modifying it. The filter block is the index a point lookup reads before the entries; a
+// corrupt one is reported in the result rather than as an error. integrityKey is the key
+// the file was written with, or nil.
+func InspectSST(path string, integrityKey []byte) (SSTInspectionResult, error) {
+	var result SSTInspectionResult
+	file, closeFile, err := openSSTSource(path, false, 0)
+	if err != nil {
+		return result, err
+	}
+	defer closeFile()
+
+	header, err := readSSTHeader(file)
+	if err != nil {
+		return result, err
+	}
+	result.FormatVersion = header.formatVersion()
+	result.ChecksumAlgorithm = header.checksumAlgorithm().String()
+	result.ByteOrder = header.byteOrder().String()
+	result.EntryCount = header.EntryCount
+	result.HasFilterBlock = header.formatVersion() >= 5
+	if header.formatVersion() >= 2 {
+		properties, err := ReadSSTProperties(path, integrityKey)
+		if err != nil {
+			return result, err
+		}
+		if result.SmallestKey, err = hex.DecodeString(properties["smallest_key"]); err != nil {
+			return result, fmt.Errorf("%w: smallest key property: %s", ErrInvalidSSTFormat, err)
+		}
+		if result.LargestKey, err = hex.DecodeString(properties["largest_key"]); err != nil {
+			return result, fmt.Errorf("%w: largest key property: %s", ErrInvalidSSTFormat, err)
+		}
+	}
+
+	result.IndexStatus = IndexOK
+	if !result.HasFilterBlock {
+		result.IndexStatus = IndexMissing
+	} else if _, err := readSSTFilter(file, integrityKey); err != nil {
+		result.IndexStatus = IndexCorrupt
+		result.IndexError = err.Error()
+	}
+	return result, nil
+}
+
+// RebuildIndex rewrites the filter block of the SST file at sstPath from its entries,
+// in place. The entries are located by decoding them, so a block whose length is damaged
+// is rebuilt too. The new block takes exactly the space of the old one, and the filter
+// offset in the footer is rewritten with it. Files written with direct I/O cannot be
+// rewritten in place. With an IntegrityKey it fails with ErrIntegrityViolation: the HMAC
+// covers the block, so once it is damaged the entries cannot be verified either, and
+// signing them again could bless tampered ones.
+func (mem *memDB) RebuildIndex(sstPath string) error {
+	if mem.cfg.IntegrityKey != nil {
+		return fmt.Errorf("%w: refusing to rebuild the index of %s", ErrIntegrityViolation, sstPath)
+	}
+	file, err := os.OpenFile(sstPath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	header, err := readSSTHeader(file)
+	if err != nil {
+		return err
+	}
+	if header.formatVersion() < 5 {
+		return fmt.Errorf("%w: version %d files have no index to rebuild", ErrInvalidSSTFormat, header.formatVersion())
+	}
+
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	footerOffset := size - footerSizeV5
+	headerEnd := header.size()
+	if footerOffset < headerEnd {
+		return fmt.Errorf("%w: file of %d bytes", ErrInvalidSSTFormat, size)
+	}
+	var footer [footerSizeV5]byte
+	if _, err := file.ReadAt(footer[:], footerOffset); err != nil {
+		return fmt.Errorf("error reading SST footer: %w", unexpectedEOF(err))
+	}
+	order := header.byteOrder()
+	propertiesOffset := int64(order.Uint64(footer[8:]))
+	checksum := order.Uint32(footer[16:])
+	if propertiesOffset < headerEnd+4 || propertiesOffset > footerOffset {
+		return fmt.Errorf("invalid properties offset in SST file: %d", propertiesOffset)
+	}
+
+	region := make([]byte, propertiesOffset-headerEnd)
+	if _, err := file.ReadAt(region, headerEnd); err != nil {
+		return fmt.Errorf("error reading SST entries: %w", unexpectedEOF(err))
+	}
+	dataStart, entries, err := locateSSTEntries(region, header, checksum)
+	if err != nil {
+		return err
+	}
+
+	filter, err := mem.filterForSlot(dataStart-4, len(entries))
+	if err != nil {
+		return err
+	}
+	for _, kv := range entries {
+		filter.Add(kv.Key)
+	}
+	block := order.AppendUint32(nil, uint32(dataStart-4))
+	block = append(block, filter.Serialize(order)...)
+	if _, err := file.WriteAt(block, headerEnd); err != nil {
+		return fmt.Errorf("error writing filter block: %w", err)
+	}
+	if _, err := file.WriteAt(order.AppendUint64(nil, uint64(headerEnd)), footerOffset); err != nil {
+		return fmt.Errorf("error writing filter block offset: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	logger.Info("rebuilt SST index", "file", sstPath, "entries", len(entries))
+	return nil
+}
+
+// locateSSTEntries finds where the compressed entries start in region, which spans from
+// the end of the header to the properties block. Every position after a filter block
+// length where a gzip stream may start is tried, until the entries found there match the
+// header and checksum.
+func locateSSTEntries(region []byte, header sstHeader, checksum uint32) (int, []KeyValue, error) {
+	gzipMagic := []byte{0x1f, 0x8b, 0x08}
+	for start := 4; start < len(region); {
+		i := bytes.Index(region[start:], gzipMagic)
+		if i < 0 {
+			break
+		}
+		start += i
+		if entries, err := decodeSSTRegion(region[start:], header, checksum); err == nil {
+			return start, entries, nil
+		}
+		start++
+	}
+	return 0, nil, fmt.Errorf("%w: no entries matching the checksum", ErrInvalidSSTFormat)
+}
+
+// decodeSSTRegion decompresses and checks the entries of a version 5 file.
+func decodeSSTRegion(data []byte, header sstHeader, checksum uint32) ([]KeyValue, error) {
+	gzReader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gzReader.Close()
+	records, err := io.ReadAll(gzReader)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := parseSSTRecords(records, header.EntryCount, header.formatVersion(), header.byteOrder())
+	if err != nil {
+		return nil, err
+	}
+	if sstChecksum(checksumFuncs[header.checksumAlgorithm()], entries) != checksum {
+		return nil, ErrChecksumMismatch
+	}
+	return entries, nil
+}
+
+// filterForSlot returns an empty filter block whose serialized size is exactly size, for
+// expectedKeys keys. The hash function of cfg is preferred; another one is used when its
+// name does not fit the slot.
+func (mem *memDB) filterForSlot(size, expectedKeys int) (*FilterBlock, error) {
+	preferred := newSSTFilter(0, mem.cfg).HashFuncName
+	var others []string
+	for name := range hashFuncs {
+		if name != preferred {
+			others = append(others, name)
+		}
+	}
+	sort.Strings(others)
+	names := append([]string{preferred}, others...)
+
+	for _, name := range names {
+		bitsSize := size - 2 - len(name) - 4
+		if bitsSize <= 0 || bitsSize%8 != 0 {
+			continue
+		}
+		words := bitsSize / 8
+		hashes := math.Round(float64(64*words) / float64(max(expectedKeys, 1)) * math.Ln2)
+		return &FilterBlock{
+			HashFuncName: name,
+			filter: &BloomFilter{
+				bits:   make([]uint64, words),
+				hashes: int(min(max(hashes, 1), math.MaxUint8)),
+				hash:   hashFuncs[name],
+			},
+		}, nil
+	}
+	return nil, fmt.Errorf("%w: no filter block fits %d bytes", ErrInvalidSSTFormat, size)
+}
+
+// rebuildCorruptIndex rebuilds the filter block of the SST file at path when it cannot be
+// read. A file whose block cannot be rebuilt stays usable, as lookups then read its entries.
+// With an IntegrityKey the file is not rebuilt and ErrIntegrityViolation is returned, see
+// RebuildIndex.
+func (mem *memDB) rebuildCorruptIndex(path string) error {
+	file, closeFile, err := openSSTSource(path, false, 0)
+	if err != nil {
+		return nil
+	}
+	_, err = readSSTFilter(file, mem.cfg.IntegrityKey)
+	closeFile()
+	if err == nil {
+		return nil
+	}
+	if mem.cfg.IntegrityKey != nil {
+		if !errors.Is(err, ErrIntegrityViolation) {
+			err = fmt.Errorf("%w: %s", ErrIntegrityViolation, err)
+		}
+		return err
+	}
+	logger.Warn("corrupt SST index, rebuilding", "file", path, "error", err)
+	if err := mem.RebuildIndex(path); err != nil {
+		logger.Error("error rebuilding SST index", "file", path, "error", err)
+	}
+	return nil
+}
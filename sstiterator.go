@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// compactionInput streams the entries of a file being compacted in ascending key order.
+type compactionInput interface {
+	Next() bool // Advances to the next entry and reports whether there is one
+	Entry() KeyValue
+	Err() error // The error that ended the iteration early, if any
+	Close() error
+}
+
+// sstIterator decodes the records of an SST file one at a time, so only the current entry
+// is held in memory. The checksum is verified once the last record was read; Next returns
+// false and Err reports ErrChecksumMismatch if it does not match.
+type sstIterator struct {
+	closeFile     func() error
+	records       *bufio.Reader
+	decompressor  io.ReadCloser // Nil for uncompressed version 1 files
+	formatVersion uint16
+	order         binary.ByteOrder
+	remaining     uint32
+	checksum      hash.Hash32
+	stored        uint32
+	entry         KeyValue
+	err           error
+}
+
+// newSSTIterator opens an SST file written with integrityKey. The HMAC is verified before
+// any entry is returned.
+func newSSTIterator(fileName string, integrityKey []byte) (*sstIterator, error) {
+	file, closeFile, err := openSSTSource(fileName, false, 0)
+	if err != nil {
+		return nil, err
+	}
+	it, err := openSSTIterator(file, integrityKey)
+	if err != nil {
+		closeFile()
+		return nil, err
+	}
+	it.closeFile = closeFile
+	return it, nil
+}
+
+func openSSTIterator(file sstSource, integrityKey []byte) (*sstIterator, error) {
+	header, err := readSSTHeader(file)
+	if err != nil {
+		return nil, err
+	}
+	it := &sstIterator{formatVersion: header.formatVersion(), order: header.byteOrder(), remaining: header.EntryCount}
+
+	if it.formatVersion == 1 {
+		if _, err := file.Seek(headerSize+sstV1PlaceholderSize, io.SeekStart); err != nil {
+			return nil, err
+		}
+		it.records = bufio.NewReader(file)
+		it.checksum = checksumHashes[ChecksumCRC32IEEE]()
+		it.stored = header.LargestKeyLen
+		return it, nil
+	}
+
+	footer, err := readSSTFooter(file, header, sstTrailerSize(integrityKey))
+	if err != nil {
+		return nil, err
+	}
+	if integrityKey != nil {
+		if err := verifySSTHMAC(file, footer, integrityKey); err != nil {
+			return nil, err
+		}
+	}
+	it.decompressor, err = newSSTDecompressor(bufio.NewReader(io.NewSectionReader(file, footer.dataOffset, footer.propertiesOffset-footer.dataOffset)), header)
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing SST entries: %w", err)
+	}
+	it.records = bufio.NewReader(it.decompressor)
+	algorithm := header.checksumAlgorithm()
+	if it.formatVersion < 4 {
+		algorithm = ChecksumCRC32IEEE
+	}
+	it.checksum = checksumHashes[algorithm]()
+	it.stored = footer.checksum
+	return it, nil
+}
+
+func (it *sstIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if it.remaining == 0 {
+		it.err = it.finish()
+		it.entry = KeyValue{}
+		return false
+	}
+	it.remaining--
+
+	entry, err := it.readRecord()
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.entry = entry
+	return true
+}
+
+// readRecord decodes the next record. Its key and value are newly allocated, so entries
+// stay valid after the iterator moved on.
+func (it *sstIterator) readRecord() (KeyValue, error) {
+	kv := KeyValue{Operation: Set}
+	var hasTags bool
+	if it.formatVersion >= 4 {
+		op, err := it.records.ReadByte()
+		if err != nil {
+			return kv, fmt.Errorf("error reading operation type: %w", unexpectedEOF(err))
+		}
+		if kv.Operation, err = operationFromSST(op); err != nil {
+			return kv, err
+		}
+		hasTags = op&sstTagsFlag != 0
+		it.checksum.Write([]byte{op})
+	}
+	var err error
+	if kv.Key, err = it.readField(); err != nil {
+		return kv, fmt.Errorf("error reading key data: %w", err)
+	}
+	if kv.Value, err = it.readField(); err != nil {
+		return kv, fmt.Errorf("error reading value data: %w", err)
+	}
+	if hasTags {
+		data, err := it.readField()
+		if err != nil {
+			return kv, fmt.Errorf("error reading tags: %w", err)
+		}
+		if kv.Tags, err = decodeTags(data); err != nil {
+			return kv, err
+		}
+	}
+	if it.formatVersion >= 3 {
+		var expiresAt [8]byte
+		if _, err := io.ReadFull(it.records, expiresAt[:]); err != nil {
+			return kv, fmt.Errorf("error reading expiry time: %w", unexpectedEOF(err))
+		}
+		kv.ExpiresAt = int64(it.order.Uint64(expiresAt[:]))
+	}
+	it.checksum.Write(kv.Key)
+	it.checksum.Write(kv.Value)
+	return kv, nil
+}
+
+func (it *sstIterator) readField() ([]byte, error) {
+	data, err := readSSTField(it.records, it.order)
+	return data, unexpectedEOF(err)
+}
+
+// finish compares the checksum of the records read with the stored one. The rest of the
+// compressed stream is drained so gzip verifies its own checksum too.
+func (it *sstIterator) finish() error {
+	if it.decompressor != nil {
+		if _, err := io.Copy(io.Discard, it.records); err != nil {
+			return fmt.Errorf("error decompressing SST entries: %w", err)
+		}
+	}
+	if it.checksum.Sum32() != it.stored {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+func (it *sstIterator) Entry() KeyValue {
+	return it.entry
+}
+
+func (it *sstIterator) Err() error {
+	return it.err
+}
+
+func (it *sstIterator) Close() error {
+	if it.decompressor != nil {
+		it.decompressor.Close()
+	}
+	if it.closeFile == nil {
+		return nil
+	}
+	return it.closeFile()
+}
+
+// mergeItem is the current entry of one compaction input.
+type mergeItem struct {
+	kv     KeyValue
+	source int // Index of the input; higher indexes are newer
+}
+
+// mergeHeap orders the current entries of the inputs by key, and entries with the same key
+// from the oldest input to the newest, so the newest version of a key is popped last.
+type mergeHeap []mergeItem
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	if c := bytes.Compare(h[i].kv.Key, h[j].kv.Key); c != 0 {
+		return c < 0
+	}
+	return h[i].source < h[j].source
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x interface{}) {
+	*h = append(*h, x.(mergeItem))
+}
+
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+var _ heap.Interface = (*mergeHeap)(nil)
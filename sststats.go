@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ReadSSTSizeHistogram returns the size in bytes of every SST file in dir.
+func ReadSSTSizeHistogram(dir string) (map[string]int64, error) {
+	fileNames, err := getSSTFileNames(dir)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]int64, len(fileNames))
+	for _, fileName := range fileNames {
+		info, err := os.Stat(filepath.Join(dir, fileName))
+		if err != nil {
+			return nil, err
+		}
+		sizes[fileName] = info.Size()
+	}
+	return sizes, nil
+}
+
+// SSTSizeStats summarizes the distribution of SST file sizes.
+type SSTSizeStats struct {
+	Sizes        map[string]int64 `json:"file_sizes"`
+	MinFileSize  int64            `json:"min_file_size"`
+	MaxFileSize  int64            `json:"max_file_size"`
+	MeanFileSize float64          `json:"mean_file_size"`
+	P50FileSize  int64            `json:"p50_file_size"`
+}
+
+func computeSSTSizeStats(sizes map[string]int64) SSTSizeStats {
+	stats := SSTSizeStats{Sizes: sizes}
+	if len(sizes) == 0 {
+		return stats
+	}
+
+	sorted := make([]int64, 0, len(sizes))
+	var total int64
+	for _, size := range sizes {
+		sorted = append(sorted, size)
+		total += size
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	stats.MinFileSize = sorted[0]
+	stats.MaxFileSize = sorted[len(sorted)-1]
+	stats.MeanFileSize = float64(total) / float64(len(sorted))
+	stats.P50FileSize = sorted[(len(sorted)+1)/2-1] // Nearest-rank median
+	return stats
+}
+
+// sstSizeCache holds the last SST size statistics of a directory so /sststats
+// does not have to stat every file on each request.
+type sstSizeCache struct {
+	dir string
+
+	mu    sync.Mutex
+	stats *SSTSizeStats
+}
+
+func (c *sstSizeCache) refresh() (SSTSizeStats, error) {
+	sizes, err := ReadSSTSizeHistogram(c.dir)
+	if err != nil {
+		return SSTSizeStats{}, err
+	}
+	stats := computeSSTSizeStats(sizes)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats = &stats
+	return stats, nil
+}
+
+// get returns the cached statistics, computing them on first use.
+func (c *sstSizeCache) get() (SSTSizeStats, error) {
+	c.mu.Lock()
+	stats := c.stats
+	c.mu.Unlock()
+	if stats != nil {
+		return *stats, nil
+	}
+	return c.refresh()
+}
+
+// start refreshes the statistics every interval.
+func (c *sstSizeCache) start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if _, err := c.refresh(); err != nil {
+				logger.Error("error refreshing SST size statistics", "error", err)
+			}
+		}
+	}()
+}
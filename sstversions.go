@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var ErrUnsupportedSSTVersion = errors.New("unsupported SST file version")
+
+// SSTReaderFunc decodes the entries of an SST file whose header has been read,
+// decompressing them into buf. It returns buf grown as needed.
+type SSTReaderFunc func(file sstSource, header sstHeader, integrityKey []byte, buf []byte) ([]KeyValue, []byte, error)
+
+// sstReaders holds the reader of every SST format version that may still be on disk:
+//
+//	1: uncompressed records after the header, checksum in the largest key length field
+//	2: gzip-compressed records, properties block and footer
+//	3: adds an expiry time to every record
+//	4: adds an operation type to every record
+//	5: adds a bloom filter block over the keys between the header and the records
+//	6: adds the smallest and largest key and the checksum offset to the header
+var sstReaders = map[uint16]SSTReaderFunc{
+	1: readSSTV1,
+	2: readCompressedSST,
+	3: readCompressedSST,
+	4: readCompressedSST,
+	5: readCompressedSST,
+	6: readCompressedSST,
+}
+
+// sstV1PlaceholderSize is the size of the unused fields version 1 wrote after the header.
+const sstV1PlaceholderSize = 12
+
+// readSSTV1 reads a version 1 file. Its writer stored the checksum over the largest
+// key length and left three placeholder fields before the uncompressed records.
+func readSSTV1(file sstSource, header sstHeader, integrityKey []byte, buf []byte) ([]KeyValue, []byte, error) {
+	if _, err := file.Seek(headerSize+sstV1PlaceholderSize, io.SeekStart); err != nil {
+		return nil, buf, err
+	}
+	records := bytes.NewBuffer(buf[:0])
+	if _, err := records.ReadFrom(file); err != nil {
+		return nil, records.Bytes(), err
+	}
+	buf = records.Bytes()
+
+	entries, err := parseSSTRecords(buf, header.EntryCount, header.formatVersion(), header.byteOrder())
+	if err != nil {
+		return nil, buf, err
+	}
+	if calculateChecksumV3(entries) != header.LargestKeyLen {
+		return nil, buf, ErrChecksumMismatch
+	}
+	return entries, buf, nil
+}
+
+// readCompressedSST reads the files of version 2 and later, whose records differ
+// only in the fields parseSSTRecords handles.
+func readCompressedSST(file sstSource, header sstHeader, integrityKey []byte, buf []byte) ([]KeyValue, []byte, error) {
+	footer, err := readSSTFooter(file, header, sstTrailerSize(integrityKey))
+	if err != nil {
+		return nil, buf, err
+	}
+	if integrityKey != nil {
+		if err := verifySSTHMAC(file, footer, integrityKey); err != nil {
+			return nil, buf, err
+		}
+	}
+	gzReader, err := newSSTDecompressor(io.NewSectionReader(file, footer.dataOffset, footer.propertiesOffset-footer.dataOffset), header)
+	if err != nil {
+		return nil, buf, fmt.Errorf("error decompressing SST entries: %w", err)
+	}
+	defer gzReader.Close()
+	decompressed := bytes.NewBuffer(buf[:0])
+	if _, err := decompressed.ReadFrom(gzReader); err != nil {
+		return nil, decompressed.Bytes(), fmt.Errorf("error decompressing SST entries: %w", err)
+	}
+	buf = decompressed.Bytes()
+
+	entries, err := parseSSTRecords(buf, header.EntryCount, header.formatVersion(), header.byteOrder())
+	if err != nil {
+		return nil, buf, err
+	}
+
+	// Compare checksums to validate file integrity
+	checksum := sstChecksum(checksumFuncs[header.checksumAlgorithm()], entries)
+	if header.formatVersion() < 4 {
+		checksum = calculateChecksumV3(entries)
+	}
+	if checksum != footer.checksum {
+		return nil, buf, ErrChecksumMismatch
+	}
+	if err := checkSSTHeaderKeys(header, entries); err != nil {
+		return nil, buf, err
+	}
+	return entries, buf, nil
+}
+
+// parseSSTRecords decodes count records laid out as formatVersion writes them, with their
+// fixed-size fields in the given byte order. The keys and values of the entries point into data.
+func parseSSTRecords(data []byte, count uint32, formatVersion uint16, order binary.ByteOrder) ([]KeyValue, error) {
+	entries := make([]KeyValue, 0, min(count, uint32(len(data)/8)))
+	rest := data
+	for i := uint32(0); i < count; i++ {
+		operation := Set
+		var hasTags bool
+		if formatVersion >= 4 {
+			if len(rest) == 0 {
+				return nil, fmt.Errorf("error reading operation type: %w", io.ErrUnexpectedEOF)
+			}
+			var err error
+			if operation, err = operationFromSST(rest[0]); err != nil {
+				return nil, err
+			}
+			hasTags = rest[0]&sstTagsFlag != 0
+			rest = rest[1:]
+		}
+		key, value, remaining, err := sliceSSTKeyValue(rest, order)
+		if err != nil {
+			return nil, err
+		}
+		rest = remaining
+		var tags map[string]string
+		if hasTags {
+			var data []byte
+			if data, rest, err = sliceSSTField(rest, order); err != nil {
+				return nil, fmt.Errorf("error reading tags: %w", err)
+			}
+			if tags, err = decodeTags(data); err != nil {
+				return nil, err
+			}
+		}
+		var expiresAt int64
+		if formatVersion >= 3 {
+			if len(rest) < 8 {
+				return nil, fmt.Errorf("error reading expiry time: %w", io.ErrUnexpectedEOF)
+			}
+			expiresAt = int64(order.Uint64(rest))
+			rest = rest[8:]
+		}
+
+		entries = append(entries, KeyValue{
+			Key:       key,
+			Value:     value,
+			Operation: operation,
+			ExpiresAt: expiresAt,
+			Tags:      tags,
+		})
+	}
+	return entries, nil
+}
+
+func sliceSSTKeyValue(data []byte, order binary.ByteOrder) ([]byte, []byte, []byte, error) {
+	key, rest, err := sliceSSTField(data, order)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error reading key data: %w", err)
+	}
+	value, rest, err := sliceSSTField(rest, order)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error reading value data: %w", err)
+	}
+	return key, value, rest, nil
+}
+
+// writeSSTFileV1 writes data in the version 1 layout read by readSSTV1.
+func writeSSTFileV1(fileName string, data []KeyValue) error {
+	var file bytes.Buffer
+	binary.Write(&file, binary.LittleEndian, magicNumber)
+	binary.Write(&file, binary.LittleEndian, uint16(1))
+	binary.Write(&file, binary.LittleEndian, uint32(len(data)))
+	binary.Write(&file, binary.LittleEndian, uint32(len(data[0].Key)))
+	binary.Write(&file, binary.LittleEndian, calculateChecksumV3(data))
+	file.Write(make([]byte, sstV1PlaceholderSize))
+	for _, kv := range data {
+		binary.Write(&file, binary.LittleEndian, uint32(len(kv.Key)))
+		file.Write(kv.Key)
+		binary.Write(&file, binary.LittleEndian, uint32(len(kv.Value)))
+		file.Write(kv.Value)
+	}
+	return os.WriteFile(fileName, file.Bytes(), 0644)
+}
+
+// MigrateAllSSTs rewrites the SST files in dir that are older than targetVersion in the
+// targetVersion layout. Newer files are left alone; each file is replaced atomically.
+func MigrateAllSSTs(dir string, targetVersion uint16) error {
+	if targetVersion < 2 || targetVersion > version {
+		return fmt.Errorf("%w: cannot migrate to version %d", ErrUnsupportedSSTVersion, targetVersion)
+	}
+	fileNames, err := getSSTFileNames(dir)
+	if err != nil {
+		return err
+	}
+	sort.Strings(fileNames)
+
+	for _, fileName := range fileNames {
+		path := filepath.Join(dir, fileName)
+		header, err := readSSTFileHeader(path)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", fileName, err)
+		}
+		if header.formatVersion() >= targetVersion {
+			continue
+		}
+		entries, err := readSSTEntries(path)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", fileName, err)
+		}
+		if len(entries) == 0 {
+			continue
+		}
+
+		tmpPath := strings.TrimSuffix(path, ".sst") + ".migrate"
+		if err := writeSSTFileVersion(tmpPath, entries, nil, gzip.DefaultCompression, targetVersion); err != nil {
+			os.Remove(tmpPath)
+			return fmt.Errorf("error migrating %s: %w", fileName, err)
+		}
+		if err := os.Rename(tmpPath, path); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+		logger.Info("migrated SST file", "file", fileName, "from_version", header.formatVersion(), "to_version", targetVersion)
+	}
+	return nil
+}
+
+// checkSSTHeaderKeys verifies that the key range in the header of a version 6 file is the
+// range of its entries.
+func checkSSTHeaderKeys(header sstHeader, entries []KeyValue) error {
+	if header.formatVersion() < 6 || len(entries) == 0 {
+		return nil
+	}
+	if !bytes.Equal(entries[0].Key, header.SmallestKey) || !bytes.Equal(entries[len(entries)-1].Key, header.LargestKey) {
+		return fmt.Errorf("%w: key range %q to %q in the header, entries span %q to %q", ErrInvalidSSTFormat,
+			header.SmallestKey, header.LargestKey, entries[0].Key, entries[len(entries)-1].Key)
+	}
+	return nil
+}
+
+func readSSTFileHeader(path string) (sstHeader, error) {
+	file, closeFile, err := openSSTSource(path, false, 0)
+	if err != nil {
+		return sstHeader{}, err
+	}
+	defer closeFile()
+	return readSSTHeader(file)
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// sstWriter streams entries into the layout of formatVersion 2 or later, compressing them
+// as they are added. The entry count, key range and filter are only known at the end, and
+// the header of version 6 files grows with the keys, so the compressed entries are held in
+// body and Finish writes the whole file to w front to back.
+type sstWriter struct {
+	w             io.Writer
+	body          sstBody      // Compressed entries
+	filter        *FilterBlock // Nil before version 5
+	formatVersion uint16
+	order         appendByteOrder
+	algorithm     ChecksumAlgorithm
+	checksum      hash.Hash32
+	gz            io.WriteCloser // gzip, or zlib with dictionary
+	dictionary    []byte         // Nil before version 6
+	mac           hash.Hash
+	record        []byte
+	count         uint32
+	smallestKey   []byte
+	largestKey    []byte
+	uncompressed  int64
+}
+
+// sstBody holds the compressed entries of an SST file until Finish writes them after the
+// header.
+type sstBody interface {
+	io.Writer
+	io.WriterTo
+	Len() int
+}
+
+// sstSpool is an sstBody kept in a temporary file, so writing a large file, as compactions
+// do, holds only a buffer of its entries in memory.
+type sstSpool struct {
+	file *os.File
+	buf  *bufio.Writer
+	size int
+}
+
+// newSSTSpool creates the temporary file of a spool in dir.
+func newSSTSpool(dir string) (*sstSpool, error) {
+	file, err := os.CreateTemp(dir, "sst-body-*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("error creating SST spool file: %w", err)
+	}
+	return &sstSpool{file: file, buf: bufio.NewWriter(file)}, nil
+}
+
+func (s *sstSpool) Write(p []byte) (int, error) {
+	n, err := s.buf.Write(p)
+	s.size += n
+	return n, err
+}
+
+func (s *sstSpool) Len() int {
+	return s.size
+}
+
+// WriteTo copies the spooled entries to w.
+func (s *sstSpool) WriteTo(w io.Writer) (int64, error) {
+	if err := s.buf.Flush(); err != nil {
+		return 0, err
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, s.file)
+}
+
+// Close removes the temporary file.
+func (s *sstSpool) Close() error {
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+// newSSTWriter returns a writer of an SST file to w, holding the compressed entries in body
+// until Finish. Files of version 4 and later store their
+// checksum with the given algorithm; older ones use CRC32. Files of version 5 and later
+// store filter, which must be sized for the entries that will be added; older ones have none.
+// The fixed-size fields are written in order, little-endian when it is nil. Files of
+// version 6 and later are compressed with the preset dictionary dict when it is set.
+func newSSTWriter(w io.Writer, body sstBody, integrityKey []byte, compressionLevel int, formatVersion uint16, checksumAlgorithm ChecksumAlgorithm, filter *FilterBlock, order binary.ByteOrder, dict []byte) (*sstWriter, error) {
+	if formatVersion < 4 {
+		checksumAlgorithm = ChecksumCRC32IEEE
+	}
+	if formatVersion < 6 {
+		dict = nil
+	}
+	if formatVersion < 5 {
+		filter = nil
+	} else if filter == nil {
+		return nil, fmt.Errorf("SST files of version %d need a filter block", formatVersion)
+	}
+	newChecksum, ok := checksumHashes[checksumAlgorithm]
+	if !ok {
+		return nil, fmt.Errorf("unknown checksum algorithm %s", checksumAlgorithm)
+	}
+	sw := &sstWriter{
+		w:             w,
+		body:          body,
+		formatVersion: formatVersion,
+		order:         byteOrderOrDefault(order),
+		algorithm:     checksumAlgorithm,
+		checksum:      newChecksum(),
+		filter:        filter,
+		dictionary:    dict,
+	}
+
+	var payload io.Writer = sw.body
+	if integrityKey != nil {
+		sw.mac = hmac.New(sha256.New, integrityKey)
+		payload = io.MultiWriter(payload, sw.mac)
+	}
+	gz, err := newSSTCompressor(payload, compressionLevel, dict)
+	if err != nil {
+		return nil, fmt.Errorf("error compressing entries: %w", err)
+	}
+	sw.gz = gz
+	return sw, nil
+}
+
+// Add appends kv. Entries must be added in ascending key order.
+func (sw *sstWriter) Add(kv KeyValue) error {
+	record := sw.record[:0]
+	if sw.formatVersion >= 4 {
+		record = append(record, sstOpType(kv))
+	}
+	record = sw.order.AppendUint32(record, uint32(len(kv.Key)))
+	record = append(record, kv.Key...)
+	record = sw.order.AppendUint32(record, uint32(len(kv.Value)))
+	record = append(record, kv.Value...)
+	if sw.formatVersion >= 4 && len(kv.Tags) > 0 {
+		tags, err := encodeTags(kv.Tags)
+		if err != nil {
+			return err
+		}
+		record = sw.order.AppendUint32(record, uint32(len(tags)))
+		record = append(record, tags...)
+	}
+	if sw.formatVersion >= 3 {
+		record = sw.order.AppendUint64(record, uint64(kv.ExpiresAt))
+	}
+	sw.record = record
+	if _, err := sw.gz.Write(record); err != nil {
+		return fmt.Errorf("error writing entries: %w", err)
+	}
+	if sw.filter != nil {
+		sw.filter.Add(kv.Key)
+	}
+
+	// The checksum covers the operation type, key and value; versions before 4 leave out the type
+	if sw.formatVersion >= 4 {
+		sw.checksum.Write(record[:1])
+	}
+	sw.checksum.Write(kv.Key)
+	sw.checksum.Write(kv.Value)
+
+	if sw.count == 0 {
+		sw.smallestKey = append([]byte(nil), kv.Key...)
+	}
+	sw.largestKey = append(sw.largestKey[:0], kv.Key...)
+	sw.count++
+	sw.uncompressed += int64(len(record))
+	return nil
+}
+
+// Finish writes the file: the header, filter block, compressed entries, properties block,
+// footer and HMAC. At least one entry must have been added.
+func (sw *sstWriter) Finish() error {
+	if sw.count == 0 {
+		return fmt.Errorf("error writing SST file: no entries")
+	}
+	if err := sw.gz.Close(); err != nil {
+		return fmt.Errorf("error compressing entries: %w", err)
+	}
+
+	versionField := sw.formatVersion | uint16(sw.algorithm)<<8
+	if sw.order == binary.BigEndian {
+		versionField |= sstBigEndianFlag
+	}
+	if len(sw.dictionary) > 0 {
+		versionField |= sstDictionaryFlag
+	}
+	header := sstHeader{
+		Magic:          magicNumber,
+		Version:        versionField,
+		EntryCount:     sw.count,
+		SmallestKeyLen: uint32(len(sw.smallestKey)),
+		LargestKeyLen:  uint32(len(sw.largestKey)),
+	}
+	if sw.formatVersion >= 6 {
+		header.SmallestKey = sw.smallestKey
+		header.LargestKey = sw.largestKey
+		header.DictionaryID = compressionDictionaryID(sw.dictionary)
+	}
+	compression := "gzip"
+	if len(sw.dictionary) > 0 {
+		compression = "zlib"
+	}
+
+	var filterBlock []byte
+	if sw.filter != nil {
+		filter := sw.filter.Serialize(sw.order)
+		filterBlock = sw.order.AppendUint32(nil, uint32(len(filter)))
+		filterBlock = append(filterBlock, filter...)
+	}
+	dataOffset := header.size() + int64(len(filterBlock))
+	propertiesOffset := dataOffset + int64(sw.body.Len())
+
+	var properties bytes.Buffer
+	err := writeSSTProperties(&properties, map[string]string{
+		"creation_time":      time.Now().Format(time.RFC3339),
+		"entry_count":        strconv.FormatUint(uint64(sw.count), 10),
+		"smallest_key":       hex.EncodeToString(sw.smallestKey),
+		"largest_key":        hex.EncodeToString(sw.largestKey),
+		"compression":        compression,
+		"uncompressed_bytes": strconv.FormatInt(sw.uncompressed, 10),
+		"compressed_bytes":   strconv.Itoa(sw.body.Len()),
+	}, sw.order)
+	if err != nil {
+		return fmt.Errorf("error writing properties block: %w", err)
+	}
+
+	var footer []byte
+	if sw.filter != nil {
+		footer = sw.order.AppendUint64(footer, uint64(header.size()))
+	}
+	footer = sw.order.AppendUint64(footer, uint64(propertiesOffset))
+	if sw.formatVersion >= 6 {
+		header.ChecksumOffset = uint64(propertiesOffset) + uint64(properties.Len()+len(footer))
+	}
+	footer = sw.order.AppendUint32(footer, sw.checksum.Sum32())
+	if sw.mac != nil {
+		sw.mac.Write(filterBlock) // The HMAC covers the filter block after the entries
+		footer = append(footer, sw.mac.Sum(nil)...)
+	}
+
+	prefix := header.appendTo(make([]byte, 0, dataOffset))
+	prefix = append(prefix, filterBlock...)
+	if _, err := sw.w.Write(prefix); err != nil {
+		return fmt.Errorf("error writing SST file: %w", err)
+	}
+	if _, err := sw.body.WriteTo(sw.w); err != nil {
+		return fmt.Errorf("error writing SST file: %w", err)
+	}
+	for _, part := range [][]byte{properties.Bytes(), footer} {
+		if _, err := sw.w.Write(part); err != nil {
+			return fmt.Errorf("error writing SST file: %w", err)
+		}
+	}
+	return nil
+}
+
+// sstFileOutput returns what SST files are written to. Tests replace it to simulate crashes.
+var sstFileOutput = func(file *os.File) io.Writer {
+	return file
+}
+
+// sstFileWriter streams entries into an SST file written with cfg. The compressed entries are
+// spooled to a temporary file next to it until Close. With cfg.UseDirectIO the file is
+// collected in memory instead and written as one aligned block on Close.
+type sstFileWriter struct {
+	*sstWriter
+	fileName string
+	file     *os.File
+	spool    *sstSpool
+	image    *bytes.Buffer
+	cfg      DBConfig
+}
+
+// createSSTFileWriter creates a writer whose filter block is sized for expectedKeys entries.
+func createSSTFileWriter(fileName string, cfg DBConfig, expectedKeys int) (*sstFileWriter, error) {
+	filter := newSSTFilter(expectedKeys, cfg)
+	fw := &sstFileWriter{fileName: fileName, cfg: cfg}
+	var w io.Writer
+	var body sstBody
+	if cfg.UseDirectIO {
+		fw.image = new(bytes.Buffer)
+		w, body = fw.image, new(bytes.Buffer)
+	} else {
+		spool, err := newSSTSpool(filepath.Dir(fileName))
+		if err != nil {
+			return nil, err
+		}
+		fw.spool, body = spool, spool
+		file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			spool.Close()
+			return nil, fmt.Errorf("error creating SST file: %w", err)
+		}
+		fw.file = file
+		w = CountingWriter{W: sstFileOutput(file), Count: &sstBytesWritten}
+	}
+
+	sw, err := newSSTWriter(w, body, cfg.IntegrityKey, cfg.GzipCompressionLevel, version, cfg.ChecksumAlgorithm, filter, cfg.ByteOrder, cfg.CompressionDictionary)
+	if err != nil {
+		fw.Abort()
+		return nil, err
+	}
+	fw.sstWriter = sw
+	return fw, nil
+}
+
+// Close completes the file and writes its bloom sidecar. On error the partial file is
+// removed. A sidecar that cannot be written is only logged, as the filter can be read
+// from the file.
+func (fw *sstFileWriter) Close() error {
+	err := fw.Finish()
+	fw.closeSpool()
+	if err != nil {
+		fw.Abort()
+		return err
+	}
+	if fw.image != nil {
+		if err := writeDirectFile(fw.fileName, fw.image.Bytes(), fw.cfg.IOAlignment); err != nil {
+			fw.Abort()
+			return fmt.Errorf("error creating SST file: %w", err)
+		}
+	} else {
+		if err := fw.file.Close(); err != nil {
+			os.Remove(fw.fileName)
+			return fmt.Errorf("error creating SST file: %w", err)
+		}
+	}
+	if fw.filter != nil {
+		if err := writeBloomSidecar(fw.fileName, fw.filter, int(fw.count), fw.cfg.IntegrityKey); err != nil {
+			os.Remove(bloomSidecarPath(fw.fileName))
+			logger.Warn("error writing bloom sidecar", "file", fw.fileName, "error", err)
+		}
+	}
+	return nil
+}
+
+// discardSSTFileWriter aborts fw unless it is nil.
+func discardSSTFileWriter(fw *sstFileWriter) {
+	if fw != nil {
+		fw.Abort()
+	}
+}
+
+// Abort discards the file.
+func (fw *sstFileWriter) Abort() {
+	fw.closeSpool()
+	if fw.file != nil {
+		fw.file.Close()
+	}
+	os.Remove(fw.fileName)
+}
+
+// closeSpool removes the spooled entries, once they were copied into the file or it is discarded.
+func (fw *sstFileWriter) closeSpool() {
+	if fw.spool != nil {
+		fw.spool.Close()
+		fw.spool = nil
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stats files are named stats_<unix nanoseconds>.json after the time they were written.
+const (
+	statsFilePrefix = "stats_"
+	statsFileSuffix = ".json"
+)
+
+// flushStatsPeriodically writes the stats to a new file in the data directory every
+// cfg.StatsFlushInterval and deletes files older than cfg.StatsRetentionDays,
+// until stopStatsFlush is called.
+func (mem *memDB) flushStatsPeriodically(done <-chan struct{}) {
+	defer mem.statsWG.Done()
+	ticker := time.NewTicker(mem.cfg.StatsFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := writeStatsFile(mem.cfg.DataDir, mem.Stats(), now); err != nil {
+				logger.Error("error writing stats file", "error", err)
+			}
+			if mem.cfg.StatsRetentionDays > 0 {
+				cutoff := now.AddDate(0, 0, -mem.cfg.StatsRetentionDays)
+				if err := pruneStatsFiles(mem.cfg.DataDir, cutoff); err != nil {
+					logger.Error("error deleting old stats files", "error", err)
+				}
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// stopStatsFlush stops the goroutine writing stats files, if it runs, and waits for it to exit.
+func (mem *memDB) stopStatsFlush() {
+	if mem.statsDone != nil {
+		close(mem.statsDone)
+		mem.statsDone = nil
+	}
+	mem.statsWG.Wait()
+}
+
+// reportStatsPeriodically writes the stats to the log output every cfg.StatsReportInterval
+// until Close, for operators who tail the log rather than scrape /metrics.
+func (mem *memDB) reportStatsPeriodically() {
+	defer mem.bgWG.Done()
+	ticker := time.NewTicker(mem.cfg.StatsReportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			report := bytes.NewBufferString(now.UTC().Format(time.RFC3339Nano) + " stats ")
+			if err := mem.PrintStats(report); err != nil {
+				logger.Error("error reporting stats", "error", err)
+				continue
+			}
+			if _, err := logOutput.Write(report.Bytes()); err != nil {
+				logger.Error("error reporting stats", "error", err)
+			}
+		case <-mem.stopCh:
+			return
+		}
+	}
+}
+
+// PrintStats writes the stats served by /stats to w as indented JSON, in a single write.
+func (mem *memDB) PrintStats(w io.Writer) error {
+	data, err := json.MarshalIndent(mem.Stats(), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+func writeStatsFile(dir string, stats DBStats, now time.Time) error {
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+	fileName := fmt.Sprintf("%s%d%s", statsFilePrefix, now.UnixNano(), statsFileSuffix)
+	return atomicWriteFile(filepath.Join(dir, fileName), data)
+}
+
+// statsFiles returns the stats files in dir by the time they were written.
+func statsFiles(dir string) (map[string]time.Time, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]time.Time)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, statsFilePrefix) || !strings.HasSuffix(name, statsFileSuffix) {
+			continue
+		}
+		nanos, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, statsFilePrefix), statsFileSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		files[name] = time.Unix(0, nanos)
+	}
+	return files, nil
+}
+
+// pruneStatsFiles deletes the stats files in dir written before cutoff.
+func pruneStatsFiles(dir string, cutoff time.Time) error {
+	files, err := statsFiles(dir)
+	if err != nil {
+		return err
+	}
+	for name, written := range files {
+		if written.Before(cutoff) {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ReadHistoricalStats returns the stats written to dir between from and to, oldest first.
+func ReadHistoricalStats(dir string, from, to time.Time) ([]DBStats, error) {
+	files, err := statsFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(files))
+	for name, written := range files {
+		if !written.Before(from) && !written.After(to) {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return files[names[i]].Before(files[names[j]])
+	})
+
+	history := make([]DBStats, 0, len(names))
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		var stats DBStats
+		if err := json.Unmarshal(data, &stats); err != nil {
+			return nil, fmt.Errorf("error decoding %s: %w", name, err)
+		}
+		history = append(history, stats)
+	}
+	return history, nil
+}
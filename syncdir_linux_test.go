@@ -0,0 +1,55 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFlushUpdatesDirectoryMtime(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	cfg.SyncDirectory = false
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Set([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Move the mtime back so the flush is seen even on coarse file system clocks
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(dir, past, past); err != nil {
+		t.Fatal(err)
+	}
+	var before syscall.Stat_t
+	if err := syscall.Stat(dir, &before); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(nil); err != nil {
+		t.Fatal(err)
+	}
+	var after syscall.Stat_t
+	if err := syscall.Stat(dir, &after); err != nil {
+		t.Fatal(err)
+	}
+	if after.Mtim.Nano() <= before.Mtim.Nano() {
+		t.Errorf("Expected the flush to update the mtime of %s, still %v", dir, time.Unix(0, after.Mtim.Nano()))
+	}
+
+	manifest, err := ReadManifest(dir)
+	if err != nil || len(manifest) != 1 {
+		t.Fatalf("Expected one SST file, got %v, %v", manifest, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, manifest[0].FileName)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"time"
+)
+
+// tagsHeader and tagsQueryParam carry the tags of an entry written through /set, as a
+// JSON object of strings.
+const (
+	tagsHeader     = "X-Tags"
+	tagsQueryParam = "tags"
+)
+
+var ErrTagsTooLarge = errors.New("tags too large")
+
+// SetOptions holds the optional parts of an entry written with SetWithOptions.
+type SetOptions struct {
+	Tags map[string]string // Metadata stored with the entry; GetMetadata returns it, Get does not
+}
+
+// encodeTags returns the JSON blob the tags of an entry are stored as in WAL and SST records.
+func encodeTags(tags map[string]string) ([]byte, error) {
+	data, err := json.Marshal(tags)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding tags: %w", err)
+	}
+	return data, nil
+}
+
+func decodeTags(data []byte) (map[string]string, error) {
+	var tags map[string]string
+	if err := json.Unmarshal(data, &tags); err != nil {
+		return nil, fmt.Errorf("error decoding tags: %w", err)
+	}
+	return tags, nil
+}
+
+// GetMetadata returns the tags of key without its value, or nil if it was written without
+// tags. A key whose newest write is a merge operand returns the tags of its base value.
+func (mem *memDB) GetMetadata(key []byte) (map[string]string, error) {
+	key = mem.transformKey(key)
+	defer mem.lockRead()()
+	if mem.closed {
+		return nil, ErrDatabaseClosed
+	}
+	mem.awaitPendingWrites()
+
+	merged := false
+	for _, kv := range mem.data {
+		if string(kv.Key) != string(key) {
+			continue
+		}
+		switch kv.Operation {
+		case Merge:
+			merged = true
+		case Delete:
+			return nil, ErrKeyNotFound
+		default:
+			return maps.Clone(kv.Tags), nil
+		}
+		break
+	}
+	if mem.tombstoned(key) {
+		return nil, ErrKeyNotFound
+	}
+
+	entries, err := mem.sstEntries(key)
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range entries {
+		if kv.Operation == Merge {
+			merged = true
+			continue
+		}
+		if kv.Operation == Delete || kv.expired(time.Now()) {
+			break
+		}
+		return maps.Clone(kv.Tags), nil
+	}
+	if merged {
+		return nil, nil
+	}
+	return nil, ErrKeyNotFound
+}
+
+func (ns *NamespacedDB) SetWithOptions(key, value []byte, opts SetOptions) error {
+	return ns.db.SetWithOptions(ns.key(key), value, opts)
+}
+
+func (ns *NamespacedDB) GetMetadata(key []byte) (map[string]string, error) {
+	return ns.db.GetMetadata(ns.key(key))
+}
+
+func (s *ShardedDB) SetWithOptions(key, value []byte, opts SetOptions) error {
+	return s.shardFor(key).SetWithOptions(key, value, opts)
+}
+
+func (s *ShardedDB) GetMetadata(key []byte) (map[string]string, error) {
+	return s.shardFor(key).GetMetadata(key)
+}
+
+// requestTags returns the tags of a /set request, from the X-Tags header or else the tags
+// query parameter, or nil if it has none.
+func requestTags(r *http.Request) (map[string]string, error) {
+	data := r.Header.Get(tagsHeader)
+	if data == "" {
+		data = r.URL.Query().Get(tagsQueryParam)
+	}
+	if data == "" {
+		return nil, nil
+	}
+	var tags map[string]string
+	if err := json.Unmarshal([]byte(data), &tags); err != nil {
+		return nil, fmt.Errorf("invalid tags: %w", err)
+	}
+	return tags, nil
+}
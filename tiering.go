@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// sstAccessTracker records when each SST file was last read, by path.
+type sstAccessTracker struct {
+	mu      sync.Mutex
+	times   map[string]time.Time
+	started time.Time // Files not read since then count as read at this time
+}
+
+func newSSTAccessTracker() *sstAccessTracker {
+	return &sstAccessTracker{times: make(map[string]time.Time), started: time.Now()}
+}
+
+// Touch records a read of the file at path.
+func (t *sstAccessTracker) Touch(path string) {
+	t.markAccessed(path, time.Now())
+}
+
+func (t *sstAccessTracker) markAccessed(path string, at time.Time) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.times[path] = at
+}
+
+// LastAccess returns when the file at path was last read, and false if it was not read
+// since the tracker was created. A nil tracker has seen no reads.
+func (t *sstAccessTracker) LastAccess(path string) (time.Time, bool) {
+	if t == nil {
+		return time.Time{}, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	at, ok := t.times[path]
+	if !ok {
+		return t.started, false
+	}
+	return at, true
+}
+
+// moved carries the last read of the file at from over to its new path.
+func (t *sstAccessTracker) moved(from, to string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if at, ok := t.times[from]; ok {
+		t.times[to] = at
+		delete(t.times, from)
+	}
+}
+
+// runStorageTierer moves cold SST files to cfg.ColdDataDir every TieringCheckInterval until Close.
+func (mem *memDB) runStorageTierer() {
+	defer mem.bgWG.Done()
+	ticker := time.NewTicker(mem.cfg.TieringCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := mem.tierSSTFiles(time.Now()); err != nil {
+				logger.Error("error tiering SST files", "error", err)
+			}
+		case <-mem.stopCh:
+			return
+		}
+	}
+}
+
+// tierSSTFiles moves the files of the manifest that were not read within cfg.ColdDataAge
+// before now to cfg.ColdDataDir. With cfg.PromoteColdFiles, cold files read since then are
+// moved back. A cold file is listed in the manifest by its path relative to DataDir, so
+// every reader finds it without knowing about tiers.
+func (mem *memDB) tierSSTFiles(now time.Time) error {
+	mem.compactionMu.Lock()
+	defer mem.compactionMu.Unlock()
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	manifest, err := ReadManifest(mem.cfg.DataDir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(mem.cfg.ColdDataDir, 0755); err != nil {
+		return fmt.Errorf("error creating cold data directory: %w", err)
+	}
+	coldPrefix, err := relativePath(mem.cfg.DataDir, mem.cfg.ColdDataDir)
+	if err != nil {
+		return fmt.Errorf("error locating cold data directory: %w", err)
+	}
+
+	cutoff := now.Add(-mem.cfg.ColdDataAge)
+	changed := false
+	for i, file := range manifest {
+		path := filepath.Join(mem.cfg.DataDir, file.FileName)
+		lastAccess, accessed := mem.access.LastAccess(path)
+		cold := file.FileName != filepath.Base(file.FileName)
+
+		var fileName, tier string
+		switch {
+		case !cold && lastAccess.Before(cutoff):
+			fileName, tier = filepath.Join(coldPrefix, file.FileName), "cold"
+		case cold && accessed && mem.cfg.PromoteColdFiles && !lastAccess.Before(cutoff):
+			fileName, tier = filepath.Base(file.FileName), "hot"
+		default:
+			continue
+		}
+
+		target := filepath.Join(mem.cfg.DataDir, fileName)
+		if err := moveFile(path, target); errors.Is(err, os.ErrNotExist) {
+			continue // Compacted away since the manifest was written
+		} else if err != nil {
+			return fmt.Errorf("error moving %s: %w", path, err)
+		}
+		mem.access.moved(path, target)
+		manifest[i].FileName = fileName
+		changed = true
+		logger.Info("moved SST file between storage tiers", "from", path, "to", target, "tier", tier)
+	}
+	if !changed {
+		return nil
+	}
+	if err := WriteManifest(mem.cfg.DataDir, manifest); err != nil {
+		return fmt.Errorf("error recording moved SST files in manifest: %w", err)
+	}
+	return nil
+}
+
+// relativePath returns the path of target relative to base, resolving both against the
+// working directory first.
+func relativePath(base, target string) (string, error) {
+	base, err := filepath.Abs(base)
+	if err != nil {
+		return "", err
+	}
+	target, err = filepath.Abs(target)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Rel(base, target)
+}
+
+// moveFile renames src to dst, copying and deleting it when they are on different devices.
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := copyFile(dst, file); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// TransformAllSSTs rewrites every SST file of the manifest with fn applied to its Set
+// entries; an entry fn returns false for is replaced by a tombstone, as is the old key of
+// an entry fn renames, so older files do not show their values again. Tombstones and merge
+// operands are kept as they are. The memtable is flushed first so its entries are transformed too, but
+// writes made while the files are rewritten are not. The new files take the place of the
+// old ones in a single manifest update and the old files are removed after it. Writing is
+// throttled to cfg.TransformBytesPerSecond so the rewrite does not starve other I/O.
+func (mem *memDB) TransformAllSSTs(ctx context.Context, fn func(KeyValue) (KeyValue, bool)) error {
+	if err := mem.Flush(nil); err != nil {
+		return fmt.Errorf("error flushing memtable: %w", err)
+	}
+	files, err := ReadManifest(mem.cfg.DataDir)
+	if err != nil {
+		return fmt.Errorf("error reading manifest: %w", err)
+	}
+
+	replaced := make(map[string]*SSTFileMeta, len(files)) // Old file name to its replacement, nil if it is dropped
+	var written []string
+	removeWritten := func() {
+		for _, path := range written {
+			os.Remove(path)
+			os.Remove(bloomSidecarPath(path))
+		}
+	}
+	start := time.Now()
+	var writtenBytes int64
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			removeWritten()
+			return err
+		}
+		path := filepath.Join(mem.cfg.DataDir, file.FileName)
+		entries, err := mem.readSSTFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue // Compacted away since the manifest was written
+		}
+		if err != nil {
+			removeWritten()
+			return fmt.Errorf("error reading %s: %w", file.FileName, err)
+		}
+		transformed := transformEntries(entries, fn)
+		if len(transformed) == 0 {
+			replaced[file.FileName] = nil
+			continue
+		}
+
+		dir := filepath.Dir(file.FileName)
+		fileName := filepath.Join(dir, newSSTFileName(filepath.Join(mem.cfg.DataDir, dir)))
+		newPath := filepath.Join(mem.cfg.DataDir, fileName)
+		if err := writeSSTFileWithConfig(newPath, transformed, mem.cfg); err != nil {
+			os.Remove(newPath)
+			removeWritten()
+			return fmt.Errorf("error rewriting %s: %w", file.FileName, err)
+		}
+		written = append(written, newPath)
+		if info, err := os.Stat(newPath); err == nil {
+			writtenBytes += info.Size()
+		}
+
+		meta := file
+		meta.FileName = fileName
+		meta.CreationTime = time.Now().UnixNano()
+		meta.SmallestKey = transformed[0].Key
+		meta.LargestKey = transformed[len(transformed)-1].Key
+		meta.Checksum = calculateChecksum(transformed)
+		replaced[file.FileName] = &meta
+
+		if err := throttleWrites(ctx, start, writtenBytes, mem.cfg.TransformBytesPerSecond); err != nil {
+			removeWritten()
+			return err
+		}
+	}
+	if len(replaced) == 0 {
+		return nil
+	}
+
+	// Files flushed since the manifest was read are kept as they are
+	mem.mu.Lock()
+	manifest, err := ReadManifest(mem.cfg.DataDir)
+	if err == nil {
+		updated := make([]SSTFileMeta, 0, len(manifest))
+		for _, file := range manifest {
+			meta, ok := replaced[file.FileName]
+			switch {
+			case !ok:
+				updated = append(updated, file)
+			case meta != nil:
+				updated = append(updated, *meta)
+			}
+		}
+		err = WriteManifest(mem.cfg.DataDir, updated)
+	}
+	mem.mu.Unlock()
+	if err != nil {
+		removeWritten()
+		return fmt.Errorf("error recording transformed SST files in manifest: %w", err)
+	}
+
+	for fileName := range replaced {
+		path := filepath.Join(mem.cfg.DataDir, fileName)
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Warn("error removing transformed SST file", "file", path, "error", err)
+		}
+		os.Remove(bloomSidecarPath(path))
+	}
+	logger.Info("transformed SST files", "files", len(replaced), "bytes_written", writtenBytes, "duration_ms", time.Since(start).Milliseconds())
+	return nil
+}
+
+// transformEntries applies fn to the Set entries of entries, keeping other operations as
+// they are. The keys fn drops or renames get a tombstone. As fn may change keys, the result
+// is sorted again, keeping the last of the entries that end up with the same key, so an
+// entry renamed to a key wins over the tombstone of that key.
+func transformEntries(entries []KeyValue, fn func(KeyValue) (KeyValue, bool)) []KeyValue {
+	var tombstones, transformed []KeyValue
+	for _, kv := range entries {
+		if kv.Operation == Set {
+			key := kv.Key
+			var keep bool
+			kv, keep = fn(kv)
+			if !keep || !bytes.Equal(kv.Key, key) {
+				tombstones = append(tombstones, KeyValue{Key: key, Operation: Delete})
+			}
+			if !keep {
+				continue
+			}
+		}
+		transformed = append(transformed, kv)
+	}
+	transformed = append(tombstones, transformed...)
+	sort.SliceStable(transformed, func(i, j int) bool {
+		return bytes.Compare(transformed[i].Key, transformed[j].Key) < 0
+	})
+	deduped := transformed[:0]
+	for _, kv := range transformed {
+		if n := len(deduped); n > 0 && bytes.Equal(deduped[n-1].Key, kv.Key) {
+			deduped[n-1] = kv
+			continue
+		}
+		deduped = append(deduped, kv)
+	}
+	return deduped
+}
+
+// throttleWrites sleeps until writing written bytes since start stays within
+// bytesPerSecond, returning early with the error of ctx once it is done.
+func throttleWrites(ctx context.Context, start time.Time, written, bytesPerSecond int64) error {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	wait := time.Duration(float64(written)/float64(bytesPerSecond)*float64(time.Second)) - time.Since(start)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
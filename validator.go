@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrValueValidationFailed is returned, wrapping the validator's error, when
+// DBConfig.ValueValidator rejects the value of a write.
+var ErrValueValidationFailed = errors.New("value validation failed")
+
+// ValidateJSON is a ValueValidator accepting only valid JSON values.
+func ValidateJSON(key, value []byte) error {
+	if !json.Valid(value) {
+		return errors.New("value is not valid JSON")
+	}
+	return nil
+}
+
+// ValidateNotEmpty is a ValueValidator rejecting empty values.
+func ValidateNotEmpty(key, value []byte) error {
+	if len(value) == 0 {
+		return errors.New("value is empty")
+	}
+	return nil
+}
+
+// ValidateMaxLength returns a ValueValidator rejecting values longer than n bytes.
+func ValidateMaxLength(n int) func(key, value []byte) error {
+	return func(key, value []byte) error {
+		if len(value) > n {
+			return fmt.Errorf("value is %d bytes long, more than the maximum of %d", len(value), n)
+		}
+		return nil
+	}
+}
+
+// validateValue checks a value about to be written with cfg.ValueValidator. Replayed
+// entries are not checked, as they were accepted when they were written.
+func (mem *memDB) validateValue(key, value []byte) error {
+	if mem.cfg.ValueValidator == nil {
+		return nil
+	}
+	if err := mem.cfg.ValueValidator(key, value); err != nil {
+		return fmt.Errorf("%w: %w", ErrValueValidationFailed, err)
+	}
+	return nil
+}
@@ -1,10 +1,21 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Operation uint8
@@ -12,11 +23,114 @@ type Operation uint8
 const (
 	Set Operation = iota
 	Delete
+	Merge
+	BatchBegin  // Starts the records of a WriteBatch
+	BatchCommit // Ends a WriteBatch; records after a BatchBegin without it are discarded on replay
 )
 
+func (op Operation) String() string {
+	switch op {
+	case Set:
+		return "set"
+	case Delete:
+		return "delete"
+	case Merge:
+		return "merge"
+	case BatchBegin:
+		return "batch-begin"
+	case BatchCommit:
+		return "batch-commit"
+	default:
+		return fmt.Sprintf("Operation(%d)", uint8(op))
+	}
+}
+
+// WALCompression selects how the key and value of a WAL record are compressed.
+type WALCompression uint8
+
+const (
+	CompressionNone WALCompression = iota
+	CompressionGzip
+	CompressionZstd
+)
+
+// compressedOpFlag marks a record whose key and value are stored compressed.
+// Uncompressed records keep the original layout so older logs still replay.
+const compressedOpFlag = 0x80
+
+// bigEndianOpFlag marks a record whose lengths are big-endian. The log has no header, so
+// every record carries its own byte order.
+const bigEndianOpFlag = 0x40
+
+// timestampOpFlag marks a record followed by the 8-byte Unix time in nanoseconds it was
+// appended at, in the byte order of the record.
+const timestampOpFlag = 0x20
+
+// tagsOpFlag marks a record whose value is followed by its tags, a JSON object with a
+// 2-byte length in the byte order of the record. The tags of compressed records follow
+// the compressed key and value and are not compressed.
+const tagsOpFlag = 0x10
+
+// expiryOpFlag marks a record followed by the 8-byte Unix time in nanoseconds the entry
+// expires at, after its tags, in the byte order of the record.
+const expiryOpFlag = 0x08
+
+// walLongFieldLength as the 2-byte length of a key, value or tags field means the length
+// does not fit in 2 bytes and follows in 4. The op byte has no bit left for a flag.
+const walLongFieldLength = math.MaxUint16
+
+var (
+	ErrUnsupportedCompression = errors.New("unsupported WAL compression")
+	ErrDatabaseClosed         = errors.New("database is closed")
+	ErrPartialWALWrite        = errors.New("WAL record partially written")
+	// ErrUnsyncedWALWrite reports a record written in full whose sync failed. The record
+	// may still reach the disk and be replayed after a restart, so the operation may be
+	// applied even though it failed; it is not retried, as that would log it twice.
+	ErrUnsyncedWALWrite = errors.New("WAL record written but not synced")
+)
+
+// walWriter returns what records are written to. Tests replace it to simulate failing disks.
+var walWriter = func(file *os.File) io.Writer {
+	return file
+}
+
+// walSync syncs the file records were written to. Tests replace it to simulate failing disks.
+var walSync = func(file *os.File) error {
+	return file.Sync()
+}
+
+func (c WALCompression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("WALCompression(%d)", uint8(c))
+	}
+}
+
 type WriteAheadLog struct {
-	file      *os.File // File to save the log
-	watermark int64
+	mu          sync.RWMutex // Held for reading by appends and for writing while the file is closed or replaced
+	closed      bool
+	file        *os.File // File to save the log
+	watermark   int64
+	Compression WALCompression     // Compression applied to new entries
+	Format      WALFormat          // Encoding of new entries; JSON entries are not compressed
+	ByteOrder   binary.ByteOrder   // Order of the lengths in new binary entries; nil is little-endian
+	Timestamps  bool               // Record the wall-clock time in new entries
+	SyncPolicy  WALSyncPolicy      // When appends are synced to disk
+	syncMonitor *walSyncMonitor    // Upgrades SyncNone while appends fail; nil keeps it
+	replica     *ReplicationClient // Receives a copy of every entry, if set
+	shipper     *WALShipper        // Uploads every rotated segment, if set
+	MaxSize     int64              // Size beyond which the file is rotated into a segment; 0 never rotates
+	segment     uint64             // Sequence number the current file gets when it is rotated
+
+	BytesWritten atomic.Uint64 // Bytes appended to the log, including record framing
+	BytesRead    atomic.Uint64 // Bytes read back while replaying the log
+	sequence     atomic.Uint64 // Records appended since the log was opened, numbering JSON records
 }
 
 func NewWriteAheadLog(filePath string) (*WriteAheadLog, error) {
@@ -25,40 +139,270 @@ func NewWriteAheadLog(filePath string) (*WriteAheadLog, error) {
 		return nil, err
 	}
 
+	// The current file comes after every rotated segment and the watermark's segment
+	segments, err := listWALSegments(filePath)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	segment, _ := readWALWatermark(filepath.Join(filepath.Dir(filePath), watermarkFileName))
+	if len(segments) > 0 {
+		segment = max(segment, segments[len(segments)-1].sequence+1)
+	}
+
 	return &WriteAheadLog{
-		file: file,
+		file:    file,
+		segment: segment,
 	}, nil
 }
 
 func (wal *WriteAheadLog) AppendEntry(operation Operation, entry KeyValue) error {
-	opByte := uint8(operation)
-	keyLen := uint16(len(entry.Key))
-	valueLen := uint16(len(entry.Value))
+	defer wal.rotateIfFull() // Runs once the read lock is released
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+	if wal.closed {
+		return ErrDatabaseClosed
+	}
 
-	if err := binary.Write(wal.file, binary.LittleEndian, opByte); err != nil {
+	record, err := wal.encodeRecord(operation, entry)
+	if err != nil {
 		return err
 	}
-	if err := binary.Write(wal.file, binary.LittleEndian, keyLen); err != nil {
+	n, err := (CountingWriter{W: walWriter(wal.file), Count: &wal.BytesWritten}).Write(record)
+	if err := wal.finishAppend(err); err != nil {
+		// Writing the record again would follow the partial one, which replay cannot parse
+		if n > 0 && n < len(record) {
+			return fmt.Errorf("%w: %d of %d bytes: %s", ErrPartialWALWrite, n, len(record), err)
+		}
+		if n == len(record) {
+			return fmt.Errorf("%w: %s", ErrUnsyncedWALWrite, err)
+		}
 		return err
 	}
-	if _, err := wal.file.Write(entry.Key); err != nil {
-		return err
+
+	// With a replica configured the entry only counts as written once the replica acknowledged it
+	if wal.replica != nil {
+		if err := wal.replica.Replicate(record); err != nil {
+			return fmt.Errorf("error replicating WAL entry: %s", err)
+		}
 	}
-	if err := binary.Write(wal.file, binary.LittleEndian, valueLen); err != nil {
+	return nil
+}
+
+// AppendBatch logs entries, in the operations given by their Operation fields, between a
+// BatchBegin and a BatchCommit record. All records go to the file in a single write, so
+// a crash either keeps the whole batch or leaves it without its commit record.
+func (wal *WriteAheadLog) AppendBatch(entries []KeyValue) error {
+	defer wal.rotateIfFull()
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+	if wal.closed {
+		return ErrDatabaseClosed
+	}
+
+	records := make([][]byte, 0, len(entries)+2)
+	begin, err := wal.encodeRecord(BatchBegin, KeyValue{})
+	if err != nil {
 		return err
 	}
-	if _, err := wal.file.Write(entry.Value); err != nil {
+	records = append(records, begin)
+	for _, entry := range entries {
+		record, err := wal.encodeRecord(entry.Operation, entry)
+		if err != nil {
+			return err
+		}
+		records = append(records, record)
+	}
+	commit, err := wal.encodeRecord(BatchCommit, KeyValue{})
+	if err != nil {
 		return err
 	}
+	records = append(records, commit)
 
+	batch := bytes.Join(records, nil)
+	n, err := (CountingWriter{W: walWriter(wal.file), Count: &wal.BytesWritten}).Write(batch)
+	if err := wal.finishAppend(err); err != nil {
+		if n == len(batch) {
+			return fmt.Errorf("%w: %s", ErrUnsyncedWALWrite, err)
+		}
+		return err
+	}
+	if wal.replica != nil {
+		for _, record := range records {
+			if err := wal.replica.Replicate(record); err != nil {
+				return fmt.Errorf("error replicating WAL entry: %s", err)
+			}
+		}
+	}
 	return nil
 }
 
+// encodeRecord returns the bytes of a WAL record in the format of the log. Batch markers
+// are never compressed and carry no timestamp. An entry that already has a timestamp, as
+// when the log is compacted, keeps it.
+func (wal *WriteAheadLog) encodeRecord(operation Operation, entry KeyValue) ([]byte, error) {
+	marker := operation == BatchBegin || operation == BatchCommit
+	if wal.Timestamps && !marker && entry.Timestamp == 0 {
+		entry.Timestamp = time.Now().UnixNano()
+	}
+	if wal.Format == WALJSON {
+		return encodeJSONWALRecord(operation, entry, wal.sequence.Add(1))
+	}
+	compression := wal.Compression
+	if marker {
+		compression = CompressionNone
+	}
+	return encodeWALRecord(operation, entry, compression, byteOrderOrDefault(wal.ByteOrder))
+}
+
+// encodeWALRecord returns the bytes of a single binary WAL record. Uncompressed records hold
+// the op byte, the key length, the key, the value length and the value. Compressed
+// records hold op|compressedOpFlag, the key and value lengths, the compression type,
+// the compressed length and the compressed key+value. The lengths are stored in order,
+// with bigEndianOpFlag in the op byte when it is big-endian; see walLongFieldLength for
+// fields of 64 KB and more. An entry with tags has
+// tagsOpFlag in the op byte and the tags after the value. An entry with an expiry time has
+// expiryOpFlag in the op byte and the expiry time after the tags. An entry with a timestamp
+// has timestampOpFlag in the op byte and the timestamp last.
+func encodeWALRecord(operation Operation, entry KeyValue, compression WALCompression, order binary.ByteOrder) ([]byte, error) {
+	var record bytes.Buffer
+	opByte := uint8(operation)
+	if order == binary.BigEndian {
+		opByte |= bigEndianOpFlag
+	}
+	if entry.Timestamp != 0 {
+		opByte |= timestampOpFlag
+	}
+	if entry.ExpiresAt != 0 {
+		opByte |= expiryOpFlag
+	}
+	var tags []byte
+	if len(entry.Tags) > 0 {
+		var err error
+		if tags, err = encodeTags(entry.Tags); err != nil {
+			return nil, err
+		}
+		if len(tags) > math.MaxUint16 {
+			return nil, fmt.Errorf("%w: %d bytes encoded", ErrTagsTooLarge, len(tags))
+		}
+		opByte |= tagsOpFlag
+	}
+	if compression == CompressionNone {
+		record.WriteByte(opByte)
+		writeWALLength(&record, len(entry.Key), order)
+		record.Write(entry.Key)
+		writeWALLength(&record, len(entry.Value), order)
+		record.Write(entry.Value)
+		appendWALTags(&record, tags, order)
+		appendWALExpiry(&record, entry.ExpiresAt, order)
+		return appendWALTimestamp(&record, entry.Timestamp, order), nil
+	}
+
+	payload := make([]byte, 0, len(entry.Key)+len(entry.Value))
+	payload = append(payload, entry.Key...)
+	payload = append(payload, entry.Value...)
+	compressed, err := compressWALPayload(compression, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	record.WriteByte(opByte | compressedOpFlag)
+	writeWALLength(&record, len(entry.Key), order)
+	writeWALLength(&record, len(entry.Value), order)
+	record.WriteByte(uint8(compression))
+	binary.Write(&record, order, uint32(len(compressed)))
+	record.Write(compressed)
+	appendWALTags(&record, tags, order)
+	appendWALExpiry(&record, entry.ExpiresAt, order)
+	return appendWALTimestamp(&record, entry.Timestamp, order), nil
+}
+
+// writeWALLength writes the length of a field, escaped with walLongFieldLength when it
+// does not fit in 2 bytes.
+func writeWALLength(record *bytes.Buffer, length int, order binary.ByteOrder) {
+	if length < walLongFieldLength {
+		binary.Write(record, order, uint16(length))
+		return
+	}
+	binary.Write(record, order, uint16(walLongFieldLength))
+	binary.Write(record, order, uint32(length))
+}
+
+// appendWALTags writes the encoded tags of a record, if it has any, after its value.
+func appendWALTags(record *bytes.Buffer, tags []byte, order binary.ByteOrder) {
+	if len(tags) > 0 {
+		writeWALLength(record, len(tags), order)
+		record.Write(tags)
+	}
+}
+
+// appendWALExpiry writes the expiry time of a record, if it has one, after its tags.
+func appendWALExpiry(record *bytes.Buffer, expiresAt int64, order binary.ByteOrder) {
+	if expiresAt != 0 {
+		binary.Write(record, order, expiresAt)
+	}
+}
+
+// appendWALTimestamp ends a record with its timestamp, if it has one, and returns its bytes.
+func appendWALTimestamp(record *bytes.Buffer, timestamp int64, order binary.ByteOrder) []byte {
+	if timestamp != 0 {
+		binary.Write(record, order, timestamp)
+	}
+	return record.Bytes()
+}
+
+func compressWALPayload(compression WALCompression, payload []byte) ([]byte, error) {
+	switch compression {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		if _, err := writer.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		// zstd is not in the standard library and this module has no dependencies.
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedCompression, compression)
+	}
+}
+
+func decompressWALPayload(compression WALCompression, compressed []byte, size int) ([]byte, error) {
+	switch compression {
+	case CompressionGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return nil, err
+		}
+		return payload, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedCompression, compression)
+	}
+}
+
+// Close waits for in-progress appends and closes the log. Later appends fail
+// with ErrDatabaseClosed.
 func (wal *WriteAheadLog) Close() error {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	if wal.closed {
+		return nil
+	}
+	wal.closed = true
+	wal.shipper.Wait()
 	return wal.file.Close()
 }
 
 func (wal *WriteAheadLog) CleanupAfterSSTCreation(position int64) error {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
 	if wal.file == nil {
 		return fmt.Errorf("WAL file not initialized")
 	}
@@ -68,14 +412,14 @@ func (wal *WriteAheadLog) CleanupAfterSSTCreation(position int64) error {
 		return fmt.Errorf("error closing WAL file: %s", err)
 	}
 
-	file, err := os.OpenFile(wal.file.Name(), os.O_RDWR, 0644)
+	file, err := os.OpenFile(wal.file.Name(), os.O_RDWR|os.O_APPEND, 0644)
 	if err != nil {
 		return fmt.Errorf("error reopening WAL file: %s", err)
 	}
-	defer file.Close() // Defer closure of the reopened file
 
 	err = file.Truncate(position)
 	if err != nil {
+		file.Close()
 		return fmt.Errorf("error truncating WAL file: %s", err)
 	}
 
@@ -85,9 +429,418 @@ func (wal *WriteAheadLog) CleanupAfterSSTCreation(position int64) error {
 		return fmt.Errorf("error seeking end of WAL file: %s", err)
 	}
 
+	// Entries before position are in SST files, so replay can start there
+	wal.watermark = position
+	if err := writeWatermark(wal.watermarkPath(), wal.segment, position); err != nil {
+		return fmt.Errorf("error writing WAL watermark: %s", err)
+	}
+	return nil
+}
+
+// CompactWAL rewrites the log with only the entries replay still needs: those after the
+// watermark, keeping the last operation of every key. Merge operands after a key's last
+// Set or Delete are all kept, as replay combines them. The watermark is reset to 0 since
+// every remaining entry comes after the last flush.
+func (wal *WriteAheadLog) CompactWAL() error {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	if wal.closed {
+		return ErrDatabaseClosed
+	}
+
+	walPath := wal.file.Name()
+	file, err := os.Open(walPath)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	// Segments rotated since the last flush are replayed in full before this file,
+	// so the watermark only applies when it points into this file
+	watermarkSegment, start := readWALWatermark(wal.watermarkPath())
+	if watermarkSegment != wal.segment || start > info.Size() {
+		start = 0
+	}
+	// A record cut short by a crash would not be replayed either, so it is dropped
+	entries, _ := readWALEntries(io.NewSectionReader(file, start, info.Size()-start))
+	file.Close()
+
+	var records bytes.Buffer
+	for _, kv := range latestWALEntries(entries) {
+		record, err := wal.encodeRecord(kv.Operation, kv)
+		if err != nil {
+			return err
+		}
+		records.Write(record)
+	}
+
+	// The watermark is reset first: replaying the old log from the start after a crash
+	// only repeats flushed entries, while the old watermark could point past the new log
+	if watermarkSegment == wal.segment {
+		if err := writeWatermark(wal.watermarkPath(), wal.segment, 0); err != nil {
+			return fmt.Errorf("error writing WAL watermark: %s", err)
+		}
+	}
+	if err := atomicWriteFile(walPath, records.Bytes()); err != nil {
+		return fmt.Errorf("error writing compacted WAL: %w", err)
+	}
+
+	compacted, err := os.OpenFile(walPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error reopening WAL file: %s", err)
+	}
+	wal.file.Close()
+	wal.file = compacted
+	wal.watermark = 0
+	logger.Info("compacted WAL", "entries_before", len(entries), "bytes_before", info.Size()-start, "bytes_after", records.Len())
 	return nil
 }
 
+// latestWALEntries returns the entries of committed batches and single records that
+// replay needs to reach the same state, in the order they were logged.
+func latestWALEntries(entries []KeyValue) []KeyValue {
+	type logged struct {
+		index int
+		kv    KeyValue
+	}
+	byKey := make(map[string][]logged)
+	var batch []logged
+	inBatch := false
+	add := func(entry logged) {
+		key := string(entry.kv.Key)
+		if entry.kv.Operation == Merge {
+			byKey[key] = append(byKey[key], entry)
+		} else {
+			byKey[key] = []logged{entry}
+		}
+	}
+	for i, kv := range entries {
+		switch {
+		case kv.Operation == BatchBegin:
+			batch, inBatch = batch[:0], true
+		case kv.Operation == BatchCommit:
+			for _, entry := range batch {
+				add(entry)
+			}
+			batch, inBatch = batch[:0], false
+		case inBatch:
+			batch = append(batch, logged{index: i, kv: kv})
+		default:
+			add(logged{index: i, kv: kv})
+		}
+	}
+
+	var kept []logged
+	for _, entries := range byKey {
+		kept = append(kept, entries...)
+	}
+	sort.Slice(kept, func(i, j int) bool {
+		return kept[i].index < kept[j].index
+	})
+	latest := make([]KeyValue, len(kept))
+	for i, entry := range kept {
+		latest[i] = entry.kv
+	}
+	return latest
+}
+
+const watermarkFileName = "watermark.dat"
+
+// watermarkPath returns the watermark file, stored next to the log.
+func (wal *WriteAheadLog) watermarkPath() string {
+	return filepath.Join(filepath.Dir(wal.file.Name()), watermarkFileName)
+}
+
+// writeWatermark atomically stores position and the segment it is in, followed by their CRC-32.
+func writeWatermark(path string, segment uint64, position int64) error {
+	data := binary.LittleEndian.AppendUint64(nil, uint64(position))
+	data = binary.LittleEndian.AppendUint64(data, segment)
+	data = binary.LittleEndian.AppendUint32(data, crc32.ChecksumIEEE(data))
+	return atomicWriteFile(path, data)
+}
+
+// readWatermark returns the position stored in the watermark file, or 0 when
+// the file is missing or corrupt.
+func readWatermark(path string) int64 {
+	_, position := readWALWatermark(path)
+	return position
+}
+
+// readWALWatermark returns the segment and position stored in the watermark file, or
+// zeros when the file is missing or corrupt. Watermarks written before the log was
+// rotated hold only a position, which is in segment 0.
+func readWALWatermark(path string) (uint64, int64) {
+	data, err := os.ReadFile(path)
+	if err != nil || (len(data) != 12 && len(data) != 20) {
+		return 0, 0
+	}
+	sum := len(data) - 4
+	if crc32.ChecksumIEEE(data[:sum]) != binary.LittleEndian.Uint32(data[sum:]) {
+		return 0, 0
+	}
+	position := int64(binary.LittleEndian.Uint64(data))
+	if position < 0 {
+		return 0, 0
+	}
+	var segment uint64
+	if len(data) == 20 {
+		segment = binary.LittleEndian.Uint64(data[8:])
+	}
+	return segment, position
+}
+
+// ReplayWAL applies the entries logged after the watermark to the memtable and
+// returns how many were applied. Entries before the watermark are already in SST files.
+func (mem *memDB) ReplayWAL() (int, error) {
+	segment, start := readWALWatermark(mem.wal.watermarkPath())
+	log, closeLog, err := mem.wal.openWALFrom(segment, start)
+	if err != nil {
+		return 0, err
+	}
+	defer closeLog()
+	entries, err := readWALEntries(CountingReader{R: log, Count: &mem.wal.BytesRead})
+	applied := mem.applyWALEntries(entries)
+	if err != nil {
+		return applied, fmt.Errorf("error replaying WAL from position %d: %w", start, err)
+	}
+	return applied, nil
+}
+
+// applyWALEntries applies the entries read from a log to the memtable and returns how
+// many were applied. The records of a batch are only applied once its commit record is
+// read, so a batch cut short by a crash is left out.
+func (mem *memDB) applyWALEntries(entries []KeyValue) int {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	applied := 0
+	var batch []KeyValue // Records of an open batch, applied once its commit record is read
+	inBatch := false
+	for _, kv := range entries {
+		kv.Key = mem.transformKey(kv.Key) // Entries may have been logged before the transformer was set
+		switch {
+		case kv.Operation == BatchBegin:
+			batch, inBatch = batch[:0], true
+		case kv.Operation == BatchCommit:
+			for _, op := range batch {
+				mem.applyEntry(op)
+			}
+			applied += len(batch)
+			batch, inBatch = batch[:0], false
+		case inBatch:
+			batch = append(batch, kv)
+		default:
+			mem.applyEntry(kv)
+			applied++
+		}
+	}
+	return applied
+}
+
+// walPosition is a point of the log: offset bytes into the segment with the given
+// sequence number, the current file being segment wal.segment. Positions grow as records
+// are appended and the log is rotated, but not across CompactWAL, which rewrites the log.
+type walPosition struct {
+	segment uint64
+	offset  int64
+}
+
+// after reports whether p comes after q in the log.
+func (p walPosition) after(q walPosition) bool {
+	return p.segment > q.segment || p.segment == q.segment && p.offset > q.offset
+}
+
+// end returns the position of the end of the log. A nil log is empty.
+func (wal *WriteAheadLog) end() (walPosition, error) {
+	if wal == nil {
+		return walPosition{}, nil
+	}
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+	if wal.file == nil {
+		return walPosition{}, nil
+	}
+	info, err := wal.file.Stat()
+	if err != nil {
+		return walPosition{}, err
+	}
+	return walPosition{segment: wal.segment, offset: info.Size()}, nil
+}
+
+// Position returns the current size of the log. A nil log is empty.
+func (wal *WriteAheadLog) Position() (int64, error) {
+	if wal == nil {
+		return 0, nil
+	}
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+	if wal.file == nil {
+		return 0, nil
+	}
+	info, err := wal.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
 func (wal *WriteAheadLog) UpdateWatermark(position int64) {
 	wal.watermark = position
 }
+
+// readWALEntries parses the records of a WAL stream in the order they were appended.
+// A record cut short by a crash stops the replay; the records read before it are still returned.
+func readWALEntries(r io.Reader) ([]KeyValue, error) {
+	reader := bufio.NewReader(r)
+	entries := make([]KeyValue, 0)
+
+	for {
+		kv, err := readWALRecord(reader)
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, kv)
+	}
+}
+
+// readWALRecord reads the next record of a WAL stream, in either format. It returns
+// io.EOF only when the stream ends before the record starts.
+func readWALRecord(reader *bufio.Reader) (KeyValue, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return KeyValue{}, err
+	}
+	if first[0] == jsonWALRecordStart {
+		return readJSONWALRecord(reader)
+	}
+	opByte, err := reader.ReadByte()
+	if err != nil {
+		return KeyValue{}, err
+	}
+	compressed := opByte&compressedOpFlag != 0
+	var order binary.ByteOrder = binary.LittleEndian
+	if opByte&bigEndianOpFlag != 0 {
+		order = binary.BigEndian
+	}
+	timestamped := opByte&timestampOpFlag != 0
+	tagged := opByte&tagsOpFlag != 0
+	expiring := opByte&expiryOpFlag != 0
+	opByte &^= compressedOpFlag | bigEndianOpFlag | timestampOpFlag | tagsOpFlag | expiryOpFlag
+	if Operation(opByte) > BatchCommit {
+		return KeyValue{}, fmt.Errorf("invalid WAL operation: %d", opByte)
+	}
+
+	kv := KeyValue{Operation: Operation(opByte)}
+	if compressed {
+		kv.Key, kv.Value, err = readCompressedWALPayload(reader, order)
+		if err != nil {
+			return KeyValue{}, fmt.Errorf("error reading compressed WAL entry: %w", err)
+		}
+	} else {
+		if kv.Key, err = readWALField(reader, order); err != nil {
+			return KeyValue{}, fmt.Errorf("error reading WAL key: %w", err)
+		}
+		if kv.Value, err = readWALField(reader, order); err != nil {
+			return KeyValue{}, fmt.Errorf("error reading WAL value: %w", err)
+		}
+	}
+	if tagged {
+		data, err := readWALField(reader, order)
+		if err != nil {
+			return KeyValue{}, fmt.Errorf("error reading WAL tags: %w", err)
+		}
+		if kv.Tags, err = decodeTags(data); err != nil {
+			return KeyValue{}, err
+		}
+	}
+	if expiring {
+		if err := binary.Read(reader, order, &kv.ExpiresAt); err != nil {
+			return KeyValue{}, fmt.Errorf("error reading WAL expiry time: %w", unexpectedEOF(err))
+		}
+	}
+	if timestamped {
+		if err := binary.Read(reader, order, &kv.Timestamp); err != nil {
+			return KeyValue{}, fmt.Errorf("error reading WAL timestamp: %w", unexpectedEOF(err))
+		}
+	}
+	return kv, nil
+}
+
+// readWALField reads a length written by writeWALLength in the given byte order followed
+// by that many bytes.
+func readWALField(reader *bufio.Reader, order binary.ByteOrder) ([]byte, error) {
+	length, err := readWALLength(reader, order)
+	if err != nil {
+		return nil, err
+	}
+	// Read in chunks, so a corrupt length does not allocate gigabytes up front
+	data, err := io.ReadAll(io.LimitReader(reader, int64(length)))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != length {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return data, nil
+}
+
+// readWALLength reads a length written by writeWALLength in the given byte order.
+func readWALLength(reader io.Reader, order binary.ByteOrder) (int, error) {
+	var length uint16
+	if err := binary.Read(reader, order, &length); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	if length != walLongFieldLength {
+		return int(length), nil
+	}
+	var long uint32
+	if err := binary.Read(reader, order, &long); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	return int(long), nil
+}
+
+// readCompressedWALPayload reads the part of a compressed record that follows the op byte.
+func readCompressedWALPayload(reader *bufio.Reader, order binary.ByteOrder) ([]byte, []byte, error) {
+	keyLen, err := readWALLength(reader, order)
+	if err != nil {
+		return nil, nil, err
+	}
+	valueLen, err := readWALLength(reader, order)
+	if err != nil {
+		return nil, nil, err
+	}
+	var header struct {
+		Compression    WALCompression
+		CompressedSize uint32
+	}
+	if err := binary.Read(reader, order, &header); err != nil {
+		return nil, nil, unexpectedEOF(err)
+	}
+
+	compressed, err := io.ReadAll(io.LimitReader(reader, int64(header.CompressedSize)))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(compressed) != int(header.CompressedSize) {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+
+	payload, err := decompressWALPayload(header.Compression, compressed, keyLen+valueLen)
+	if err != nil {
+		return nil, nil, err
+	}
+	return payload[:keyLen], payload[keyLen:], nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,1229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWALCompressionReplay(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "wal.log")
+	wal, err := NewWriteAheadLog(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := []byte(strings.Repeat(`{"name":"value"}`, 1000))
+	wal.AppendEntry(Set, KeyValue{Key: []byte("plain"), Value: value})
+	wal.Compression = CompressionGzip
+	if err := wal.AppendEntry(Set, KeyValue{Key: []byte("gzip"), Value: value}); err != nil {
+		t.Fatal(err)
+	}
+	wal.AppendEntry(Delete, KeyValue{Key: []byte("plain")})
+	wal.Compression = CompressionZstd
+	if err := wal.AppendEntry(Set, KeyValue{Key: []byte("zstd")}); !errors.Is(err, ErrUnsupportedCompression) {
+		t.Errorf("Expected ErrUnsupportedCompression, got %v", err)
+	}
+	wal.Close()
+
+	data, err := os.ReadFile(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readWALEntries(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(entries))
+	}
+	if string(entries[1].Key) != "gzip" || !bytes.Equal(entries[1].Value, value) || entries[1].Operation != Set {
+		t.Errorf("Compressed entry did not round-trip: key %q, %d value bytes", entries[1].Key, len(entries[1].Value))
+	}
+	if string(entries[2].Key) != "plain" || entries[2].Operation != Delete {
+		t.Errorf("Unexpected entry after compressed record: %+v", entries[2])
+	}
+}
+
+func TestWALLargeValuesReplay(t *testing.T) {
+	blob := make([]byte, 100*1024)
+	rand.New(rand.NewSource(1)).Read(blob) // Does not shrink when compressed
+	values := map[string][]byte{
+		"edge":  bytes.Repeat([]byte("e"), math.MaxUint16),
+		"large": bytes.Repeat([]byte("l"), 70000),
+		"blob":  blob,
+		"after": []byte("value"),
+	}
+	for _, compression := range []WALCompression{CompressionNone, CompressionGzip} {
+		dir := t.TempDir()
+		walPath := filepath.Join(dir, "wal.log")
+		wal, err := NewWriteAheadLog(walPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wal.Compression = compression
+		cfg := DefaultDBConfig()
+		cfg.DataDir = dir
+		db := NewMemDBWithConfig(wal, cfg)
+		for _, key := range []string{"edge", "large", "blob", "after"} {
+			if err := db.Set([]byte(key), values[key]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		wal.Close() // Without closing db, as after a crash
+
+		wal, err = NewWriteAheadLog(walPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		replayed := NewMemDBWithConfig(wal, cfg)
+		if n, err := replayed.ReplayWAL(); err != nil || n != 4 {
+			t.Fatalf("%s: expected 4 entries replayed, got %d, %v", compression, n, err)
+		}
+		for key, expected := range values {
+			if value, err := replayed.Get([]byte(key)); err != nil || !bytes.Equal(value, expected) {
+				t.Errorf("%s, %s: expected %d value bytes, got %d, %v", compression, key, len(expected), len(value), err)
+			}
+		}
+		replayed.Close()
+	}
+}
+
+func TestJSONWALRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "wal.log")
+	wal, err := NewWriteAheadLog(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	cfg.WALFormat = WALJSON
+	cfg.MaxMemtableEntries = 2000
+	db := NewMemDBWithConfig(wal, cfg)
+	for i := 0; i < 1000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte{byte(i), 0, '\n', '{'}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 1000; i += 10 {
+		if _, err := db.Del([]byte(fmt.Sprintf("key%04d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wal.Close() // Without closing db, as after a crash
+
+	data, err := os.ReadFile(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte(`{"op":0,"key":"a2V5MDAwMA==","value":"AAAKew==","seq":1}`+"\n")) {
+		t.Fatalf("Expected JSON lines, got %.80q", data)
+	}
+
+	wal, err = NewWriteAheadLog(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed := NewMemDBWithConfig(wal, cfg)
+	defer replayed.Close()
+	if n, err := replayed.ReplayWAL(); err != nil || n != 1100 {
+		t.Fatalf("Expected 1100 entries replayed, got %d, %v", n, err)
+	}
+	for i := 0; i < 1000; i++ {
+		value, err := replayed.Get([]byte(fmt.Sprintf("key%04d", i)))
+		if i%10 == 0 {
+			if !errors.Is(err, ErrKeyNotFound) {
+				t.Errorf("key%04d: expected ErrKeyNotFound, got %q, %v", i, value, err)
+			}
+		} else if err != nil || !bytes.Equal(value, []byte{byte(i), 0, '\n', '{'}) {
+			t.Errorf("key%04d: expected its value, got %q, %v", i, value, err)
+		}
+	}
+}
+
+func TestWALDumpBinary(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "wal.log")
+	wal, err := NewWriteAheadLog(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.AppendEntry(Set, KeyValue{Key: []byte("a"), Value: []byte("1")})
+	wal.Compression = CompressionGzip
+	wal.AppendEntry(Set, KeyValue{Key: []byte("b"), Value: []byte("2")})
+	wal.AppendBatch([]KeyValue{{Key: []byte("a"), Operation: Delete}})
+	wal.Close()
+
+	var out bytes.Buffer
+	if err := WALDump(walPath, &out); err != nil {
+		t.Fatal(err)
+	}
+	expected := `     1  set    key="a" value="1"
+     2  set    key="b" value="2"
+     3  batch-begin
+     4  delete key="a" value=""
+     5  batch-commit
+`
+	if out.String() != expected {
+		t.Errorf("Expected dump\n%s\ngot\n%s", expected, out.String())
+	}
+}
+
+// BenchmarkWALCompression reports the WAL bytes written per entry for text-heavy
+// and binary-heavy values under each compression setting.
+func BenchmarkWALCompression(b *testing.B) {
+	text := []byte(strings.Repeat(`{"id":12345,"name":"example","tags":["a","b"]},`, 2000))
+	binaryValue := make([]byte, len(text))
+	rand.New(rand.NewSource(1)).Read(binaryValue)
+	// Keep values within the 2-byte length field of a record
+	text, binaryValue = text[:60000], binaryValue[:60000]
+
+	workloads := []struct {
+		name  string
+		value []byte
+	}{
+		{"text", text},
+		{"binary", binaryValue},
+	}
+	for _, compression := range []WALCompression{CompressionNone, CompressionGzip, CompressionZstd} {
+		for _, workload := range workloads {
+			b.Run(fmt.Sprintf("%s/%s", compression, workload.name), func(b *testing.B) {
+				wal, err := NewWriteAheadLog(filepath.Join(b.TempDir(), "wal.log"))
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer wal.Close()
+				wal.Compression = compression
+
+				entry := KeyValue{Key: []byte("key"), Value: workload.value}
+				if err := wal.AppendEntry(Set, entry); errors.Is(err, ErrUnsupportedCompression) {
+					b.Skip(err)
+				}
+				b.SetBytes(int64(len(workload.value)))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := wal.AppendEntry(Set, entry); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StopTimer()
+
+				size, err := wal.Position()
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.ReportMetric(float64(size)/float64(b.N+1), "walbytes/entry")
+			})
+		}
+	}
+}
+
+func TestWALCloseDuringAppends(t *testing.T) {
+	wal, err := NewWriteAheadLog(filepath.Join(t.TempDir(), "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				err := wal.AppendEntry(Set, KeyValue{Key: []byte(fmt.Sprintf("key%d_%d", i, j)), Value: []byte("value")})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if !errors.Is(err, ErrDatabaseClosed) {
+			t.Errorf("Expected ErrDatabaseClosed after Close, got %v", err)
+		}
+	}
+	if err := wal.AppendEntry(Set, KeyValue{Key: []byte("late")}); !errors.Is(err, ErrDatabaseClosed) {
+		t.Errorf("Expected ErrDatabaseClosed, got %v", err)
+	}
+}
+
+func TestReplayStartsAtWatermark(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWriteAheadLog(filepath.Join(dir, "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	value := []byte(strings.Repeat("v", 100))
+	for cycle := 0; cycle < 5; cycle++ {
+		for i := 0; i < 2000; i++ {
+			if err := wal.AppendEntry(Set, KeyValue{Key: []byte(fmt.Sprintf("key%d_%d", cycle, i)), Value: value}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		position, err := wal.Position()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := wal.CleanupAfterSSTCreation(position); err != nil {
+			t.Fatalf("Cleanup failed: %s", err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if err := wal.AppendEntry(Set, KeyValue{Key: []byte(fmt.Sprintf("tail%d", i)), Value: value}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	replay := func() (int, time.Duration) {
+		db := NewMemDB(wal)
+		start := time.Now()
+		n, err := db.ReplayWAL()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n, time.Since(start)
+	}
+
+	n, fromWatermark := replay()
+	if n != 10 {
+		t.Errorf("Expected replay from the watermark to apply 10 entries, got %d", n)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, watermarkFileName), []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	n, fromStart := replay()
+	if n != 5*2000+10 {
+		t.Errorf("Expected a corrupt watermark to replay all %d entries, got %d", 5*2000+10, n)
+	}
+	if fromStart < 5*fromWatermark {
+		t.Errorf("Replay from the watermark took %s, not 5x faster than %s from position 0", fromWatermark, fromStart)
+	}
+}
+
+func TestReplayUntilSequence(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWriteAheadLog(filepath.Join(dir, "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	db := NewMemDBWithConfig(wal, cfg)
+
+	// An older SST file holds a value of "a" that the WAL deletes at sequence 3
+	sstData := []KeyValue{{Key: []byte("a"), Value: []byte("old")}, {Key: []byte("c"), Value: []byte("sst")}}
+	if err := writeSSTFile(filepath.Join(dir, "file_1.sst"), sstData); err != nil {
+		t.Fatal(err)
+	}
+	if err := addToManifest(dir, SSTFileMeta{FileName: "file_1.sst", SmallestKey: []byte("a"), LargestKey: []byte("c")}); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Set([]byte("a"), []byte("1"))
+	db.Set([]byte("b"), []byte("2"))
+	db.Del([]byte("a"))
+	db.Set([]byte("a"), []byte("3"))
+
+	recovered, _, err := ReplayUntilSequence(wal, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := recovered.Get([]byte("a")); err != nil || string(value) != "1" {
+		t.Errorf("Expected a=1 at sequence 2, got %q, %v", value, err)
+	}
+
+	recovered, position, err := ReplayUntilSequence(wal, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovered.cfg = cfg
+	snapshot, err := SnapshotAtWALPosition(recovered, position)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := make(map[string]string)
+	for _, kv := range snapshot.data {
+		state[string(kv.Key)] = string(kv.Value)
+	}
+	if len(state) != 2 || state["b"] != "2" || state["c"] != "sst" {
+		t.Errorf("Unexpected state at sequence 3: %v", state)
+	}
+	if readWatermark(wal.watermarkPath()) != 0 {
+		t.Error("Replaying to a sequence number moved the watermark")
+	}
+}
+
+func TestSnapshotLeavesOutLaterFlushes(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The first flushed file has sequence number 0 but holds the records 1 to 3
+	for _, key := range []string{"a", "b", "c"} {
+		if err := db.Set([]byte(key), []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("a"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+
+	for seq, want := range map[uint64]string{1: "a=1", 3: "a=1 b=1 c=1", 4: "a=2 b=1 c=1"} {
+		replayed, position, err := ReplayUntilSequence(db.wal, seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		replayed.cfg = cfg
+		snapshot, err := SnapshotAtWALPosition(replayed, position)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var state []string
+		for _, kv := range snapshot.data {
+			state = append(state, fmt.Sprintf("%s=%s", kv.Key, kv.Value))
+		}
+		sort.Strings(state)
+		if got := strings.Join(state, " "); got != want {
+			t.Errorf("Expected %s at sequence %d, got %s", want, seq, got)
+		}
+	}
+}
+
+func TestCompactWAL(t *testing.T) {
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "wal.log")
+	wal, err := NewWriteAheadLog(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	for i := 0; i < 1000; i++ {
+		if err := wal.AppendEntry(Set, KeyValue{Key: []byte("key1"), Value: []byte(fmt.Sprintf("value%d", i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wal.AppendEntry(Set, KeyValue{Key: []byte("key2"), Value: []byte("value")})
+	wal.AppendEntry(Delete, KeyValue{Key: []byte("key2")})
+	wal.AppendBatch([]KeyValue{{Key: []byte("key3"), Value: []byte("batched")}})
+
+	if err := wal.CompactWAL(); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.AppendEntry(Set, KeyValue{Key: []byte("key4"), Value: []byte("after")}); err != nil {
+		t.Fatalf("Error appending to the compacted WAL: %v", err)
+	}
+
+	data, err := os.ReadFile(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readWALEntries(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key1 []KeyValue
+	for _, kv := range entries {
+		if string(kv.Key) == "key1" {
+			key1 = append(key1, kv)
+		}
+	}
+	if len(key1) != 1 || string(key1[0].Value) != "value999" {
+		t.Fatalf("Expected one entry for key1 with value999, got %v", key1)
+	}
+	if len(entries) != 4 {
+		t.Errorf("Expected 4 entries after compaction, got %d", len(entries))
+	}
+	if readWatermark(wal.watermarkPath()) != 0 {
+		t.Error("Expected the watermark to be reset to 0")
+	}
+
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	db := NewMemDBWithConfig(wal, cfg)
+	if _, err := db.ReplayWAL(); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"key1": "value999", "key3": "batched", "key4": "after"} {
+		if value, err := db.Get([]byte(key)); err != nil || string(value) != want {
+			t.Errorf("%s: expected %s, got %s, %v", key, want, value, err)
+		}
+	}
+	if _, err := db.Get([]byte("key2")); err == nil {
+		t.Error("Expected key2 to stay deleted")
+	}
+}
+
+func TestWALBytesWritten(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWriteAheadLog(filepath.Join(dir, "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	db := NewMemDBWithConfig(wal, cfg)
+
+	var expected uint64
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		value := bytes.Repeat([]byte("v"), i)
+		if err := db.Set(key, value); err != nil {
+			t.Fatal(err)
+		}
+		expected += 1 + 2 + uint64(len(key)) + 2 + uint64(len(value)) // Operation and two length fields
+	}
+	if written := wal.BytesWritten.Load(); written != expected {
+		t.Errorf("Expected %d bytes written, got %d", expected, written)
+	}
+
+	if _, err := db.ReplayWAL(); err != nil {
+		t.Fatal(err)
+	}
+	if read := wal.BytesRead.Load(); read != expected {
+		t.Errorf("Expected %d bytes read during replay, got %d", expected, read)
+	}
+}
+
+func TestWALRotation(t *testing.T) {
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "wal.log")
+	wal, err := NewWriteAheadLog(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	cfg.MaxWALSize = 1 << 20
+	db := NewMemDBWithConfig(wal, cfg)
+
+	value := bytes.Repeat([]byte("v"), 32<<10)
+	for i := 0; i < 64; i++ { // 2 MB of values
+		if err := db.Set([]byte(fmt.Sprintf("key-%02d", i)), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count := wal.WALFileCount(); count < 2 {
+		t.Fatalf("Expected at least 2 WAL files, got %d", count)
+	}
+	segments, err := listWALSegments(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) < 1 || segments[0].path != filepath.Join(dir, "wal-000000.log") {
+		t.Fatalf("Expected rotated segments starting at wal-000000.log, got %+v", segments)
+	}
+	wal.Close()
+
+	// Every segment is replayed, as none of the entries were flushed
+	reopened, err := NewWriteAheadLog(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	replayed := NewMemDBWithConfig(reopened, cfg)
+	applied, err := replayed.ReplayWAL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied != 64 {
+		t.Errorf("Expected 64 entries replayed from the segments, got %d", applied)
+	}
+
+	// Once the memtable is flushed the segments are no longer needed
+	position, err := reopened.Position()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.CleanupAfterSSTCreation(position); err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.RemoveFlushedSegments(); err != nil {
+		t.Fatal(err)
+	}
+	if count := reopened.WALFileCount(); count != 1 {
+		t.Errorf("Expected only the current WAL file after cleanup, got %d", count)
+	}
+}
+
+// diskFullWriter fails the first failures writes as if the disk were full.
+type diskFullWriter struct {
+	w        io.Writer
+	failures int
+	calls    int
+}
+
+func (d *diskFullWriter) Write(p []byte) (int, error) {
+	d.calls++
+	if d.calls <= d.failures {
+		return 0, &os.PathError{Op: "write", Path: "wal.log", Err: syscall.ENOSPC}
+	}
+	return d.w.Write(p)
+}
+
+func TestWALAppendRetriesDiskFull(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWriteAheadLog(filepath.Join(dir, "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	db := NewMemDBWithConfig(wal, cfg)
+
+	disk := &diskFullWriter{failures: 2}
+	originalWriter := walWriter
+	walWriter = func(file *os.File) io.Writer {
+		disk.w = file
+		return disk
+	}
+	defer func() { walWriter = originalWriter }()
+
+	var logs bytes.Buffer
+	originalLogger := logger
+	logger = slog.New(slog.NewJSONHandler(&logs, nil))
+	defer func() { logger = originalLogger }()
+
+	if err := db.Set([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("Expected the append to succeed after the disk freed up, got %v", err)
+	}
+	if disk.calls != 3 {
+		t.Errorf("Expected 3 write attempts, got %d", disk.calls)
+	}
+	if !strings.Contains(logs.String(), `"level":"WARN"`) || !strings.Contains(logs.String(), `"retries":2`) {
+		t.Errorf("Expected a warning and the retry count in the logs, got %s", logs.String())
+	}
+
+	// Once the retry time is used up the error is returned
+	db.cfg.WALWriteRetryPolicy.MaxRetryDuration = 30 * time.Millisecond
+	disk.calls, disk.failures = 0, 1000
+	logs.Reset()
+	if err := db.Set([]byte("key"), []byte("other")); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("Expected ENOSPC, got %v", err)
+	}
+	if !strings.Contains(logs.String(), `"level":"ERROR"`) {
+		t.Errorf("Expected an error log on the final failure, got %s", logs.String())
+	}
+
+	// Deletes log while holding the memtable lock, so they fail fast instead of retrying
+	disk.calls, disk.failures = 0, 1
+	if _, err := db.Del([]byte("key")); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("Expected ENOSPC from the delete, got %v", err)
+	}
+	if disk.calls != 1 {
+		t.Errorf("Expected a single write attempt for the delete, got %d", disk.calls)
+	}
+}
+
+func TestWALByteOrder(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "wal.log")
+	wal, err := NewWriteAheadLog(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.AppendEntry(Set, KeyValue{Key: []byte("little"), Value: []byte("value")})
+	wal.ByteOrder = binary.BigEndian
+	wal.AppendEntry(Set, KeyValue{Key: []byte("big"), Value: []byte("value")})
+	wal.Compression = CompressionGzip
+	wal.AppendBatch([]KeyValue{{Key: []byte("compressed"), Value: []byte(strings.Repeat("value", 100))}})
+	wal.Close()
+
+	data, err := os.ReadFile(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := data[1+2+len("little")+2+len("value"):]
+	if second[0] != uint8(Set)|bigEndianOpFlag || binary.BigEndian.Uint16(second[1:]) != uint16(len("big")) {
+		t.Errorf("Expected a big-endian record, got % x", second[:3])
+	}
+	entries, err := readWALEntries(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, kv := range entries {
+		if kv.Operation == Set {
+			keys = append(keys, string(kv.Key))
+		}
+	}
+	if strings.Join(keys, ",") != "little,big,compressed" {
+		t.Errorf("Expected records of both byte orders to replay, got %v", keys)
+	}
+}
+
+func TestWALEntryTimestamp(t *testing.T) {
+	for _, format := range []WALFormat{WALBinary, WALJSON} {
+		dir := t.TempDir()
+		wal, err := NewWriteAheadLog(filepath.Join(dir, "wal.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := DefaultDBConfig()
+		cfg.DataDir = dir
+		cfg.WALFormat = format
+		cfg.EntryTimestamp = true
+		db := NewMemDBWithConfig(wal, cfg)
+		for i := 0; i < 100; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("key%d", i)), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		wal.Close()
+
+		data, err := os.ReadFile(filepath.Join(dir, "wal.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := readWALEntries(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 100 {
+			t.Fatalf("%s: expected 100 replayed entries, got %d", format, len(entries))
+		}
+		now := time.Now()
+		for i, kv := range entries {
+			if logged := time.Unix(0, kv.Timestamp); now.Sub(logged) > time.Second || logged.After(now) {
+				t.Fatalf("%s: entry %d has timestamp %s, expected one within 1s of %s", format, i, logged, now)
+			}
+			if string(kv.Key) != fmt.Sprintf("key%d", i) || string(kv.Value) != "value" {
+				t.Errorf("%s: entry %d replayed as %q=%q", format, i, kv.Key, kv.Value)
+			}
+		}
+	}
+
+	// Records without a timestamp still replay next to timestamped ones
+	wal, err := NewWriteAheadLog(filepath.Join(t.TempDir(), "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	wal.AppendEntry(Set, KeyValue{Key: []byte("plain")})
+	wal.Timestamps = true
+	wal.AppendEntry(Set, KeyValue{Key: []byte("stamped")})
+	data, err := os.ReadFile(wal.file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readWALEntries(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Timestamp != 0 || entries[1].Timestamp == 0 || string(entries[1].Key) != "stamped" {
+		t.Errorf("Unexpected entries %+v", entries)
+	}
+}
+
+func TestWALEntryExpiry(t *testing.T) {
+	expiresAt := time.Now().Add(time.Hour).UnixNano()
+	for _, format := range []WALFormat{WALBinary, WALJSON} {
+		for _, compression := range []WALCompression{CompressionNone, CompressionGzip} {
+			wal, err := NewWriteAheadLog(filepath.Join(t.TempDir(), "wal.log"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			wal.Format = format
+			wal.Compression = compression
+			wal.Timestamps = true
+			wal.AppendEntry(Set, KeyValue{Key: []byte("plain"), Value: []byte("value")})
+			wal.AppendEntry(Set, KeyValue{Key: []byte("expiring"), Value: []byte("value"), ExpiresAt: expiresAt, Tags: map[string]string{"owner": "alice"}})
+			data, err := os.ReadFile(wal.file.Name())
+			wal.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries, err := readWALEntries(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 2 || entries[0].ExpiresAt != 0 || entries[1].ExpiresAt != expiresAt ||
+				entries[1].Tags["owner"] != "alice" || entries[1].Timestamp == 0 || string(entries[1].Value) != "value" {
+				t.Errorf("%s, compression %d: unexpected entries %+v", format, compression, entries)
+			}
+		}
+	}
+}
+
+// flakyWriter fails writes at random with probability rate.
+type flakyWriter struct {
+	w    io.Writer
+	rng  *rand.Rand
+	rate float64
+}
+
+func (f *flakyWriter) Write(p []byte) (int, error) {
+	if f.rng.Float64() < f.rate {
+		return 0, &os.PathError{Op: "write", Path: "wal.log", Err: syscall.EIO}
+	}
+	return f.w.Write(p)
+}
+
+func TestWALSyncPolicyUpgrade(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWriteAheadLog(filepath.Join(dir, "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = dir
+	cfg.WALErrorRateThreshold = 0.001
+	db := NewMemDBWithConfig(wal, cfg)
+
+	flaky := &flakyWriter{w: wal.file, rng: rand.New(rand.NewSource(1)), rate: 0.005}
+	originalWriter := walWriter
+	walWriter = func(*os.File) io.Writer { return flaky }
+	defer func() { walWriter = originalWriter }()
+
+	if policy := db.Stats().WALSyncPolicy; policy != "none" {
+		t.Fatalf("Expected the WAL to start without syncing, got %s", policy)
+	}
+	for i := 0; i < 2000 && wal.EffectiveSyncPolicy() == SyncNone; i++ {
+		wal.AppendEntry(Set, KeyValue{Key: []byte(fmt.Sprintf("key%d", i)), Value: []byte("value")})
+	}
+	if policy := db.Stats().WALSyncPolicy; policy != "per-entry" {
+		t.Errorf("Expected a 0.5%% error rate to upgrade the WAL to per-entry syncs, got %s", policy)
+	}
+
+	// The policy is restored once the rate stayed low for the recovery window
+	monitor := newWALSyncMonitor(0.001, time.Minute)
+	start := time.Now()
+	monitor.record(start, true)
+	if monitor.policy() != SyncPerEntry {
+		t.Fatal("Expected a failed append to upgrade the policy")
+	}
+	recovered := start.Add(walErrorRateBuckets * time.Second) // The failure left the window
+	monitor.record(recovered, false)
+	monitor.record(recovered.Add(30*time.Second), false)
+	if monitor.policy() != SyncPerEntry {
+		t.Error("Expected the policy to stay upgraded within the recovery window")
+	}
+	monitor.record(recovered.Add(time.Minute), false)
+	if monitor.policy() != SyncNone {
+		t.Error("Expected the policy to be downgraded after the recovery window")
+	}
+}
+
+func TestWALUnsyncedWriteNotRetried(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	cfg.WALSyncPolicy = SyncPerEntry
+	cfg.WALWriteRetryPolicy = RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	syncs := 0
+	originalSync := walSync
+	walSync = func(*os.File) error {
+		syncs++
+		return &os.PathError{Op: "sync", Path: "wal.log", Err: syscall.ENOSPC}
+	}
+	err = db.Set([]byte("key"), []byte("value"))
+	walSync = originalSync
+	if !errors.Is(err, ErrUnsyncedWALWrite) {
+		t.Fatalf("Expected ErrUnsyncedWALWrite, got %v", err)
+	}
+	if syncs != 1 {
+		t.Errorf("Expected the written record not to be retried, got %d syncs", syncs)
+	}
+
+	// The record is in the log once, so a replay may still apply it
+	file, err := os.Open(cfg.WALPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	entries, err := readWALEntries(file)
+	if err != nil || len(entries) != 1 || string(entries[0].Key) != "key" {
+		t.Errorf("Expected the record logged once, got %d entries, %v", len(entries), err)
+	}
+}
+
+var errSimulatedCrash = errors.New("simulated crash")
+
+// CrashWriter passes the first Limit bytes written through it on to W and then stops, like
+// a process that dies mid-write. With Panic it panics with errSimulatedCrash; otherwise the
+// write fails with it.
+type CrashWriter struct {
+	W       io.Writer
+	Limit   int
+	Panic   bool
+	written int
+}
+
+func (c *CrashWriter) Write(p []byte) (int, error) {
+	if c.written+len(p) <= c.Limit {
+		n, err := c.W.Write(p)
+		c.written += n
+		return n, err
+	}
+	n, _ := c.W.Write(p[:c.Limit-c.written])
+	c.written += n
+	if c.Panic {
+		panic(errSimulatedCrash)
+	}
+	return n, errSimulatedCrash
+}
+
+// crashed calls fn and reports whether it panicked with errSimulatedCrash.
+func crashed(fn func()) (crashed bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if r != errSimulatedCrash {
+				panic(r)
+			}
+			crashed = true
+		}
+	}()
+	fn()
+	return false
+}
+
+func TestWALCrashMidRecord(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "wal.log")
+	wal, err := NewWriteAheadLog(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const complete = 50
+	for i := 0; i < complete; i++ {
+		if err := wal.AppendEntry(Set, KeyValue{Key: []byte(fmt.Sprintf("key-%02d", i)), Value: []byte(fmt.Sprintf("value-%02d", i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Readers of the log see complete records only, before and after the crash
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				file, err := os.Open(walPath)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				entries, _ := readWALEntries(file)
+				file.Close()
+				for i, kv := range entries {
+					if i >= complete || string(kv.Key) != fmt.Sprintf("key-%02d", i) || string(kv.Value) != fmt.Sprintf("value-%02d", i) {
+						t.Errorf("Reader saw entry %d as %s=%s", i, kv.Key, kv.Value)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	torn := KeyValue{Key: []byte("torn"), Value: bytes.Repeat([]byte("v"), 100)}
+	record, err := wal.encodeRecord(Set, torn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	originalWriter := walWriter
+	walWriter = func(file *os.File) io.Writer {
+		return &CrashWriter{W: file, Limit: len(record) / 2, Panic: true}
+	}
+	if !crashed(func() { wal.AppendEntry(Set, torn) }) {
+		t.Error("Expected the append to crash")
+	}
+	walWriter = originalWriter
+	close(stop)
+	readers.Wait()
+	wal.Close()
+
+	if info, err := os.Stat(walPath); err != nil || info.Size() == 0 {
+		t.Fatalf("Expected the torn record in the log, got %v, %v", info, err)
+	}
+	reopened, err := NewWriteAheadLog(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = filepath.Dir(walPath)
+	db := NewMemDBWithConfig(reopened, cfg)
+	applied, err := db.ReplayWAL()
+	if err == nil {
+		t.Error("Expected the replay to report the torn record")
+	}
+	if applied != complete {
+		t.Errorf("Expected %d complete records replayed, got %d", complete, applied)
+	}
+	for i := 0; i < complete; i++ {
+		if value, err := db.Get([]byte(fmt.Sprintf("key-%02d", i))); err != nil || string(value) != fmt.Sprintf("value-%02d", i) {
+			t.Errorf("Expected key-%02d to be recovered, got %q, %v", i, value, err)
+		}
+	}
+	if _, err := db.Get([]byte("torn")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected the torn record to be skipped, got %v", err)
+	}
+}
+
+// memShippingBackend keeps shipped WAL segments in memory.
+type memShippingBackend struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (b *memShippingBackend) Upload(name string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objects[name] = data
+	return nil
+}
+
+func (b *memShippingBackend) List() ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var names []string
+	for name := range b.objects {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (b *memShippingBackend) Download(name string) (io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data, ok := b.objects[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func TestWALShippingReplay(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultDBConfig()
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.WALPath = filepath.Join(dir, "wal.log")
+	cfg.MaxWALSize = 4 << 10
+	db, err := OpenDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	backend := &memShippingBackend{objects: make(map[string][]byte)}
+	db.wal.shipper = NewWALShipper(backend, "")
+
+	value := bytes.Repeat([]byte("v"), 100)
+	for i := 0; i < 200; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key-%03d", i)), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Set([]byte("key-000"), []byte("overwritten")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Del([]byte("key-001")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ { // Rotate the overwrite and the delete out of the current file
+		if err := db.Set([]byte(fmt.Sprintf("pad-%03d", i)), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.wal.shipper.Wait()
+
+	segments, err := listWALSegments(cfg.WALPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, _ := backend.List()
+	if len(segments) < 2 || len(names) != len(segments) {
+		t.Fatalf("Expected every rotated segment to be shipped, got %d segments and %v", len(segments), names)
+	}
+
+	// The shipped segments rebuild the database without the local disk
+	restoreDir := t.TempDir()
+	restoreCfg := cfg
+	restoreCfg.DataDir = filepath.Join(restoreDir, "data")
+	restoreCfg.WALPath = filepath.Join(restoreDir, "wal.log")
+	restored, err := OpenDB(restoreCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if _, err := NewWALShipper(backend, "").Replay("", restored); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := restored.Get([]byte("key-000")); err != nil || string(got) != "overwritten" {
+		t.Errorf("Expected the overwritten value of key-000, got %q, %v", got, err)
+	}
+	if _, err := restored.Get([]byte("key-001")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected key-001 to be deleted, got %v", err)
+	}
+	for i := 2; i < 200; i++ {
+		if got, err := restored.Get([]byte(fmt.Sprintf("key-%03d", i))); err != nil || !bytes.Equal(got, value) {
+			t.Fatalf("Expected key-%03d to be restored, got %q, %v", i, got, err)
+		}
+	}
+
+	// Replaying from a later segment leaves out the earlier ones
+	sort.Strings(names)
+	partialCfg := restoreCfg
+	partialCfg.DataDir = t.TempDir()
+	partial := NewMemDBWithConfig(nil, partialCfg)
+	defer partial.Close()
+	applied, err := NewWALShipper(backend, "").Replay(names[len(names)-1], partial)
+	if err != nil || applied == 0 {
+		t.Fatalf("Expected entries of the last segment replayed, got %d, %v", applied, err)
+	}
+	if _, err := partial.Get([]byte("key-002")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected key-002 from the first segment to be left out, got %v", err)
+	}
+}
+
+func TestWALShippingPrefixes(t *testing.T) {
+	backend := &memShippingBackend{objects: make(map[string][]byte)}
+	value := bytes.Repeat([]byte("v"), 100)
+	// Two shards of a database whose segments have the same file names share the bucket
+	base := DefaultDBConfig()
+	base.DataDir = t.TempDir()
+	base.MaxWALSize = 4 << 10
+	for i := 0; i < 2; i++ {
+		cfg := shardConfig(base, i)
+		if err := os.MkdirAll(cfg.DataDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		db, err := OpenDB(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.wal.shipper = NewWALShipper(backend, cfg.WALShippingPrefix)
+		for j := 0; j < 100; j++ {
+			if err := db.Set([]byte(fmt.Sprintf("shard-%d-key-%03d", i, j)), value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.wal.shipper.Wait()
+		db.Close()
+	}
+	if err := backend.Upload("other-segment", bytes.NewReader(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		shipper := NewWALShipper(backend, fmt.Sprintf("shard-%d/", i))
+		names, err := shipper.Segments()
+		if err != nil || len(names) == 0 {
+			t.Fatalf("Expected segments of shard %d, got %v, %v", i, names, err)
+		}
+		cfg := DefaultDBConfig()
+		cfg.DataDir = t.TempDir()
+		restored := NewMemDBWithConfig(nil, cfg)
+		if _, err := shipper.Replay("", restored); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := restored.Get([]byte(fmt.Sprintf("shard-%d-key-000", i))); err != nil {
+			t.Errorf("Expected the keys of shard %d restored, got %v", i, err)
+		}
+		if _, err := restored.Get([]byte(fmt.Sprintf("shard-%d-key-000", 1-i))); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected the keys of shard %d left out of shard %d, got %v", 1-i, i, err)
+		}
+		restored.Close()
+	}
+	// Without a prefix only the objects outside the shard prefixes are listed
+	if names, err := NewWALShipper(backend, "").Segments(); err != nil || len(names) != 1 || names[0] != "other-segment" {
+		t.Errorf("Expected only the unprefixed object, got %v, %v", names, err)
+	}
+}
+
+func TestS3BackendRoundTrip(t *testing.T) {
+	objects := make(map[string][]byte)
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=key/") || r.Header.Get("x-amz-content-sha256") == "" {
+			http.Error(w, "unsigned request", http.StatusForbidden)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/bucket/")
+		switch {
+		case r.Method == http.MethodPut:
+			objects[name], _ = io.ReadAll(r.Body)
+		case r.URL.Path == "/bucket" && r.URL.Query().Get("list-type") == "2":
+			fmt.Fprint(w, "<ListBucketResult>")
+			for name := range objects {
+				fmt.Fprintf(w, "<Contents><Key>%s</Key></Contents>", name)
+			}
+			fmt.Fprint(w, "<IsTruncated>false</IsTruncated></ListBucketResult>")
+		case objects[name] != nil:
+			w.Write(objects[name])
+		default:
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+		}
+	}))
+	defer store.Close()
+
+	backend := &S3Backend{Endpoint: store.URL, Region: "us-east-1", Bucket: "bucket", AccessKey: "key", SecretKey: "secret", Client: store.Client()}
+	if err := backend.Upload("wal-000000.log", strings.NewReader("segment")); err != nil {
+		t.Fatal(err)
+	}
+	names, err := backend.List()
+	if err != nil || len(names) != 1 || names[0] != "wal-000000.log" {
+		t.Fatalf("Expected the uploaded segment in the listing, got %v, %v", names, err)
+	}
+	body, err := backend.Download("wal-000000.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	if data, _ := io.ReadAll(body); string(data) != "segment" {
+		t.Errorf("Expected the uploaded content, got %q", data)
+	}
+	if _, err := backend.Download("missing.log"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Expected a 404 error for a missing segment, got %v", err)
+	}
+}
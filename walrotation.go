@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// walSegment is a log file that was rotated out of use. Segments are numbered in the
+// order they were written; the current file has the number of the next segment.
+type walSegment struct {
+	sequence uint64
+	path     string
+}
+
+// walSegmentPath returns the name the log at walPath is renamed to when it is rotated
+// as segment sequence, e.g. wal-000003.log for wal.log.
+func walSegmentPath(walPath string, sequence uint64) string {
+	ext := filepath.Ext(walPath)
+	return fmt.Sprintf("%s-%06d%s", strings.TrimSuffix(walPath, ext), sequence, ext)
+}
+
+// listWALSegments returns the rotated segments of the log at walPath, oldest first.
+func listWALSegments(walPath string) ([]walSegment, error) {
+	ext := filepath.Ext(walPath)
+	prefix := strings.TrimSuffix(walPath, ext) + "-"
+	entries, err := os.ReadDir(filepath.Dir(walPath))
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []walSegment
+	for _, entry := range entries {
+		path := filepath.Join(filepath.Dir(walPath), entry.Name())
+		if entry.IsDir() || !strings.HasPrefix(path, prefix) || !strings.HasSuffix(path, ext) {
+			continue
+		}
+		sequence, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(path, prefix), ext), 10, 64)
+		if err != nil {
+			continue // Not a segment, like an incremental backup of the log
+		}
+		segments = append(segments, walSegment{sequence: sequence, path: path})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].sequence < segments[j].sequence
+	})
+	return segments, nil
+}
+
+// rotateIfFull starts a new log file once the current one grew beyond MaxSize.
+// A failed rotation leaves the log in the current file, so it is only logged.
+func (wal *WriteAheadLog) rotateIfFull() {
+	if wal.MaxSize <= 0 {
+		return
+	}
+	if err := wal.rotateWAL(); err != nil {
+		logger.Warn("error rotating WAL", "error", err)
+	}
+}
+
+// rotateWAL renames the current file after its segment number and opens a new one.
+// The watermark names its segment, so it stays valid when the file it points into is renamed.
+func (wal *WriteAheadLog) rotateWAL() error {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	if wal.closed {
+		return nil
+	}
+	offset, err := wal.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if offset <= wal.MaxSize {
+		return nil // Another append rotated the file first
+	}
+
+	walPath := wal.file.Name()
+	segmentPath := walSegmentPath(walPath, wal.segment)
+	if err := wal.file.Close(); err != nil {
+		return fmt.Errorf("error closing WAL file: %s", err)
+	}
+	renameErr := os.Rename(walPath, segmentPath)
+	file, err := os.OpenFile(walPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening WAL file: %s", err)
+	}
+	wal.file = file
+	if renameErr != nil {
+		return fmt.Errorf("error renaming WAL file: %s", renameErr) // The old file was reopened
+	}
+
+	wal.segment++
+	wal.watermark = 0
+	logger.Info("rotated WAL", "segment", segmentPath, "bytes", offset)
+	wal.shipper.shipAsync(segmentPath)
+	return nil
+}
+
+// WALFileCount returns the number of files the log is made of: the rotated segments
+// that were not cleaned up yet and the current file.
+func (wal *WriteAheadLog) WALFileCount() int {
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+	segments, err := listWALSegments(wal.file.Name())
+	if err != nil {
+		return 1
+	}
+	return len(segments) + 1
+}
+
+// RemoveFlushedSegments deletes the segments older than the watermark's segment. Every
+// entry in them is in an SST file. A nil log has no segments.
+func (wal *WriteAheadLog) RemoveFlushedSegments() error {
+	if wal == nil {
+		return nil
+	}
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+	watermarkSegment, _ := readWALWatermark(wal.watermarkPath())
+	segments, err := listWALSegments(wal.file.Name())
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if segment.sequence >= watermarkSegment {
+			break
+		}
+		if err := os.Remove(segment.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing WAL segment: %w", err)
+		}
+		logger.Debug("removed flushed WAL segment", "segment", segment.path)
+	}
+	return nil
+}
+
+// filesFrom returns the segments from the given one onwards, oldest first, followed by
+// the current file.
+func (wal *WriteAheadLog) filesFrom(segment uint64) ([]walSegment, error) {
+	wal.mu.RLock()
+	walPath := wal.file.Name()
+	current := wal.segment
+	wal.mu.RUnlock()
+
+	segments, err := listWALSegments(walPath)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]walSegment, 0, len(segments)+1)
+	for _, s := range segments {
+		if s.sequence >= segment && s.sequence < current {
+			files = append(files, s)
+		}
+	}
+	return append(files, walSegment{sequence: current, path: walPath}), nil
+}
+
+// openWALFrom returns a reader over the records logged from position in the given segment
+// onwards: the rest of that segment, the segments rotated after it and the current file.
+// A position beyond the end of its file reads the whole file.
+func (wal *WriteAheadLog) openWALFrom(segment uint64, position int64) (io.Reader, func(), error) {
+	files, err := wal.filesFrom(segment)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var opened []*os.File
+	closeFiles := func() {
+		for _, file := range opened {
+			file.Close()
+		}
+	}
+	readers := make([]io.Reader, 0, len(files))
+	for _, s := range files {
+		file, err := os.Open(s.path)
+		if err != nil {
+			closeFiles()
+			return nil, nil, err
+		}
+		opened = append(opened, file)
+		info, err := file.Stat()
+		if err != nil {
+			closeFiles()
+			return nil, nil, err
+		}
+
+		start := int64(0)
+		if s.sequence == segment && position <= info.Size() {
+			start = position
+		}
+		readers = append(readers, io.NewSectionReader(file, start, info.Size()-start))
+	}
+	return io.MultiReader(readers...), closeFiles, nil
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogShippingBackend stores WAL segments away from the machine that wrote them.
+type LogShippingBackend interface {
+	Upload(name string, r io.Reader) error
+	List() ([]string, error)
+	Download(name string) (io.ReadCloser, error)
+}
+
+// WALShipper uploads the segments the WAL is rotated into, so the log survives the loss
+// of the disk, and replays them into a database for recovery. The object names start with
+// prefix, so several databases or shards can ship to the same bucket.
+type WALShipper struct {
+	backend LogShippingBackend
+	prefix  string
+	uploads sync.WaitGroup
+}
+
+func NewWALShipper(backend LogShippingBackend, prefix string) *WALShipper {
+	return &WALShipper{backend: backend, prefix: prefix}
+}
+
+// newLogShippingBackend returns the backend cfg.WALShippingBackend names, or nil when
+// shipping is disabled.
+func newLogShippingBackend(cfg DBConfig) (LogShippingBackend, error) {
+	switch cfg.WALShippingBackend {
+	case "":
+		return nil, nil
+	case "s3":
+		return NewS3BackendFromEnv(cfg.WALShippingBucket)
+	default:
+		return nil, fmt.Errorf("unknown WAL shipping backend %q", cfg.WALShippingBackend)
+	}
+}
+
+// Ship uploads the segment at path under the prefix and its file name.
+func (s *WALShipper) Ship(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return s.upload(file)
+}
+
+func (s *WALShipper) upload(file *os.File) error {
+	if err := s.backend.Upload(s.prefix+filepath.Base(file.Name()), file); err != nil {
+		return fmt.Errorf("error uploading WAL segment %s: %w", filepath.Base(file.Name()), err)
+	}
+	return nil
+}
+
+// shipAsync uploads the segment at path in the background. The file is opened first, so
+// the upload completes even if the segment is removed once flushed. Failures are logged.
+// A nil shipper does nothing.
+func (s *WALShipper) shipAsync(path string) {
+	if s == nil {
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		logger.Error("error shipping WAL segment", "segment", path, "error", err)
+		return
+	}
+	s.uploads.Add(1)
+	go func() {
+		defer s.uploads.Done()
+		defer file.Close()
+		if err := s.upload(file); err != nil {
+			logger.Error("error shipping WAL segment", "segment", path, "error", err)
+			return
+		}
+		logger.Info("shipped WAL segment", "segment", path)
+	}()
+}
+
+// Wait blocks until the uploads started by rotations are done. A nil shipper has none.
+func (s *WALShipper) Wait() {
+	if s == nil {
+		return
+	}
+	s.uploads.Wait()
+}
+
+// Segments returns the file names of the segments uploaded under the prefix, oldest first.
+// Objects of other prefixes, including those of the prefix followed by a subdirectory, are
+// left out.
+func (s *WALShipper) Segments() ([]string, error) {
+	objects, err := s.backend.List()
+	if err != nil {
+		return nil, fmt.Errorf("error listing WAL segments: %w", err)
+	}
+	var names []string
+	for _, object := range objects {
+		name, ok := strings.CutPrefix(object, s.prefix)
+		if ok && name != "" && !strings.Contains(name, "/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names) // Segment numbers are zero-padded
+	return names, nil
+}
+
+// Replay applies the segments uploaded under the prefix to the memtable of mem in order,
+// starting with the segment whose file name is from, or the oldest one when from is empty,
+// and returns how many entries were applied. Flush mem afterwards to persist them.
+func (s *WALShipper) Replay(from string, mem *memDB) (int, error) {
+	names, err := s.Segments()
+	if err != nil {
+		return 0, err
+	}
+	applied := 0
+	for _, name := range names {
+		if name < from {
+			continue
+		}
+		body, err := s.backend.Download(s.prefix + name)
+		if err != nil {
+			return applied, fmt.Errorf("error downloading WAL segment %s: %w", name, err)
+		}
+		entries, err := readWALEntries(body)
+		body.Close()
+		applied += mem.applyWALEntries(entries)
+		if err != nil {
+			return applied, fmt.Errorf("error replaying WAL segment %s: %w", name, err)
+		}
+	}
+	return applied, nil
+}
+
+// S3Backend stores WAL segments in a bucket of S3 or of a store with an S3-compatible
+// API, addressed path-style and signed with AWS Signature Version 4.
+type S3Backend struct {
+	Endpoint     string // e.g. https://s3.us-east-1.amazonaws.com
+	Region       string
+	Bucket       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string // Only for temporary credentials
+	Client       *http.Client
+}
+
+// NewS3BackendFromEnv returns a backend for bucket with the credentials and region of the
+// standard AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN and AWS_REGION
+// variables. AWS_ENDPOINT_URL points it at an S3-compatible store instead of AWS.
+func NewS3BackendFromEnv(bucket string) (*S3Backend, error) {
+	b := &S3Backend{
+		Region:       os.Getenv("AWS_REGION"),
+		Bucket:       bucket,
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		Endpoint:     os.Getenv("AWS_ENDPOINT_URL"),
+		Client:       &http.Client{Timeout: 5 * time.Minute},
+	}
+	if b.AccessKey == "" || b.SecretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	if b.Region == "" {
+		b.Region = "us-east-1"
+	}
+	if b.Endpoint == "" {
+		b.Endpoint = "https://s3." + b.Region + ".amazonaws.com"
+	}
+	return b, nil
+}
+
+// Upload stores the content of r as the object name. The content is read into memory
+// first, as the signature covers its hash.
+func (b *S3Backend) Upload(name string, r io.Reader) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	resp, err := b.do(http.MethodPut, name, nil, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// List returns the names of the objects in the bucket.
+func (b *S3Backend) List() ([]string, error) {
+	var names []string
+	query := url.Values{"list-type": {"2"}}
+	for {
+		resp, err := b.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error decoding bucket listing: %w", err)
+		}
+		for _, object := range result.Contents {
+			names = append(names, object.Key)
+		}
+		if !result.IsTruncated {
+			return names, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// Download returns the content of the object name. The caller must close it.
+func (b *S3Backend) Download(name string) (io.ReadCloser, error) {
+	resp, err := b.do(http.MethodGet, name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// do sends a signed request for the object key of the bucket, or for the bucket itself
+// when key is empty. Responses other than 2xx are returned as errors.
+func (b *S3Backend) do(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	path := "/" + s3Escape(b.Bucket)
+	if key != "" {
+		segments := strings.Split(key, "/")
+		for i, segment := range segments {
+			segments[i] = s3Escape(segment)
+		}
+		path += "/" + strings.Join(segments, "/") // The slashes of prefixes are left as they are
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(b.Endpoint, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.URL.RawPath = path
+	req.URL.RawQuery = s3CanonicalQuery(query)
+	b.sign(req, body, time.Now().UTC())
+
+	resp, err := b.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(message))
+	}
+	return resp, nil
+}
+
+// sign adds the AWS Signature Version 4 headers to req.
+func (b *S3Backend) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", hex.EncodeToString(payloadHash[:]))
+	if b.SessionToken != "" {
+		req.Header.Set("x-amz-security-token", b.SessionToken)
+	}
+
+	names := []string{"host"}
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, name := range names {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.RawPath,
+		req.URL.RawQuery,
+		headers.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := now.Format("20060102") + "/" + b.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + b.SecretKey)
+	for _, part := range []string{now.Format("20060102"), b.Region, "s3", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.AccessKey, scope, signedHeaders, hex.EncodeToString(key)))
+}
+
+// s3Escape percent-encodes every byte of s but the unreserved characters, as the
+// canonical request of a signature requires.
+func s3Escape(s string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~", c) >= 0 {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
+
+// s3CanonicalQuery encodes query sorted by name, as the canonical request of a signature
+// requires.
+func s3CanonicalQuery(query url.Values) string {
+	var params []string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, s3Escape(name)+"="+s3Escape(value))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
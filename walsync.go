@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// WALSyncPolicy selects when WAL appends are synced to disk.
+type WALSyncPolicy uint8
+
+const (
+	SyncNone     WALSyncPolicy = iota // Leave writing back to the OS; a crash of the machine may lose recent entries
+	SyncPerEntry                      // Sync the file after every append
+)
+
+func (p WALSyncPolicy) String() string {
+	switch p {
+	case SyncNone:
+		return "none"
+	case SyncPerEntry:
+		return "per-entry"
+	default:
+		return fmt.Sprintf("WALSyncPolicy(%d)", uint8(p))
+	}
+}
+
+// walErrorRateBuckets is the number of one-second buckets the WAL error rate is measured over.
+const walErrorRateBuckets = 60
+
+// slidingWindowCounter counts writes and failed writes in one-second buckets over the last
+// walErrorRateBuckets seconds.
+type slidingWindowCounter struct {
+	mu      sync.Mutex
+	buckets [walErrorRateBuckets]struct {
+		second         int64
+		writes, errors uint64
+	}
+}
+
+// Add counts a write at now.
+func (c *slidingWindowCounter) Add(now time.Time, failed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	second := now.Unix()
+	bucket := &c.buckets[second%walErrorRateBuckets]
+	if bucket.second != second {
+		bucket.second, bucket.writes, bucket.errors = second, 0, 0
+	}
+	bucket.writes++
+	if failed {
+		bucket.errors++
+	}
+}
+
+// ErrorRate returns the share of the writes within the window before now that failed,
+// or 0 without writes.
+func (c *slidingWindowCounter) ErrorRate(now time.Time) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var writes, errors uint64
+	for _, bucket := range c.buckets {
+		if now.Unix()-bucket.second < walErrorRateBuckets {
+			writes += bucket.writes
+			errors += bucket.errors
+		}
+	}
+	if writes == 0 {
+		return 0
+	}
+	return float64(errors) / float64(writes)
+}
+
+// walSyncMonitor upgrades a WAL from SyncNone to SyncPerEntry while the rate of failed
+// appends exceeds threshold, and downgrades it again once the rate stayed at or below
+// threshold for recoveryWindow.
+type walSyncMonitor struct {
+	threshold      float64
+	recoveryWindow time.Duration
+	counter        slidingWindowCounter
+
+	mu         sync.Mutex
+	upgraded   bool
+	belowSince time.Time // When the rate last dropped to the threshold while upgraded
+}
+
+func newWALSyncMonitor(threshold float64, recoveryWindow time.Duration) *walSyncMonitor {
+	return &walSyncMonitor{threshold: threshold, recoveryWindow: recoveryWindow}
+}
+
+// record counts an append at now and switches the policy if the error rate calls for it.
+// A nil monitor ignores it.
+func (m *walSyncMonitor) record(now time.Time, failed bool) {
+	if m == nil {
+		return
+	}
+	m.counter.Add(now, failed)
+	rate := m.counter.ErrorRate(now)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case rate > m.threshold:
+		m.belowSince = time.Time{}
+		if !m.upgraded {
+			m.upgraded = true
+			logger.Warn("WAL error rate above threshold, syncing every entry", "error_rate", rate, "threshold", m.threshold)
+		}
+	case m.upgraded && m.belowSince.IsZero():
+		m.belowSince = now
+	case m.upgraded && now.Sub(m.belowSince) >= m.recoveryWindow:
+		m.upgraded = false
+		m.belowSince = time.Time{}
+		logger.Warn("WAL error rate recovered, no longer syncing every entry", "error_rate", rate, "threshold", m.threshold)
+	}
+}
+
+// policy returns the policy appends follow instead of SyncNone.
+func (m *walSyncMonitor) policy() WALSyncPolicy {
+	if m == nil {
+		return SyncNone
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.upgraded {
+		return SyncPerEntry
+	}
+	return SyncNone
+}
+
+// EffectiveSyncPolicy returns the policy of the next append: SyncPolicy, unless the error
+// rate upgraded SyncNone. A nil log syncs nothing.
+func (wal *WriteAheadLog) EffectiveSyncPolicy() WALSyncPolicy {
+	if wal == nil {
+		return SyncNone
+	}
+	if wal.SyncPolicy != SyncNone {
+		return wal.SyncPolicy
+	}
+	return wal.syncMonitor.policy()
+}
+
+// finishAppend syncs the file after a successful write if the policy requires it, and
+// counts the append towards the error rate. It returns the error of the write or sync.
+func (wal *WriteAheadLog) finishAppend(err error) error {
+	if err == nil && wal.EffectiveSyncPolicy() == SyncPerEntry {
+		if err = walSync(wal.file); err != nil {
+			err = fmt.Errorf("error syncing WAL: %w", err)
+		}
+	}
+	wal.syncMonitor.record(time.Now(), err != nil)
+	return err
+}
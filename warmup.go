@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// warmupProgressInterval is the number of keys Warmup handles between progress reports.
+const warmupProgressInterval = 1000
+
+var (
+	errMemtableFull      = errors.New("memtable is full")
+	errTooManyWarmupKeys = errors.New("too many keys to warm up")
+)
+
+// WarmupProgressFunc is called while keys are warmed up, every warmupProgressInterval
+// keys and once all total keys are done.
+type WarmupProgressFunc func(warmed, total int)
+
+// Warmup copies the values of keys from the SST files into the memtable, so the first
+// reads of a fresh instance do not wait for the disk, and returns how many it copied.
+// Keys already in the memtable and keys without a plain value on disk are left alone. The
+// copies are not logged, as the SST files hold them already; the next flush writes them
+// again. Warmup stops early once the memtable is full, as the next write would flush it.
+func (mem *memDB) Warmup(ctx context.Context, keys [][]byte, progress WarmupProgressFunc) (int, error) {
+	loaded := 0
+	for i, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return loaded, err
+		}
+		ok, err := mem.warmKey(mem.transformKey(key))
+		if errors.Is(err, errMemtableFull) {
+			logger.Info("warmup stopped, the memtable is full", "loaded", loaded, "skipped", len(keys)-i)
+			return loaded, nil
+		}
+		if err != nil {
+			return loaded, fmt.Errorf("error warming up key %q: %w", key, err)
+		}
+		if ok {
+			loaded++
+		}
+		if progress != nil && ((i+1)%warmupProgressInterval == 0 || i+1 == len(keys)) {
+			progress(i+1, len(keys))
+		}
+	}
+	return loaded, nil
+}
+
+// warmKey copies the newest SST entry of key into the memtable and reports whether it did.
+// Entries with a TTL are left on disk, where reads check their expiry.
+func (mem *memDB) warmKey(key []byte) (bool, error) {
+	defer mem.lockRead()()
+	if mem.closed {
+		return false, ErrDatabaseClosed
+	}
+	if mem.memtableFull(mem.size.Load()) {
+		return false, errMemtableFull
+	}
+	for _, kv := range mem.data {
+		if string(kv.Key) == string(key) {
+			return false, nil
+		}
+	}
+	if mem.tombstoned(key) {
+		return false, nil
+	}
+
+	files, err := mem.sstCandidates(key)
+	if err != nil {
+		return false, err
+	}
+	for _, file := range files {
+		kv, found, err := mem.lookupSST(filepath.Join(mem.cfg.DataDir, file.FileName), key)
+		if errors.Is(err, os.ErrNotExist) {
+			continue // Compacted away since the manifest was written
+		}
+		if err != nil {
+			return false, err
+		}
+		if !found {
+			continue
+		}
+		if kv.Operation != Set || kv.ExpiresAt != 0 {
+			return false, nil // Deleted, expiring, or merge operands resolved on each read
+		}
+		mem.upsert(kv)
+		return true, nil
+	}
+	return false, nil
+}
+
+// Warmup warms up the keys of the namespace.
+func (ns *NamespacedDB) Warmup(ctx context.Context, keys [][]byte, progress WarmupProgressFunc) (int, error) {
+	prefixed := make([][]byte, len(keys))
+	for i, key := range keys {
+		prefixed[i] = ns.key(key)
+	}
+	return ns.db.Warmup(ctx, prefixed, progress)
+}
+
+// Warmup warms up the keys of each shard, one shard after another. The progress counts
+// the keys of all shards handled so far, out of all keys.
+func (s *ShardedDB) Warmup(ctx context.Context, keys [][]byte, progress WarmupProgressFunc) (int, error) {
+	byShard := make(map[*memDB][][]byte)
+	for _, key := range keys {
+		shard := s.shardFor(key)
+		byShard[shard] = append(byShard[shard], key)
+	}
+	loaded, offset := 0, 0
+	for i, shard := range s.shards {
+		var shardProgress WarmupProgressFunc
+		if progress != nil {
+			shardProgress = func(n, _ int) {
+				progress(offset+n, len(keys))
+			}
+		}
+		n, err := shard.Warmup(ctx, byShard[shard], shardProgress)
+		loaded += n
+		if err != nil {
+			return loaded, fmt.Errorf("error warming up shard %d: %w", i, err)
+		}
+		offset += len(byShard[shard])
+	}
+	return loaded, nil
+}
+
+// warmupStatus tracks the warmup run through /warmup, for /warmup/status.
+type warmupStatus struct {
+	mu     sync.Mutex
+	state  string // "not started", "running" or "complete"
+	warmed int
+	total  int
+	loaded int
+	err    error // Error that ended the last run
+}
+
+// start marks a warmup of total keys as running, unless one already is.
+func (st *warmupStatus) start(total int) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.state == "running" {
+		return false
+	}
+	st.state, st.warmed, st.total, st.loaded, st.err = "running", 0, total, 0, nil
+	return true
+}
+
+func (st *warmupStatus) progress(warmed int) {
+	st.mu.Lock()
+	st.warmed = warmed
+	st.mu.Unlock()
+}
+
+func (st *warmupStatus) finish(loaded int, err error) {
+	st.mu.Lock()
+	st.state, st.loaded, st.err = "complete", loaded, err
+	st.mu.Unlock()
+}
+
+// report returns the state and progress of the last warmup.
+func (st *warmupStatus) report() map[string]interface{} {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	response := map[string]interface{}{"status": st.state}
+	if st.state != "not started" {
+		response["warmed"] = st.warmed
+		response["total"] = st.total
+	}
+	if st.state == "complete" {
+		response["loaded"] = st.loaded
+	}
+	if st.err != nil {
+		response["error"] = st.err.Error()
+	}
+	return response
+}
+
+// handleWarmup copies the values of the keys listed one per line in the "keys" field of a
+// multipart form, or of the keys starting with ?prefix=, from the SST files into the
+// memtable. At most DBConfig.WarmupMaxKeys keys are accepted. The progress is streamed as
+// one JSON object per line, {"warmed": n, "total": m}, followed by
+// {"done": true, "loaded": n} with the number of values copied, or {"error": "..."}.
+func (s *server) handleWarmup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	storage := s.storage(r)
+	var keys [][]byte
+	var err error
+	status := http.StatusBadRequest
+	if r.URL.Query().Has("prefix") {
+		keys, err = prefixKeys(storage, []byte(r.URL.Query().Get("prefix")), s.cfg.WarmupMaxKeys)
+		status = http.StatusInternalServerError
+	} else {
+		var file io.Reader
+		if file, err = multipartFile(r, "keys"); err == nil {
+			keys, err = readWarmupKeys(file, s.cfg.WarmupMaxKeys)
+		}
+	}
+	if errors.Is(err, errTooManyWarmupKeys) {
+		http.Error(w, fmt.Sprintf("more than %d keys to warm up", s.cfg.WarmupMaxKeys), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if !s.warmup.start(len(keys)) {
+		http.Error(w, "warmup already running", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	loaded, err := storage.Warmup(r.Context(), keys, func(warmed, total int) {
+		s.warmup.progress(warmed)
+		_ = encoder.Encode(map[string]int{"warmed": warmed, "total": total})
+		flusher.Flush()
+	})
+	s.warmup.finish(loaded, err)
+	if err != nil {
+		logger.Error("error warming up keys", "error", err)
+		_ = encoder.Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	_ = encoder.Encode(map[string]interface{}{"done": true, "loaded": loaded})
+}
+
+// handleWarmupStatus reports whether a warmup is "running", "complete" or "not started",
+// with its progress once one started.
+func (s *server) handleWarmupStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	response, _ := json.Marshal(s.warmup.report())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(response)
+}
+
+// readWarmupKeys returns the non-empty lines of r, or errTooManyWarmupKeys once there
+// are more than maxKeys of them.
+func readWarmupKeys(r io.Reader, maxKeys int) ([][]byte, error) {
+	var keys [][]byte
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("error reading keys: %w", err)
+		}
+		if key := bytes.TrimRight(line, "\r\n"); len(key) > 0 {
+			if len(keys) == maxKeys {
+				return nil, errTooManyWarmupKeys
+			}
+			keys = append(keys, key)
+		}
+		if err == io.EOF {
+			return keys, nil
+		}
+	}
+}
+
+// prefixKeys returns the live keys of storage starting with prefix, or
+// errTooManyWarmupKeys once there are more than maxKeys of them.
+func prefixKeys(storage Storage, prefix []byte, maxKeys int) ([][]byte, error) {
+	var keys [][]byte
+	err := storage.Export(func(kv KeyValue) error {
+		if !bytes.HasPrefix(kv.Key, prefix) {
+			return nil
+		}
+		if len(keys) == maxKeys {
+			return errTooManyWarmupKeys
+		}
+		keys = append(keys, kv.Key)
+		return nil
+	})
+	return keys, err
+}